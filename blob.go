@@ -0,0 +1,153 @@
+// blob.go
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ErrBadBlobIndex = errors.New("malformed blob index")
+
+// Where a file's contents lie within a blob of files packed end to end. Hash is the SHA-256 of the contents if known,
+// otherwise nil to hash them by reading.
+type BlobIndexEntry struct {
+	Offset int64
+	Size   int64
+	Hash   []byte
+	Path   string
+}
+
+// An index entry whose contents do not lie within the blob:
+type BlobRangeError struct {
+	Path     string
+	Offset   int64
+	Size     int64
+	BlobSize int64
+}
+
+func (e *BlobRangeError) Error() string {
+	return fmt.Sprintf("'%s' at %d+%d lies outside the %d byte blob", e.Path, e.Offset, e.Size, e.BlobSize)
+}
+
+// Reads a blob index: one line per file of its offset within the blob, its size, the hex SHA-256 of its contents or
+// "-" if not known, and its path, separated by single spaces. The path comes last so that it may contain spaces.
+// Blank lines and lines starting with '#' are ignored.
+func ReadBlobIndex(path string) ([]BlobIndexEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	index := []BlobIndexEntry(nil)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		e, err := parseBlobIndexLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		index = append(index, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func parseBlobIndexLine(text string) (BlobIndexEntry, error) {
+	fields := strings.SplitN(text, " ", 4)
+	if len(fields) != 4 || fields[3] == "" {
+		return BlobIndexEntry{}, ErrBadBlobIndex
+	}
+	e := BlobIndexEntry{Path: fields[3]}
+	err := error(nil)
+	if e.Offset, err = strconv.ParseInt(fields[0], 10, 64); err != nil || e.Offset < 0 {
+		return BlobIndexEntry{}, ErrBadBlobIndex
+	}
+	if e.Size, err = strconv.ParseInt(fields[1], 10, 64); err != nil || e.Size < 0 {
+		return BlobIndexEntry{}, ErrBadBlobIndex
+	}
+	if fields[2] != "-" {
+		if e.Hash, err = hex.DecodeString(fields[2]); err != nil || len(e.Hash) != sha256.Size {
+			return BlobIndexEntry{}, ErrBadBlobIndex
+		}
+	}
+	return e, nil
+}
+
+// Writes an index in the format ReadBlobIndex reads:
+func WriteBlobIndex(w io.Writer, index []BlobIndexEntry) error {
+	for _, e := range index {
+		if strings.ContainsAny(e.Path, "\r\n") {
+			return ErrBadPath
+		}
+		hash := "-"
+		if e.Hash != nil {
+			hash = hex.EncodeToString(e.Hash)
+		}
+		if _, err := fmt.Fprintf(w, "%d %d %s %s\n", e.Offset, e.Size, hash, e.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serves a file's contents from its range of the blob:
+type blobSection struct {
+	*io.SectionReader
+	hash []byte
+}
+
+func (s blobSection) Hash() []byte {
+	return s.hash
+}
+
+// Constructs a reader serving each indexed file from its range of the blob at blobPath, which is opened once and kept
+// open until the reader is closed. Every range must lie within the blob. Files are laid out in the tarball in index
+// order, whatever their order in the blob, and served as regular files with the blob's mode and modification time;
+// clients extract them into separate files as usual.
+func NewVirtualTarballReaderFromBlob(blobPath string, index []BlobIndexEntry, options VirtualTarballOptions) (*VirtualTarballReader, error) {
+	blob, err := os.Open(blobPath)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := blob.Stat()
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+
+	files := make([]*TarballFile, 0, len(index))
+	for _, e := range index {
+		// Compared without summing so that huge offsets cannot overflow:
+		if e.Offset < 0 || e.Size < 0 || e.Offset > stat.Size() || e.Size > stat.Size()-e.Offset {
+			blob.Close()
+			return nil, &BlobRangeError{Path: e.Path, Offset: e.Offset, Size: e.Size, BlobSize: stat.Size()}
+		}
+		files = append(files, &TarballFile{
+			Path:    e.Path,
+			Mode:    stat.Mode().Perm(),
+			ModTime: stat.ModTime(),
+			Content: blobSection{SectionReader: io.NewSectionReader(blob, e.Offset, e.Size), hash: e.Hash},
+		})
+	}
+
+	t, err := NewVirtualTarballReader(files, options)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	t.blob = blob
+	return t, nil
+}
@@ -0,0 +1,89 @@
+// blob_test.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBlob_RoundTrip(t *testing.T) {
+	const blobName, indexName = "test.blob", "test.blobindex"
+	defer os.Remove(blobName)
+	defer os.Remove(indexName)
+	if _, err := createTestFile(blobName, []byte("hello\nworld\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte("world\n"))
+	index := []BlobIndexEntry{
+		{Offset: 6, Size: 6, Hash: sum[:], Path: "sub/b.txt"},
+		{Offset: 0, Size: 6, Path: "a file.txt"},
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteBlobIndex(buf, index); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(indexName, append([]byte("# packed\n\n"), buf.Bytes()...), 0644)
+	read, err := ReadBlobIndex(indexName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 || read[1].Path != "a file.txt" || read[1].Hash != nil || !bytes.Equal(read[0].Hash, sum[:]) {
+		t.Fatalf("unexpected index %+v", read)
+	}
+
+	options := getOptions()
+	options.HashFiles = true
+	tb, err := NewVirtualTarballReaderFromBlob(blobName, read, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	// Laid out in index order, not blob order:
+	expected := []byte("world\n\x00hello\n\x00")
+	data := make([]byte, len(expected))
+	if _, err := tb.ReadAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("read %q; expected %q", data, expected)
+	}
+	if tb.OpenFiles() != 0 {
+		t.Fatalf("expected no files opened besides the blob; %d open", tb.OpenFiles())
+	}
+	hello := sha256.Sum256([]byte("hello\n"))
+	if !bytes.Equal(tb.files[1].Hash, hello[:]) {
+		t.Fatal("unhashed entry was not hashed from the blob")
+	}
+}
+
+func TestBlob_OutOfRange(t *testing.T) {
+	const blobName = "test.blob"
+	defer os.Remove(blobName)
+	if _, err := createTestFile(blobName, []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []BlobIndexEntry{
+		{Offset: 5, Size: 6, Path: "past.txt"},
+		{Offset: 11, Size: 0, Path: "beyond.txt"},
+		{Offset: 1, Size: 1<<63 - 1, Path: "overflow.txt"},
+	} {
+		_, err := NewVirtualTarballReaderFromBlob(blobName, []BlobIndexEntry{e}, getOptions())
+		rerr := (*BlobRangeError)(nil)
+		if !errors.As(err, &rerr) || rerr.Path != e.Path || rerr.BlobSize != 10 {
+			t.Fatalf("%s: expected BlobRangeError; got %v", e.Path, err)
+		}
+	}
+
+	for _, line := range []string{"0 1 - ", "x 1 - a", "0 -1 - a", "0 1 abcd a"} {
+		if _, err := parseBlobIndexLine(line); err != ErrBadBlobIndex {
+			t.Fatalf("%q: expected ErrBadBlobIndex; got %v", line, err)
+		}
+	}
+}
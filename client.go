@@ -3,19 +3,60 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/ed25519"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
 	"time"
 )
 import "github.com/dustin/go-humanize"
+import "golang.org/x/time/rate"
+
+var ErrInterrupted = errors.New("interrupted; progress saved for resume")
+var ErrLookupTimeout = errors.New("no response to file entries request")
+var ErrManifestHashId = errors.New("manifest does not describe the requested tarball")
+
+// Rounds of receiving files again after they fail verification before giving up:
+const maxVerifyRetries = 3
+
+// What the client does when a received file fails verification:
+type CorruptionPolicy int
+
+const (
+	// Receive failed files again, up to maxVerifyRetries times, extracting everything else; Run then reports the
+	// files that never verified:
+	CorruptionCollect = CorruptionPolicy(iota)
+	// Stop the download at the first file that fails, without saving progress, and report it:
+	CorruptionAbort
+)
+
+// Files that failed verification, in the order found. Matches ErrHashMismatch with errors.Is.
+type CorruptFilesError struct {
+	Paths []string
+}
+
+func (e *CorruptFilesError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrHashMismatch, strings.Join(e.Paths, ", "))
+}
+
+func (e *CorruptFilesError) Is(target error) bool {
+	return target == ErrHashMismatch
+}
 
 type ClientState int
 
 const (
 	ExpectAnnouncement = ClientState(iota)
+	ExpectTOCHeader
+	ExpectTOCSections
+	ExpectManifestDigest
 	ExpectMetadataHeader
 	ExpectMetadataSections
 	ExpectDataSections
@@ -31,13 +72,53 @@ type Client struct {
 	state       ClientState
 	resendTimer <-chan time.Time
 
-	hashId               []byte
-	metadataSectionCount uint16
-	metadataSections     [][]byte
-	nextSectionIndex     uint16
-
-	nakRegions *NakRegions
-	lastAck    Region
+	hashId           []byte
+	metadata         *metadataDecoder
+	nextSectionIndex uint16
+
+	// Sizes advertised in the server's metadata header; 0 until received:
+	regionSize  uint16
+	sectionSize uint16
+
+	tocSections    [][]byte
+	nextTOCSection uint16
+	toc            []TOCEntry
+
+	// Summary from the server's announcement, if it sent one:
+	announced *AnnounceSummary
+
+	// Signature block received with the metadata header or manifest digest:
+	signature []byte
+
+	// Metadata cached from a previous download of this tarball:
+	cachedDigest   []byte
+	cachedMetadata []byte
+	// The cached metadata was given to DownloadWithManifest and is used without asking the server for any:
+	preloaded bool
+
+	// Guards changes to nakRegions against Progress and IsComplete called from other goroutines:
+	progressLock sync.Mutex
+	nakRegions   *NakRegions
+	lastAck      Region
+	// Regions of files skipped by Since; never received, so saved as still NAKed for later runs:
+	sinceSkipped []Region
+
+	receiveLimiter *rate.Limiter
+	writeQueue     *writeQueue
+	// Decompresses data received as a gzip stream with GzipStream:
+	stream *gzipStream
+
+	droppedMalformed int64
+	// When a corrupted section was last asked for again, so a burst of corruption doesn't flood the server:
+	lastChecksumAsk time.Time
+	// Data received from each server sending our tarball:
+	sources sourceTracker
+
+	// Rounds of receiving files again after they failed verification, and the files still failing at the end:
+	verifyRetries int
+	verifyFailed  []*TarballFile
+	// Set under progressLock to the first file found corrupt with CorruptionAbort, possibly by the write queue:
+	corrupt *TarballFile
 
 	bytesReceived     int64
 	lastBytesReceived int64
@@ -52,6 +133,48 @@ type ClientOptions struct {
 	HashId         []byte
 	StorePath      string
 	RefreshRate    time.Duration
+	// Fetch the lightweight table of contents before the full metadata:
+	FetchTOC bool
+	// Maximum bytes of out-of-order metadata sections to buffer; 0 means unlimited:
+	MaxMetadataBuffer int
+	// File to cache received metadata in so that reconnecting skips the metadata exchange if unchanged:
+	MetadataCachePath string
+	// Skip transferring files that already exist with matching contents:
+	Update bool
+	// Remove existing files not present in the tarball after a completed download:
+	Delete bool
+	// Verify there is enough free disk space and free inodes before downloading:
+	CheckFreeSpace  bool
+	CheckFreeInodes bool
+	// Install a SIGINT handler that flushes written data and saves progress to ResumePath before exiting:
+	HandleInterrupt bool
+	// File to save and resume download progress from; defaults to ".lancaster-<id>.resume" in the current directory:
+	ResumePath string
+	// Save progress to ResumePath when RunContext is cancelled:
+	SaveProgressOnCancel bool
+	// On interrupt, overwrite regions of partially written files that were never received with zeros:
+	ZeroFillIncomplete bool
+	// Verify the metadata signature against this key before accepting any data:
+	PublicKey ed25519.PublicKey
+	// Queue up to this many received regions for a separate goroutine to write to disk; 0 writes synchronously:
+	WriteQueueDepth int
+	// Maximum bytes/sec of data to write; data over the cap is dropped and NAKed again later. 0 means unlimited:
+	MaxReceiveRate int64
+	// Called once per file as soon as it is completely written and, if verifying, verified:
+	OnFileComplete func(path string, tf *TarballFile)
+	// When resuming, recheck partly received files against their block hashes instead of trusting the saved progress;
+	// blocks that match are kept and the rest received again. Files without block hashes keep their saved progress.
+	VerifyResume bool
+	// Decides what to do with each entry whose path already exists; nil writes over it:
+	ConflictResolver func(existing os.FileInfo, incoming *TarballFile) ConflictAction
+	// What to do when a file fails verification with VerifyHashes:
+	OnCorruption CorruptionPolicy
+	// Only receive and extract entries modified after this time, leaving older ones as they are. Directories and
+	// entries without a recorded modification time are always extracted. Zero extracts everything.
+	Since time.Time
+	// Stay on the given group rather than follow a metadata-only server's redirect to another group for data.
+	// Redirects are not signed, so anyone able to send to the group can move clients elsewhere:
+	IgnoreRedirects bool
 }
 
 func NewClient(m *Multicast, options ClientOptions) *Client {
@@ -59,15 +182,79 @@ func NewClient(m *Multicast, options ClientOptions) *Client {
 		options.RefreshRate = time.Second
 	}
 
-	return &Client{
+	c := &Client{
 		m:       m,
 		options: options,
 		state:   ExpectAnnouncement,
 		hashId:  options.HashId,
 	}
+
+	if options.MaxReceiveRate > 0 {
+		// Allow at least one full datagram through per burst:
+		burst := int(options.MaxReceiveRate)
+		if burst < maxDatagramSize {
+			burst = maxDatagramSize
+		}
+		c.receiveLimiter = rate.NewLimiter(rate.Limit(options.MaxReceiveRate), burst)
+	}
+
+	if options.MetadataCachePath != "" {
+		digest, md, err := loadMetadataCache(options.MetadataCachePath)
+		if err == nil {
+			c.cachedDigest = digest
+			c.cachedMetadata = md
+		} else if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "ignoring metadata cache: %s\n", err)
+		}
+	}
+
+	return c
 }
 
 func (c *Client) Run() error {
+	return c.RunContext(context.Background())
+}
+
+// Downloads into destRoot using metadata distributed ahead of time, as written by WriteManifest or cached with
+// MetadataCachePath, instead of fetching it from the server. The tarball it describes is the one downloaded; if a
+// HashId was given in the options it must be that tarball's. Data is requested as soon as the server announces it.
+// With a PublicKey the server's signed digest is fetched first, and the server's metadata used instead should the
+// manifest not match it.
+func (c *Client) DownloadWithManifest(manifest []byte, destRoot string) error {
+	digest, md, err := parseMetadataCache(manifest)
+	if err != nil {
+		return err
+	}
+	d := newMetadataDecoder(1, 0)
+	if err = d.AddSection(0, md); err != nil {
+		return err
+	}
+	_, files, err := d.Finish()
+	if err != nil {
+		return err
+	}
+	options := VirtualTarballOptions{
+		NoPadding:   d.Flags()&metadataFlagNoPadding != 0,
+		GzipStream:  d.Flags()&metadataFlagGzipStream != 0,
+		DetectHoles: d.Flags()&metadataFlagDataExtents != 0,
+		HashSize:    d.HashSize(),
+	}
+	hashId := tarballHashId(files, options)
+	if c.hashId != nil && compareHashes(c.hashId, hashId) != 0 {
+		return ErrManifestHashId
+	}
+
+	c.hashId = hashId
+	c.cachedDigest = digest
+	c.cachedMetadata = md
+	c.preloaded = true
+	c.options.TarballOptions.ExtractRoot = destRoot
+	return c.Run()
+}
+
+// Runs the download until complete or ctx is cancelled. On cancellation the writer is flushed and closed, progress
+// is saved if SaveProgressOnCancel is set, the multicast groups are left and ctx.Err() is returned.
+func (c *Client) RunContext(ctx context.Context) error {
 	err := error(nil)
 
 	err = c.m.SendsControlToServer()
@@ -94,17 +281,37 @@ func (c *Client) Run() error {
 	c.state = ExpectAnnouncement
 
 	// Start ticking every second to measure bandwidth:
-	refreshTimer := time.Tick(c.options.RefreshRate)
+	refreshTicker := time.NewTicker(c.options.RefreshRate)
+	defer refreshTicker.Stop()
+	refreshTimer := refreshTicker.C
 	c.lastTime = time.Now()
 	c.startTime = c.lastTime
 	c.lastBytesReceived = 0
 
 	// Send NAKs at a regular rate:
-	c.resendTimer = time.Tick(resendTimeout)
+	resendTicker := time.NewTicker(resendTimeout)
+	defer resendTicker.Stop()
+	c.resendTimer = resendTicker.C
+
+	// Ask for the announcement of a known HashId rather than waiting for the server's ticker:
+	logError(c.ask())
+
+	// Checkpoint progress on interrupt if requested:
+	interrupt := make(chan os.Signal, 1)
+	if c.options.HandleInterrupt {
+		signal.Notify(interrupt, os.Interrupt)
+		defer signal.Stop(interrupt)
+	}
 
 	// Main message loop:
 loop:
 	for {
+		if f := c.firstCorrupt(); f != nil {
+			c.verifyFailed = []*TarballFile{f}
+			c.teardown(false)
+			return &CorruptFilesError{Paths: []string{f.Path}}
+		}
+
 		select {
 		case msg := <-c.m.ControlToClient:
 			if msg.Error != nil {
@@ -143,6 +350,16 @@ loop:
 			if c.state == Done {
 				break loop
 			}
+
+		case <-interrupt:
+			fmt.Println()
+			return c.checkpoint()
+
+		case <-ctx.Done():
+			if err := c.teardown(c.options.SaveProgressOnCancel); err != nil {
+				return err
+			}
+			return ctx.Err()
 		}
 	}
 
@@ -156,14 +373,253 @@ loop:
 	fmt.Printf("%v elapsed %15s/s avg\n", diff, humanize.IBytes(uint64(float64(c.bytesReceived)/diff.Seconds())))
 
 	// Close virtual tarball writer:
+	if c.stream != nil {
+		if err := c.stream.Close(); err != nil {
+			c.teardown(false)
+			return err
+		}
+	}
 	if c.tb != nil {
+		if err := c.drainWriteQueue(); err != nil {
+			return err
+		}
 		if err := c.tb.Close(); err != nil {
 			return err
 		}
+
+		// Download is complete so progress need not be resumed:
+		if err := os.Remove(c.resumePath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if c.options.Delete {
+			// Remove files not in the tarball, keeping our metadata cache:
+			removed, err := c.tb.RemoveExtraneous(c.extractRoot(), c.options.MetadataCachePath)
+			for _, path := range removed {
+				fmt.Printf("  removed '%s'\n", path)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		// Restore directory modes last since they may forbid writing within:
+		if err := c.tb.FinishDirectories(); err != nil {
+			return err
+		}
 	}
 
 	// Close multicast sockets:
-	return c.m.Close()
+	if err := c.m.Close(); err != nil {
+		return err
+	}
+	if len(c.verifyFailed) > 0 {
+		paths := make([]string, 0, len(c.verifyFailed))
+		for _, f := range c.verifyFailed {
+			fmt.Fprintf(os.Stderr, "'%s' failed verification\n", f.Path)
+			paths = append(paths, f.Path)
+		}
+		return &CorruptFilesError{Paths: paths}
+	}
+	// Entries skipped for directories that could not be created:
+	if c.tb != nil {
+		return c.tb.Unwritable()
+	}
+	return nil
+}
+
+// Number of received regions waiting to be written to disk and the queue's depth; both 0 if writes are synchronous:
+func (c *Client) WriteQueueFill() (int, int) {
+	if c.writeQueue == nil {
+		return 0, 0
+	}
+	return c.writeQueue.Len(), c.writeQueue.Cap()
+}
+
+// Waits for queued regions to be written:
+func (c *Client) drainWriteQueue() error {
+	if c.writeQueue == nil {
+		return nil
+	}
+	err := c.writeQueue.Close()
+	c.writeQueue = nil
+	return err
+}
+
+// Count of datagrams dropped for being malformed or arriving on the wrong channel:
+func (c *Client) DroppedMalformed() int64 {
+	return c.droppedMalformed
+}
+
+// Flushes written data and saves progress so a later run can resume, then tears down:
+func (c *Client) checkpoint() error {
+	if err := c.teardown(true); err != nil {
+		return err
+	}
+	return ErrInterrupted
+}
+
+// Finishes pending writes, optionally saves progress, and closes the writer and multicast sockets:
+func (c *Client) teardown(saveProgress bool) error {
+	err := c.closeWriter(saveProgress)
+	// Always leave the multicast groups so receive goroutines exit:
+	if cerr := c.m.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *Client) closeWriter(saveProgress bool) error {
+	if c.tb == nil {
+		return nil
+	}
+	if err := c.drainWriteQueue(); err != nil {
+		return err
+	}
+	if err := c.tb.Flush(); err != nil {
+		return err
+	}
+	if c.stream != nil {
+		// Decompression cannot carry on where it stopped, so there is no progress to save:
+		c.stream.Abort()
+		saveProgress = false
+	}
+	if saveProgress {
+		if err := c.saveResume(); err != nil {
+			return err
+		}
+	}
+	if c.options.ZeroFillIncomplete {
+		n, err := c.tb.ZeroFill(c.pendingRegions())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Zero-filled %s never written\n", humanize.IBytes(uint64(n)))
+	}
+	if err := c.tb.Close(); err != nil {
+		return err
+	}
+	if saveProgress {
+		fmt.Printf("Progress saved to '%s'\n", c.resumePath())
+	}
+	return nil
+}
+
+// Directory the tarball is extracted into:
+func (c *Client) extractRoot() string {
+	if c.options.TarballOptions.ExtractRoot == "" {
+		return "."
+	}
+	return c.options.TarballOptions.ExtractRoot
+}
+
+func (c *Client) resumePath() string {
+	if c.options.ResumePath != "" {
+		return c.options.ResumePath
+	}
+	return fmt.Sprintf(".lancaster-%s.resume", hex.EncodeToString(c.hashId))
+}
+
+// Resume files hold the tarball hashId followed by the serialized NakRegions:
+func (c *Client) saveResume() error {
+	naks, err := c.nakRegions.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if len(c.sinceSkipped) > 0 {
+		// A later run without Since must still receive the skipped files:
+		r := &NakRegions{}
+		if err := r.UnmarshalBinary(naks); err != nil {
+			return err
+		}
+		for _, k := range c.sinceSkipped {
+			r.Nak(k.start, k.endEx)
+		}
+		if naks, err = r.MarshalBinary(); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, 0, hashSize+len(naks))
+	buf = append(buf, c.hashId[:hashSize]...)
+	buf = append(buf, naks...)
+	return ioutil.WriteFile(c.resumePath(), buf, 0644)
+}
+
+func (c *Client) loadResume() error {
+	buf, err := ioutil.ReadFile(c.resumePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(buf) < hashSize || compareHashes(buf, c.hashId) != 0 {
+		// Progress for another tarball:
+		return nil
+	}
+
+	r := &NakRegions{}
+	if err := r.UnmarshalBinary(buf[hashSize:]); err != nil {
+		return err
+	}
+	if r.size != c.nakRegions.size {
+		return ErrBadNakState
+	}
+
+	c.progressLock.Lock()
+	c.nakRegions = r
+	c.progressLock.Unlock()
+	resumed := r.size - r.NakedBytes()
+	c.bytesReceived += resumed
+	c.lastBytesReceived += resumed
+	fmt.Printf("\bResuming with %s already received\n", humanize.IBytes(uint64(resumed)))
+	return nil
+}
+
+// Replaces the saved progress of partly received files by the blocks already on disk that match their block hashes:
+func (c *Client) verifyResume() error {
+	c.progressLock.Lock()
+	before := c.nakRegions.NakedBytes()
+	c.progressLock.Unlock()
+
+	checked, kept, again := 0, int64(0), int64(0)
+	for _, tf := range c.tb.files {
+		start, endEx := tf.offset, tf.offset+tf.Size
+		if tf.BlockSize == 0 || tf.Size == 0 {
+			continue
+		}
+		c.progressLock.Lock()
+		partial := !c.nakRegions.IsFullyAcked(start, endEx) && c.nakRegions.IsAcked(start, endEx)
+		c.progressLock.Unlock()
+		if !partial {
+			continue
+		}
+
+		blocks, err := c.tb.MatchingBlocks(tf)
+		if err != nil {
+			return err
+		}
+		c.progressLock.Lock()
+		c.nakRegions.Nak(start, endEx)
+		for _, r := range blocks {
+			c.nakRegions.Ack(r.start, r.endEx)
+			kept += r.endEx - r.start
+		}
+		c.progressLock.Unlock()
+		checked++
+		again += tf.Size
+	}
+	again -= kept
+
+	c.progressLock.Lock()
+	after := c.nakRegions.NakedBytes()
+	c.progressLock.Unlock()
+	c.bytesReceived += before - after
+	c.lastBytesReceived += before - after
+	if checked > 0 {
+		fmt.Printf("\b%d partly received files verified: %s kept, %s to receive again\n", checked, humanize.IBytes(uint64(kept)), humanize.IBytes(uint64(again)))
+	}
+	return nil
 }
 
 func (c *Client) reportBandwidth() {
@@ -172,14 +628,21 @@ func (c *Client) reportBandwidth() {
 	sec := rightMeow.Sub(c.lastTime).Seconds()
 
 	pct := float64(0.0)
-	if c.nakRegions != nil {
-		pct = float64(c.bytesReceived) * 100.0 / float64(c.nakRegions.size)
+	if received, total := c.ContentProgress(); total > 0 {
+		// Padding between files would skew small files' share:
+		pct = float64(received) * 100.0 / float64(total)
+	} else if c.nakRegions != nil && c.nakRegions.IsAllAcked() {
+		pct = 100.0
 	}
 	nakMeter := ""
 	if c.nakRegions != nil {
 		nakMeter = c.nakRegions.ASCIIMeter(48)
 	}
-	fmt.Printf("\b%9s/s %6.2f%% [%s]\r", humanize.IBytes(uint64(float64(byteCount)/sec)), pct, nakMeter)
+	queue := ""
+	if n, depth := c.WriteQueueFill(); depth > 0 {
+		queue = fmt.Sprintf(" q %d/%d", n, depth)
+	}
+	fmt.Printf("\b%9s/s %6.2f%% [%s]%s\r", humanize.IBytes(uint64(float64(byteCount)/sec)), pct, nakMeter, queue)
 
 	c.lastBytesReceived = c.bytesReceived
 	c.lastTime = rightMeow
@@ -187,6 +650,10 @@ func (c *Client) reportBandwidth() {
 
 func (c *Client) processControl(msg UDPMessage) error {
 	hashId, op, data, err := extractClientMessage(msg)
+	if isMalformed(err) {
+		c.droppedMalformed++
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -194,19 +661,68 @@ func (c *Client) processControl(msg UDPMessage) error {
 	switch c.state {
 	case ExpectAnnouncement:
 		switch op {
-		case AnnounceTarball:
+		case AnnounceTarball, AnnounceTarballs:
 			//fmt.Printf("announce %s\n", hex.EncodeToString(hashId))
-			if c.hashId == nil {
-				// If client has not specified a hashId to listen for, accept the first one that's announced:
-				c.hashId = hashId
-			} else if compareHashes(c.hashId, hashId) != 0 {
+			hashIds := [][]byte(nil)
+			hashIds, err = AnnouncedHashIds(msg)
+			if err != nil {
+				c.droppedMalformed++
+				return nil
+			}
+			if !c.acceptAnnouncement(hashIds) {
 				// These are not the droids we're looking for.
 				//fmt.Printf("\rIgnore announcement for %s; only interested in %s\n", hex.EncodeToString(hashId), hex.EncodeToString(c.hashId))
 				return nil
 			}
 
-			// Request metadata header:
-			c.state = ExpectMetadataHeader
+			// Only single announcements carry a summary:
+			c.announced = nil
+			if op == AnnounceTarball {
+				c.announced, err = decodeAnnounceSummary(data)
+				if err != nil {
+					// A malformed summary is not fatal; carry on as for a bare announcement:
+					c.announced = nil
+					c.droppedMalformed++
+				}
+			}
+
+			if c.options.FetchTOC && !c.preloaded {
+				// Request table of contents header:
+				c.state = ExpectTOCHeader
+				if err = c.ask(); err != nil {
+					return err
+				}
+				return nil
+			}
+
+			if err = c.requestMetadata(); err != nil {
+				return err
+			}
+		default:
+			// ignore
+		}
+
+	case ExpectTOCHeader:
+		if compareHashes(c.hashId, hashId) != 0 {
+			// These are not the droids we're looking for.
+			return nil
+		}
+
+		switch op {
+		case RespondTOCHeader:
+			if len(data) < 2 {
+				return ErrMessageTooShort
+			}
+			// Even an empty table of contents has its count, so a server never sends no sections:
+			if byteOrder.Uint16(data[0:2]) == 0 {
+				c.droppedMalformed++
+				return nil
+			}
+			c.tocSections = make([][]byte, byteOrder.Uint16(data[0:2]))
+			c.nextTOCSection = 0
+
+			// Request TOC sections:
+			c.state = ExpectTOCSections
 			if err = c.ask(); err != nil {
 				return err
 			}
@@ -214,6 +730,83 @@ func (c *Client) processControl(msg UDPMessage) error {
 			// ignore
 		}
 
+	case ExpectTOCSections:
+		if compareHashes(c.hashId, hashId) != 0 {
+			// These are not the droids we're looking for.
+			return nil
+		}
+
+		switch op {
+		case RespondTOCSection:
+			sectionIndex, section := uint16(0), []byte(nil)
+			sectionIndex, section, err = decodeSection(data)
+			if err == ErrSectionChecksum {
+				// Corrupted in transit; ask for it again:
+				c.droppedMalformed++
+				return c.askAfterChecksum()
+			} else if err != nil {
+				return err
+			}
+			if int(sectionIndex) >= len(c.tocSections) {
+				c.droppedMalformed++
+				return nil
+			}
+			if sectionIndex == c.nextTOCSection {
+				c.tocSections[sectionIndex] = append([]byte(nil), section...)
+				c.nextTOCSection++
+			}
+
+			if c.nextTOCSection < uint16(len(c.tocSections)) {
+				// Request next TOC section:
+				if err = c.ask(); err != nil {
+					return err
+				}
+				return nil
+			}
+
+			// Done receiving TOC; decode and move on to metadata:
+			c.toc, err = decodeTOC(bytes.Join(c.tocSections, nil))
+			c.tocSections = nil
+			if err != nil {
+				return err
+			}
+			if err = c.requestMetadata(); err != nil {
+				return err
+			}
+		default:
+			// ignore
+		}
+
+	case ExpectManifestDigest:
+		if compareHashes(c.hashId, hashId) != 0 {
+			// These are not the droids we're looking for.
+			return nil
+		}
+
+		switch op {
+		case RespondManifestDigest:
+			if len(data) < metadataDigestSize {
+				return ErrMessageTooShort
+			}
+			c.signature = append([]byte(nil), data[metadataDigestSize:]...)
+			if !bytes.Equal(data[:metadataDigestSize], c.cachedDigest) {
+				// Cached metadata is stale; request metadata header:
+				c.cachedDigest = nil
+				c.cachedMetadata = nil
+				c.state = ExpectMetadataHeader
+				if err = c.ask(); err != nil {
+					return err
+				}
+				return nil
+			}
+
+			if err = c.useCachedMetadata(); err != nil {
+				return err
+			}
+		default:
+			// ignore
+		}
+
 	case ExpectMetadataHeader:
 		if compareHashes(c.hashId, hashId) != 0 {
 			// These are not the droids we're looking for.
@@ -224,9 +817,14 @@ func (c *Client) processControl(msg UDPMessage) error {
 		switch op {
 		case RespondMetadataHeader:
 			//fmt.Printf("metaheader %s\n", hex.EncodeToString(hashId))
+			if len(data) < metadataHeaderMsgSize {
+				return ErrMessageTooShort
+			}
 			// Read count of sections:
-			c.metadataSectionCount = byteOrder.Uint16(data[0:2])
-			c.metadataSections = make([][]byte, c.metadataSectionCount)
+			sectionCount := byteOrder.Uint16(data[0:2])
+			c.adoptServerSizes(byteOrder.Uint16(data[2:4]), byteOrder.Uint16(data[4:6]))
+			c.signature = append([]byte(nil), data[metadataHeaderMsgSize:]...)
+			c.metadata = newMetadataDecoder(sectionCount, c.options.MaxMetadataBuffer)
 
 			// Request metadata sections:
 			c.state = ExpectMetadataSections
@@ -249,25 +847,35 @@ func (c *Client) processControl(msg UDPMessage) error {
 		case RespondMetadataSection:
 			//fmt.Printf("metasection %s\n", hex.EncodeToString(hashId))
 
-			sectionIndex := byteOrder.Uint16(data[0:2])
-			if sectionIndex == c.nextSectionIndex {
-				c.metadataSections[sectionIndex] = make([]byte, len(data[2:]))
-				copy(c.metadataSections[sectionIndex], data[2:])
+			sectionIndex, section := uint16(0), []byte(nil)
+			sectionIndex, section, err = decodeSection(data)
+			if err == ErrSectionChecksum {
+				// Corrupted in transit; ask for just this section again rather than failing the whole metadata:
+				c.droppedMalformed++
+				return c.askAfterChecksum()
+			} else if err != nil {
+				return err
+			}
+			if err = c.metadata.AddSection(sectionIndex, section); err != nil {
+				return err
+			}
+			if c.metadata.Flags()&metadataFlagInvalidUTF8 != 0 && c.options.TarballOptions.InvalidUTF8.resolve() == InvalidUTF8Reject {
+				// Refuse before receiving the rest of the metadata:
+				return ErrInvalidUTF8Path
+			}
 
-				c.nextSectionIndex++
-				if c.nextSectionIndex >= c.metadataSectionCount {
-					// Done receiving all metadata sections; decode:
-					if err = c.decodeMetadata(); err != nil {
-						return err
-					}
+			c.nextSectionIndex = c.metadata.NextSection()
+			if c.metadata.IsComplete() {
+				// Done receiving all metadata sections; decode:
+				if err = c.decodeMetadata(); err != nil {
+					return err
+				}
 
-					// Start expecting data sections:
-					c.state = ExpectDataSections
-					if err = c.ask(); err != nil {
-						return err
-					}
-					return nil
+				// Start expecting data sections:
+				if err = c.startData(); err != nil {
+					return err
 				}
+				return nil
 			}
 
 			// Request next metadata sections:
@@ -280,16 +888,244 @@ func (c *Client) processControl(msg UDPMessage) error {
 		}
 
 	case ExpectDataSections:
-		// Not interested in control messages really at this time. Maybe introduce server death messages?
+		if compareHashes(c.hashId, hashId) != 0 {
+			// These are not the droids we're looking for.
+			return nil
+		}
+
+		switch op {
+		case RedirectData:
+			// A metadata-only server names the group serving data:
+			if c.options.IgnoreRedirects {
+				return nil
+			}
+			group := (*net.UDPAddr)(nil)
+			group, err = decodeRedirectData(data)
+			if err != nil {
+				c.droppedMalformed++
+				return nil
+			}
+			if err = c.followRedirect(group); err != nil {
+				return err
+			}
+		default:
+			// ignore
+		}
 	}
 
 	return nil
 }
 
+// Moves to group for the rest of the download, sending NAKs there straight away; the server there answers requests
+// as well as sending data:
+func (c *Client) followRedirect(group *net.UDPAddr) error {
+	current := c.m.Group()
+	if group.IP.Equal(current.IP) && group.Port == current.Port {
+		return nil
+	}
+
+	m, err := c.m.withGroup(group)
+	if err != nil {
+		return err
+	}
+	for _, join := range []func() error{m.SendsControlToServer, m.ListensControlToClient, m.ListensData} {
+		if err := join(); err != nil {
+			m.Close()
+			return err
+		}
+	}
+
+	err = c.m.Close()
+	c.m = m
+	fmt.Printf("\nRedirected to %s for data\n", group)
+	if err != nil {
+		return err
+	}
+	return c.ask()
+}
+
+// Listens for announcements for d and returns the HashIds announced, singly or packed, in the order first seen:
+func DiscoverTarballs(m *Multicast, d time.Duration) ([][]byte, error) {
+	if err := m.ListensControlToClient(); err != nil {
+		return nil, err
+	}
+
+	hashIds := make([][]byte, 0)
+	seen := make(map[string]bool)
+	timeout := time.After(d)
+	for {
+		select {
+		case msg := <-m.ControlToClient:
+			if msg.Error != nil {
+				return hashIds, msg.Error
+			}
+			announced, err := AnnouncedHashIds(msg)
+			if err != nil {
+				// Not every datagram on the control channel is ours to parse:
+				continue
+			}
+			for _, hashId := range announced {
+				if !seen[string(hashId)] {
+					seen[string(hashId)] = true
+					hashIds = append(hashIds, hashId)
+				}
+			}
+		case <-timeout:
+			return hashIds, nil
+		}
+	}
+}
+
+// Asks the server of hashId for the metadata entries of path, or of every path starting with path if prefix is set,
+// without fetching the rest of the metadata. Requests are resent until answered; fails with ErrLookupTimeout, along
+// with any entries already received, if the server stops answering for d.
+func LookupFileEntries(m *Multicast, hashId []byte, path string, prefix bool, d time.Duration) ([]FileEntry, error) {
+	if err := m.ListensControlToClient(); err != nil {
+		return nil, err
+	}
+	if err := m.SendsControlToServer(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]FileEntry, 0)
+	timeout := time.After(d)
+	for {
+		// Responses too large for one datagram are fetched from where the last left off:
+		req := encodeFileEntriesRequest(path, prefix, uint32(len(entries)))
+		if _, err := m.SendControlToServer(controlToServerMessage(hashId, RequestFileEntries, req)); err != nil && !isENOBUFS(err) {
+			return entries, err
+		}
+
+		resend := time.After(resendTimeout)
+	wait:
+		for {
+			select {
+			case msg := <-m.ControlToClient:
+				if msg.Error != nil {
+					return entries, msg.Error
+				}
+				id, op, data, err := extractClientMessage(msg)
+				if err != nil || op != RespondFileEntries || compareHashes(id, hashId) != 0 {
+					continue
+				}
+				answered, got, more, err := decodeFileEntries(data)
+				if err != nil || !bytes.Equal(answered, req) {
+					// Another client's answer:
+					continue
+				}
+				entries = append(entries, got...)
+				if !more {
+					return entries, nil
+				}
+				timeout = time.After(d)
+				break wait
+			case <-resend:
+				break wait
+			case <-timeout:
+				return entries, ErrLookupTimeout
+			}
+		}
+	}
+}
+
+// Whether announced HashIds include the one we are after. If the client has not specified a hashId to listen for, it
+// accepts the first one that's announced:
+func (c *Client) acceptAnnouncement(hashIds [][]byte) bool {
+	if c.hashId == nil {
+		c.hashId = hashIds[0]
+		return true
+	}
+	for _, hashId := range hashIds {
+		if compareHashes(c.hashId, hashId) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Summary from the server's announcement; nil if the server announced only its HashId:
+func (c *Client) Announcement() *AnnounceSummary {
+	return c.announced
+}
+
+// Skips the metadata exchange, decodes cached metadata and moves on to data:
+func (c *Client) useCachedMetadata() error {
+	c.metadata = newMetadataDecoder(1, 0)
+	if err := c.metadata.AddSection(0, c.cachedMetadata); err != nil {
+		return err
+	}
+	c.cachedMetadata = nil
+	if err := c.decodeMetadata(); err != nil {
+		return err
+	}
+
+	// Start expecting data sections:
+	return c.startData()
+}
+
+// Validates cached metadata or else requests the metadata header:
+func (c *Client) requestMetadata() error {
+	if c.preloaded && c.options.PublicKey == nil {
+		// Matched by HashId, which is all the announcement has to go on:
+		return c.useCachedMetadata()
+	}
+	if c.cachedDigest != nil && c.announced != nil && c.options.PublicKey == nil &&
+		bytes.Equal(c.announced.MetadataDigest, c.cachedDigest) {
+		// Announced digest already validates the cache; a signature would still need fetching:
+		return c.useCachedMetadata()
+	}
+
+	c.state = ExpectMetadataHeader
+	if c.cachedDigest != nil {
+		c.state = ExpectManifestDigest
+	}
+	return c.ask()
+}
+
+// Table of contents received if FetchTOC is enabled:
+func (c *Client) TOC() []TOCEntry {
+	return c.toc
+}
+
+// Moves on to receiving data, or straight to done if there is nothing left to transfer:
+func (c *Client) startData() error {
+	if c.nakRegions.IsAllAcked() {
+		return c.finishData()
+	}
+
+	c.state = ExpectDataSections
+	return c.ask()
+}
+
+// Asks again for a section that failed its checksum, at most once per resendTimeout; the resend timer covers
+// anything left unasked.
+func (c *Client) askAfterChecksum() error {
+	now := time.Now()
+	if now.Sub(c.lastChecksumAsk) < resendTimeout {
+		return nil
+	}
+	c.lastChecksumAsk = now
+	return c.ask()
+}
+
 func (c *Client) ask() error {
 	err := (error)(nil)
 
 	switch c.state {
+	case ExpectAnnouncement:
+		if c.hashId == nil {
+			// Nothing to ask for; wait for any announcement:
+			return nil
+		}
+		_, err = c.m.SendControlToServer(controlToServerMessage(c.hashId, RequestAnnounce, nil))
+	case ExpectTOCHeader:
+		_, err = c.m.SendControlToServer(controlToServerMessage(c.hashId, RequestTOCHeader, nil))
+	case ExpectTOCSections:
+		req := make([]byte, 2)
+		byteOrder.PutUint16(req[0:2], c.nextTOCSection)
+		_, err = c.m.SendControlToServer(controlToServerMessage(c.hashId, RequestTOCSection, req))
+	case ExpectManifestDigest:
+		_, err = c.m.SendControlToServer(controlToServerMessage(c.hashId, RequestManifestDigest, nil))
 	case ExpectMetadataHeader:
 		_, err = c.m.SendControlToServer(controlToServerMessage(c.hashId, RequestMetadataHeader, nil))
 	case ExpectMetadataSections:
@@ -298,31 +1134,17 @@ func (c *Client) ask() error {
 		byteOrder.PutUint16(req[0:2], uint16(c.nextSectionIndex))
 		_, err = c.m.SendControlToServer(controlToServerMessage(c.hashId, RequestMetadataSection, req))
 	case ExpectDataSections:
+		if c.writeQueue != nil && c.writeQueue.Full() {
+			// Disk cannot keep up; hold off NAKing until the queue drains:
+			c.resendTimer = time.After(resendTimeout)
+			return nil
+		}
 		// Send a message to get a new region:
 		//fmt.Printf("ack: [%v %v]\n", c.lastAck.start, c.lastAck.endEx)
-		max := c.m.MaxMessageSize() - (protocolControlPrefixSize)
-		bytes := make([]byte, max)
-		// Send last ACK:
-		i := 0
-		i += binary.PutUvarint(bytes[i:], uint64(c.lastAck.start))
-		i += binary.PutUvarint(bytes[i:], uint64(c.lastAck.endEx))
-		// Send as many NAK'd regions as we can fit in a message so the server doesnt waste time sending already-ACKed sections:
-		{
-			naks := c.nakRegions.Naks()
-			n := 0
-			for _, k := range naks {
-				if i >= max-2*binary.MaxVarintLen64 {
-					break
-				}
-				i += binary.PutUvarint(bytes[i:], uint64(k.start))
-				i += binary.PutUvarint(bytes[i:], uint64(k.endEx))
-				n++
-			}
-			//if n < len(naks) {
-			//	fmt.Printf("%s", hex.Dump(bytes[:i]))
-			//}
-		}
-		_, err = c.m.SendControlToServer(controlToServerMessage(c.hashId, AckDataSection, bytes[:i]))
+		// Send last ACK and as many NAK'd regions as we can fit in a message so the server doesnt waste time sending already-ACKed sections:
+		max := c.serverMessageSize() - (protocolControlPrefixSize)
+		ackMsg := encodeAckDataSection(c.lastAck, c.nakRegions.Naks(), max)
+		_, err = c.m.SendControlToServer(controlToServerMessage(c.hashId, AckDataSection, ackMsg))
 	case Done:
 	default:
 		return nil
@@ -341,67 +1163,62 @@ func (c *Client) ask() error {
 	return nil
 }
 
-func (c *Client) decodeMetadata() error {
-	// Decode all metadata sections and create a VirtualTarballWriter to download against:
-	md := bytes.Join(c.metadataSections, nil)
-	mdBuf := bytes.NewBuffer(md)
-
-	err := error(nil)
-	readPrimitive := func(data interface{}) {
-		if err == nil {
-			err = binary.Read(mdBuf, byteOrder, data)
+// Checks the metadata signature if a public key is configured; only warns if not. The signature only vouches for
+// file contents through their hashes, so signed metadata must hash every non-empty regular file and each is verified
+// as it is written.
+func (c *Client) verifySignature(digest []byte, files []*TarballFile) error {
+	if c.options.PublicKey == nil {
+		if len(c.signature) > 0 {
+			fmt.Fprintf(os.Stderr, "warning: metadata is signed but no public key is configured to verify it\n")
 		}
+		return nil
 	}
-	readString := func(s *string) {
-		if err != nil {
-			return
-		}
-
-		strlen := uint16(0)
-		readPrimitive(&strlen)
-		if err != nil {
-			return
-		}
-
-		strbuf := make([]byte, strlen)
-		n := 0
-		n, err = mdBuf.Read(strbuf)
-		if err != nil {
-			return
-		}
-
-		if uint16(n) != strlen {
-			err = errors.New("unable to read string from message")
-			return
+	if err := verifyMetadataSignature(c.options.PublicKey, digest, c.signature); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.Mode&os.ModeType == 0 && f.Size > 0 && f.Hash == nil {
+			return ErrSignedNoHashes
 		}
+	}
+	c.options.TarballOptions.VerifyHashes = true
+	return nil
+}
 
-		*s = string(strbuf)
+func (c *Client) decodeMetadata() error {
+	// Collect the incrementally decoded metadata and create a VirtualTarballWriter to download against:
+	size, files, err := c.metadata.Finish()
+	if err != nil {
+		return err
 	}
+	header := metadataHeader{size: size, flags: c.metadata.Flags(), streamSize: c.metadata.StreamSize(),
+		hashSize: uint8(c.metadata.HashSize()), modes: c.metadata.ModeTable()}
+	c.metadata = nil
+
+	// Adopt the sender's tarball layout:
+	c.options.TarballOptions.NoPadding = header.flags&metadataFlagNoPadding != 0
+	c.options.TarballOptions.GzipStream = header.flags&metadataFlagGzipStream != 0
+	c.options.TarballOptions.HashSize = int(header.hashSize)
 
-	// Deserialize tarball metadata:
-	size := int64(0)
-	readPrimitive(&size)
-	fileCount := uint32(0)
-	readPrimitive(&fileCount)
+	md, err := encodeHeaderAndFiles(header, files)
 	if err != nil {
 		return err
 	}
+	if err = c.verifySignature(metadataDigest(md), files); err != nil {
+		return err
+	}
 
-	files := make([]*TarballFile, 0, fileCount)
-	for n := uint32(0); n < fileCount; n++ {
-		f := &TarballFile{}
-		readString(&f.Path)
-		readPrimitive(&f.Size)
-		readPrimitive(&f.Mode)
-		readString(&f.SymlinkDestination)
-		if err != nil {
-			return err
+	if c.options.MetadataCachePath != "" {
+		// Cache metadata for the next run:
+		if err := saveMetadataCache(c.options.MetadataCachePath, md); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to cache metadata: %s\n", err)
 		}
-
-		files = append(files, f)
 	}
 
-	// Create a writer:
+	// Create a writer confined to the extraction root:
+	if err := os.MkdirAll(c.extractRoot(), 0755); err != nil {
+		return err
+	}
 	c.tb, err = NewVirtualTarballWriter(files, c.options.TarballOptions)
 	if err != nil {
 		return err
@@ -409,7 +1226,46 @@ func (c *Client) decodeMetadata() error {
 	if c.tb.size != size {
 		return errors.New("calculated tarball size does not match specified")
 	}
-	c.nakRegions = NewNakRegions(c.tb.size)
+	c.tb.OnFileComplete = c.options.OnFileComplete
+	if c.options.OnCorruption == CorruptionAbort {
+		c.tb.OnFileCorrupt = c.fileCorrupt
+	}
+	c.tb.ConflictResolver = c.options.ConflictResolver
+	if c.options.CheckFreeSpace {
+		if err := c.tb.CheckFreeSpace(c.extractRoot()); err != nil {
+			return err
+		}
+	}
+	if c.options.CheckFreeInodes {
+		if err := c.tb.CheckFreeInodes(c.extractRoot()); err != nil {
+			return err
+		}
+	}
+	if c.options.TarballOptions.NoPadding {
+		if err := c.tb.CreateEmptyEntries(); err != nil {
+			return err
+		}
+	}
+	// Regions are of the gzip stream rather than the tarball with GzipStream:
+	nakSize := c.tb.size
+	if c.options.TarballOptions.GzipStream {
+		nakSize = header.streamSize
+	}
+	c.progressLock.Lock()
+	c.nakRegions = NewNakRegions(nakSize)
+	c.progressLock.Unlock()
+
+	if c.options.TarballOptions.GzipStream {
+		// Decompressed from its start so nothing is resumed or skipped:
+		if c.options.Update || !c.options.Since.IsZero() {
+			fmt.Print("\bwhole-tarball gzip stream; receiving every file\n")
+		}
+		c.progressLock.Lock()
+		c.stream = newGzipStream(c.tb, c.tb.size)
+		c.progressLock.Unlock()
+	} else if err := c.skipReceived(); err != nil {
+		return err
+	}
 
 	fmt.Print("\bReceiving files:\n")
 	for _, f := range c.tb.files {
@@ -418,12 +1274,118 @@ func (c *Client) decodeMetadata() error {
 
 	fmt.Printf("%15s  ID: %s\n", humanize.Comma(c.tb.size), hex.EncodeToString(c.hashId))
 
+	if c.options.WriteQueueDepth > 0 && c.stream == nil {
+		// The decompressor already writes from its own goroutine:
+		c.writeQueue = newWriteQueue(c.tb, c.options.WriteQueueDepth)
+	}
+
 	// Start elapsed timer:
 	c.startTime = time.Now()
 
 	return nil
 }
 
+// Marks what need not be received as received: progress resumed from an interrupted run, files older than Since, files
+// and blocks already up to date with Update, and holes of sparse files:
+func (c *Client) skipReceived() error {
+	// Resume progress from an interrupted run:
+	if err := c.loadResume(); err != nil {
+		return err
+	}
+	if c.options.VerifyResume {
+		if err := c.verifyResume(); err != nil {
+			return err
+		}
+	}
+
+	if !c.options.Since.IsZero() {
+		// Mark regions of older files as received so they are never NAKed:
+		older := c.tb.SkipOlder(c.options.Since)
+		c.progressLock.Lock()
+		before := c.nakRegions.NakedBytes()
+		for _, f := range older {
+			start, endEx := f.offset, f.offset+f.Size+c.options.TarballOptions.padding()
+			// Only bytes not already received in an earlier run are owed to a later one:
+			for _, k := range c.nakRegions.Naks() {
+				if k.start < endEx && start < k.endEx {
+					if k.start < start {
+						k.start = start
+					}
+					if k.endEx > endEx {
+						k.endEx = endEx
+					}
+					c.sinceSkipped = append(c.sinceSkipped, k)
+				}
+			}
+			c.nakRegions.Ack(start, endEx)
+		}
+		skipped := before - c.nakRegions.NakedBytes()
+		c.progressLock.Unlock()
+		c.bytesReceived += skipped
+		c.lastBytesReceived += skipped
+		fmt.Printf("\b%d files not modified since %s\n", len(older), c.options.Since.Format(time.RFC3339))
+	}
+
+	if c.options.Update {
+		// Mark regions of files that are already up to date as received so they are never NAKed:
+		upToDate, err := c.tb.UpToDateFiles()
+		if err != nil {
+			return err
+		}
+		for _, f := range upToDate {
+			n := f.Size + c.options.TarballOptions.padding()
+			c.progressLock.Lock()
+			c.nakRegions.Ack(f.offset, f.offset+n)
+			c.progressLock.Unlock()
+			c.bytesReceived += n
+			c.lastBytesReceived += n
+		}
+		fmt.Printf("\b%d files up to date\n", len(upToDate))
+
+		// Keep unchanged blocks of files updated in place so only the changed blocks are received:
+		blocks, err := c.tb.UpToDateBlocks()
+		if err != nil {
+			return err
+		}
+		reused := int64(0)
+		c.progressLock.Lock()
+		for _, r := range blocks {
+			if c.nakRegions.IsFullyAcked(r.start, r.endEx) {
+				// Part of a file already up to date:
+				continue
+			}
+			c.nakRegions.Ack(r.start, r.endEx)
+			reused += r.endEx - r.start
+		}
+		c.progressLock.Unlock()
+		c.bytesReceived += reused
+		c.lastBytesReceived += reused
+		if reused > 0 {
+			fmt.Printf("\b%s reused from existing files\n", humanize.IBytes(uint64(reused)))
+		}
+	}
+
+	// Holes of sparse files are never sent; the writer leaves them unwritten:
+	c.progressLock.Lock()
+	before := c.nakRegions.NakedBytes()
+	for _, r := range c.tb.Holes() {
+		c.nakRegions.Ack(r.start, r.endEx)
+	}
+	holes := before - c.nakRegions.NakedBytes()
+	c.progressLock.Unlock()
+	c.bytesReceived += holes
+	c.lastBytesReceived += holes
+	if holes > 0 {
+		fmt.Printf("\b%s of holes in sparse files not sent\n", humanize.IBytes(uint64(holes)))
+	}
+
+	// Files already received are not reported complete again:
+	for _, r := range c.nakRegions.Acks() {
+		c.tb.MarkWritten(r.start, r.endEx)
+	}
+	return nil
+}
+
 func (c *Client) processData(msg UDPMessage) error {
 	// Not ready for data yet:
 	if c.tb == nil {
@@ -433,6 +1395,10 @@ func (c *Client) processData(msg UDPMessage) error {
 
 	// Decode data message:
 	hashId, region, data, err := extractDataMessage(msg)
+	if isMalformed(err) {
+		c.droppedMalformed++
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -445,37 +1411,270 @@ func (c *Client) processData(msg UDPMessage) error {
 
 	c.lastAck = Region{start: region, endEx: region + int64(len(data))}
 
-	if c.nakRegions.IsAcked(c.lastAck.start, c.lastAck.endEx) {
+	// A region only partly received before, e.g. truncated by a smaller receive buffer, is not yet ACKed:
+	if c.nakRegions.IsFullyAcked(c.lastAck.start, c.lastAck.endEx) {
 		// Already ACKed:
+		c.sources.record(msg.SourceAddress, c.lastAck, 0, c.nakRegions, time.Now())
 		allDone := c.nakRegions.IsAllAcked()
 		if allDone {
-			c.state = Done
+			return c.finishData()
 		}
 
 		return nil
 	}
 
+	if c.receiveLimiter != nil && !c.receiveLimiter.AllowN(time.Now(), len(data)) {
+		// Over our receive rate; drop and let it be NAKed again:
+		return nil
+	}
+
 	// ACK the region:
+	c.progressLock.Lock()
+	naked := c.nakRegions.NakedBytes()
 	err = c.nakRegions.Ack(c.lastAck.start, c.lastAck.endEx)
+	naked -= c.nakRegions.NakedBytes()
+	c.progressLock.Unlock()
 	if err != nil {
 		return err
 	}
+	c.sources.record(msg.SourceAddress, c.lastAck, naked, c.nakRegions, time.Now())
 	// Write the data:
-	n := 0
-	n, err = c.tb.WriteAt(data, region)
-	if err != nil {
-		return err
-	}
-	if n < len(data) {
-		fmt.Print("\bNot enough data written! %d < %d\n", n, len(data))
+	if c.stream != nil {
+		// Decompressed in order; blocks while the decompressor catches up:
+		if err = c.stream.Put(region, data, c.receivedPrefix()); err != nil {
+			return err
+		}
+	} else if c.writeQueue != nil {
+		// Blocks if the queue is full, applying backpressure to receiving:
+		if err = c.writeQueue.Put(region, data); err != nil {
+			return err
+		}
+	} else {
+		n := 0
+		n, err = c.tb.WriteAt(data, region)
+		if err != nil {
+			return err
+		}
+		if n < len(data) {
+			fmt.Print("\bNot enough data written! %d < %d\n", n, len(data))
+		}
 	}
 
 	c.bytesReceived += int64(len(data))
 
 	allDone := c.nakRegions.IsAllAcked()
 	if allDone {
+		return c.finishData()
+	}
+
+	return nil
+}
+
+// Verifies received files if enabled before finishing; files failing verification are NAKed to be received again,
+// up to maxVerifyRetries times.
+func (c *Client) finishData() error {
+	if c.stream != nil {
+		// The rest of the tarball must be written before it is done:
+		if err := c.stream.Close(); err != nil {
+			// Nothing more can be written; Run returns the error:
+			c.state = Done
+			return nil
+		}
+	}
+	if !c.options.TarballOptions.VerifyHashes {
+		c.state = Done
+		return nil
+	}
+
+	// Queued writes must land before files are verified:
+	if err := c.drainWriteQueue(); err != nil {
+		return err
+	}
+	failed, err := c.tb.VerifyFiles()
+	if err != nil {
+		return err
+	}
+	if len(failed) == 0 {
+		c.state = Done
+		return nil
+	}
+	if c.options.OnCorruption == CorruptionAbort {
+		// The run loop stops before asking for anything more:
+		c.fileCorrupt(failed[0].Path, failed[0])
+		return nil
+	}
+	if c.verifyRetries >= maxVerifyRetries || c.stream != nil {
+		// Give up, as at once for a gzip stream which cannot be received again in part; Run reports ErrHashMismatch:
+		c.verifyFailed = failed
 		c.state = Done
+		return nil
+	}
+	c.verifyRetries++
+
+	c.progressLock.Lock()
+	for _, f := range failed {
+		fmt.Printf("\b'%s' failed verification; receiving again\n", f.Path)
+		c.nakRegions.Nak(f.offset, f.offset+f.Size+c.options.TarballOptions.padding())
+	}
+	c.progressLock.Unlock()
+	if c.options.WriteQueueDepth > 0 {
+		c.writeQueue = newWriteQueue(c.tb, c.options.WriteQueueDepth)
+	}
+	c.state = ExpectDataSections
+	return c.ask()
+}
+
+// Files that still failed verification after maxVerifyRetries rounds of receiving them again:
+func (c *Client) VerifyFailures() []*TarballFile {
+	return c.verifyFailed
+}
+
+// Records the first file to fail verification with CorruptionAbort; called by the writer, perhaps from the write
+// queue's goroutine:
+func (c *Client) fileCorrupt(path string, tf *TarballFile) {
+	c.progressLock.Lock()
+	defer c.progressLock.Unlock()
+
+	if c.corrupt == nil {
+		c.corrupt = tf
+	}
+}
+
+func (c *Client) firstCorrupt() *TarballFile {
+	c.progressLock.Lock()
+	defer c.progressLock.Unlock()
+
+	return c.corrupt
+}
+
+// Receive stats of each source that has sent data for our tarball, by address, for deciding which server to favor
+// when several serve it. Datagrams dropped for exceeding MaxReceiveRate are not counted. Safe to call while the client
+// is running.
+func (c *Client) SourceStats() []SourceStats {
+	return c.sources.stats()
+}
+
+// Bytes of the tarball received so far, including those resumed or already up to date, out of its total size. Both
+// are zero until the metadata has been received. Safe to call while the client is running.
+func (c *Client) Progress() (received, total int64) {
+	c.progressLock.Lock()
+	defer c.progressLock.Unlock()
+
+	if c.nakRegions == nil {
+		return 0, 0
+	}
+	return c.nakRegions.size - c.nakRegions.NakedBytes(), c.nakRegions.size
+}
+
+// Like Progress in bytes of file contents, leaving out the padding between files that the tarball size includes.
+func (c *Client) ContentProgress() (received, total int64) {
+	c.progressLock.Lock()
+	defer c.progressLock.Unlock()
+
+	if c.nakRegions == nil || c.tb == nil {
+		return 0, 0
 	}
+	total = c.tb.ContentSize()
+	received = total
+	for _, r := range c.pendingRegions() {
+		received -= c.tb.ContentBytes(r.start, r.endEx)
+	}
+	return received, total
+}
 
+// Content bytes received of a single file, out of its size; received is -1 if the file is not in the tarball. Safe
+// to call while the client is running.
+func (c *Client) FileProgress(path string) (received, total int64) {
+	c.progressLock.Lock()
+	defer c.progressLock.Unlock()
+
+	if c.nakRegions == nil || c.tb == nil {
+		return -1, 0
+	}
+	for _, f := range c.tb.files {
+		if f.Path != path {
+			continue
+		}
+		received = f.Size
+		for _, r := range c.pendingRegions() {
+			start, endEx := r.start, r.endEx
+			if start < f.offset {
+				start = f.offset
+			}
+			if endEx > f.offset+f.Size {
+				endEx = f.offset + f.Size
+			}
+			if start < endEx {
+				received -= endEx - start
+			}
+		}
+		return received, f.Size
+	}
+	return -1, 0
+}
+
+// Regions of the tarball not yet written, which with GzipStream follow what the decompressor has written so far:
+func (c *Client) pendingRegions() []Region {
+	if c.stream == nil {
+		return c.nakRegions.Naks()
+	}
+	if written := c.stream.Written(); written < c.tb.size {
+		return []Region{{start: written, endEx: c.tb.size}}
+	}
 	return nil
 }
+
+// End of the data received without a gap from the start:
+func (c *Client) receivedPrefix() int64 {
+	naks := c.nakRegions.Naks()
+	if len(naks) == 0 {
+		return c.nakRegions.size
+	}
+	return naks[0].start
+}
+
+// Opens a file being received to read its bytes as they arrive. Fails with ErrNoMetadata until the metadata has been
+// received. Safe to call while the client is running.
+func (c *Client) OpenReceived(path string) (*ReceivedFile, error) {
+	c.progressLock.Lock()
+	tb := c.tb
+	c.progressLock.Unlock()
+
+	if tb == nil {
+		return nil, ErrNoMetadata
+	}
+	return tb.OpenReceived(path)
+}
+
+// Whether every byte of the tarball has been received. Safe to call while the client is running.
+func (c *Client) IsComplete() bool {
+	c.progressLock.Lock()
+	defer c.progressLock.Unlock()
+
+	return c.nakRegions != nil && c.nakRegions.IsAllAcked()
+}
+
+// Adopts the sizes the server slices the tarball and metadata with. Receive buffers grow to fit the server's
+// datagrams so that none are truncated when our own datagram size is smaller.
+func (c *Client) adoptServerSizes(regionSize, sectionSize uint16) {
+	c.regionSize = regionSize
+	c.sectionSize = sectionSize
+
+	datagramSize := int(regionSize) + protocolDataMsgPrefixSize
+	if n := int(sectionSize) + protocolControlPrefixSize + metadataSectionMsgSize; n > datagramSize {
+		datagramSize = n
+	}
+	if datagramSize > c.m.MaxMessageSize() {
+		c.m.SetDatagramSize(datagramSize)
+	}
+}
+
+// Largest control message the server can receive whole, as implied by its advertised region size; our own datagram
+// size until that is known:
+func (c *Client) serverMessageSize() int {
+	size := c.m.MaxMessageSize()
+	if serverSize := int(c.regionSize) + protocolDataMsgPrefixSize; c.regionSize > 0 && serverSize < size {
+		size = serverSize
+	}
+	return size
+}
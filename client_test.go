@@ -0,0 +1,1200 @@
+// client_test.go
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+import "golang.org/x/time/rate"
+
+func TestClient_DropsMalformed(t *testing.T) {
+	c := NewClient(nil, ClientOptions{})
+	hashId := []byte("01234567")
+
+	msgs := []UDPMessage{
+		{Data: dataMessage(hashId, 0, []byte("stray data"))},
+		{Data: controlToServerMessage(hashId, RequestMetadataHeader, nil)},
+		{Data: []byte{protocolVersion}},
+	}
+	for _, msg := range msgs {
+		if err := c.processControl(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.DroppedMalformed() != int64(len(msgs)) {
+		t.Fatalf("expected %d dropped; got %d", len(msgs), c.DroppedMalformed())
+	}
+}
+
+func TestClient_TOCSectionCount(t *testing.T) {
+	c := NewClient(nil, ClientOptions{})
+	c.hashId = []byte("01234567")
+
+	// A header announcing no sections is dropped rather than leaving nowhere to store section 0:
+	c.state = ExpectTOCHeader
+	if err := c.processControl(UDPMessage{Data: controlToClientMessage(c.hashId, RespondTOCHeader, []byte{0, 0})}); err != nil {
+		t.Fatal(err)
+	}
+	if c.state != ExpectTOCHeader || c.DroppedMalformed() != 1 {
+		t.Fatalf("expected header dropped; state = %v, dropped = %d", c.state, c.DroppedMalformed())
+	}
+
+	// So is a section past the announced count:
+	c.state = ExpectTOCSections
+	c.tocSections = make([][]byte, 1)
+	c.nextTOCSection = 1
+	msg := UDPMessage{Data: controlToClientMessage(c.hashId, RespondTOCSection, encodeSection(1, []byte("toc")))}
+	if err := c.processControl(msg); err != nil {
+		t.Fatal(err)
+	}
+	if c.DroppedMalformed() != 2 {
+		t.Fatalf("expected section dropped; dropped = %d", c.DroppedMalformed())
+	}
+}
+
+func TestClient_Resume(t *testing.T) {
+	hashId := []byte("01234567")
+	c := NewClient(nil, ClientOptions{ResumePath: "test.resume"})
+	c.hashId = hashId
+	c.nakRegions = NewNakRegions(100)
+	c.nakRegions.Ack(0, 40)
+	c.nakRegions.Ack(60, 70)
+	if err := c.saveResume(); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.resume")
+
+	r := NewClient(nil, ClientOptions{ResumePath: "test.resume"})
+	r.hashId = hashId
+	r.nakRegions = NewNakRegions(100)
+	if err := r.loadResume(); err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, r.nakRegions.Naks(), c.nakRegions.Naks())
+	if r.bytesReceived != 50 {
+		t.Fatalf("bytesReceived != 50; bytesReceived = %d", r.bytesReceived)
+	}
+
+	// Progress for a different tarball is ignored:
+	o := NewClient(nil, ClientOptions{ResumePath: "test.resume"})
+	o.hashId = []byte("76543210")
+	o.nakRegions = NewNakRegions(100)
+	if err := o.loadResume(); err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, o.nakRegions.Naks(), []Region{{0, 100}})
+}
+
+func TestClient_VerifyResume(t *testing.T) {
+	blocks := [][]byte{}
+	for _, b := range []string{"aaaa", "bbbb", "cccc"} {
+		sum := sha256.Sum256([]byte(b))
+		blocks = append(blocks, sum[:])
+	}
+	c := NewClient(nil, ClientOptions{VerifyResume: true})
+	c.tb = newTarballWriter(t, []*TarballFile{
+		&TarballFile{Path: "partial.bin", Size: 12, Mode: 0644, BlockSize: 4, BlockHashes: blocks},
+	})
+	defer os.Remove("partial.bin")
+
+	// Saved progress claims the first two blocks, but only the first and an unrecorded third block are on disk:
+	if err := ioutil.WriteFile("partial.bin", []byte("aaaaXXXXcccc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.nakRegions = NewNakRegions(c.tb.size)
+	c.nakRegions.Ack(0, 8)
+	c.bytesReceived = 8
+
+	if err := c.verifyResume(); err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, c.nakRegions.Naks(), []Region{{4, 8}, {12, 13}})
+	if c.bytesReceived != 8 {
+		t.Fatalf("bytesReceived != 8; bytesReceived = %d", c.bytesReceived)
+	}
+
+	// Files not partly received keep their progress:
+	c.nakRegions = NewNakRegions(c.tb.size)
+	if err := c.verifyResume(); err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, c.nakRegions.Naks(), []Region{{0, 13}})
+}
+
+func TestClient_Since(t *testing.T) {
+	since := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	c := NewClient(nil, ClientOptions{Since: since, ResumePath: "since.resume"})
+	c.tb = newTarballWriter(t, []*TarballFile{
+		&TarballFile{Path: "since", Mode: os.ModeDir | 0755, ModTime: since.Add(-time.Hour)},
+		&TarballFile{Path: "since/new.txt", Size: 3, Mode: 0644, ModTime: since.Add(time.Second)},
+		&TarballFile{Path: "since/old.txt", Size: 4, Mode: 0644, ModTime: since},
+		&TarballFile{Path: "since/unknown.txt", Size: 2, Mode: 0644},
+	})
+	defer os.RemoveAll("since")
+	c.nakRegions = NewNakRegions(c.tb.size)
+
+	if err := c.skipReceived(); err != nil {
+		t.Fatal(err)
+	}
+	// Only the old file is never requested; the directory and the file without a modification time are kept:
+	cmp(t, c.nakRegions.Naks(), []Region{{0, 5}, {10, 13}})
+	if c.bytesReceived != 5 {
+		t.Fatalf("bytesReceived != 5; bytesReceived = %d", c.bytesReceived)
+	}
+
+	// Saved progress still NAKs the old file for a later run without Since:
+	c.hashId = []byte("01234567")
+	defer os.Remove("since.resume")
+	if err := c.saveResume(); err != nil {
+		t.Fatal(err)
+	}
+	naks := c.nakRegions
+	c.nakRegions = NewNakRegions(c.tb.size)
+	if err := c.loadResume(); err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, c.nakRegions.Naks(), []Region{{0, 13}})
+	c.nakRegions = naks
+
+	// Nor is it extracted if its bytes arrive anyway:
+	if _, err := c.tb.WriteAt([]byte("\x00ab\n\x00old\n\x00u\n\x00"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat("since/old.txt"); !os.IsNotExist(err) {
+		t.Fatalf("expected old file not to be extracted; got %v", err)
+	}
+	for _, path := range []string{"since/new.txt", "since/unknown.txt"} {
+		if _, err := os.Lstat(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClient_MaxReceiveRate(t *testing.T) {
+	hashId := []byte("01234567")
+	c := NewClient(nil, ClientOptions{MaxReceiveRate: 1})
+	c.hashId = hashId
+	c.tb = newTarballWriter(t, []*TarballFile{
+		&TarballFile{Path: "paced.txt", Size: 7, Mode: 0644},
+	})
+	defer closeTarballWriter(t, c.tb)
+	c.nakRegions = NewNakRegions(c.tb.size)
+	c.state = ExpectDataSections
+
+	// Bucket starts full, so each message drains it for the rest of the test:
+	c.receiveLimiter = rate.NewLimiter(rate.Limit(1), 4)
+	if err := c.processData(UDPMessage{Data: dataMessage(hashId, 0, []byte("abcd"))}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.processData(UDPMessage{Data: dataMessage(hashId, 4, []byte("efg\x00"))}); err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, c.nakRegions.Naks(), []Region{{4, 8}})
+	if c.bytesReceived != 4 {
+		t.Fatalf("bytesReceived != 4; bytesReceived = %d", c.bytesReceived)
+	}
+}
+
+func TestClient_SourceStats(t *testing.T) {
+	hashId := []byte("01234567")
+	newClient := func(path string) *Client {
+		c := NewClient(nil, ClientOptions{})
+		c.hashId = hashId
+		c.tb = newTarballWriter(t, []*TarballFile{
+			&TarballFile{Path: path, Size: 7, Mode: 0644},
+		})
+		c.nakRegions = NewNakRegions(c.tb.size)
+		c.state = ExpectDataSections
+		return c
+	}
+	c := newClient("sourced.txt")
+	defer closeTarballWriter(t, c.tb)
+
+	near := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	far := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 40000}
+	// Sources are told apart by IP and port, however the IP is held:
+	c.processData(UDPMessage{Data: dataMessage(hashId, 0, []byte("ab")), SourceAddress: near})
+	c.processData(UDPMessage{Data: dataMessage(hashId, 2, []byte("cd")), SourceAddress: &net.UDPAddr{IP: near.IP.To4(), Port: 40000}})
+	// Overlaps what near already sent:
+	c.processData(UDPMessage{Data: dataMessage(hashId, 2, []byte("cd")), SourceAddress: far})
+	c.processData(UDPMessage{Data: dataMessage(hashId, 2, []byte("cdefg\x00")), SourceAddress: far})
+
+	stats := c.SourceStats()
+	if len(stats) != 2 || stats[0].Address != near.String() || stats[1].Address != far.String() {
+		t.Fatalf("unexpected sources %+v", stats)
+	}
+	if stats[0].Datagrams != 2 || stats[0].NewBytes != 4 || stats[0].Duplicates != 0 || stats[0].LostBytes != 0 {
+		t.Fatalf("near = %+v", stats[0])
+	}
+	if stats[1].Datagrams != 2 || stats[1].NewBytes != 4 || stats[1].Duplicates != 1 || stats[1].DuplicateRatio() != 0.5 {
+		t.Fatalf("far = %+v", stats[1])
+	}
+
+	// Bytes still NAKed that a source skipped over count as lost, until it starts over:
+	c = newClient("lossy.txt")
+	defer closeTarballWriter(t, c.tb)
+	c.processData(UDPMessage{Data: dataMessage(hashId, 0, []byte("ab")), SourceAddress: near})
+	c.processData(UDPMessage{Data: dataMessage(hashId, 4, []byte("efg\x00")), SourceAddress: near})
+	c.processData(UDPMessage{Data: dataMessage(hashId, 0, []byte("ab")), SourceAddress: near})
+	c.processData(UDPMessage{Data: dataMessage(hashId, 2, []byte("cd")), SourceAddress: near})
+
+	stats = c.SourceStats()
+	if len(stats) != 1 || stats[0].Datagrams != 4 || stats[0].NewBytes != 8 || stats[0].LostBytes != 2 || stats[0].LossRatio() != 0.2 {
+		t.Fatalf("unexpected sources %+v", stats)
+	}
+}
+
+type blockingWriterAt struct {
+	release chan empty
+}
+
+func (w *blockingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+func TestClient_WriteQueue(t *testing.T) {
+	hashId := []byte("01234567")
+	c := NewClient(nil, ClientOptions{})
+	c.hashId = hashId
+	c.tb = newTarballWriter(t, []*TarballFile{
+		&TarballFile{Path: "queued.txt", Size: 7, Mode: 0644},
+	})
+	defer closeTarballWriter(t, c.tb)
+	c.nakRegions = NewNakRegions(c.tb.size)
+	c.state = ExpectDataSections
+
+	c.writeQueue = newWriteQueue(c.tb, 2)
+	c.processData(UDPMessage{Data: dataMessage(hashId, 0, []byte("abcd"))})
+	c.processData(UDPMessage{Data: dataMessage(hashId, 4, []byte("efg\x00"))})
+	if err := c.drainWriteQueue(); err != nil {
+		t.Fatal(err)
+	}
+	c.tb.Close()
+	if buf, _ := ioutil.ReadFile("queued.txt"); string(buf) != "abcdefg" {
+		t.Fatalf("unexpected contents %q", buf)
+	}
+
+	// A full queue holds off NAKs; with no multicast this would panic if it tried to send:
+	w := &blockingWriterAt{release: make(chan empty)}
+	c.writeQueue = newWriteQueue(w, 1)
+	c.writeQueue.Put(0, []byte("a"))
+	c.writeQueue.Put(1, []byte("b"))
+	if n, depth := c.WriteQueueFill(); n != 1 || depth != 1 {
+		t.Fatalf("fill = %d/%d; expected 1/1", n, depth)
+	}
+	if err := c.ask(); err != nil {
+		t.Fatal(err)
+	}
+	close(w.release)
+	c.drainWriteQueue()
+}
+
+func TestClient_GzipStreamOutOfOrder(t *testing.T) {
+	contents := make([]byte, 3000)
+	rand.New(rand.NewSource(4)).Read(contents)
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	zw.Write(append(append([]byte(nil), contents...), 0))
+	zw.Close()
+	stream := buf.Bytes()
+
+	hashId := []byte("01234567")
+	c := NewClient(nil, ClientOptions{})
+	c.hashId = hashId
+	c.tb = newTarballWriter(t, []*TarballFile{
+		&TarballFile{Path: "streamed.bin", Size: int64(len(contents)), Mode: 0644},
+	})
+	defer os.Remove("streamed.bin")
+	c.nakRegions = NewNakRegions(int64(len(stream)))
+	c.stream = newGzipStream(c.tb, c.tb.size)
+	c.state = ExpectDataSections
+
+	// Regions arrive last first, so all but the first are staged until it arrives:
+	const regionSize = 500
+	for start := (len(stream) - 1) / regionSize * regionSize; start >= 0; start -= regionSize {
+		end := start + regionSize
+		if end > len(stream) {
+			end = len(stream)
+		}
+		if err := c.processData(UDPMessage{Data: dataMessage(hashId, int64(start), stream[start:end])}); err != nil {
+			t.Fatal(err)
+		}
+		if start > 0 && c.stream.Written() != 0 {
+			t.Fatalf("wrote %d bytes before the start of the stream arrived", c.stream.Written())
+		}
+	}
+	if c.state != Done {
+		t.Fatalf("expected done; state = %v", c.state)
+	}
+	if received, total := c.ContentProgress(); received != total {
+		t.Fatalf("content progress %d/%d once written", received, total)
+	}
+	if err := c.tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if received, _ := ioutil.ReadFile("streamed.bin"); !bytes.Equal(received, contents) {
+		t.Fatal("decompressed contents differ")
+	}
+
+	// A stream decompressing to the wrong size fails:
+	z := newGzipStream(&blockingWriterAt{release: make(chan empty)}, 1)
+	close(z.w.(*blockingWriterAt).release)
+	if err := z.Put(0, stream, int64(len(stream))); err != nil && err != ErrStreamSize {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != ErrStreamSize {
+		t.Fatalf("expected ErrStreamSize; got %v", err)
+	}
+}
+
+func TestClient_Cancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 178), Port: 13770}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetLoopback(true)
+	m.SetTTL(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := NewClient(m, ClientOptions{RefreshRate: 10 * time.Millisecond})
+	done := make(chan error, 1)
+	go func() { done <- c.RunContext(ctx) }()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled; got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("client did not stop after cancel")
+	}
+
+	// Receive loops must have exited:
+	for i := 0; i < 50 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("leaked %d goroutines", n-before)
+	}
+}
+
+func TestClient_AnnounceSummarySkipsDigestRequest(t *testing.T) {
+	hashId := []byte("01234567")
+	md, err := encodeMetadata(0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No multicast: any request sent to the server would panic.
+	c := NewClient(nil, ClientOptions{ResumePath: "summary.resume"})
+	c.cachedDigest = metadataDigest(md)
+	c.cachedMetadata = md
+
+	summary := encodeAnnounceSummary(AnnounceSummary{Size: 0, FileCount: 0, MetadataDigest: metadataDigest(md)})
+	if err := c.processControl(UDPMessage{Data: controlToClientMessage(hashId, AnnounceTarball, summary)}); err != nil {
+		t.Fatal(err)
+	}
+	if c.Announcement() == nil || c.Announcement().FileCount != 0 {
+		t.Fatalf("unexpected announcement %+v", c.Announcement())
+	}
+	if c.state != Done {
+		t.Fatalf("expected Done from cached metadata; state = %v", c.state)
+	}
+}
+
+func TestClient_Progress(t *testing.T) {
+	hashId := []byte("01234567")
+	c := NewClient(nil, ClientOptions{})
+	if received, total := c.Progress(); received != 0 || total != 0 || c.IsComplete() {
+		t.Fatalf("expected no progress before metadata; got %d/%d", received, total)
+	}
+
+	c.hashId = hashId
+	c.tb = newTarballWriter(t, []*TarballFile{
+		&TarballFile{Path: "progress.txt", Size: 7, Mode: 0644},
+	})
+	defer closeTarballWriter(t, c.tb)
+	c.nakRegions = NewNakRegions(c.tb.size)
+	c.state = ExpectDataSections
+
+	// Poll from another goroutine while data is received:
+	stop := make(chan empty)
+	polled := make(chan empty)
+	go func() {
+		defer close(polled)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.Progress()
+				c.IsComplete()
+			}
+		}
+	}()
+
+	if err := c.processData(UDPMessage{Data: dataMessage(hashId, 0, []byte("abcd"))}); err != nil {
+		t.Fatal(err)
+	}
+	if received, total := c.Progress(); received != 4 || total != 8 || c.IsComplete() {
+		t.Fatalf("expected 4/8 received; got %d/%d", received, total)
+	}
+	if received, total := c.ContentProgress(); received != 4 || total != 7 {
+		t.Fatalf("expected 4/7 content bytes received; got %d/%d", received, total)
+	}
+	if received, total := c.FileProgress("progress.txt"); received != 4 || total != 7 {
+		t.Fatalf("expected 4/7 bytes of progress.txt received; got %d/%d", received, total)
+	}
+	if received, _ := c.FileProgress("missing.txt"); received != -1 {
+		t.Fatalf("expected -1 for a file not in the tarball; got %d", received)
+	}
+	if err := c.processData(UDPMessage{Data: dataMessage(hashId, 4, []byte("efg\x00"))}); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	<-polled
+
+	if received, total := c.Progress(); received != 8 || total != 8 || !c.IsComplete() {
+		t.Fatalf("expected 8/8 received; got %d/%d", received, total)
+	}
+}
+
+// Runs s in the background; the returned func stops it and waits for it to leave its groups, failing the test if it
+// had stopped for any reason other than multicast being unavailable:
+func serve(t *testing.T, s *Server) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.RunContext(ctx)
+	}()
+	return func() {
+		cancel()
+		err := <-stopped
+		if _, ok := err.(net.Error); !ok && err != context.Canceled {
+			t.Errorf("server stopped: %v", err)
+		}
+	}
+}
+
+func TestClient_MismatchedDatagramSize(t *testing.T) {
+	contents := make([]byte, 5000)
+	for i := range contents {
+		contents[i] = byte(i * 7)
+	}
+	// Served from memory, followed by its padding byte:
+	tarball := append(append([]byte(nil), contents...), 0)
+
+	tests := []struct {
+		group      net.IP
+		port       int
+		serverSize int
+		clientSize int
+	}{
+		// Server datagrams would be truncated by the client's smaller receive buffers:
+		{net.IPv4(239, 0, 0, 181), 13800, 1400, 300},
+		// Client ACKs would be truncated by the server's smaller receive buffers:
+		{net.IPv4(239, 0, 0, 182), 13810, 300, 1400},
+	}
+	for _, test := range tests {
+		newMulticast := func(datagramSize int) *Multicast {
+			m, err := NewMulticast(&net.UDPAddr{IP: test.group, Port: test.port}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.SetLoopback(true)
+			m.SetTTL(0)
+			m.SetDatagramSize(datagramSize)
+			return m
+		}
+
+		tb := newScriptedReader([]*TarballFile{
+			&TarballFile{Path: "mismatch.bin", Size: int64(len(contents)), Mode: 0644},
+		})
+		tb.read = func(buf []byte, offset int64) (int, error) {
+			return copy(buf, tarball[offset:]), nil
+		}
+		stop := serve(t, NewServer(newMulticast(test.serverSize), tb, ServerOptions{}))
+
+		cm := newMulticast(test.clientSize)
+		c := NewClient(cm, ClientOptions{HashId: tb.HashId(), RefreshRate: 10 * time.Millisecond})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := c.RunContext(ctx)
+		cancel()
+		cm.Close()
+		stop()
+		if err != nil {
+			t.Fatalf("server %d, client %d: %v", test.serverSize, test.clientSize, err)
+		}
+
+		if int(c.regionSize)+protocolDataMsgPrefixSize != test.serverSize {
+			t.Fatalf("client adopted region size %d from a %d byte server", c.regionSize, test.serverSize)
+		}
+		received, err := ioutil.ReadFile("mismatch.bin")
+		os.Remove("mismatch.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, contents) {
+			t.Fatalf("server %d, client %d: received contents differ", test.serverSize, test.clientSize)
+		}
+	}
+}
+
+func TestClient_AnnounceTarballs(t *testing.T) {
+	wanted := []byte("wanted!!")
+	c := NewClient(nil, ClientOptions{HashId: wanted})
+
+	// Announcements not including our HashId are ignored:
+	others := [][]byte{[]byte("other--1"), []byte("other--2")}
+	for _, msg := range encodeAnnounceTarballs(others, maxDatagramSize) {
+		if err := c.processControl(UDPMessage{Data: msg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.state != ExpectAnnouncement {
+		t.Fatalf("expected to keep waiting for an announcement; state = %v", c.state)
+	}
+	if !c.acceptAnnouncement(append(others, wanted)) {
+		t.Fatal("expected a packed announcement including our HashId to be accepted")
+	}
+
+	// Without a HashId the first announced is taken:
+	c = NewClient(nil, ClientOptions{})
+	if !c.acceptAnnouncement(others) || !bytes.Equal(c.hashId, others[0]) {
+		t.Fatalf("expected the first HashId; got %q", c.hashId)
+	}
+}
+
+func TestDiscoverTarballs(t *testing.T) {
+	group := &net.UDPAddr{IP: net.IPv4(239, 0, 0, 185), Port: 13840}
+	listener, err := NewMulticast(group, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	sender, err := NewMulticast(group, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	sender.SetLoopback(true)
+	sender.SetTTL(0)
+	if err := sender.SendsControlToClient(); err != nil {
+		t.Fatal(err)
+	}
+
+	single := []byte("single!!")
+	packed := [][]byte{[]byte("packed-1"), []byte("packed-2"), single}
+	done := make(chan empty)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+			sender.SendControlToClient(controlToClientMessage(single, AnnounceTarball, nil))
+			AnnounceHashIds(sender, packed)
+		}
+	}()
+
+	hashIds, err := DiscoverTarballs(listener, 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashIds) == 0 {
+		t.Skip("no announcements received; multicast loopback unavailable")
+	}
+	if len(hashIds) != 3 {
+		t.Fatalf("expected 3 distinct HashIds; got %q", hashIds)
+	}
+}
+
+func TestLookupFileEntries(t *testing.T) {
+	newMulticast := func() *Multicast {
+		m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 192), Port: 13920}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.SetLoopback(true)
+		m.SetTTL(0)
+		return m
+	}
+
+	// Enough matches that the answer spans several responses:
+	files := []*TarballFile{&TarballFile{Path: "other.txt", Size: 1, Mode: 0644}}
+	for i := 0; i < 100; i++ {
+		files = append(files, &TarballFile{Path: fmt.Sprintf("lookup/a-rather-long-file-name-%03d.txt", i), Size: 2, Mode: 0644})
+	}
+	tb := newScriptedReader(files)
+
+	sm := newMulticast()
+	defer sm.Close()
+	if err := sm.SendsControlToClient(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.ListensControlToServer(); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(sm, tb, ServerOptions{})
+	done := make(chan empty)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case ctrl := <-sm.ControlToServer:
+				s.processControl(ctrl)
+			}
+		}
+	}()
+
+	cm := newMulticast()
+	defer cm.Close()
+	entries, err := LookupFileEntries(cm, s.hashId, "lookup/", true, 500*time.Millisecond)
+	if err == ErrLookupTimeout && len(entries) == 0 {
+		t.Skip("no response received; multicast loopback unavailable")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 100 {
+		t.Fatalf("expected 100 entries; got %d", len(entries))
+	}
+	for i, e := range entries {
+		if e.File.Path != files[i+1].Path || e.Offset != files[i+1].offset {
+			t.Fatalf("entry %d is %q at %d; expected %q at %d", i, e.File.Path, e.Offset, files[i+1].Path, files[i+1].offset)
+		}
+	}
+
+	// Exact lookups match only the path itself:
+	entries, err = LookupFileEntries(cm, s.hashId, "other.txt", false, 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].File.Path != "other.txt" {
+		t.Fatalf("expected only other.txt; got %v", entries)
+	}
+}
+
+// Loss and latency on one simulated client's link, applied to every datagram it receives:
+type linkProfile struct {
+	Loss    float64
+	Latency time.Duration
+}
+
+// Serves files, keyed by path, from one server reading with options to a client per profile over group on an in-process
+// network. Each client extracts into its own directory and must reconstruct every file with matching hashes.
+func runTransfer(t *testing.T, group *net.UDPAddr, files map[string][]byte, options VirtualTarballOptions, profiles []linkProfile) {
+	dir, err := ioutil.TempDir("", "lancaster-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	for path, contents := range files {
+		local := filepath.Join(src, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(local, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sources, err := MergeTarballSources(TarballSource{Root: src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.HashFiles = true
+	tb, err := NewVirtualTarballReader(sources, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	network := newMemoryNetwork()
+	newMulticast := func() *Multicast {
+		m := network.newMulticast(t, group)
+		m.SetDatagramSize(1400)
+		return m
+	}
+	defer serve(t, NewServer(newMulticast(), tb, ServerOptions{}))()
+
+	errs := make([]error, len(profiles))
+	clients := make([]*Client, len(profiles))
+	var wg sync.WaitGroup
+	for i, profile := range profiles {
+		cm := newMulticast()
+		defer cm.Close()
+		if profile.Loss > 0 || profile.Latency > 0 {
+			rng := rand.New(rand.NewSource(int64(i + 1)))
+			lock := sync.Mutex{}
+			profile := profile
+			cm.receiveFilter = func(data []byte) bool {
+				time.Sleep(profile.Latency)
+				lock.Lock()
+				defer lock.Unlock()
+				return rng.Float64() >= profile.Loss
+			}
+		}
+
+		root := filepath.Join(dir, fmt.Sprintf("client%d", i))
+		copts := getOptions()
+		copts.ExtractRoot = root
+		copts.VerifyHashes = true
+		clients[i] = NewClient(cm, ClientOptions{
+			HashId:         tb.HashId(),
+			TarballOptions: copts,
+			RefreshRate:    10 * time.Millisecond,
+			ResumePath:     root + ".resume",
+		})
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			errs[i] = clients[i].RunContext(ctx)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, profile := range profiles {
+		if errs[i] != nil {
+			t.Fatalf("client %d %+v: %v", i, profile, errs[i])
+		}
+		if failed := clients[i].VerifyFailures(); len(failed) > 0 {
+			t.Fatalf("client %d %+v: %d files failed verification", i, profile, len(failed))
+		}
+		for path, contents := range files {
+			received, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("client%d", i), filepath.FromSlash(path)))
+			if err != nil {
+				t.Fatalf("client %d %+v: %v", i, profile, err)
+			}
+			if sha256.Sum256(received) != sha256.Sum256(contents) {
+				t.Fatalf("client %d %+v: %s differs", i, profile, path)
+			}
+		}
+	}
+}
+
+func TestClient_LossyTransfer(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	files := map[string][]byte{}
+	for i, size := range []int{0, 1, 1399, 20000, 65536} {
+		contents := make([]byte, size)
+		rng.Read(contents)
+		files[fmt.Sprintf("dir%d/file%d.bin", i%2, i)] = contents
+	}
+
+	runTransfer(t, &net.UDPAddr{IP: net.IPv4(239, 0, 0, 186), Port: 13850}, files, getOptions(), []linkProfile{
+		{},
+		{Loss: 0.05},
+		{Loss: 0.2, Latency: 100 * time.Microsecond},
+		{Loss: 0.4},
+	})
+}
+
+func TestClient_GzipStream(t *testing.T) {
+	// Many small similar files, which compress well together, with enough random ids to need several regions:
+	rng := rand.New(rand.NewSource(3))
+	files := map[string][]byte{}
+	for i := 0; i < 200; i++ {
+		files[fmt.Sprintf("logs/day%03d.log", i)] = []byte(fmt.Sprintf("%03d: nothing to report for %016x\n", i, rng.Uint64()))
+	}
+
+	options := getOptions()
+	options.GzipStream = true
+	// Loss has later regions arrive before earlier ones, which are staged until they follow on:
+	runTransfer(t, &net.UDPAddr{IP: net.IPv4(239, 0, 0, 189), Port: 13880}, files, options, []linkProfile{
+		{},
+		{Loss: 0.3},
+	})
+}
+
+func TestClient_OnCorruption(t *testing.T) {
+	// Bytes of the bad files are altered on the way to the client every time they are sent:
+	files := []*TarballFile{}
+	contents := map[string][]byte{}
+	for _, path := range []string{"bad1.bin", "good.bin", "bad2.bin"} {
+		fill := byte('g')
+		if strings.HasPrefix(path, "bad") {
+			fill = 'B'
+		}
+		contents[path] = bytes.Repeat([]byte{fill}, 3000)
+		files = append(files, &TarballFile{Path: path, Mode: 0644, Content: bytesProvider{Reader: bytes.NewReader(contents[path])}})
+	}
+	options := getOptions()
+	options.HashFiles = true
+	tb, err := NewVirtualTarballReader(files, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	group := &net.UDPAddr{IP: net.IPv4(239, 0, 0, 195), Port: 13950}
+	network := newMemoryNetwork()
+	newMulticast := func() *Multicast {
+		m := network.newMulticast(t, group)
+		m.SetDatagramSize(1400)
+		return m
+	}
+	defer serve(t, NewServer(newMulticast(), tb, ServerOptions{}))()
+
+	download := func(policy CorruptionPolicy) (*Client, string, error) {
+		dir, err := ioutil.TempDir("", "lancaster-corruption")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cm := newMulticast()
+		cm.receiveFilter = func(data []byte) bool {
+			if i := bytes.Index(data, []byte("BBBB")); i >= 0 {
+				data[i] = 'X'
+			}
+			return true
+		}
+		copts := getOptions()
+		copts.ExtractRoot = dir
+		copts.VerifyHashes = true
+		c := NewClient(cm, ClientOptions{
+			HashId:         tb.HashId(),
+			TarballOptions: copts,
+			RefreshRate:    10 * time.Millisecond,
+			ResumePath:     dir + ".resume",
+			OnCorruption:   policy,
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		return c, dir, c.RunContext(ctx)
+	}
+
+	// Abort stops at the first bad file without receiving it again:
+	c, dir, err := download(CorruptionAbort)
+	defer os.RemoveAll(dir)
+	corrupt, ok := err.(*CorruptFilesError)
+	if !ok || !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("expected CorruptFilesError; got %v", err)
+	}
+	if len(corrupt.Paths) != 1 || !strings.HasPrefix(corrupt.Paths[0], "bad") {
+		t.Fatalf("expected one bad file; got %v", corrupt.Paths)
+	}
+	if c.verifyRetries != 0 {
+		t.Fatalf("received files again %d times before aborting", c.verifyRetries)
+	}
+
+	// Collect receives bad files again until it gives up, extracting the rest, and reports every bad file:
+	c, dir, err = download(CorruptionCollect)
+	defer os.RemoveAll(dir)
+	corrupt, ok = err.(*CorruptFilesError)
+	if !ok || !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("expected CorruptFilesError; got %v", err)
+	}
+	if strings.Join(corrupt.Paths, ",") != "bad1.bin,bad2.bin" {
+		t.Fatalf("expected both bad files; got %v", corrupt.Paths)
+	}
+	if c.verifyRetries != maxVerifyRetries {
+		t.Fatalf("received files again %d times; expected %d", c.verifyRetries, maxVerifyRetries)
+	}
+	received, err := ioutil.ReadFile(filepath.Join(dir, "good.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, contents["good.bin"]) {
+		t.Fatal("good.bin differs")
+	}
+}
+
+func TestClient_RedirectData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := make([]byte, 50000)
+	rand.New(rand.NewSource(2)).Read(contents)
+	tb, err := NewVirtualTarballReader([]*TarballFile{{Path: "data.bin", Mode: 0644, Content: bytesProvider{Reader: bytes.NewReader(contents)}}}, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	catalog := &net.UDPAddr{IP: net.IPv4(239, 0, 0, 187), Port: 13860}
+	data := &net.UDPAddr{IP: net.IPv4(239, 0, 0, 188), Port: 13870}
+	network := newMemoryNetwork()
+	newMulticast := func(group *net.UDPAddr) *Multicast {
+		m := network.newMulticast(t, group)
+		m.SetDatagramSize(1400)
+		return m
+	}
+
+	metadataOnly := NewServer(newMulticast(catalog), tb, ServerOptions{MetadataOnly: true, DataRedirect: data})
+	if _, err := metadataOnly.RunOnce(context.Background()); err != ErrMetadataOnly {
+		t.Fatalf("expected ErrMetadataOnly from RunOnce; got %v", err)
+	}
+	defer serve(t, NewServer(newMulticast(catalog), tb, ServerOptions{MetadataOnly: true, DataRedirect: data}))()
+	defer serve(t, NewServer(newMulticast(data), tb, ServerOptions{}))()
+
+	// Clients told to stay put ignore the redirect, and so never receive any data:
+	root := filepath.Join(dir, "client")
+	copts := getOptions()
+	copts.ExtractRoot = root
+	options := ClientOptions{
+		HashId:          tb.HashId(),
+		TarballOptions:  copts,
+		RefreshRate:     10 * time.Millisecond,
+		ResumePath:      root + ".resume",
+		IgnoreRedirects: true,
+	}
+	c := NewClient(newMulticast(catalog), options)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	err = c.RunContext(ctx)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the client to wait on the catalog; got %v", err)
+	}
+	if g := c.m.Group(); !g.IP.Equal(catalog.IP) || g.Port != catalog.Port {
+		t.Fatalf("expected the client to stay on %s; on %s", catalog, g)
+	}
+
+	options.IgnoreRedirects = false
+	c = NewClient(newMulticast(catalog), options)
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := c.RunContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if g := c.m.Group(); !g.IP.Equal(data.IP) || g.Port != data.Port {
+		t.Fatalf("expected the client to move to %s; on %s", data, g)
+	}
+	received, err := ioutil.ReadFile(filepath.Join(root, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, contents) {
+		t.Fatal("received contents differ")
+	}
+}
+
+func TestClient_DownloadWithManifest(t *testing.T) {
+	createTestFile("preloaded.txt", []byte("preloaded\n"))
+	defer os.Remove("preloaded.txt")
+	options := getOptions()
+	options.HashFiles = true
+	options.HashSize = 16
+	tb, err := NewVirtualTarballReader([]*TarballFile{
+		&TarballFile{Path: "preloaded.txt", LocalPath: "preloaded.txt", Size: 10, Mode: 0644},
+	}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	md, err := encodeHeaderAndFiles(newMetadataHeader(tb.Size(), tb.Options()), tb.Files())
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := append(metadataDigest(md), md...)
+
+	// The manifest identifies the tarball as the server does, including the layout its flags record:
+	_, decoded, err := parseMetadataCache(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newMetadataDecoder(1, 0)
+	d.AddSection(0, decoded)
+	_, files, err := d.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := tarballHashId(files, VirtualTarballOptions{HashSize: d.HashSize()}); !bytes.Equal(id, tb.HashId()) {
+		t.Fatalf("manifest HashId %x; expected %x", id, tb.HashId())
+	}
+
+	// Downloads ask for data and nothing else, watched here by another host on the group:
+	group := &net.UDPAddr{IP: net.IPv4(239, 0, 0, 196), Port: 13960}
+	network := newMemoryNetwork()
+	watcher := network.newMulticast(t, group)
+	defer watcher.Close()
+	if err := watcher.ListensControlToServer(); err != nil {
+		t.Fatal(err)
+	}
+	requested := make(chan ControlToServerOp, 1000)
+	watched := make(chan empty)
+	defer close(watched)
+	go func() {
+		for {
+			select {
+			case msg := <-watcher.ControlToServer:
+				if _, op, _, err := extractServerMessage(msg); err == nil {
+					requested <- op
+				}
+			case <-watched:
+				return
+			}
+		}
+	}()
+	defer serve(t, NewServer(network.newMulticast(t, group), tb, ServerOptions{}))()
+
+	dir, err := ioutil.TempDir("", "lancaster-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewClient(network.newMulticast(t, group), ClientOptions{
+		TarballOptions: VirtualTarballOptions{VerifyHashes: true},
+		RefreshRate:    10 * time.Millisecond,
+		ResumePath:     dir + ".resume",
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.DownloadWithManifest(manifest, dir)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("download did not complete")
+	}
+	received, err := ioutil.ReadFile(filepath.Join(dir, "preloaded.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(received) != "preloaded\n" {
+		t.Fatalf("received %q", received)
+	}
+	for len(requested) > 0 {
+		switch op := <-requested; op {
+		case RequestAnnounce, AckDataSection:
+		default:
+			t.Fatalf("client sent request %d besides asking for data", op)
+		}
+	}
+
+	// A manifest for another tarball is refused before anything is sent:
+	c = NewClient(nil, ClientOptions{HashId: []byte("notthis!")})
+	if err := c.DownloadWithManifest(manifest, "unused"); err != ErrManifestHashId {
+		t.Fatalf("expected ErrManifestHashId; got %v", err)
+	}
+	manifest[len(manifest)-1] ^= 0xff
+	if err := c.DownloadWithManifest(manifest, "unused"); err != ErrMetadataDigestMismatch {
+		t.Fatalf("expected ErrMetadataDigestMismatch; got %v", err)
+	}
+}
+
+func TestClient_CorruptSection(t *testing.T) {
+	hashId := []byte("01234567")
+	md, err := encodeMetadata(0, 0, testMetadataFiles())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections := sliceSections(md, 16)
+
+	m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 189), Port: 13890}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if err := m.SendsControlToServer(); err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(m, ClientOptions{})
+	c.hashId = hashId
+	c.state = ExpectMetadataSections
+	c.metadata = newMetadataDecoder(uint16(len(sections)), 0)
+
+	// A flipped bit is caught before the section reaches the decoder, which still wants it:
+	msg := encodeSection(0, sections[0])
+	msg[len(msg)-1] ^= 0x10
+	if err := c.processControl(UDPMessage{Data: controlToClientMessage(hashId, RespondMetadataSection, msg)}); err != nil {
+		t.Fatal(err)
+	}
+	if c.DroppedMalformed() != 1 || c.metadata.NextSection() != 0 {
+		t.Fatalf("corrupt section accepted; %d dropped, next section %d", c.DroppedMalformed(), c.metadata.NextSection())
+	}
+	// Another corrupted copy straight after is dropped without asking again:
+	asked := c.lastChecksumAsk
+	if asked.IsZero() {
+		t.Fatal("corrupt section not asked for again")
+	}
+	if err := c.processControl(UDPMessage{Data: controlToClientMessage(hashId, RespondMetadataSection, msg)}); err != nil {
+		t.Fatal(err)
+	}
+	if c.DroppedMalformed() != 2 || c.lastChecksumAsk != asked {
+		t.Fatalf("expected second corrupt section dropped without asking; %d dropped", c.DroppedMalformed())
+	}
+
+	msg = encodeSection(0, sections[0])
+	if err := c.processControl(UDPMessage{Data: controlToClientMessage(hashId, RespondMetadataSection, msg)}); err != nil {
+		t.Fatal(err)
+	}
+	if c.metadata.NextSection() != 1 {
+		t.Fatalf("intact section refused; next section %d", c.metadata.NextSection())
+	}
+
+	// A corrupted index is caught too:
+	msg = encodeSection(1, sections[1])
+	msg[0] ^= 0x02
+	if _, _, err := decodeSection(msg); err != ErrSectionChecksum {
+		t.Fatalf("expected ErrSectionChecksum; got %v", err)
+	}
+}
+
+func TestClient_RefusesInvalidUTF8(t *testing.T) {
+	hashId := []byte("01234567")
+	files := testMetadataFiles()
+	md, err := encodeMetadata(0, 0, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md[8]&metadataFlagInvalidUTF8 != 0 {
+		t.Fatal("flagged invalid UTF-8 for valid paths")
+	}
+	files = append(files, &TarballFile{Path: "\xfe\xff.txt", Mode: 0644})
+	md, err = encodeMetadata(0, 0, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md[8]&metadataFlagInvalidUTF8 == 0 {
+		t.Fatal("expected invalid UTF-8 paths to be flagged")
+	}
+
+	// Refused from the first section, without asking for the rest:
+	sections := sliceSections(md, 16)
+	c := NewClient(nil, ClientOptions{TarballOptions: VirtualTarballOptions{InvalidUTF8: InvalidUTF8Reject}})
+	c.hashId = hashId
+	c.state = ExpectMetadataSections
+	c.metadata = newMetadataDecoder(uint16(len(sections)), 0)
+	msg := controlToClientMessage(hashId, RespondMetadataSection, encodeSection(0, sections[0]))
+	if err := c.processControl(UDPMessage{Data: msg}); err != ErrInvalidUTF8Path {
+		t.Fatalf("expected ErrInvalidUTF8Path; got %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+// clock.go
+package main
+
+import "time"
+
+// Source of time for the server's timers; tests substitute this to advance time deterministically.
+type Clock interface {
+	Now() time.Time
+	Tick(d time.Duration) <-chan time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Default Clock backed by package time:
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Tick(d time.Duration) <-chan time.Time  { return time.Tick(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -0,0 +1,67 @@
+// counting_reader_at.go
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// Wraps an io.ReaderAt to count bytes read, both in total and at least once per offset, e.g. to show how much of a
+// tarball the server has pushed onto the wire regardless of client ACK state.
+type CountingReaderAt struct {
+	r    io.ReaderAt
+	size int64
+
+	lock        sync.Mutex
+	totalBytes  int64
+	unread      *NakRegions
+	regionReads map[int64]int
+}
+
+func NewCountingReaderAt(r io.ReaderAt, size int64) *CountingReaderAt {
+	return &CountingReaderAt{
+		r:           r,
+		size:        size,
+		unread:      NewNakRegions(size),
+		regionReads: make(map[int64]int),
+	}
+}
+
+// io.ReaderAt:
+func (c *CountingReaderAt) ReadAt(buf []byte, offset int64) (int, error) {
+	n, err := c.r.ReadAt(buf, offset)
+	if n > 0 {
+		c.lock.Lock()
+		c.totalBytes += int64(n)
+		c.regionReads[offset]++
+		endEx := offset + int64(n)
+		if endEx > c.size {
+			endEx = c.size
+		}
+		c.unread.Ack(offset, endEx)
+		c.lock.Unlock()
+	}
+	return n, err
+}
+
+// Total bytes read including repeated reads:
+func (c *CountingReaderAt) TotalBytes() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.totalBytes
+}
+
+// Bytes read at least once:
+func (c *CountingReaderAt) UniqueBytes() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.size - c.unread.NakedBytes()
+}
+
+// Number of reads starting at offset:
+func (c *CountingReaderAt) RegionReads(offset int64) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.regionReads[offset]
+}
@@ -0,0 +1,21 @@
+// +build darwin dragonfly freebsd linux
+
+package main
+
+import "syscall"
+
+func statDiskFree(path string) (diskFree, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return diskFree{}, err
+	}
+
+	d := diskFree{
+		Bytes:      uint64(st.Bavail) * uint64(st.Bsize),
+		BytesKnown: true,
+		Inodes:     uint64(st.Ffree),
+		// Filesystems without a fixed inode table report zero total inodes:
+		InodesKnown: st.Files != 0,
+	}
+	return d, nil
+}
@@ -0,0 +1,7 @@
+// +build darwin
+
+package main
+
+// IP_DONTFRAG is not defined by package syscall on darwin:
+const ipDontFragOption = 0x1c
+const ipDontFragValue = 1
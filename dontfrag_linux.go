@@ -0,0 +1,9 @@
+// +build linux
+
+package main
+
+import "syscall"
+
+// Path MTU discovery in "do" mode sets DF and fails oversized sends with EMSGSIZE:
+const ipDontFragOption = syscall.IP_MTU_DISCOVER
+const ipDontFragValue = syscall.IP_PMTUDISC_DO
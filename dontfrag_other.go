@@ -0,0 +1,7 @@
+// +build dragonfly netbsd openbsd
+
+package main
+
+// Setting DF is not available; SetDontFragment has no effect:
+const ipDontFragOption = 0
+const ipDontFragValue = 0
@@ -0,0 +1,8 @@
+// +build freebsd solaris
+
+package main
+
+import "syscall"
+
+const ipDontFragOption = syscall.IP_DONTFRAG
+const ipDontFragValue = 1
@@ -0,0 +1,7 @@
+// +build windows
+
+package main
+
+// IP_DONTFRAGMENT is not defined by package syscall on windows:
+const ipDontFragOption = 14
+const ipDontFragValue = 1
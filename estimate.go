@@ -0,0 +1,70 @@
+// estimate.go
+package main
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+var ErrLossOutOfRange = errors.New("loss must be at least 0 and less than 1")
+var ErrBadEstimateRate = errors.New("rate must be positive")
+var ErrBadRegionSize = errors.New("region size must be positive")
+var ErrBadEstimateSize = errors.New("size must not be negative")
+
+// Planning estimate of a transfer. Counts are expected values under the model described at EstimateTransfer.
+type TransferEstimate struct {
+	// Data regions in the tarball, each sent as one datagram:
+	Regions int64
+	// Data datagrams sent including retransmissions:
+	Datagrams int64
+	// Of Datagrams, those resending a lost region:
+	Retransmits int64
+	// Datagram bytes sent including data message prefixes:
+	WireBytes int64
+	// Sweeps over the tarball until the last lost region is expected to arrive; 1 with no loss:
+	Rounds int
+	// Time to send WireBytes at the given rate:
+	Duration time.Duration
+}
+
+// Estimates sending a tarball of size bytes in regions of regionSize bytes at bytesPerSecond of datagram bytes, where
+// each datagram is lost independently with probability loss. A lost region is resent on the next sweep until it
+// arrives, so each region is sent 1/(1-loss) times on average. The model ignores metadata, NAK round trips, rate
+// ramp-up and clients losing different regions; treat it as a planning aid, not a guarantee.
+func EstimateTransfer(size int64, bytesPerSecond float64, loss float64, regionSize int) (TransferEstimate, error) {
+	if !(loss >= 0 && loss < 1) {
+		return TransferEstimate{}, ErrLossOutOfRange
+	}
+	if !(bytesPerSecond > 0) {
+		return TransferEstimate{}, ErrBadEstimateRate
+	}
+	if regionSize <= 0 {
+		return TransferEstimate{}, ErrBadRegionSize
+	}
+	if size < 0 {
+		return TransferEstimate{}, ErrBadEstimateSize
+	}
+
+	e := TransferEstimate{}
+	// Only the last region is short:
+	e.Regions = size / int64(regionSize)
+	if int64(regionSize)*e.Regions < size {
+		e.Regions++
+	}
+
+	sends := 1 / (1 - loss)
+	e.Datagrams = int64(math.Ceil(float64(e.Regions) * sends))
+	e.Retransmits = e.Datagrams - e.Regions
+	// Resent data in proportion to what is lost, and a prefix on every datagram:
+	e.WireBytes = size + int64(float64(size)*(sends-1)) + e.Datagrams*protocolDataMsgPrefixSize
+
+	// Sweeps continue while more than one region is expected to still be missing:
+	e.Rounds = 1
+	if e.Regions > 1 && loss > 0 {
+		e.Rounds += int(math.Ceil(math.Log(float64(e.Regions)) / -math.Log(loss)))
+	}
+
+	e.Duration = time.Duration(float64(e.WireBytes) / bytesPerSecond * float64(time.Second))
+	return e, nil
+}
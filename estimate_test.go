@@ -0,0 +1,52 @@
+// estimate_test.go
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEstimateTransfer(t *testing.T) {
+	// 10 regions, the last one short, at 1000 datagram bytes/sec with no loss:
+	regionSize := 1000 - protocolDataMsgPrefixSize
+	size := int64(9*regionSize + 100)
+	e, err := EstimateTransfer(size, 1000, 0, regionSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Regions != 10 || e.Datagrams != 10 || e.Retransmits != 0 || e.Rounds != 1 {
+		t.Fatalf("unexpected lossless estimate %+v", e)
+	}
+	if e.WireBytes != 9000+100+protocolDataMsgPrefixSize {
+		t.Fatalf("expected %d wire bytes; got %d", 9000+100+protocolDataMsgPrefixSize, e.WireBytes)
+	}
+	if e.Duration != time.Duration(e.WireBytes)*time.Millisecond {
+		t.Fatalf("unexpected duration %v", e.Duration)
+	}
+
+	// Half of all datagrams lost doubles what is sent:
+	e, err = EstimateTransfer(int64(1000*regionSize), 1000, 0.5, regionSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Regions != 1000 || e.Datagrams != 2000 || e.Retransmits != 1000 || e.WireBytes != 2000000 {
+		t.Fatalf("unexpected lossy estimate %+v", e)
+	}
+	// 1000 regions halve to under one missing after 10 resends:
+	if e.Rounds != 11 {
+		t.Fatalf("expected 11 rounds; got %d", e.Rounds)
+	}
+
+	if _, err = EstimateTransfer(size, 1000, 1, regionSize); err != ErrLossOutOfRange {
+		t.Fatalf("expected ErrLossOutOfRange; got %v", err)
+	}
+	if _, err = EstimateTransfer(size, 0, 0, regionSize); err != ErrBadEstimateRate {
+		t.Fatalf("expected ErrBadEstimateRate; got %v", err)
+	}
+	if _, err = EstimateTransfer(size, 1000, 0, 0); err != ErrBadRegionSize {
+		t.Fatalf("expected ErrBadRegionSize; got %v", err)
+	}
+	if _, err = EstimateTransfer(-1, 1000, 0, regionSize); err != ErrBadEstimateSize {
+		t.Fatalf("expected ErrBadEstimateSize; got %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+// gzip_stream.go
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrStreamSize = errors.New("gzip stream does not decompress to the tarball size")
+
+// Compresses the whole tarball into w as the single gzip stream sent with GzipStream, a buffer at a time:
+func gzipTarball(tb TarballReader, w io.Writer) error {
+	zw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, io.NewSectionReader(tb, 0, tb.Size())); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Decompresses a received gzip stream into w as its bytes become contiguous, writing the tarball in order from a
+// separate goroutine. Regions received ahead of the contiguous prefix are staged in a temporary file until the
+// regions before them arrive.
+type gzipStream struct {
+	// Tarball bytes written so far; accessed atomically for progress reporting, first for 64-bit alignment:
+	written int64
+
+	w    io.WriterAt
+	size int64
+
+	pw *io.PipeWriter
+	// Stream bytes passed to the decompressor:
+	fed     int64
+	staging *os.File
+
+	done      chan error
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newGzipStream(w io.WriterAt, size int64) *gzipStream {
+	pr, pw := io.Pipe()
+	z := &gzipStream{
+		w:    w,
+		size: size,
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+	go z.decompressLoop(pr)
+	return z
+}
+
+func (z *gzipStream) decompressLoop(pr *io.PipeReader) {
+	err := z.decompress(pr)
+	// Fail whatever is fed after decompression stops:
+	pr.CloseWithError(err)
+	z.done <- err
+}
+
+func (z *gzipStream) decompress(r io.Reader) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64*1024)
+	offset := int64(0)
+	for {
+		n, err := zr.Read(buf)
+		if n > 0 {
+			if offset+int64(n) > z.size {
+				return ErrStreamSize
+			}
+			if _, err := z.w.WriteAt(buf[:n], offset); err != nil {
+				return err
+			}
+			offset += int64(n)
+			atomic.StoreInt64(&z.written, offset)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if offset != z.size {
+		return ErrStreamSize
+	}
+	return nil
+}
+
+// Takes stream bytes received at offset; contiguous is where the received prefix of the stream now ends. Blocks
+// while the decompressor catches up:
+func (z *gzipStream) Put(offset int64, data []byte, contiguous int64) error {
+	if offset < z.fed {
+		// Only the part not already passed on, e.g. the rest of a region truncated before:
+		if offset+int64(len(data)) <= z.fed {
+			return nil
+		}
+		data = data[z.fed-offset:]
+		offset = z.fed
+	}
+
+	if offset == z.fed {
+		if err := z.feed(data); err != nil {
+			return err
+		}
+	} else if err := z.stage(data, offset); err != nil {
+		return err
+	}
+
+	// Staged regions that now follow on:
+	if contiguous > z.fed && z.staging != nil {
+		if _, err := io.Copy(streamFeeder{z}, io.NewSectionReader(z.staging, z.fed, contiguous-z.fed)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (z *gzipStream) feed(p []byte) error {
+	n, err := z.pw.Write(p)
+	z.fed += int64(n)
+	return err
+}
+
+func (z *gzipStream) stage(data []byte, offset int64) error {
+	if z.staging == nil {
+		f, err := ioutil.TempFile("", "lancaster-stream-")
+		if err != nil {
+			return err
+		}
+		z.staging = f
+	}
+	_, err := z.staging.WriteAt(data, offset)
+	return err
+}
+
+// Passes staged bytes on to the decompressor:
+type streamFeeder struct {
+	z *gzipStream
+}
+
+func (f streamFeeder) Write(p []byte) (int, error) {
+	fed := f.z.fed
+	err := f.z.feed(p)
+	return int(f.z.fed - fed), err
+}
+
+// Tarball bytes written so far. Safe to call from other goroutines:
+func (z *gzipStream) Written() int64 {
+	return atomic.LoadInt64(&z.written)
+}
+
+// Ends the stream once every byte has been put, waiting for the rest to be written; fails with ErrStreamSize if it
+// did not decompress to exactly the tarball size. Safe to call more than once.
+func (z *gzipStream) Close() error {
+	return z.stop(nil)
+}
+
+// Stops decompressing without writing the rest:
+func (z *gzipStream) Abort() {
+	z.stop(ErrInterrupted)
+}
+
+func (z *gzipStream) stop(reason error) error {
+	z.closeOnce.Do(func() {
+		z.pw.CloseWithError(reason)
+		z.closeErr = <-z.done
+		if reason != nil {
+			z.closeErr = nil
+		}
+		if z.staging != nil {
+			z.staging.Close()
+			os.Remove(z.staging.Name())
+		}
+	})
+	return z.closeErr
+}
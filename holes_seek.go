@@ -0,0 +1,56 @@
+// +build freebsd linux solaris
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// lseek whence values to find the next data or hole at or after an offset:
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// Returns the data extents of the first size bytes of f, or nil if there are no holes or the filesystem cannot
+// report them. Moves f's file offset.
+func dataExtents(f *os.File, size int64) ([]DataExtent, error) {
+	extents := make([]DataExtent, 0)
+	for o := int64(0); o < size; {
+		start, err := f.Seek(o, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// Only a hole remains:
+			break
+		}
+		if errors.Is(err, syscall.EINVAL) {
+			// Hole detection unsupported:
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if start >= size {
+			break
+		}
+		end, err := f.Seek(start, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		if end > size {
+			end = size
+		}
+		extents = append(extents, DataExtent{Offset: start, Length: end - start})
+		o = end
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if len(extents) == 1 && extents[0].Offset == 0 && extents[0].Length == size {
+		return nil, nil
+	}
+	return extents, nil
+}
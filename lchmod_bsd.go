@@ -0,0 +1,22 @@
+// +build dragonfly freebsd netbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Sets the mode of a symlink itself on platforms whose symlinks have their own permissions:
+func lchmod(name string, mode os.FileMode) error {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_LCHMOD, uintptr(unsafe.Pointer(p)), uintptr(mode.Perm()), 0)
+	if errno != 0 {
+		return &os.PathError{Op: "lchmod", Path: name, Err: errno}
+	}
+	return nil
+}
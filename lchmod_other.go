@@ -0,0 +1,10 @@
+// +build darwin linux openbsd solaris windows
+
+package main
+
+import "os"
+
+// Symlink permissions are ignored or cannot be set here:
+func lchmod(name string, mode os.FileMode) error {
+	return nil
+}
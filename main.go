@@ -2,9 +2,14 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
@@ -12,14 +17,19 @@ import (
 	"strings"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/urfave/cli"
 )
 
 func main() {
 	netInterfaceName := ""
 	netInterface := (*net.Interface)(nil)
+	sendInterfaceName := ""
+	sendInterface := (*net.Interface)(nil)
 	ttl := 0
+	readBufferSize := 0
 	loopbackEnable := false
+	dontFragment := false
 	hashIdStr := ""
 	hashId := []byte(nil)
 	options := VirtualTarballOptions{}
@@ -27,6 +37,50 @@ func main() {
 	linkLocal := false
 	host := ""
 	port := ""
+	metadataCachePath := ""
+	update := false
+	resumePath := ""
+	verifyResume := false
+	checkFreeSpace := false
+	checkFreeInodes := false
+	deleteExtraneous := false
+	maxReceiveRate := int64(0)
+	zeroFill := false
+	writeQueueDepth := 0
+	signKeyPath := ""
+	snapshot := ""
+	verifyKeyPath := ""
+	manifestPath := ""
+	blobIndexPath := ""
+	regenerateMetadata := false
+	sourceCheckInterval := time.Duration(0)
+	dataQuiesce := time.Duration(0)
+	maxRetransmits := 0
+	sectionCoalesce := time.Duration(0)
+	unicastMetadata := false
+	metadataOnly := false
+	dataRedirect := ""
+	statePath := ""
+	metadataRate := float64(0)
+	once := false
+	onceLead := time.Duration(0)
+	onceRetransmit := time.Duration(0)
+	announceRate := float64(0)
+	stripComponents := 0
+	transform := ""
+	caseSensitive := false
+	directories := false
+	onConflict := ""
+	onCorruption := ""
+	since := ""
+	ignoreRedirects := false
+	invalidUTF8 := ""
+	regionCacheSize := int64(0)
+	blockSize := int64(0)
+	abortOnSourceModified := false
+	announceSummary := false
+	discoverWait := time.Duration(0)
+	lookupPrefix := false
 
 	createMulticast := func() (*Multicast, error) {
 		// If no address specified use either link-local or well-known:
@@ -55,6 +109,13 @@ func main() {
 
 		m.SetTTL(ttl)
 		m.SetLoopback(loopbackEnable)
+		m.SetReadBuffer(readBufferSize)
+		m.SetDontFragment(dontFragment)
+		if sendInterface != nil {
+			if err := m.SetSendInterface(sendInterface); err != nil {
+				return nil, err
+			}
+		}
 		return m, nil
 	}
 
@@ -75,17 +136,34 @@ func main() {
 			Usage:       "Interface name to bind to",
 			Destination: &netInterfaceName,
 		},
+		cli.StringFlag{
+			Name:        "send-interface",
+			Value:       "",
+			Usage:       "Interface name to send multicast out of, e.g. to keep traffic off a management network; defaults to --interface",
+			Destination: &sendInterfaceName,
+		},
 		cli.IntFlag{
 			Name:        "ttl,t",
 			Value:       8,
 			Usage:       "Packet TTL",
 			Destination: &ttl,
 		},
+		cli.IntFlag{
+			Name:        "read-buffer",
+			Value:       0,
+			Usage:       "UDP receive buffer size in bytes; 0 uses defaults",
+			Destination: &readBufferSize,
+		},
 		cli.BoolFlag{
 			Name:        "loopback,o",
 			Usage:       "Enable loopback support for testing",
 			Destination: &loopbackEnable,
 		},
+		cli.BoolFlag{
+			Name:        "dont-fragment",
+			Usage:       "Set DF on data datagrams so that sends larger than the path MTU fail instead of fragmenting",
+			Destination: &dontFragment,
+		},
 		cli.BoolFlag{
 			Name:        "link-local,k",
 			Usage:       "Use link-local group address 224.0.0.100 which cannot be routed to WAN, usually will only survive across switches",
@@ -104,6 +182,16 @@ func main() {
 			Usage:       "refresh rate of meter UI",
 			Destination: &refreshRate,
 		},
+		cli.BoolFlag{
+			Name:        "mmap",
+			Usage:       "memory-map served files for faster reads",
+			Destination: &options.MemoryMap,
+		},
+		cli.BoolFlag{
+			Name:        "dirs",
+			Usage:       "include directories so that empty ones are recreated and directory modes restored; changes the id of the files served",
+			Destination: &directories,
+		},
 		cli.StringFlag{
 			Name:        "id",
 			Usage:       "specific hash ID of transfer to download",
@@ -111,6 +199,25 @@ func main() {
 			Destination: &hashIdStr,
 		},
 	}
+	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		// Default filesystems are case-insensitive:
+		options.CaseInsensitive = true
+		app.Flags = append(app.Flags,
+			cli.BoolFlag{
+				Name:        "case-sensitive",
+				Usage:       "Allow downloading files whose paths differ only by case, onto a case-sensitive filesystem",
+				Destination: &caseSensitive,
+			},
+		)
+	} else {
+		app.Flags = append(app.Flags,
+			cli.BoolFlag{
+				Name:        "case-insensitive",
+				Usage:       "Reject downloading files whose paths differ only by case",
+				Destination: &options.CaseInsensitive,
+			},
+		)
+	}
 	if runtime.GOOS == "windows" {
 		// Windows needs compatibility mode always enabled:
 		options.CompatMode = true
@@ -124,6 +231,10 @@ func main() {
 		)
 	}
 	app.Before = func(c *cli.Context) error {
+		// Case-sensitive filesystems can be chosen on darwin and windows, e.g. case-sensitive APFS:
+		if caseSensitive {
+			options.CaseInsensitive = false
+		}
 		// Find network interface by name:
 		if netInterfaceName != "" {
 			var err error
@@ -132,6 +243,13 @@ func main() {
 				return err
 			}
 		}
+		if sendInterfaceName != "" {
+			var err error
+			sendInterface, err = net.InterfaceByName(sendInterfaceName)
+			if err != nil {
+				return err
+			}
+		}
 		// Decode hash ID string flag:
 		if hashIdStr != "" {
 			err := error(nil)
@@ -153,19 +271,221 @@ func main() {
 			Aliases:     []string{"d"},
 			Usage:       "download files from a multicast group locally",
 			UsageText:   "download",
-			Description: "downloads files to current directory. If [id] is specified, it must match the ID generated by a server.",
+			Description: "downloads files to current directory, or to --root. If [id] is specified, it must match the ID generated by a server.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "root",
+					Usage:       "directory to extract into; nothing is written outside it, even through symlinks",
+					Destination: &options.ExtractRoot,
+				},
+				cli.StringFlag{
+					Name:        "metadata-cache",
+					Usage:       "file to cache metadata in to skip re-fetching it when reconnecting",
+					Destination: &metadataCachePath,
+				},
+				cli.StringFlag{
+					Name:        "manifest",
+					Usage:       "manifest or metadata cache distributed ahead of time to download the tarball it describes without fetching metadata",
+					Destination: &manifestPath,
+				},
+				cli.StringFlag{
+					Name:        "resume-file",
+					Usage:       "file to save progress to on interrupt and resume from; defaults to .lancaster-<id>.resume",
+					Destination: &resumePath,
+				},
+				cli.BoolFlag{
+					Name:        "verify-resume",
+					Usage:       "when resuming, recheck partly received files against the server's block hashes instead of trusting saved progress",
+					Destination: &verifyResume,
+				},
+				cli.BoolFlag{
+					Name:        "zero-fill",
+					Usage:       "on interrupt, zero-fill parts of files that were never received",
+					Destination: &zeroFill,
+				},
+				cli.BoolFlag{
+					Name:        "update,u",
+					Usage:       "skip downloading files that already exist with matching contents",
+					Destination: &update,
+				},
+				cli.BoolFlag{
+					Name:        "check-space",
+					Usage:       "verify there is enough free disk space before downloading",
+					Destination: &checkFreeSpace,
+				},
+				cli.BoolFlag{
+					Name:        "check-inodes",
+					Usage:       "verify there are enough free inodes for all files and directories before downloading",
+					Destination: &checkFreeInodes,
+				},
+				cli.BoolFlag{
+					Name:        "ignore-mode-errors",
+					Usage:       "warn instead of failing when file modes cannot be set, e.g. on FAT filesystems",
+					Destination: &options.IgnoreModeErrors,
+				},
+				cli.DurationFlag{
+					Name:        "max-mtime-skew",
+					Usage:       "reject modification times more than this far in the future; 0 disables the check",
+					Destination: &options.MaxModTimeSkew,
+				},
+				cli.BoolFlag{
+					Name:        "clamp-mtime",
+					Usage:       "clamp implausible future modification times to now instead of failing",
+					Destination: &options.ClampModTime,
+				},
+				cli.BoolFlag{
+					Name:        "verify",
+					Usage:       "verify files against the hashes sent by a server run with --hash, receiving failed files again",
+					Destination: &options.VerifyHashes,
+				},
+				cli.BoolFlag{
+					Name:        "tolerate-bad-padding",
+					Usage:       "warn instead of failing when the byte between files is not NUL",
+					Destination: &options.TolerateBadPadding,
+				},
+				cli.IntFlag{
+					Name:        "write-buffer",
+					Usage:       "coalesce data received in order into disk writes of up to this many bytes, e.g. 1048576; 0 writes each datagram as it arrives",
+					Destination: &options.WriteBufferSize,
+				},
+				cli.IntFlag{
+					Name:        "write-retries",
+					Usage:       "retry opening and writing a file this many times, with doubling waits of up to a second, on errors that may pass such as EINTR, EAGAIN or ENOSPC",
+					Destination: &options.WriteRetries,
+				},
+				cli.BoolFlag{
+					Name:        "devices",
+					Usage:       "create received device nodes, which needs privileges; they are skipped otherwise",
+					Destination: &options.CreateDevices,
+				},
+				cli.BoolFlag{
+					Name:        "skip-unwritable-dirs",
+					Usage:       "skip entries whose directory cannot be created and report them at the end instead of failing",
+					Destination: &options.SkipUnwritableDirs,
+				},
+				cli.IntFlag{
+					Name:        "strip-components",
+					Usage:       "remove this many leading components from extracted paths, skipping entries with no more",
+					Destination: &stripComponents,
+				},
+				cli.StringFlag{
+					Name:        "transform",
+					Usage:       "extract paths under directory 'old' to 'new' instead, given as old=new",
+					Destination: &transform,
+				},
+				cli.StringFlag{
+					Name:        "on-conflict",
+					Usage:       "what to do with a path that already exists: overwrite, skip, rename, abort or ask",
+					Destination: &onConflict,
+				},
+				cli.StringFlag{
+					Name:        "on-corruption",
+					Usage:       "what to do with a file that fails verification: collect to receive it again and report it at the end, or abort",
+					Destination: &onCorruption,
+				},
+				cli.StringFlag{
+					Name:        "invalid-utf8",
+					Usage:       "what to do with paths that are not valid UTF-8: passthrough, reject, or escape to %XX; defaults to passthrough, or escape on Windows",
+					Destination: &invalidUTF8,
+				},
+				cli.StringFlag{
+					Name:        "since",
+					Usage:       "only download files modified after this RFC 3339 time, e.g. 2026-01-02T15:04:05Z, leaving older ones as they are",
+					Destination: &since,
+				},
+				cli.BoolFlag{
+					Name:        "delete",
+					Usage:       "after downloading, delete files in the current directory that are not in the transfer",
+					Destination: &deleteExtraneous,
+				},
+				cli.Int64Flag{
+					Name:        "max-rate",
+					Value:       0,
+					Usage:       "maximum bytes/sec of data to receive; 0 is unlimited",
+					Destination: &maxReceiveRate,
+				},
+				cli.IntFlag{
+					Name:        "write-queue",
+					Value:       0,
+					Usage:       "number of received regions to queue for writing to disk in the background; 0 writes synchronously",
+					Destination: &writeQueueDepth,
+				},
+				cli.BoolFlag{
+					Name:        "ignore-redirects",
+					Usage:       "stay on the group given rather than follow a metadata-only server's unsigned redirect to another group for data",
+					Destination: &ignoreRedirects,
+				},
+				cli.StringFlag{
+					Name:        "verify-key",
+					Usage:       "public key file to verify the metadata signature against; every file is then verified against its signed hash",
+					Destination: &verifyKeyPath,
+				},
+			},
 			Action: func(c *cli.Context) error {
 				m, err := createMulticast()
 				if err != nil {
 					return err
 				}
 
+				publicKey := ed25519.PublicKey(nil)
+				if verifyKeyPath != "" {
+					publicKey, err = loadPublicKey(verifyKeyPath)
+					if err != nil {
+						return err
+					}
+				}
+
+				options.PathMap, err = buildPathMap(stripComponents, transform)
+				if err != nil {
+					return err
+				}
+				conflictResolver, err := buildConflictResolver(onConflict)
+				if err != nil {
+					return err
+				}
+				corruptionPolicy, ok := corruptionPolicies[onCorruption]
+				if !ok {
+					return fmt.Errorf("unknown on-corruption policy '%s'", onCorruption)
+				}
+				if options.InvalidUTF8, ok = invalidUTF8Policies[invalidUTF8]; !ok {
+					return fmt.Errorf("unknown invalid-utf8 policy '%s'", invalidUTF8)
+				}
+				sinceTime := time.Time{}
+				if since != "" {
+					if sinceTime, err = time.Parse(time.RFC3339, since); err != nil {
+						return err
+					}
+				}
+
 				clientOptions := ClientOptions{
-					HashId:         hashId,
-					TarballOptions: options,
-					RefreshRate:    refreshRate,
+					HashId:             hashId,
+					TarballOptions:     options,
+					RefreshRate:        refreshRate,
+					MetadataCachePath:  metadataCachePath,
+					Update:             update,
+					Delete:             deleteExtraneous,
+					CheckFreeSpace:     checkFreeSpace,
+					CheckFreeInodes:    checkFreeInodes,
+					HandleInterrupt:    true,
+					ResumePath:         resumePath,
+					VerifyResume:       verifyResume,
+					MaxReceiveRate:     maxReceiveRate,
+					ZeroFillIncomplete: zeroFill,
+					WriteQueueDepth:    writeQueueDepth,
+					PublicKey:          publicKey,
+					ConflictResolver:   conflictResolver,
+					OnCorruption:       corruptionPolicy,
+					Since:              sinceTime,
+					IgnoreRedirects:    ignoreRedirects,
 				}
 				cl := NewClient(m, clientOptions)
+				if manifestPath != "" {
+					manifest, err := ioutil.ReadFile(manifestPath)
+					if err != nil {
+						return err
+					}
+					return cl.DownloadWithManifest(manifest, options.ExtractRoot)
+				}
 				return cl.Run()
 			},
 		},
@@ -177,12 +497,223 @@ func main() {
 			Description: `Specify a list of files and directories to serve.
 Files can be renamed by having '::' separating the local filename and the renamed file.
 Folders are added without recursion unless appended with a ':::'`,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "hash",
+					Usage:       "hash file contents so updating clients can skip unchanged files",
+					Destination: &options.HashFiles,
+				},
+				cli.Int64Flag{
+					Name:        "block-size",
+					Value:       0,
+					Usage:       "with --hash, also hash files in blocks of this many bytes so updating clients receive only changed blocks; 0 disables",
+					Destination: &blockSize,
+				},
+				cli.IntFlag{
+					Name:        "hash-size",
+					Usage:       "truncate file hashes to this many bytes, 8 to 32, to shrink metadata; short hashes catch corruption but not deliberate collisions. 0 keeps full hashes",
+					Destination: &options.HashSize,
+				},
+				cli.BoolFlag{
+					Name:        "mode-table",
+					Usage:       "send each file's mode as a 1-byte code into a table of common modes to shrink metadata",
+					Destination: &options.ModeTable,
+				},
+				cli.BoolFlag{
+					Name:        "no-padding",
+					Usage:       "omit the NUL padding byte after each file; clients follow the served layout",
+					Destination: &options.NoPadding,
+				},
+				cli.BoolFlag{
+					Name:        "gzip",
+					Usage:       "send the whole tarball as one gzip stream, compressed once at startup and spooled to a temporary file; clients receive every file in full",
+					Destination: &options.GzipStream,
+				},
+				cli.BoolFlag{
+					Name:        "detect-holes",
+					Usage:       "skip sending holes in sparse files, which clients recreate; files are sent dense where holes cannot be detected",
+					Destination: &options.DetectHoles,
+				},
+				cli.StringFlag{
+					Name:        "manifest",
+					Usage:       "serve the single source directory argument using a precomputed manifest file",
+					Destination: &manifestPath,
+				},
+				cli.StringFlag{
+					Name:        "blob-index",
+					Usage:       "serve the files packed into the single blob argument at the offsets listed in this index file",
+					Destination: &blobIndexPath,
+				},
+				cli.BoolFlag{
+					Name:        "trust-manifest",
+					Usage:       "with --manifest, serve the manifest's hashes without hashing the files again",
+					Destination: &options.TrustMetadata,
+				},
+				cli.StringFlag{
+					Name:        "metadata-cache",
+					Usage:       "file to cache metadata and file hashes in to speed up restarts",
+					Destination: &metadataCachePath,
+				},
+				cli.BoolFlag{
+					Name:        "regenerate-metadata",
+					Usage:       "ignore the metadata cache and rebuild it",
+					Destination: &regenerateMetadata,
+				},
+				cli.DurationFlag{
+					Name:        "source-check",
+					Usage:       "how often to check source files for modification while serving; 0 disables",
+					Destination: &sourceCheckInterval,
+				},
+				cli.Int64Flag{
+					Name:        "region-cache",
+					Value:       0,
+					Usage:       "bytes of recently sent data to keep in memory for retransmission; 0 disables",
+					Destination: &regionCacheSize,
+				},
+				cli.DurationFlag{
+					Name:        "data-quiesce",
+					Usage:       "stop sending data this long after the last client request; 0 sends until all requested data is sent",
+					Destination: &dataQuiesce,
+				},
+				cli.IntFlag{
+					Name:        "max-retransmits",
+					Usage:       "give up on a region after resending it this many times; 0 resends without limit",
+					Destination: &maxRetransmits,
+				},
+				cli.DurationFlag{
+					Name:        "section-coalesce",
+					Usage:       "answer repeated requests for the same metadata section at most once in this period; 0 answers every request",
+					Destination: &sectionCoalesce,
+				},
+				cli.BoolFlag{
+					Name:        "unicast-metadata",
+					Usage:       "answer metadata requests to the requesting client only; only one of several clients on a host receives replies",
+					Destination: &unicastMetadata,
+				},
+				cli.BoolFlag{
+					Name:        "metadata-only",
+					Usage:       "announce and answer metadata requests but never send data",
+					Destination: &metadataOnly,
+				},
+				cli.StringFlag{
+					Name:        "data-redirect",
+					Usage:       "with --metadata-only, multicast group:port of a server sending the data, which clients are redirected to",
+					Destination: &dataRedirect,
+				},
+				cli.StringFlag{
+					Name:        "state",
+					Usage:       "file to save sending progress to so that a restarted server carries on where it left off",
+					Destination: &statePath,
+				},
+				cli.BoolFlag{
+					Name:        "once",
+					Usage:       "send everything once to clients already listening, then exit",
+					Destination: &once,
+				},
+				cli.DurationFlag{
+					Name:        "once-lead",
+					Usage:       "with --once, how long to announce and answer metadata requests before sending; defaults to 3s",
+					Destination: &onceLead,
+				},
+				cli.DurationFlag{
+					Name:        "once-retransmit",
+					Usage:       "with --once, how long to collect NAKs after sending for one round of retransmission; 0 skips it",
+					Destination: &onceRetransmit,
+				},
+				cli.Float64Flag{
+					Name:        "metadata-rate",
+					Usage:       "maximum metadata responses/sec, with bursts of up to a second's worth; 0 is unlimited",
+					Destination: &metadataRate,
+				},
+				cli.Float64Flag{
+					Name:        "announce-rate",
+					Usage:       "maximum announcements/sec sent on client request, with bursts of up to a second's worth; 0 is unlimited",
+					Destination: &announceRate,
+				},
+				cli.BoolFlag{
+					Name:        "abort-on-modified",
+					Usage:       "stop serving if a source file is modified instead of no longer serving that file",
+					Destination: &abortOnSourceModified,
+				},
+				cli.BoolFlag{
+					Name:        "announce-summary",
+					Usage:       "include total size, file count and metadata digest in announcements",
+					Destination: &announceSummary,
+				},
+				cli.StringFlag{
+					Name:        "sign-key",
+					Usage:       "private key file to sign the metadata with",
+					Destination: &signKeyPath,
+				},
+				cli.StringFlag{
+					Name:        "snapshot",
+					Usage:       "serve from a read-only snapshot of --snapshot-root taken at startup: 'btrfs' or 'zfs=<dataset>'",
+					Destination: &snapshot,
+				},
+				cli.StringFlag{
+					Name:        "snapshot-root",
+					Usage:       "directory to snapshot with --snapshot; source files under it are served from the snapshot",
+					Destination: &options.SnapshotRoot,
+				},
+				cli.IntFlag{
+					Name:        "max-open-files",
+					Usage:       "most source files to keep open while serving; 0 reads one file at a time, -1 takes half the open file limit",
+					Destination: &options.MaxOpenFiles,
+				},
+				cli.BoolFlag{
+					Name:        "pin-files",
+					Usage:       "hold source files open from startup so files replaced while serving are still served as they were",
+					Destination: &options.PinFiles,
+				},
+			},
 			Action: func(c *cli.Context) error {
-				files, err := buildTarball(c.Args())
+				if blockSize < 0 || blockSize > maxBlockSize {
+					return errors.New("block-size out of range")
+				}
+				options.BlockSize = uint32(blockSize)
+
+				err := error(nil)
+				options.Snapshot, err = buildSnapshotter(snapshot)
 				if err != nil {
 					return err
 				}
-				tb, err := NewVirtualTarballReader(files, options)
+
+				tb := (*VirtualTarballReader)(nil)
+				if manifestPath != "" {
+					if c.NArg() != 1 {
+						return errors.New("expected a single source directory with --manifest")
+					}
+					tb, err = NewVirtualTarballReaderFromManifest(manifestPath, c.Args().First(), options)
+				} else if blobIndexPath != "" {
+					if c.NArg() != 1 {
+						return errors.New("expected a single blob with --blob-index")
+					}
+					index := []BlobIndexEntry(nil)
+					index, err = ReadBlobIndex(blobIndexPath)
+					if err != nil {
+						return err
+					}
+					tb, err = NewVirtualTarballReaderFromBlob(c.Args().First(), index, options)
+				} else {
+					files := []*TarballFile(nil)
+					files, err = buildTarball(c.Args(), directories)
+					if err != nil {
+						return err
+					}
+					if metadataCachePath != "" && !regenerateMetadata {
+						// Reuse hashes of unchanged files:
+						applied, err := applyServerMetadataCache(metadataCachePath, files, options)
+						if err != nil && !os.IsNotExist(err) {
+							fmt.Fprintf(os.Stderr, "ignoring metadata cache: %s\n", err)
+						}
+						// Files from the command line carry no hashes of their own, so only those applied from the
+						// cache, whose size and modification time still match, are trusted:
+						if applied > 0 {
+							options.TrustMetadata = true
+						}
+					}
+					tb, err = NewVirtualTarballReader(files, options)
+				}
 				if err != nil {
 					return err
 				}
@@ -193,8 +724,60 @@ Folders are added without recursion unless appended with a ':::'`,
 					return err
 				}
 
+				serverOptions := ServerOptions{
+					RefreshRate:           refreshRate,
+					MetadataCachePath:     metadataCachePath,
+					RegenerateMetadata:    regenerateMetadata,
+					SourceCheckInterval:   sourceCheckInterval,
+					AbortOnSourceModified: abortOnSourceModified,
+					AnnounceSummary:       announceSummary,
+					RegionCacheSize:       regionCacheSize,
+					SectionCoalesce:       sectionCoalesce,
+					BatchLead:             onceLead,
+					BatchRetransmitWait:   onceRetransmit,
+					UnicastMetadata:       unicastMetadata,
+					StatePath:             statePath,
+					MetadataOnly:          metadataOnly,
+				}
+				if dataRedirect != "" {
+					if !metadataOnly {
+						return errors.New("data-redirect requires metadata-only")
+					}
+					serverOptions.DataRedirect, err = net.ResolveUDPAddr("udp4", dataRedirect)
+					if err != nil {
+						return err
+					}
+					if !serverOptions.DataRedirect.IP.IsMulticast() {
+						return errors.New("data-redirect must be a multicast group")
+					}
+				}
+				if signKeyPath != "" {
+					serverOptions.SigningKey, err = loadSigningKey(signKeyPath)
+					if err != nil {
+						return err
+					}
+				}
+
 				// Create server and run loop:
-				s := NewServer(m, tb, ServerOptions{RefreshRate: refreshRate})
+				s := NewServer(m, tb, serverOptions)
+				if err := s.SetDataQuiesce(dataQuiesce); err != nil {
+					return err
+				}
+				s.SetMaxRegionRetransmits(maxRetransmits)
+				if err := s.SetMetadataResponseRate(metadataRate, int(math.Ceil(metadataRate))); err != nil {
+					return err
+				}
+				if err := s.SetAnnounceResponseRate(announceRate, int(math.Ceil(announceRate))); err != nil {
+					return err
+				}
+				if once {
+					stats, err := s.RunOnce(context.Background())
+					fmt.Printf("Sent %d regions (%s), resent %d regions (%s) in %v\n", stats.RegionsSent, humanize.IBytes(uint64(stats.BytesSent)), stats.RegionsResent, humanize.IBytes(uint64(stats.BytesResent)), stats.Elapsed)
+					if stats.RegionsAbandoned > 0 {
+						fmt.Printf("Gave up on %d regions after %d retransmits\n", stats.RegionsAbandoned, maxRetransmits)
+					}
+					return err
+				}
 				return s.Run()
 			},
 		},
@@ -203,10 +786,12 @@ Folders are added without recursion unless appended with a ':::'`,
 			Aliases: []string{"i"},
 			Usage:   "compute id for list of files",
 			Action: func(c *cli.Context) error {
-				files, err := buildTarball(c.Args())
+				files, err := buildTarball(c.Args(), directories)
 				if err != nil {
 					return err
 				}
+				// Neither needs content hashes:
+				options.LazyHash = true
 				tb, err := NewVirtualTarballReader(files, options)
 				if err != nil {
 					return err
@@ -216,14 +801,148 @@ Folders are added without recursion unless appended with a ':::'`,
 				return nil
 			},
 		},
+		cli.Command{
+			Name:      "manifest",
+			Usage:     "hash a directory into a manifest file to serve later with --manifest",
+			UsageText: "manifest [directory] [manifestfile]",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 2 {
+					return errors.New("expected a directory and a manifest file name")
+				}
+				return WriteManifest(c.Args().Get(1), TarballSource{Root: c.Args().First(), Directories: directories})
+			},
+		},
+		cli.Command{
+			Name:      "verify",
+			Usage:     "check a received directory against a manifest or metadata cache, printing one line per problem file",
+			UsageText: "verify [directory] [manifestfile]",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 2 {
+					return errors.New("expected a directory and a manifest file name")
+				}
+				problems, err := VerifyTree(c.Args().Get(1), c.Args().First())
+				if err != nil {
+					return err
+				}
+				for _, p := range problems {
+					fmt.Println(p)
+				}
+				if len(problems) > 0 {
+					return ErrTreeMismatch
+				}
+				return nil
+			},
+		},
+		cli.Command{
+			Name:      "diff",
+			Usage:     "preview what serving a new directory changes for clients holding an old one, printing '+', '-' or '~' and a path per line",
+			UsageText: "diff [olddirectory] [newdirectory]",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 2 {
+					return errors.New("expected an old and a new directory")
+				}
+				readers := make([]*VirtualTarballReader, 0, 2)
+				for _, root := range []string{c.Args().Get(0), c.Args().Get(1)} {
+					files, err := MergeTarballSources(TarballSource{Root: root, Directories: directories})
+					if err != nil {
+						return err
+					}
+					diffOptions := options
+					diffOptions.HashFiles = true
+					tb, err := NewVirtualTarballReader(files, diffOptions)
+					if err != nil {
+						return err
+					}
+					defer tb.Close()
+					readers = append(readers, tb)
+				}
+				fmt.Print(DiffTarballs(readers[0], readers[1]))
+				return nil
+			},
+		},
+		cli.Command{
+			Name:  "discover",
+			Usage: "list the HashIds of tarballs announced to the multicast group",
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:        "wait",
+					Value:       3 * time.Second,
+					Usage:       "how long to listen for announcements",
+					Destination: &discoverWait,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				m, err := createMulticast()
+				if err != nil {
+					return err
+				}
+				defer m.Close()
+
+				hashIds, err := DiscoverTarballs(m, discoverWait)
+				for _, hashId := range hashIds {
+					fmt.Printf("%s\n", hex.EncodeToString(hashId))
+				}
+				return err
+			},
+		},
+		cli.Command{
+			Name:      "lookup",
+			Usage:     "look up the metadata entries of files in the tarball given by --id without fetching all of its metadata",
+			UsageText: "lookup [path]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "prefix",
+					Usage:       "list every file whose path starts with the given path",
+					Destination: &lookupPrefix,
+				},
+				cli.DurationFlag{
+					Name:        "wait",
+					Value:       3 * time.Second,
+					Usage:       "how long to wait for the server to answer",
+					Destination: &discoverWait,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return errors.New("expected a path")
+				}
+				if hashId == nil {
+					return errors.New("--id is required")
+				}
+				m, err := createMulticast()
+				if err != nil {
+					return err
+				}
+				defer m.Close()
+
+				entries, err := LookupFileEntries(m, hashId, c.Args().First(), lookupPrefix, discoverWait)
+				for _, e := range entries {
+					fmt.Printf("  %v %15s %15s '%s'\n", e.File.Mode, humanize.Comma(e.Offset), humanize.Comma(e.File.Size), e.File.Path)
+				}
+				return err
+			},
+		},
+		cli.Command{
+			Name:      "keygen",
+			Usage:     "generate a key pair for signing served metadata",
+			UsageText: "keygen [keyfile]",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return errors.New("expected a key file name")
+				}
+				return generateKeyPair(c.Args().First())
+			},
+		},
 		cli.Command{
 			Name:  "ls",
 			Usage: "compute list of files",
 			Action: func(c *cli.Context) error {
-				files, err := buildTarball(c.Args())
+				files, err := buildTarball(c.Args(), directories)
 				if err != nil {
 					return err
 				}
+				// Neither needs content hashes:
+				options.LazyHash = true
 				tb, err := NewVirtualTarballReader(files, options)
 				if err != nil {
 					return err
@@ -243,7 +962,114 @@ Folders are added without recursion unless appended with a ':::'`,
 	return
 }
 
-func buildTarball(args cli.Args) ([]*TarballFile, error) {
+// Composes the download path mapping flags: components are stripped before the old=new prefix is replaced.
+func buildPathMap(stripComponents int, transform string) (func(path string) string, error) {
+	if stripComponents < 0 {
+		return nil, errors.New("strip-components must not be negative")
+	}
+
+	maps := make([]func(path string) string, 0, 2)
+	if stripComponents > 0 {
+		maps = append(maps, StripComponents(stripComponents))
+	}
+	if transform != "" {
+		parts := strings.SplitN(transform, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("expected transform as old=new")
+		}
+		// Tarball paths are '/'-separated wherever they are extracted:
+		maps = append(maps, ReplacePathPrefix(filepath.ToSlash(parts[0]), filepath.ToSlash(parts[1])))
+	}
+	if len(maps) == 0 {
+		return nil, nil
+	}
+
+	return func(path string) string {
+		for _, m := range maps {
+			if path == "" {
+				break
+			}
+			path = m(path)
+		}
+		return path
+	}, nil
+}
+
+var conflictActions = map[string]ConflictAction{
+	"overwrite": ConflictOverwrite,
+	"skip":      ConflictSkip,
+	"rename":    ConflictRename,
+	"abort":     ConflictAbort,
+}
+
+var corruptionPolicies = map[string]CorruptionPolicy{
+	"":        CorruptionCollect,
+	"collect": CorruptionCollect,
+	"abort":   CorruptionAbort,
+}
+
+var invalidUTF8Policies = map[string]InvalidUTF8Policy{
+	"":            InvalidUTF8Default,
+	"passthrough": InvalidUTF8Passthrough,
+	"reject":      InvalidUTF8Reject,
+	"escape":      InvalidUTF8Escape,
+}
+
+// Resolves every conflict with the named action, or asks on the terminal for each one given "ask":
+func buildConflictResolver(policy string) (func(existing os.FileInfo, incoming *TarballFile) ConflictAction, error) {
+	if policy == "" {
+		return nil, nil
+	}
+	if action, ok := conflictActions[policy]; ok {
+		return func(existing os.FileInfo, incoming *TarballFile) ConflictAction {
+			return action
+		}, nil
+	}
+	if policy != "ask" {
+		return nil, fmt.Errorf("unknown on-conflict action '%s'", policy)
+	}
+
+	input := bufio.NewReader(os.Stdin)
+	always := ConflictAction(-1)
+	return func(existing os.FileInfo, incoming *TarballFile) ConflictAction {
+		if always >= 0 {
+			return always
+		}
+		for {
+			fmt.Fprintf(os.Stderr, "\n'%s' exists (%v, %d bytes); [o]verwrite, [s]kip, [r]ename, [a]bort? Capitalize to apply to all: ", incoming.Path, existing.Mode(), existing.Size())
+			line, err := input.ReadString('\n')
+			answer := strings.TrimSpace(line)
+			if err != nil && answer == "" {
+				// No one to ask:
+				return ConflictAbort
+			}
+			for name, action := range conflictActions {
+				if answer == "" || answer[0] != name[0] && answer[0] != name[0]-'a'+'A' {
+					continue
+				}
+				if answer[0] < 'a' {
+					always = action
+				}
+				return action
+			}
+		}
+	}, nil
+}
+
+// Parses the --snapshot kind: "btrfs" or "zfs=<dataset>":
+func buildSnapshotter(kind string) (Snapshotter, error) {
+	switch {
+	case kind == "":
+		return nil, nil
+	case kind == "btrfs":
+		return BtrfsSnapshotter{}, nil
+	case strings.HasPrefix(kind, "zfs="):
+		return ZFSSnapshotter{Dataset: kind[len("zfs="):]}, nil
+	}
+	return nil, fmt.Errorf("unknown snapshot kind '%s'", kind)
+}
+
+func buildTarball(args cli.Args, directories bool) ([]*TarballFile, error) {
 	if !args.Present() {
 		return nil, errors.New("Require arguments to specify which files to serve")
 	}
@@ -308,11 +1134,8 @@ func buildTarball(args cli.Args) ([]*TarballFile, error) {
 				}
 
 				// Allow/prevent recursion accordingly:
-				if info.IsDir() {
-					if !isRecursive {
-						return filepath.SkipDir
-					}
-					return nil
+				if info.IsDir() && !isRecursive {
+					return filepath.SkipDir
 				}
 
 				// Translate to relative path with '/'s:
@@ -324,6 +1147,19 @@ func buildTarball(args cli.Args) ([]*TarballFile, error) {
 					tarPath = subdir + "/" + tarPath
 				}
 
+				// Directory entries are included if asked for, so that empty directories are recreated:
+				if info.IsDir() {
+					if !directories {
+						return nil
+					}
+					files = append(files, &TarballFile{
+						Path:      tarPath,
+						LocalPath: fullPath,
+						Mode:      info.Mode(),
+					})
+					return nil
+				}
+
 				// Add file to virtual tarball list:
 				files = append(files, &TarballFile{
 					Path:      tarPath,
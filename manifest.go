@@ -0,0 +1,232 @@
+// manifest.go
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var ErrTreeMismatch = errors.New("tree does not match manifest")
+
+// Walks src and hashes every file into a manifest file so the expensive hashing step can be done ahead of serving.
+// The manifest holds the same encoding as the served metadata, prefixed with its digest like the metadata cache.
+func WriteManifest(path string, src TarballSource) error {
+	files, err := MergeTarballSources(src)
+	if err != nil {
+		return err
+	}
+
+	size := int64(0)
+	for _, f := range files {
+		stat, err := os.Lstat(f.LocalPath)
+		if err != nil {
+			return err
+		}
+		f.ModTime = stat.ModTime()
+
+		if stat.Mode()&os.ModeSymlink == os.ModeSymlink {
+			f.Size = 0
+			f.SymlinkDestination, err = os.Readlink(f.LocalPath)
+			if err != nil {
+				return err
+			}
+		} else if stat.IsDir() || isSpecial(stat.Mode()) {
+			f.Size = 0
+			if stat.Mode()&os.ModeDevice != 0 {
+				f.DeviceMajor, f.DeviceMinor = deviceNumbers(stat)
+			}
+		} else if stat.Mode()&os.ModeType == 0 {
+			f.Hash, err = hashFile(f.LocalPath)
+			if err != nil {
+				return err
+			}
+		}
+
+		if size, err = addEntrySize(size, f.Size, 1); err != nil {
+			return err
+		}
+	}
+
+	md, err := encodeMetadata(size, 0, files)
+	if err != nil {
+		return err
+	}
+	return saveMetadataCache(path, md)
+}
+
+// Reads the file list from a manifest written by WriteManifest, resolving local paths against root.
+func ReadManifest(path string, root string) ([]*TarballFile, error) {
+	_, md, err := loadMetadataCache(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := newMetadataDecoder(1, 0)
+	if err = d.AddSection(0, md); err != nil {
+		return nil, err
+	}
+	_, files, err := d.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		f.LocalPath = filepath.Join(root, filepath.FromSlash(f.Path))
+	}
+	return files, nil
+}
+
+// Constructs a reader from a precomputed manifest; hashes and modification times are taken from it as-is.
+func NewVirtualTarballReaderFromManifest(path string, root string, options VirtualTarballOptions) (*VirtualTarballReader, error) {
+	files, err := ReadManifest(path, root)
+	if err != nil {
+		return nil, err
+	}
+	return NewVirtualTarballReader(files, options)
+}
+
+// A file in a received tree that does not match its manifest entry. Kind is one of "missing", "type", "size",
+// "symlink" or "hash".
+type TreeProblem struct {
+	Path   string
+	Kind   string
+	Detail string
+}
+
+// Tab-separated kind, path and detail, for one problem per line of output:
+func (p TreeProblem) String() string {
+	return p.Kind + "\t" + p.Path + "\t" + p.Detail
+}
+
+// Checks every entry of a manifest or metadata cache against the tree extracted under root, reporting missing
+// files, type, size and symlink mismatches, and contents not matching recorded hashes.
+func VerifyTree(manifestPath string, root string) ([]TreeProblem, error) {
+	files, err := ReadManifest(manifestPath, root)
+	if err != nil {
+		return nil, err
+	}
+
+	problems := make([]TreeProblem, 0)
+	for _, f := range files {
+		stat, err := os.Lstat(f.LocalPath)
+		if os.IsNotExist(err) {
+			problems = append(problems, TreeProblem{Path: f.Path, Kind: "missing"})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if stat.Mode()&os.ModeType != f.Mode&os.ModeType {
+			problems = append(problems, TreeProblem{Path: f.Path, Kind: "type", Detail: fmt.Sprintf("expected %v got %v", f.Mode&os.ModeType, stat.Mode()&os.ModeType)})
+			continue
+		}
+		if f.Mode&os.ModeSymlink != 0 {
+			dest, err := os.Readlink(f.LocalPath)
+			if err != nil {
+				return nil, err
+			}
+			if dest != f.SymlinkDestination {
+				problems = append(problems, TreeProblem{Path: f.Path, Kind: "symlink", Detail: fmt.Sprintf("expected '%s' got '%s'", f.SymlinkDestination, dest)})
+			}
+			continue
+		}
+		if f.Mode&os.ModeType != 0 {
+			continue
+		}
+
+		if stat.Size() != f.Size {
+			problems = append(problems, TreeProblem{Path: f.Path, Kind: "size", Detail: fmt.Sprintf("expected %d got %d", f.Size, stat.Size())})
+			continue
+		}
+		if f.Hash != nil {
+			hash, err := hashFile(f.LocalPath)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(hash, f.Hash) {
+				problems = append(problems, TreeProblem{Path: f.Path, Kind: "hash"})
+			}
+		}
+	}
+	return problems, nil
+}
+
+// Files added, removed and changed between two tarballs, each sorted by path. Added and Changed hold entries of the
+// newer tarball and Removed those of the older.
+type TarballDiff struct {
+	Added   []*TarballFile
+	Removed []*TarballFile
+	Changed []*TarballFile
+}
+
+// Lines of "+", "-" or "~", a tab and the path, in path order within each of added, removed and changed:
+func (d TarballDiff) String() string {
+	lines := make([]string, 0, len(d.Added)+len(d.Removed)+len(d.Changed))
+	for _, group := range []struct {
+		marker string
+		files  []*TarballFile
+	}{{"+", d.Added}, {"-", d.Removed}, {"~", d.Changed}} {
+		for _, f := range group.files {
+			lines = append(lines, group.marker+"\t"+f.Path+"\n")
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// Compares two tarballs by path. Regular files hashed in both are changed if their content hashes differ, otherwise
+// if their size or modification time does; call HashContents first for readers built with LazyHash. Changes of entry
+// type, symlink destination or device numbers count as changes; permission changes alone do not.
+func DiffTarballs(a, b *VirtualTarballReader) TarballDiff {
+	byPath := make(map[string]*TarballFile, len(a.files))
+	for _, f := range a.files {
+		byPath[f.Path] = f
+	}
+
+	d := TarballDiff{Added: []*TarballFile{}, Removed: []*TarballFile{}, Changed: []*TarballFile{}}
+	for _, f := range b.files {
+		old, ok := byPath[f.Path]
+		if !ok {
+			d.Added = append(d.Added, f)
+			continue
+		}
+		delete(byPath, f.Path)
+		if entryChanged(old, f) {
+			d.Changed = append(d.Changed, f)
+		}
+	}
+	for _, f := range byPath {
+		d.Removed = append(d.Removed, f)
+	}
+
+	for _, files := range [][]*TarballFile{d.Added, d.Removed, d.Changed} {
+		sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	}
+	return d
+}
+
+func entryChanged(a, b *TarballFile) bool {
+	if a.Mode&os.ModeType != b.Mode&os.ModeType || a.SymlinkDestination != b.SymlinkDestination {
+		return true
+	}
+	if a.Mode&os.ModeDevice != 0 && (a.DeviceMajor != b.DeviceMajor || a.DeviceMinor != b.DeviceMinor) {
+		return true
+	}
+	if a.Mode&os.ModeType != 0 {
+		return false
+	}
+	if a.Hash != nil && b.Hash != nil {
+		// Hashes truncated to different lengths are compared over the shorter:
+		n := len(a.Hash)
+		if len(b.Hash) < n {
+			n = len(b.Hash)
+		}
+		return !bytes.Equal(a.Hash[:n], b.Hash[:n])
+	}
+	return a.Size != b.Size || !a.ModTime.Equal(b.ModTime)
+}
@@ -0,0 +1,169 @@
+// manifest_test.go
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestManifest_RoundTrip(t *testing.T) {
+	if err := os.MkdirAll("manifest_src/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("manifest_src")
+	defer os.Remove("test.manifest")
+	createTestFile("manifest_src/a.txt", []byte("hello\n"))
+	createTestFile("manifest_src/sub/b.txt", []byte("world\n"))
+
+	if err := WriteManifest("test.manifest", TarballSource{Root: "manifest_src", Directories: true}); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ReadManifest("test.manifest", "manifest_src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 || files[0].Path != "a.txt" || files[1].Path != "sub" || files[2].Path != "sub/b.txt" {
+		t.Fatalf("unexpected manifest files %+v", files)
+	}
+	expectedHash, _ := hashFile("manifest_src/a.txt")
+	if !bytes.Equal(files[0].Hash, expectedHash) || files[0].ModTime.IsZero() {
+		t.Fatalf("manifest missing hash or mtime: %+v", files[0])
+	}
+
+	// Serving from a trusted manifest must not rehash, even if contents changed since:
+	ioutil.WriteFile("manifest_src/a.txt", []byte("HELLO\n"), 0644)
+	options := getOptions()
+	options.HashFiles = true
+	options.TrustMetadata = true
+	tb, err := NewVirtualTarballReaderFromManifest("test.manifest", "manifest_src", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+	if !bytes.Equal(tb.files[0].Hash, expectedHash) {
+		t.Fatal("reader rehashed file from manifest")
+	}
+
+	// Otherwise the manifest's hashes are recomputed from the sources:
+	options.TrustMetadata = false
+	rehashed, err := NewVirtualTarballReaderFromManifest("test.manifest", "manifest_src", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rehashed.Close()
+	currentHash, _ := hashFile("manifest_src/a.txt")
+	if !bytes.Equal(rehashed.files[0].Hash, currentHash) {
+		t.Fatal("expected the stale manifest hash to be recomputed")
+	}
+
+	// A source whose size no longer matches is rejected, trusted or not:
+	ioutil.WriteFile("manifest_src/a.txt", []byte("hello, world\n"), 0644)
+	options.TrustMetadata = true
+	_, err = NewVirtualTarballReaderFromManifest("test.manifest", "manifest_src", options)
+	if mismatch, ok := err.(*SizeMismatchError); !ok || !errors.Is(err, ErrSizeMismatch) || mismatch.Path != "a.txt" || mismatch.Size != 6 || mismatch.Actual != 13 {
+		t.Fatalf("expected a SizeMismatchError for a.txt; got %v", err)
+	}
+
+	// Corrupt manifest is rejected:
+	buf, _ := ioutil.ReadFile("test.manifest")
+	buf[len(buf)-1] ^= 0xff
+	ioutil.WriteFile("test.manifest", buf, 0644)
+	if _, err := ReadManifest("test.manifest", "manifest_src"); err != ErrMetadataDigestMismatch {
+		t.Fatalf("expected ErrMetadataDigestMismatch; got %v", err)
+	}
+}
+
+func TestVerifyTree(t *testing.T) {
+	if err := os.MkdirAll("verify_src/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("verify_src")
+	defer os.Remove("verify.manifest")
+	createTestFile("verify_src/a.txt", []byte("alpha\n"))
+	createTestFile("verify_src/b.txt", []byte("bravo\n"))
+	createTestFile("verify_src/c.txt", []byte("charlie\n"))
+	createTestFile("verify_src/sub/d.txt", []byte("delta\n"))
+
+	if err := WriteManifest("verify.manifest", TarballSource{Root: "verify_src"}); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := VerifyTree("verify.manifest", "verify_src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("expected no problems; got %v", problems)
+	}
+
+	ioutil.WriteFile("verify_src/a.txt", []byte("ALPHA\n"), 0644)
+	ioutil.WriteFile("verify_src/b.txt", []byte("bravo!\n"), 0644)
+	os.Remove("verify_src/c.txt")
+	problems, err = VerifyTree("verify.manifest", "verify_src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{}
+	for _, p := range problems {
+		lines = append(lines, p.String())
+	}
+	expected := []string{"hash\ta.txt\t", "size\tb.txt\texpected 6 got 7", "missing\tc.txt\t"}
+	if len(lines) != len(expected) {
+		t.Fatalf("problems = %q", lines)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Fatalf("problem %d = %q; expected %q", i, lines[i], expected[i])
+		}
+	}
+}
+
+func TestDiffTarballs(t *testing.T) {
+	for _, dir := range []string{"diff_old/sub", "diff_new/sub"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.RemoveAll("diff_old")
+	defer os.RemoveAll("diff_new")
+	createTestFile("diff_old/same.txt", []byte("same\n"))
+	createTestFile("diff_new/same.txt", []byte("same\n"))
+	createTestFile("diff_old/sub/edited.txt", []byte("before\n"))
+	createTestFile("diff_new/sub/edited.txt", []byte("after!\n"))
+	createTestFile("diff_old/gone.txt", []byte("gone\n"))
+	createTestFile("diff_new/b_new.txt", []byte("new\n"))
+	createTestFile("diff_new/a_new.txt", []byte("new\n"))
+
+	readers := []*VirtualTarballReader{}
+	for _, root := range []string{"diff_old", "diff_new"} {
+		files, err := MergeTarballSources(TarballSource{Root: root})
+		if err != nil {
+			t.Fatal(err)
+		}
+		options := getOptions()
+		options.HashFiles = true
+		tb, err := NewVirtualTarballReader(files, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tb.Close()
+		readers = append(readers, tb)
+	}
+
+	d := DiffTarballs(readers[0], readers[1])
+	expected := "+\ta_new.txt\n+\tb_new.txt\n-\tgone.txt\n~\tsub/edited.txt\n"
+	if d.String() != expected {
+		t.Fatalf("diff = %q; expected %q", d.String(), expected)
+	}
+	if d.Changed[0] != readers[1].files[len(readers[1].files)-1] {
+		t.Fatal("expected changed entries from the newer tarball")
+	}
+
+	// Identical trees do not differ:
+	d = DiffTarballs(readers[1], readers[1])
+	if len(d.Added) != 0 || len(d.Removed) != 0 || len(d.Changed) != 0 {
+		t.Fatalf("expected no differences; got %q", d.String())
+	}
+}
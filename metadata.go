@@ -0,0 +1,582 @@
+// metadata.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+const metadataDigestSize = sha256.Size
+
+// Metadata flags so sender and receiver agree on the tarball layout:
+const (
+	// Files are not followed by a trailing NUL padding byte:
+	metadataFlagNoPadding = uint8(1 << iota)
+	// Each entry is followed by its block size and block hashes:
+	metadataFlagBlockHashes
+	// Each entry is then followed by its data extents; entries without holes have one extent covering the file:
+	metadataFlagDataExtents
+	// Data is sent as one gzip stream of the whole tarball, whose size follows the flags:
+	metadataFlagGzipStream
+	// File hashes are truncated to the length in the uint8 that follows the flags and any stream size:
+	metadataFlagHashSize
+	// Each entry's mode is a uint8 code into the table of modes that follows any hash size; see encodeModeTable:
+	metadataFlagModeTable
+	// Some entry's path is not valid UTF-8, so that clients rejecting such paths refuse the tarball from the header.
+	// Set from the paths themselves rather than an option:
+	metadataFlagInvalidUTF8
+)
+
+// Code of an entry mode not in the mode table, which follows in full as a uint32:
+const modeEscape = uint8(0xff)
+
+// Most modes a mode table holds; every other code is an index into it:
+const maxModeTableSize = int(modeEscape)
+
+// Metadata flags describing a tarball built with the given options:
+func metadataFlags(options VirtualTarballOptions) uint8 {
+	flags := uint8(0)
+	if options.NoPadding {
+		flags |= metadataFlagNoPadding
+	}
+	if options.HashFiles && options.BlockSize > 0 {
+		flags |= metadataFlagBlockHashes
+	}
+	if options.DetectHoles {
+		flags |= metadataFlagDataExtents
+	}
+	if options.GzipStream {
+		flags |= metadataFlagGzipStream
+	}
+	if options.HashSize > 0 {
+		flags |= metadataFlagHashSize
+	}
+	if options.ModeTable {
+		flags |= metadataFlagModeTable
+	}
+	return flags
+}
+
+// Fields of the metadata preceding its file entries:
+type metadataHeader struct {
+	size  int64
+	flags uint8
+	// Size of the gzip stream data is sent as with metadataFlagGzipStream:
+	streamSize int64
+	// Length of file hashes with metadataFlagHashSize:
+	hashSize uint8
+	// Modes entries are coded against with metadataFlagModeTable, and the code of each:
+	modes     []os.FileMode
+	modeCodes map[os.FileMode]uint8
+}
+
+// The header of metadata describing a tarball of size bytes built with options:
+func newMetadataHeader(size int64, options VirtualTarballOptions) metadataHeader {
+	return metadataHeader{size: size, flags: metadataFlags(options), hashSize: uint8(options.HashSize)}
+}
+
+// Serializes tarball metadata; this is the payload sliced into metadata sections.
+func encodeMetadata(size int64, flags uint8, files []*TarballFile) ([]byte, error) {
+	return encodeHeaderAndFiles(metadataHeader{size: size, flags: flags}, files)
+}
+
+// Like encodeMetadata, also recording the stream size, hash size and mode table that h's flags call for. Hashes must
+// all be of the recorded size. Without modes of its own, h's mode table is built from files:
+func encodeHeaderAndFiles(h metadataHeader, files []*TarballFile) ([]byte, error) {
+	for _, f := range files {
+		if !utf8.ValidString(f.Path) {
+			h.flags |= metadataFlagInvalidUTF8
+			break
+		}
+	}
+	flags := h.flags
+	if flags&metadataFlagHashSize != 0 && !validHashSize(int(h.hashSize)) {
+		return nil, ErrBadHashSize
+	}
+	if flags&metadataFlagModeTable != 0 {
+		if h.modes == nil {
+			h.modes = buildModeTable(files)
+		}
+		if len(h.modes) > maxModeTableSize {
+			return nil, ErrBadModeTable
+		}
+		h.modeCodes = make(map[os.FileMode]uint8, len(h.modes))
+		for i, mode := range h.modes {
+			h.modeCodes[mode] = uint8(i)
+		}
+	}
+
+	// Size the buffer exactly once from the actual string lengths:
+	mdSize := 8 + 1 + 4
+	if flags&metadataFlagGzipStream != 0 {
+		mdSize += 8
+	}
+	if flags&metadataFlagHashSize != 0 {
+		mdSize++
+	}
+	if flags&metadataFlagModeTable != 0 {
+		mdSize += 1 + 4*len(h.modes)
+	}
+	for _, f := range files {
+		mdSize += encodedEntrySize(f, h)
+	}
+	mdBuf := bytes.NewBuffer(make([]byte, 0, mdSize))
+
+	binary.Write(mdBuf, byteOrder, h.size)
+	mdBuf.WriteByte(flags)
+	if flags&metadataFlagGzipStream != 0 {
+		binary.Write(mdBuf, byteOrder, h.streamSize)
+	}
+	if flags&metadataFlagHashSize != 0 {
+		mdBuf.WriteByte(h.hashSize)
+	}
+	if flags&metadataFlagModeTable != 0 {
+		encodeModeTable(mdBuf, h.modes)
+	}
+	binary.Write(mdBuf, byteOrder, uint32(len(files)))
+	for _, f := range files {
+		if err := encodeEntry(mdBuf, f, h); err != nil {
+			return nil, err
+		}
+	}
+
+	return mdBuf.Bytes(), nil
+}
+
+// Mode table: a uint8 count of modes, then each mode as a uint32. Entries give the index of their mode in the table,
+// or modeEscape followed by the mode itself.
+func encodeModeTable(mdBuf *bytes.Buffer, modes []os.FileMode) {
+	mdBuf.WriteByte(uint8(len(modes)))
+	for _, mode := range modes {
+		binary.Write(mdBuf, byteOrder, uint32(mode))
+	}
+}
+
+// Modes that recur among files, most common first; a mode used once costs more in the table than in full. Ties are
+// broken by mode so that the same files always give the same table:
+func buildModeTable(files []*TarballFile) []os.FileMode {
+	counts := make(map[os.FileMode]int)
+	for _, f := range files {
+		counts[encodedMode(f)]++
+	}
+	modes := []os.FileMode(nil)
+	for mode, n := range counts {
+		if n > 1 {
+			modes = append(modes, mode)
+		}
+	}
+	sort.Slice(modes, func(i, j int) bool {
+		if counts[modes[i]] != counts[modes[j]] {
+			return counts[modes[i]] > counts[modes[j]]
+		}
+		return modes[i] < modes[j]
+	})
+	if len(modes) > maxModeTableSize {
+		modes = modes[:maxModeTableSize]
+	}
+	return modes
+}
+
+// A file's mode as encoded in metadata. Directory symlinks are flagged with ModeDir, which lstat never reports
+// alongside ModeSymlink:
+func encodedMode(f *TarballFile) os.FileMode {
+	if f.SymlinkIsDir {
+		return f.Mode | os.ModeDir
+	}
+	return f.Mode
+}
+
+// Bytes encodeEntry writes for f:
+func encodedEntrySize(f *TarballFile, h metadataHeader) int {
+	flags := h.flags
+	size := (2 + len(f.Path)) + 8 + 4 + (2 + len(f.SymlinkDestination)) + 8 + (2 + len(f.Hash))
+	if flags&metadataFlagModeTable != 0 {
+		if _, ok := h.modeCodes[encodedMode(f)]; ok {
+			size -= 4 - 1
+		} else {
+			size++
+		}
+	}
+	if f.Mode&os.ModeDevice != 0 {
+		size += 4 + 4
+	}
+	if flags&metadataFlagBlockHashes != 0 {
+		size += 4 + 4 + len(f.BlockHashes)*sha256.Size
+	}
+	if flags&metadataFlagDataExtents != 0 {
+		extents := len(f.DataExtents)
+		if f.DataExtents == nil {
+			extents = 1
+		}
+		size += 4 + extents*(8+8)
+	}
+	return size
+}
+
+// Serializes one file entry of the metadata, as decodeTarballFile reads it:
+func encodeEntry(mdBuf *bytes.Buffer, f *TarballFile, h metadataHeader) error {
+	err := error(nil)
+	flags := h.flags
+
+	writePrimitive := func(data interface{}) {
+		if err == nil {
+			err = binary.Write(mdBuf, byteOrder, data)
+		}
+	}
+	writeString := func(s string) {
+		// Lengths are encoded as uint16:
+		if err == nil && len(s) > math.MaxUint16 {
+			err = ErrPathTooLong
+		}
+		writePrimitive(uint16(len(s)))
+		if err == nil {
+			_, err = mdBuf.WriteString(s)
+		}
+	}
+	writeTime := func(t time.Time) {
+		// Zero time is encoded as 0:
+		n := int64(0)
+		if !t.IsZero() {
+			n = t.UnixNano()
+		}
+		writePrimitive(n)
+	}
+
+	writeString(f.Path)
+	writePrimitive(f.Size)
+	mode := encodedMode(f)
+	if code, ok := h.modeCodes[mode]; ok && flags&metadataFlagModeTable != 0 {
+		writePrimitive(code)
+	} else {
+		if flags&metadataFlagModeTable != 0 {
+			writePrimitive(modeEscape)
+		}
+		writePrimitive(mode)
+	}
+	// Device numbers follow the mode only for device nodes:
+	if f.Mode&os.ModeDevice != 0 {
+		writePrimitive(f.DeviceMajor)
+		writePrimitive(f.DeviceMinor)
+	}
+	writeString(f.SymlinkDestination)
+	writeTime(f.ModTime)
+	if err == nil && f.Hash != nil && flags&metadataFlagHashSize != 0 && len(f.Hash) != int(h.hashSize) {
+		err = ErrBadHashSize
+	}
+	writeString(string(f.Hash))
+	if flags&metadataFlagBlockHashes != 0 {
+		writePrimitive(f.BlockSize)
+		writePrimitive(uint32(len(f.BlockHashes)))
+		for _, b := range f.BlockHashes {
+			if err == nil && len(b) != sha256.Size {
+				err = ErrBadBlockHash
+			}
+			if err == nil {
+				_, err = mdBuf.Write(b)
+			}
+		}
+	}
+	if flags&metadataFlagDataExtents != 0 {
+		extents := f.DataExtents
+		if extents == nil {
+			extents = []DataExtent{{Offset: 0, Length: f.Size}}
+		}
+		writePrimitive(uint32(len(extents)))
+		for _, e := range extents {
+			writePrimitive(e.Offset)
+			writePrimitive(e.Length)
+		}
+	}
+	return err
+}
+
+// How RequestFileEntries matches paths:
+const (
+	fileEntriesExact = byte(iota)
+	fileEntriesPrefix
+)
+
+// A file's metadata entry and the tarball offset its contents start at, as looked up with RequestFileEntries:
+type FileEntry struct {
+	File   *TarballFile
+	Offset int64
+}
+
+// RequestFileEntries payload: how to match, the index of the first matching entry wanted, then the path. Later
+// indexes fetch the entries that did not fit in earlier responses:
+func encodeFileEntriesRequest(path string, prefix bool, first uint32) []byte {
+	data := make([]byte, 1+4+len(path))
+	data[0] = fileEntriesExact
+	if prefix {
+		data[0] = fileEntriesPrefix
+	}
+	byteOrder.PutUint32(data[1:5], first)
+	copy(data[5:], path)
+	return data
+}
+
+func decodeFileEntriesRequest(data []byte) (path string, prefix bool, first uint32, err error) {
+	if len(data) < 1+4 {
+		return "", false, 0, ErrMessageTooShort
+	}
+	if data[0] != fileEntriesExact && data[0] != fileEntriesPrefix {
+		return "", false, 0, ErrBadEntriesRequest
+	}
+	return string(data[5:]), data[0] == fileEntriesPrefix, byteOrder.Uint32(data[1:5]), nil
+}
+
+// RespondFileEntries payload: the request answered, preceded by its uint16 length so that clients can tell their
+// answers apart; the metadata flags the entries are encoded with; whether more entries follow those that fit in
+// maxSize bytes; then an entry count and each entry's tarball offset and metadata encoding:
+func encodeFileEntries(request []byte, h metadataHeader, files []*TarballFile, maxSize int) ([]byte, error) {
+	// Without the header's mode table, modes are sent in full:
+	h.flags &^= metadataFlagModeTable
+	buf := bytes.NewBuffer(make([]byte, 0, maxSize))
+	binary.Write(buf, byteOrder, uint16(len(request)))
+	buf.Write(request)
+	buf.WriteByte(h.flags)
+	more := buf.Len()
+	buf.WriteByte(0)
+	count := buf.Len()
+	binary.Write(buf, byteOrder, uint16(0))
+
+	n := 0
+	for _, f := range files {
+		if n == math.MaxUint16 || buf.Len()+8+encodedEntrySize(f, h) > maxSize {
+			break
+		}
+		binary.Write(buf, byteOrder, f.offset)
+		if err := encodeEntry(buf, f, h); err != nil {
+			return nil, err
+		}
+		n++
+	}
+	if n == 0 && len(files) > 0 {
+		// Clients would ask for the same entry forever:
+		return nil, ErrPathTooLong
+	}
+
+	data := buf.Bytes()
+	if n < len(files) {
+		data[more] = 1
+	}
+	byteOrder.PutUint16(data[count:count+2], uint16(n))
+	return data, nil
+}
+
+func decodeFileEntries(data []byte) (request []byte, entries []FileEntry, more bool, err error) {
+	if len(data) < 2 {
+		return nil, nil, false, ErrMessageTooShort
+	}
+	l := int(byteOrder.Uint16(data[0:2]))
+	if len(data) < 2+l+1+1+2 {
+		return nil, nil, false, ErrMessageTooShort
+	}
+	request = data[2 : 2+l]
+	p := data[2+l:]
+	flags := p[0]
+	more = p[1] != 0
+	count := int(byteOrder.Uint16(p[2:4]))
+	p = p[4:]
+
+	entries = make([]FileEntry, 0, count)
+	for len(entries) < count {
+		if len(p) < 8 {
+			return nil, nil, false, ErrMetadataTruncated
+		}
+		offset := int64(byteOrder.Uint64(p[0:8]))
+		f, n, err := decodeTarballFile(p[8:], flags, nil)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if f == nil {
+			return nil, nil, false, ErrMetadataTruncated
+		}
+		entries = append(entries, FileEntry{File: f, Offset: offset})
+		p = p[8+n:]
+	}
+	if len(p) > 0 {
+		return nil, nil, false, ErrMetadataTrailingData
+	}
+	return request, entries, more, nil
+}
+
+// Table of contents entry locating a file within the tarball without the rest of its metadata:
+type TOCEntry struct {
+	Path   string
+	Offset int64
+	Size   int64
+}
+
+func encodeTOC(files []*TarballFile) []byte {
+	size := 4
+	for _, f := range files {
+		size += 2 + len(f.Path) + 8 + 8
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	binary.Write(buf, byteOrder, uint32(len(files)))
+	for _, f := range files {
+		binary.Write(buf, byteOrder, uint16(len(f.Path)))
+		buf.WriteString(f.Path)
+		binary.Write(buf, byteOrder, f.offset)
+		binary.Write(buf, byteOrder, f.Size)
+	}
+	return buf.Bytes()
+}
+
+func decodeTOC(data []byte) ([]TOCEntry, error) {
+	if len(data) < 4 {
+		return nil, ErrMetadataTruncated
+	}
+	count := byteOrder.Uint32(data[0:4])
+	p := data[4:]
+	// Every entry takes at least its path length, offset and size; a larger count cannot be what was sent, and is
+	// refused before it sizes the allocation below:
+	if uint64(count) > uint64(len(p)/(2+8+8)) {
+		return nil, ErrMetadataTruncated
+	}
+
+	toc := make([]TOCEntry, 0, count)
+	for n := uint32(0); n < count; n++ {
+		if len(p) < 2 {
+			return nil, ErrMetadataTruncated
+		}
+		l := int(byteOrder.Uint16(p[0:2]))
+		if len(p) < 2+l+16 {
+			return nil, ErrMetadataTruncated
+		}
+		e := TOCEntry{Path: string(p[2 : 2+l])}
+		e.Offset = int64(byteOrder.Uint64(p[2+l : 2+l+8]))
+		e.Size = int64(byteOrder.Uint64(p[2+l+8 : 2+l+16]))
+		toc = append(toc, e)
+		p = p[2+l+16:]
+	}
+	if len(p) > 0 {
+		return nil, ErrMetadataTrailingData
+	}
+	return toc, nil
+}
+
+// Checksum of the whole encoded metadata:
+func metadataDigest(md []byte) []byte {
+	sum := sha256.Sum256(md)
+	return sum[:]
+}
+
+// Cached metadata is stored as its digest followed by the encoded metadata.
+func saveMetadataCache(path string, md []byte) error {
+	buf := make([]byte, 0, metadataDigestSize+len(md))
+	buf = append(buf, metadataDigest(md)...)
+	buf = append(buf, md...)
+	return ioutil.WriteFile(path, buf, 0644)
+}
+
+// Returns the digest and encoded metadata from a cache file, verifying its integrity.
+func loadMetadataCache(path string) ([]byte, []byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseMetadataCache(buf)
+}
+
+func parseMetadataCache(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < metadataDigestSize {
+		return nil, nil, ErrMetadataTruncated
+	}
+
+	digest, md := buf[:metadataDigestSize], buf[metadataDigestSize:]
+	if !bytes.Equal(digest, metadataDigest(md)) {
+		return nil, nil, ErrMetadataDigestMismatch
+	}
+	return digest, md, nil
+}
+
+// The server's metadata cache is keyed by the tarball's HashId, stored ahead of the client cache format.
+func saveServerMetadataCache(path string, hashId []byte, md []byte) error {
+	buf := make([]byte, 0, hashSize+metadataDigestSize+len(md))
+	buf = append(buf, hashId...)
+	buf = append(buf, metadataDigest(md)...)
+	buf = append(buf, md...)
+	return ioutil.WriteFile(path, buf, 0644)
+}
+
+// Returns the HashId and decoded file list along with the encoded metadata from a server cache file.
+func loadServerMetadataCache(path string) ([]byte, []*TarballFile, []byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(buf) < hashSize {
+		return nil, nil, nil, ErrMetadataTruncated
+	}
+
+	_, md, err := parseMetadataCache(buf[hashSize:])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	d := newMetadataDecoder(1, 0)
+	if err = d.AddSection(0, md); err != nil {
+		return nil, nil, nil, err
+	}
+	_, files, err := d.Finish()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return buf[:hashSize], files, md, nil
+}
+
+// Presets hashes and modification times of files whose size and modification time match the server metadata cache
+// so that NewVirtualTarballReader does not need to rehash them, returning how many files were preset. Cached entries
+// hashed at another hash size or block size than options ask for are left alone, since they would be served as they
+// are.
+func applyServerMetadataCache(path string, files []*TarballFile, options VirtualTarballOptions) (int, error) {
+	_, cached, _, err := loadServerMetadataCache(path)
+	if err != nil {
+		return 0, err
+	}
+
+	hashSize := sha256.Size
+	if options.HashSize > 0 {
+		hashSize = options.HashSize
+	}
+	blockSize := uint32(0)
+	if options.HashFiles {
+		blockSize = options.BlockSize
+	}
+
+	byPath := make(map[string]*TarballFile, len(cached))
+	for _, cf := range cached {
+		byPath[cf.Path] = cf
+	}
+	applied := 0
+	for _, f := range files {
+		cf, ok := byPath[f.Path]
+		if !ok || cf.Hash == nil || f.Hash != nil || f.LocalPath == "" || f.Content != nil {
+			continue
+		}
+		if len(cf.Hash) != hashSize || cf.BlockSize != blockSize {
+			continue
+		}
+		stat, err := os.Lstat(f.LocalPath)
+		if err != nil {
+			continue
+		}
+		if stat.Size() != cf.Size || !stat.ModTime().Equal(cf.ModTime) {
+			continue
+		}
+		f.ModTime = cf.ModTime
+		f.Hash = cf.Hash
+		f.BlockSize = cf.BlockSize
+		f.BlockHashes = cf.BlockHashes
+		applied++
+	}
+	return applied, nil
+}
@@ -0,0 +1,381 @@
+// metadata_decoder.go
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"os"
+	"time"
+)
+
+var (
+	ErrMetadataTruncated      = errors.New("metadata truncated")
+	ErrMetadataTrailingData   = errors.New("metadata has trailing data")
+	ErrMetadataDigestMismatch = errors.New("metadata digest mismatch")
+	ErrPathTooLong            = errors.New("path too long to encode in metadata")
+	ErrBadBlockHash           = errors.New("block hash is not a SHA-256 digest")
+	ErrBadEntriesRequest      = errors.New("bad file entries request")
+	ErrBadModeTable           = errors.New("mode code not in the metadata mode table")
+)
+
+type metadataDecodeState int
+
+const (
+	expectMetadataSize = metadataDecodeState(iota)
+	expectMetadataFlags
+	expectMetadataStreamSize
+	expectMetadataHashSize
+	expectMetadataModeTable
+	expectMetadataFileCount
+	expectMetadataFiles
+	metadataDecoded
+)
+
+// Incrementally decodes metadata sections as they arrive so that only the unparsed tail and any
+// out-of-order sections need to be held in memory.
+type metadataDecoder struct {
+	sectionCount uint16
+	nextSection  uint16
+
+	// Out-of-order sections waiting for their predecessors:
+	pending     map[uint16][]byte
+	pendingSize int
+	maxPending  int
+
+	// Contiguous bytes not yet parsed into an entry:
+	tail []byte
+
+	state     metadataDecodeState
+	size      int64
+	flags     uint8
+	fileCount uint32
+	files     []*TarballFile
+	// Size of the gzip stream with metadataFlagGzipStream:
+	streamSize int64
+	// Length of file hashes with metadataFlagHashSize:
+	hashSize uint8
+	// Modes that entries are coded against with metadataFlagModeTable:
+	modes []os.FileMode
+}
+
+// maxPending limits the total bytes of out-of-order sections buffered; 0 means no limit.
+func newMetadataDecoder(sectionCount uint16, maxPending int) *metadataDecoder {
+	d := &metadataDecoder{
+		sectionCount: sectionCount,
+		pending:      make(map[uint16][]byte),
+		maxPending:   maxPending,
+	}
+	return d
+}
+
+func (d *metadataDecoder) NextSection() uint16 {
+	return d.nextSection
+}
+
+func (d *metadataDecoder) IsComplete() bool {
+	return d.nextSection >= d.sectionCount
+}
+
+func (d *metadataDecoder) AddSection(index uint16, data []byte) error {
+	if index >= d.sectionCount || index < d.nextSection {
+		// Out of range or already decoded:
+		return nil
+	}
+
+	if index > d.nextSection {
+		if _, ok := d.pending[index]; ok {
+			return nil
+		}
+		// Drop section if over budget; it will be requested again later:
+		if d.maxPending > 0 && d.pendingSize+len(data) > d.maxPending {
+			return nil
+		}
+
+		section := make([]byte, len(data))
+		copy(section, data)
+		d.pending[index] = section
+		d.pendingSize += len(section)
+		return nil
+	}
+
+	// Decode this section and any buffered sections that are now contiguous:
+	if err := d.decode(data); err != nil {
+		return err
+	}
+	d.nextSection++
+	for {
+		section, ok := d.pending[d.nextSection]
+		if !ok {
+			break
+		}
+		delete(d.pending, d.nextSection)
+		d.pendingSize -= len(section)
+
+		if err := d.decode(section); err != nil {
+			return err
+		}
+		d.nextSection++
+	}
+
+	return nil
+}
+
+// Returns the decoded tarball size and file list once all sections are received:
+func (d *metadataDecoder) Finish() (int64, []*TarballFile, error) {
+	if !d.IsComplete() || d.state != metadataDecoded {
+		return 0, nil, ErrMetadataTruncated
+	}
+	if len(d.tail) > 0 {
+		return 0, nil, ErrMetadataTrailingData
+	}
+	return d.size, d.files, nil
+}
+
+// Tarball layout flags; valid once decoding has passed the header:
+func (d *metadataDecoder) Flags() uint8 {
+	return d.flags
+}
+
+// Size of the gzip stream data is sent as with metadataFlagGzipStream, otherwise 0; valid once decoding has passed
+// the header:
+func (d *metadataDecoder) StreamSize() int64 {
+	return d.streamSize
+}
+
+// Length file hashes are truncated to as with metadataFlagHashSize, otherwise 0; valid once decoding has passed the
+// header:
+func (d *metadataDecoder) HashSize() int {
+	return int(d.hashSize)
+}
+
+// Modes of the table entries are coded against with metadataFlagModeTable, otherwise nil; valid once decoding has
+// passed the header:
+func (d *metadataDecoder) ModeTable() []os.FileMode {
+	return d.modes
+}
+
+// The header field following state that the flags call for, or the file count once there are none left:
+func (d *metadataDecoder) nextHeaderState(state metadataDecodeState) metadataDecodeState {
+	for state++; state < expectMetadataFileCount; state++ {
+		switch {
+		case state == expectMetadataStreamSize && d.flags&metadataFlagGzipStream != 0,
+			state == expectMetadataHashSize && d.flags&metadataFlagHashSize != 0,
+			state == expectMetadataModeTable && d.flags&metadataFlagModeTable != 0:
+			return state
+		}
+	}
+	return expectMetadataFileCount
+}
+
+func (d *metadataDecoder) decode(data []byte) error {
+	d.tail = append(d.tail, data...)
+
+	p := d.tail
+	for {
+		switch d.state {
+		case expectMetadataSize:
+			if len(p) < 8 {
+				return d.keep(p)
+			}
+			d.size = int64(byteOrder.Uint64(p[0:8]))
+			p = p[8:]
+			d.state = expectMetadataFlags
+		case expectMetadataFlags:
+			if len(p) < 1 {
+				return d.keep(p)
+			}
+			d.flags = p[0]
+			p = p[1:]
+			d.state = d.nextHeaderState(expectMetadataFlags)
+		case expectMetadataStreamSize:
+			if len(p) < 8 {
+				return d.keep(p)
+			}
+			d.streamSize = int64(byteOrder.Uint64(p[0:8]))
+			p = p[8:]
+			d.state = d.nextHeaderState(expectMetadataStreamSize)
+		case expectMetadataHashSize:
+			if len(p) < 1 {
+				return d.keep(p)
+			}
+			if !validHashSize(int(p[0])) {
+				return ErrBadHashSize
+			}
+			d.hashSize = p[0]
+			p = p[1:]
+			d.state = d.nextHeaderState(expectMetadataHashSize)
+		case expectMetadataModeTable:
+			if len(p) < 1 || len(p) < 1+4*int(p[0]) {
+				return d.keep(p)
+			}
+			if int(p[0]) > maxModeTableSize {
+				return ErrBadModeTable
+			}
+			d.modes = make([]os.FileMode, p[0])
+			for i := range d.modes {
+				d.modes[i] = os.FileMode(byteOrder.Uint32(p[1+4*i : 5+4*i]))
+			}
+			p = p[1+4*len(d.modes):]
+			d.state = d.nextHeaderState(expectMetadataModeTable)
+		case expectMetadataFileCount:
+			if len(p) < 4 {
+				return d.keep(p)
+			}
+			d.fileCount = byteOrder.Uint32(p[0:4])
+			p = p[4:]
+			d.files = make([]*TarballFile, 0, d.fileCount)
+			d.state = expectMetadataFiles
+			if d.fileCount == 0 {
+				d.state = metadataDecoded
+			}
+		case expectMetadataFiles:
+			f, n, err := decodeTarballFile(p, d.flags, d.modes)
+			if err != nil {
+				return err
+			}
+			if f == nil {
+				return d.keep(p)
+			}
+			if d.hashSize > 0 && f.Hash != nil && len(f.Hash) != int(d.hashSize) {
+				return ErrBadHashSize
+			}
+			p = p[n:]
+			d.files = append(d.files, f)
+			if uint32(len(d.files)) >= d.fileCount {
+				d.state = metadataDecoded
+			}
+		case metadataDecoded:
+			if len(p) > 0 {
+				return ErrMetadataTrailingData
+			}
+			return d.keep(p)
+		}
+	}
+}
+
+func (d *metadataDecoder) keep(p []byte) error {
+	// Copy the unparsed tail so the consumed prefix can be released:
+	d.tail = append([]byte(nil), p...)
+	return nil
+}
+
+// Decodes a single file entry from p, expanding mode codes against modes; returns nil if p does not yet hold a
+// complete entry.
+func decodeTarballFile(p []byte, flags uint8, modes []os.FileMode) (*TarballFile, int, error) {
+	i := 0
+	readString := func() (string, bool) {
+		if len(p) < i+2 {
+			return "", false
+		}
+		l := int(byteOrder.Uint16(p[i : i+2]))
+		if len(p) < i+2+l {
+			return "", false
+		}
+		s := string(p[i+2 : i+2+l])
+		i += 2 + l
+		return s, true
+	}
+
+	f := &TarballFile{}
+	ok := false
+	if f.Path, ok = readString(); !ok {
+		return nil, 0, nil
+	}
+	if len(p) < i+8 {
+		return nil, 0, nil
+	}
+	f.Size = int64(byteOrder.Uint64(p[i : i+8]))
+	i += 8
+	code := modeEscape
+	if flags&metadataFlagModeTable != 0 {
+		if len(p) < i+1 {
+			return nil, 0, nil
+		}
+		code = p[i]
+		i++
+		if code != modeEscape && int(code) >= len(modes) {
+			return nil, 0, ErrBadModeTable
+		}
+	}
+	if code == modeEscape {
+		if len(p) < i+4 {
+			return nil, 0, nil
+		}
+		f.Mode = os.FileMode(byteOrder.Uint32(p[i : i+4]))
+		i += 4
+	} else {
+		f.Mode = modes[code]
+	}
+	if f.Mode&os.ModeSymlink != 0 && f.Mode&os.ModeDir != 0 {
+		f.SymlinkIsDir = true
+		f.Mode &^= os.ModeDir
+	}
+	if f.Mode&os.ModeDevice != 0 {
+		if len(p) < i+8 {
+			return nil, 0, nil
+		}
+		f.DeviceMajor = byteOrder.Uint32(p[i : i+4])
+		f.DeviceMinor = byteOrder.Uint32(p[i+4 : i+8])
+		i += 8
+	}
+	if f.SymlinkDestination, ok = readString(); !ok {
+		return nil, 0, nil
+	}
+	if len(p) < i+8 {
+		return nil, 0, nil
+	}
+	if n := int64(byteOrder.Uint64(p[i : i+8])); n != 0 {
+		f.ModTime = time.Unix(0, n)
+	}
+	i += 8
+	hash := ""
+	if hash, ok = readString(); !ok {
+		return nil, 0, nil
+	}
+	if hash != "" {
+		f.Hash = []byte(hash)
+	}
+	if flags&metadataFlagBlockHashes != 0 {
+		if len(p) < i+8 {
+			return nil, 0, nil
+		}
+		f.BlockSize = byteOrder.Uint32(p[i : i+4])
+		if f.BlockSize > maxBlockSize {
+			return nil, 0, ErrBadBlockSize
+		}
+		count := int(byteOrder.Uint32(p[i+4 : i+8]))
+		i += 8
+		if count > (len(p)-i)/sha256.Size {
+			return nil, 0, nil
+		}
+		if count > 0 {
+			f.BlockHashes = make([][]byte, count)
+			for n := range f.BlockHashes {
+				f.BlockHashes[n] = append([]byte(nil), p[i:i+sha256.Size]...)
+				i += sha256.Size
+			}
+		}
+	}
+	if flags&metadataFlagDataExtents != 0 {
+		if len(p) < i+4 {
+			return nil, 0, nil
+		}
+		count := int(byteOrder.Uint32(p[i : i+4]))
+		i += 4
+		if count > (len(p)-i)/16 {
+			return nil, 0, nil
+		}
+		f.DataExtents = make([]DataExtent, count)
+		for n := range f.DataExtents {
+			f.DataExtents[n].Offset = int64(byteOrder.Uint64(p[i : i+8]))
+			f.DataExtents[n].Length = int64(byteOrder.Uint64(p[i+8 : i+16]))
+			i += 16
+		}
+		if count == 1 && f.DataExtents[0].Offset == 0 && f.DataExtents[0].Length == f.Size {
+			// No holes:
+			f.DataExtents = nil
+		}
+	}
+
+	return f, i, nil
+}
@@ -0,0 +1,500 @@
+// metadata_decoder_test.go
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func encodeTestMetadata(files []*TarballFile) []byte {
+	size := int64(0)
+	for _, f := range files {
+		size += f.Size + 1
+	}
+
+	md, err := encodeMetadata(size, 0, files)
+	if err != nil {
+		panic(err)
+	}
+	return md
+}
+
+func sliceSections(md []byte, sectionSize int) [][]byte {
+	sections := [][]byte(nil)
+	for o := 0; o < len(md); o += sectionSize {
+		l := sectionSize
+		if o+l > len(md) {
+			l = len(md) - o
+		}
+		sections = append(sections, md[o:o+l])
+	}
+	return sections
+}
+
+func testMetadataFiles() []*TarballFile {
+	return []*TarballFile{
+		{Path: "a.txt", Size: 10, Mode: 0644, ModTime: time.Unix(1500000000, 5), Hash: []byte("0123456789abcdef0123456789abcdef")},
+		{Path: "dir/b.txt", Size: 0, Mode: 0600},
+		{Path: "link", Size: 0, Mode: os.ModeSymlink | 0777, SymlinkDestination: "a.txt"},
+		{Path: "dirlink", Size: 0, Mode: os.ModeSymlink | 0755, SymlinkDestination: "dir", SymlinkIsDir: true},
+	}
+}
+
+func verifyDecodedFiles(t *testing.T, d *metadataDecoder, expected []*TarballFile) {
+	size, files, err := d.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 10+1+0+1+0+1+0+1 {
+		t.Fatalf("unexpected size %d", size)
+	}
+	if len(files) != len(expected) {
+		t.Fatalf("len(files) != %d; len(files) = %d", len(expected), len(files))
+	}
+	for i, f := range files {
+		e := expected[i]
+		if f.Path != e.Path || f.Size != e.Size || f.Mode != e.Mode || f.SymlinkDestination != e.SymlinkDestination ||
+			f.SymlinkIsDir != e.SymlinkIsDir ||
+			!f.ModTime.Equal(e.ModTime) || !bytes.Equal(f.Hash, e.Hash) {
+			t.Fatalf("files[%d] = %+v; expected %+v", i, f, e)
+		}
+	}
+}
+
+func TestMetadataDecoder_InOrder(t *testing.T) {
+	expected := testMetadataFiles()
+	sections := sliceSections(encodeTestMetadata(expected), 5)
+
+	d := newMetadataDecoder(uint16(len(sections)), 0)
+	for i, s := range sections {
+		if err := d.AddSection(uint16(i), s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !d.IsComplete() {
+		t.Fatal("expected complete")
+	}
+	verifyDecodedFiles(t, d, expected)
+}
+
+func TestMetadataDecoder_OutOfOrder(t *testing.T) {
+	expected := testMetadataFiles()
+	sections := sliceSections(encodeTestMetadata(expected), 7)
+
+	d := newMetadataDecoder(uint16(len(sections)), 0)
+	for i := len(sections) - 1; i >= 0; i-- {
+		if err := d.AddSection(uint16(i), sections[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(d.pending) != 0 || d.pendingSize != 0 {
+		t.Fatalf("expected no pending sections; pending = %d", len(d.pending))
+	}
+	verifyDecodedFiles(t, d, expected)
+}
+
+func TestMetadataDecoder_MaxPending(t *testing.T) {
+	expected := testMetadataFiles()
+	sections := sliceSections(encodeTestMetadata(expected), 8)
+
+	d := newMetadataDecoder(uint16(len(sections)), 8)
+	d.AddSection(2, sections[2])
+	d.AddSection(3, sections[3])
+	if len(d.pending) != 1 {
+		t.Fatalf("expected 1 pending section; pending = %d", len(d.pending))
+	}
+
+	// Dropped sections must be re-sent:
+	for i, s := range sections {
+		d.AddSection(uint16(i), s)
+	}
+	verifyDecodedFiles(t, d, expected)
+}
+
+func TestMetadataDecoder_Flags(t *testing.T) {
+	md, err := encodeMetadata(0, metadataFlagNoPadding, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newMetadataDecoder(1, 0)
+	if err := d.AddSection(0, md); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Flags() != metadataFlagNoPadding {
+		t.Fatalf("flags = %d; expected %d", d.Flags(), metadataFlagNoPadding)
+	}
+}
+
+func TestMetadataDecoder_StreamSize(t *testing.T) {
+	files := []*TarballFile{{Path: "a.txt", Size: 10, Mode: 0644}}
+	md, err := encodeHeaderAndFiles(metadataHeader{size: 11, flags: metadataFlagGzipStream, streamSize: 1234}, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Split mid stream size to decode it across sections:
+	d := newMetadataDecoder(2, 0)
+	if err := d.AddSection(0, md[:12]); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddSection(1, md[12:]); err != nil {
+		t.Fatal(err)
+	}
+	size, decoded, err := d.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 11 || len(decoded) != 1 || decoded[0].Path != "a.txt" || decoded[0].Size != 10 {
+		t.Fatalf("unexpected metadata: size %d, files %+v", size, decoded)
+	}
+	if d.StreamSize() != 1234 {
+		t.Fatalf("stream size = %d; expected 1234", d.StreamSize())
+	}
+}
+
+func TestMetadataDecoder_HashSize(t *testing.T) {
+	files := []*TarballFile{
+		{Path: "a.txt", Size: 10, Mode: 0644, Hash: []byte("8 bytes!")},
+		{Path: "b", Mode: os.ModeDir | 0755},
+	}
+	header := metadataHeader{size: 12, flags: metadataFlagGzipStream | metadataFlagHashSize, streamSize: 99, hashSize: 8}
+	md, err := encodeHeaderAndFiles(header, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cap(md) != len(md) {
+		t.Fatalf("metadata buffer misestimated; len = %d, cap = %d", len(md), cap(md))
+	}
+
+	d := newMetadataDecoder(1, 0)
+	if err := d.AddSection(0, md); err != nil {
+		t.Fatal(err)
+	}
+	_, decoded, err := d.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.HashSize() != 8 || d.StreamSize() != 99 || string(decoded[0].Hash) != "8 bytes!" || decoded[1].Hash != nil {
+		t.Fatalf("unexpected metadata: hash size %d, stream size %d, files %+v", d.HashSize(), d.StreamSize(), decoded)
+	}
+
+	// Hashes of any other length are refused both ways:
+	files[0].Hash = []byte("sixteen bytes!!!")
+	if _, err := encodeHeaderAndFiles(header, files); err != ErrBadHashSize {
+		t.Fatalf("expected ErrBadHashSize encoding; got %v", err)
+	}
+	header.hashSize = 16
+	md, err = encodeHeaderAndFiles(header, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md[8+1+8] = 8
+	d = newMetadataDecoder(1, 0)
+	if err := d.AddSection(0, md); err != ErrBadHashSize {
+		t.Fatalf("expected ErrBadHashSize decoding; got %v", err)
+	}
+	header.hashSize = 4
+	if _, err := encodeHeaderAndFiles(header, nil); err != ErrBadHashSize {
+		t.Fatalf("expected ErrBadHashSize for a 4-byte hash size; got %v", err)
+	}
+}
+
+func TestMetadataDecoder_ModeTable(t *testing.T) {
+	files := []*TarballFile{}
+	for i := 0; i < 20; i++ {
+		files = append(files, &TarballFile{Path: fmt.Sprintf("file%02d", i), Mode: 0644})
+	}
+	files = append(files,
+		&TarballFile{Path: "bin", Mode: os.ModeDir | 0755},
+		&TarballFile{Path: "lib", Mode: os.ModeDir | 0755},
+		&TarballFile{Path: "run.sh", Mode: os.ModeSetuid | 0750},
+		&TarballFile{Path: "tty", Mode: os.ModeDevice | os.ModeCharDevice | 0620, DeviceMajor: 4, DeviceMinor: 1},
+		&TarballFile{Path: "up", Mode: os.ModeSymlink | 0777, SymlinkDestination: "..", SymlinkIsDir: true},
+		&TarballFile{Path: "up2", Mode: os.ModeSymlink | 0777, SymlinkDestination: "..", SymlinkIsDir: true},
+	)
+
+	full, err := encodeMetadata(0, 0, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := metadataHeader{flags: metadataFlagModeTable}
+	md, err := encodeHeaderAndFiles(header, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cap(md) != len(md) {
+		t.Fatalf("metadata buffer misestimated; len = %d, cap = %d", len(md), cap(md))
+	}
+	if len(md) >= len(full) {
+		t.Fatalf("coded modes take %d bytes; %d in full", len(md), len(full))
+	}
+
+	// Sections split mid-table and mid-entry:
+	sections := sliceSections(md, 3)
+	d := newMetadataDecoder(uint16(len(sections)), 0)
+	for i, s := range sections {
+		if err := d.AddSection(uint16(i), s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, decoded, err := d.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Recurring modes are coded, most common first; the setuid file and device node are escaped:
+	expected := []os.FileMode{0644, os.ModeDir | 0755, os.ModeSymlink | os.ModeDir | 0777}
+	cmpModes := fmt.Sprint(d.ModeTable())
+	if cmpModes != fmt.Sprint(expected) {
+		t.Fatalf("mode table %s; expected %v", cmpModes, expected)
+	}
+	for i, f := range decoded {
+		e := files[i]
+		if f.Path != e.Path || f.Mode != e.Mode || f.SymlinkIsDir != e.SymlinkIsDir || f.DeviceMajor != e.DeviceMajor ||
+			f.DeviceMinor != e.DeviceMinor {
+			t.Fatalf("decoded[%d] = %+v; expected %+v", i, f, e)
+		}
+	}
+
+	// Re-encoding with the decoded table reproduces the metadata, as clients do to check its signature:
+	header.modes = d.ModeTable()
+	again, err := encodeHeaderAndFiles(header, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, md) {
+		t.Fatal("re-encoded metadata differs")
+	}
+
+	// Codes past the end of the table are refused:
+	header.modes = expected[:1]
+	md, _ = encodeHeaderAndFiles(header, files)
+	md[8+1+1+4+4+2+len("file00")+8] = 5
+	d = newMetadataDecoder(1, 0)
+	if err := d.AddSection(0, md); err != ErrBadModeTable {
+		t.Fatalf("expected ErrBadModeTable; got %v", err)
+	}
+}
+
+func TestEncodeMetadata_Sizing(t *testing.T) {
+	files := testMetadataFiles()
+	files[0].Path = strings.Repeat("long/", 100) + files[0].Path
+	md := encodeTestMetadata(files)
+	if cap(md) != len(md) {
+		t.Fatalf("metadata buffer misestimated; len = %d, cap = %d", len(md), cap(md))
+	}
+
+	files[0].Path = strings.Repeat("x", 65536)
+	if _, err := encodeMetadata(0, 0, files); err != ErrPathTooLong {
+		t.Fatalf("expected ErrPathTooLong; got %v", err)
+	}
+}
+
+func TestMetadataDecoder_BlockHashes(t *testing.T) {
+	files := testMetadataFiles()
+	files[0].BlockSize = 4
+	for i := 0; i < 3; i++ {
+		files[0].BlockHashes = append(files[0].BlockHashes, bytes.Repeat([]byte{byte(i + 1)}, 32))
+	}
+	md, err := encodeMetadata(14, metadataFlagBlockHashes, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cap(md) != len(md) {
+		t.Fatalf("metadata buffer misestimated; len = %d, cap = %d", len(md), cap(md))
+	}
+
+	// Small sections split entries within their block hashes:
+	sections := sliceSections(md, 7)
+	d := newMetadataDecoder(uint16(len(sections)), 0)
+	for i, section := range sections {
+		if err := d.AddSection(uint16(i), section); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, decoded, err := d.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded[0].BlockSize != 4 || len(decoded[0].BlockHashes) != 3 || !bytes.Equal(decoded[0].BlockHashes[2], files[0].BlockHashes[2]) {
+		t.Fatalf("block hashes not decoded: size %d, %d hashes", decoded[0].BlockSize, len(decoded[0].BlockHashes))
+	}
+	if decoded[1].BlockSize != 0 || decoded[1].BlockHashes != nil {
+		t.Fatalf("unexpected block hashes for '%s'", decoded[1].Path)
+	}
+
+	files[0].BlockHashes[1] = []byte("short")
+	if _, err := encodeMetadata(14, metadataFlagBlockHashes, files); err != ErrBadBlockHash {
+		t.Fatalf("expected ErrBadBlockHash; got %v", err)
+	}
+
+	// A block size from the wire is bounded before anything is allocated for it:
+	files[0].BlockHashes = nil
+	files[0].BlockSize = maxBlockSize + 1
+	md, err = encodeMetadata(14, metadataFlagBlockHashes, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = newMetadataDecoder(1, 0)
+	if err := d.AddSection(0, md); err != ErrBadBlockSize {
+		t.Fatalf("expected ErrBadBlockSize; got %v", err)
+	}
+}
+
+func TestMetadataDecoder_DataExtents(t *testing.T) {
+	files := testMetadataFiles()
+	files[0].DataExtents = []DataExtent{{Offset: 2, Length: 3}, {Offset: 8, Length: 2}}
+	files[1].DataExtents = []DataExtent{}
+	md, err := encodeMetadata(14, metadataFlagDataExtents, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cap(md) != len(md) {
+		t.Fatalf("metadata buffer misestimated; len = %d, cap = %d", len(md), cap(md))
+	}
+
+	sections := sliceSections(md, 5)
+	d := newMetadataDecoder(uint16(len(sections)), 0)
+	for i, section := range sections {
+		if err := d.AddSection(uint16(i), section); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, decoded, err := d.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded[0].DataExtents) != 2 || decoded[0].DataExtents[1] != files[0].DataExtents[1] {
+		t.Fatalf("data extents not decoded: %+v", decoded[0].DataExtents)
+	}
+	// All holes is distinct from no holes:
+	if decoded[1].DataExtents == nil || len(decoded[1].DataExtents) != 0 {
+		t.Fatalf("expected '%s' to be all holes; got %+v", decoded[1].Path, decoded[1].DataExtents)
+	}
+	for _, f := range decoded[2:] {
+		if f.DataExtents != nil {
+			t.Fatalf("unexpected data extents for '%s': %+v", f.Path, f.DataExtents)
+		}
+	}
+}
+
+func TestMetadataDecoder_Truncated(t *testing.T) {
+	md := encodeTestMetadata(testMetadataFiles())
+
+	d := newMetadataDecoder(1, 0)
+	d.AddSection(0, md[:len(md)-1])
+	if _, _, err := d.Finish(); err != ErrMetadataTruncated {
+		t.Fatalf("expected ErrMetadataTruncated; got %v", err)
+	}
+}
+
+func TestMetadataCache_RoundTrip(t *testing.T) {
+	const fname = "metadata.cache"
+	defer os.Remove(fname)
+
+	md := encodeTestMetadata(testMetadataFiles())
+	if err := saveMetadataCache(fname, md); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, cached, err := loadMetadataCache(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(digest, metadataDigest(md)) || !bytes.Equal(cached, md) {
+		t.Fatal("cached metadata does not match")
+	}
+
+	// Corrupt the cache:
+	buf, _ := ioutil.ReadFile(fname)
+	buf[len(buf)-1] ^= 0xff
+	ioutil.WriteFile(fname, buf, 0644)
+	if _, _, err := loadMetadataCache(fname); err != ErrMetadataDigestMismatch {
+		t.Fatalf("expected ErrMetadataDigestMismatch; got %v", err)
+	}
+}
+
+func TestTOC_RoundTrip(t *testing.T) {
+	files := testMetadataFiles()
+	tb := newTarballWriter(t, files)
+
+	toc, err := decodeTOC(encodeTOC(tb.files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toc) != len(files) {
+		t.Fatalf("len(toc) != %d; len(toc) = %d", len(files), len(toc))
+	}
+	for i, e := range toc {
+		f := tb.files[i]
+		if e.Path != f.Path || e.Offset != f.offset || e.Size != f.Size {
+			t.Fatalf("toc[%d] = %+v; expected %s at %d", i, e, f.Path, f.offset)
+		}
+	}
+
+	if _, err := decodeTOC(encodeTOC(tb.files)[:10]); err != ErrMetadataTruncated {
+		t.Fatalf("expected ErrMetadataTruncated; got %v", err)
+	}
+	// A count no data could hold is refused without allocating for it:
+	if _, err := decodeTOC([]byte{0xff, 0xff, 0xff, 0xff}); err != ErrMetadataTruncated {
+		t.Fatalf("expected ErrMetadataTruncated for a huge count; got %v", err)
+	}
+}
+
+func TestFileEntries_RoundTrip(t *testing.T) {
+	files := testMetadataFiles()
+	tb := newTarballWriter(t, files)
+	h := metadataHeader{size: tb.size, flags: 0}
+	largest := 0
+	for _, f := range tb.files {
+		if n := encodedEntrySize(f, h); n > largest {
+			largest = n
+		}
+	}
+
+	// Page through the entries one response at a time, as LookupFileEntries does:
+	entries := []FileEntry(nil)
+	for {
+		req := encodeFileEntriesRequest("", true, uint32(len(entries)))
+		_, prefix, first, err := decodeFileEntriesRequest(req)
+		if err != nil || !prefix || int(first) != len(entries) {
+			t.Fatalf("decodeFileEntriesRequest = %v, %d, %v", prefix, first, err)
+		}
+		data, err := encodeFileEntries(req, h, tb.files[len(entries):], 2+len(req)+4+8+largest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answered, got, more, err := decodeFileEntries(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(answered, req) {
+			t.Fatalf("answered %q; expected %q", answered, req)
+		}
+		entries = append(entries, got...)
+		if !more {
+			break
+		}
+	}
+	if len(entries) != len(files) {
+		t.Fatalf("len(entries) != %d; len(entries) = %d", len(files), len(entries))
+	}
+	for i, e := range entries {
+		f := tb.files[i]
+		if e.File.Path != f.Path || e.File.Size != f.Size || e.Offset != f.offset {
+			t.Fatalf("entries[%d] = %+v; expected %s at %d", i, e, f.Path, f.offset)
+		}
+	}
+
+	if _, err := encodeFileEntries(nil, h, tb.files, 8); err != ErrPathTooLong {
+		t.Fatalf("expected ErrPathTooLong; got %v", err)
+	}
+}
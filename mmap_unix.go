@@ -0,0 +1,23 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var errMmapTooLarge = errors.New("file too large to map")
+
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	// A mapping's length is an int, which cannot address every file on 32-bit platforms:
+	if int64(int(size)) != size {
+		return nil, errMmapTooLarge
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,19 @@
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errMmapUnsupported = errors.New("mmap not supported")
+
+// Memory-mapping is not implemented on Windows; readers fall back to ReadAt.
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
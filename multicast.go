@@ -2,8 +2,15 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"os"
 	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 )
 
@@ -14,37 +21,91 @@ const (
 	DataSection
 )
 
+var (
+	ErrInterfaceNotMulticast = errors.New("interface is down or does not support multicast")
+	ErrInterfaceNoIPv4       = errors.New("interface has no IPv4 address")
+	ErrNotSending            = errors.New("multicast is not set up to send this kind of message")
+)
+
+// Names the interface that cannot be used for multicast. Matches the underlying Err with errors.Is.
+type InterfaceError struct {
+	Name string
+	Err  error
+}
+
+func (e *InterfaceError) Error() string {
+	return fmt.Sprintf("interface '%s': %s", e.Name, e.Err)
+}
+
+func (e *InterfaceError) Is(target error) bool {
+	return target == e.Err
+}
+
 type UDPMessage struct {
 	Error error
 
-	Data          []byte
+	Data []byte
+	// Address of the socket the datagram was sent from, for replying to or telling apart individual senders; nil for
+	// errors:
 	SourceAddress *net.UDPAddr
 }
 
+// The socket operations a Multicast uses once a connection is set up, as provided by *net.UDPConn:
+type packetConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
 type Multicast struct {
+	// Accessed atomically since clients adopt the server's size while receive loops run; first for 64-bit alignment:
+	datagramSize int64
+
 	netInterface     *net.Interface
-	datagramSize     int
+	sendInterface    *net.Interface
 	sendControlCount int
 	recvControlCount int
 	sendDataCount    int
 	recvDataCount    int
 	ttl              int
 	loopback         bool
+	readBufferSize   int
+	dontFragment     bool
 
 	controlToServerAddr *net.UDPAddr
 	controlToClientAddr *net.UDPAddr
 	dataAddr            *net.UDPAddr
 
-	controlToServerConn *net.UDPConn
-	controlToClientConn *net.UDPConn
-	dataConn            *net.UDPConn
+	controlToServerConn packetConn
+	controlToClientConn packetConn
+	dataConn            packetConn
 
 	ControlToServer chan UDPMessage
 	ControlToClient chan UDPMessage
 	Data            chan UDPMessage
+
+	// Tests set this to simulate lossy links: received datagrams it rejects are dropped as if never received. Called
+	// from every receive loop at once:
+	receiveFilter func(data []byte) bool
+	// Tests set this to open connections to a group in-process instead of joining it with a socket; no socket options
+	// apply to them:
+	openConn func(group *net.UDPAddr) (packetConn, error)
+
+	// Closed by Close to stop receive loops that are blocked delivering a message:
+	closed    chan empty
+	closeOnce sync.Once
+	closeErr  error
+	receivers sync.WaitGroup
 }
 
 func NewMulticast(controlToServerAddr *net.UDPAddr, netInterface *net.Interface) (*Multicast, error) {
+	if netInterface != nil {
+		if _, err := interfaceIPv4(netInterface); err != nil {
+			return nil, err
+		}
+	}
+
 	// Control to-server address is port+0:
 	if controlToServerAddr.Port == 0 {
 		// Set default port if not specified:
@@ -80,140 +141,242 @@ func NewMulticast(controlToServerAddr *net.UDPAddr, netInterface *net.Interface)
 		sendControlCount:    2,
 		recvControlCount:    32,
 		sendDataCount:       64,
-		recvDataCount:       64,
+		recvDataCount:       256,
 		ttl:                 8,
 		loopback:            false,
 		controlToServerAddr: controlToServerAddr,
 		controlToClientAddr: controlToClientAddr,
 		dataAddr:            dataAddr,
+		closed:              make(chan empty),
 	}
 	return c, nil
 }
 
-func (m *Multicast) ListensControlToServer() error {
-	controlToServerConn, err := net.ListenMulticastUDP("udp", m.netInterface, m.controlToServerAddr)
+// A Multicast on another group with the same interfaces and settings, joined to nothing yet:
+func (m *Multicast) withGroup(group *net.UDPAddr) (*Multicast, error) {
+	n, err := NewMulticast(&net.UDPAddr{IP: group.IP, Port: group.Port, Zone: group.Zone}, m.netInterface)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	m.controlToServerConn = controlToServerConn
+	n.datagramSize = atomic.LoadInt64(&m.datagramSize)
+	n.sendInterface = m.sendInterface
+	n.sendControlCount = m.sendControlCount
+	n.recvControlCount = m.recvControlCount
+	n.sendDataCount = m.sendDataCount
+	n.recvDataCount = m.recvDataCount
+	n.ttl = m.ttl
+	n.loopback = m.loopback
+	n.readBufferSize = m.readBufferSize
+	n.dontFragment = m.dontFragment
+	n.receiveFilter = m.receiveFilter
+	n.openConn = m.openConn
+	return n, nil
+}
 
-	if err := m.setConnectionProperties(m.controlToServerConn); err != nil {
-		return err
-	}
-	if err := m.controlToServerConn.SetReadBuffer(m.datagramSize * m.recvControlCount); err != nil {
+func (m *Multicast) ListensControlToServer() error {
+	controlToServerConn, err := m.listen(m.controlToServerAddr, m.recvControlCount)
+	if err != nil {
 		return err
 	}
+	m.controlToServerConn = controlToServerConn
 	m.ControlToServer = make(chan UDPMessage)
+	m.receivers.Add(1)
 	go m.receiveLoop(m.controlToServerConn, m.ControlToServer)
 	return nil
 }
 
 func (m *Multicast) ListensControlToClient() error {
-	controlToClientConn, err := net.ListenMulticastUDP("udp", m.netInterface, m.controlToClientAddr)
+	controlToClientConn, err := m.listen(m.controlToClientAddr, m.recvControlCount)
 	if err != nil {
 		return err
 	}
 	m.controlToClientConn = controlToClientConn
-	if err := m.setConnectionProperties(m.controlToClientConn); err != nil {
-		return err
-	}
-	if err := m.controlToClientConn.SetReadBuffer(m.datagramSize * m.recvControlCount); err != nil {
-		return err
-	}
 	m.ControlToClient = make(chan UDPMessage)
+	m.receivers.Add(1)
 	go m.receiveLoop(m.controlToClientConn, m.ControlToClient)
 	return nil
 }
 
 func (m *Multicast) ListensData() error {
-	dataConn, err := net.ListenMulticastUDP("udp", m.netInterface, m.dataAddr)
+	dataConn, err := m.listen(m.dataAddr, m.recvDataCount)
 	if err != nil {
 		return err
 	}
-
 	m.dataConn = dataConn
-	if err := m.setConnectionProperties(m.dataConn); err != nil {
-		return err
-	}
-	if err := m.dataConn.SetReadBuffer(m.datagramSize * m.recvDataCount); err != nil {
-		return err
-	}
 	m.Data = make(chan UDPMessage)
+	m.receivers.Add(1)
 	go m.receiveLoop(m.dataConn, m.Data)
 	return nil
 }
 
 func (m *Multicast) SendsControlToServer() error {
-	controlToServerConn, err := net.ListenMulticastUDP("udp", m.netInterface, m.controlToServerAddr)
+	controlToServerConn, err := m.send(m.controlToServerAddr, m.sendControlCount, false)
 	if err != nil {
 		return err
 	}
 	m.controlToServerConn = controlToServerConn
+	return nil
+}
 
-	if err := m.setConnectionProperties(m.controlToServerConn); err != nil {
+func (m *Multicast) SendsControlToClient() error {
+	controlToClientConn, err := m.send(m.controlToClientAddr, m.sendControlCount, false)
+	if err != nil {
 		return err
 	}
-	if err := m.controlToServerConn.SetWriteBuffer(m.datagramSize * m.sendControlCount); err != nil {
+	m.controlToClientConn = controlToClientConn
+	return nil
+}
+
+func (m *Multicast) SendsData() error {
+	dataConn, err := m.send(m.dataAddr, m.sendDataCount, true)
+	if err != nil {
 		return err
 	}
-
+	m.dataConn = dataConn
 	return nil
 }
 
-func (m *Multicast) SendsControlToClient() error {
-	controlToClientConn, err := net.ListenMulticastUDP("udp", m.netInterface, m.controlToClientAddr)
+// Joins group to receive up to count messages at a time:
+func (m *Multicast) listen(group *net.UDPAddr, count int) (packetConn, error) {
+	if m.openConn != nil {
+		return m.openConn(group)
+	}
+	conn, err := m.listenMulticastUDP(group)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	m.controlToClientConn = controlToClientConn
+	if err := m.setConnectionProperties(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := m.setReadBuffer(conn, m.MaxMessageSize()*count); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
 
-	if err := m.setConnectionProperties(m.controlToClientConn); err != nil {
-		return err
+// Joins group to send up to count messages at a time; dontFragment applies SetDontFragment's setting:
+func (m *Multicast) send(group *net.UDPAddr, count int, dontFragment bool) (packetConn, error) {
+	if m.openConn != nil {
+		return m.openConn(group)
 	}
-	if err := m.controlToClientConn.SetWriteBuffer(m.datagramSize * m.sendControlCount); err != nil {
-		return err
+	conn, err := m.listenMulticastUDP(group)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.setConnectionProperties(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.SetWriteBuffer(m.MaxMessageSize() * count); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if dontFragment {
+		if err := m.setDontFragment(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
 	}
+	return conn, nil
+}
 
-	return nil
+// Leaves all groups and waits for receive loops to exit; safe to call more than once, and while other goroutines are
+// still sending, whose sends then fail. The sockets are closed but never cleared, so that senders need no lock.
+func (m *Multicast) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		for _, c := range []packetConn{m.controlToServerConn, m.controlToClientConn, m.dataConn} {
+			if c == nil {
+				continue
+			}
+			if err := c.Close(); err != nil && m.closeErr == nil {
+				m.closeErr = err
+			}
+		}
+	})
+
+	m.receivers.Wait()
+	return m.closeErr
 }
 
-func (m *Multicast) SendsData() error {
-	dataConn, err := net.ListenMulticastUDP("udp", m.netInterface, m.dataAddr)
+// Listens on the group's port with SO_REUSEADDR (and SO_REUSEPORT where available) set before bind so
+// that multiple receivers on one host can each join the group:
+func (m *Multicast) listenMulticastUDP(groupAddr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: controlReuseAddr}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", net.JoinHostPort(net.IPv4zero.String(), strconv.Itoa(groupAddr.Port)))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	conn := pc.(*net.UDPConn)
 
-	m.dataConn = dataConn
-	if err := m.setConnectionProperties(m.dataConn); err != nil {
-		return err
+	if err := m.joinGroup(conn, groupAddr.IP); err != nil {
+		conn.Close()
+		return nil, err
 	}
-	if err := m.dataConn.SetWriteBuffer(m.datagramSize * m.sendDataCount); err != nil {
+	return conn, nil
+}
+
+func controlReuseAddr(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = setReuseAddr(fd)
+	})
+	if err != nil {
 		return err
 	}
-
-	return nil
+	return serr
 }
 
-func (m *Multicast) Close() error {
-	if m.controlToServerConn != nil {
-		err := m.controlToServerConn.Close()
+func (m *Multicast) joinGroup(c *net.UDPConn, group net.IP) error {
+	mreq := &syscall.IPMreq{}
+	copy(mreq.Multiaddr[:], group.To4())
+
+	if m.netInterface != nil {
+		// Join on the interface's IPv4 address and send from it unless a send interface is set:
+		addr, err := interfaceIPv4(m.netInterface)
 		if err != nil {
 			return err
 		}
-	}
-	if m.controlToClientConn != nil {
-		err := m.controlToClientConn.Close()
-		if err != nil {
+		mreq.Interface = addr
+		if err := setSocketOptionInet4Addr(c, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, mreq.Interface); err != nil {
 			return err
 		}
 	}
-	if m.dataConn != nil {
-		err := m.dataConn.Close()
-		if err != nil {
-			return err
+
+	return setSocketOptionIPMreq(c, syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+}
+
+// First IPv4 address of an interface that is up and supports multicast:
+func interfaceIPv4(ifi *net.Interface) ([4]byte, error) {
+	addr := [4]byte{}
+	if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 {
+		return addr, &InterfaceError{Name: ifi.Name, Err: ErrInterfaceNotMulticast}
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return addr, err
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			copy(addr[:], ipnet.IP.To4())
+			return addr, nil
 		}
 	}
-	return nil
+	return addr, &InterfaceError{Name: ifi.Name, Err: ErrInterfaceNoIPv4}
+}
+
+// Pins outgoing multicast to the send interface so no other network sees it:
+func (m *Multicast) setSendInterface(c *net.UDPConn) error {
+	if m.sendInterface == nil {
+		return nil
+	}
+	addr, err := interfaceIPv4(m.sendInterface)
+	if err != nil {
+		return err
+	}
+	return setSocketOptionInet4Addr(c, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, addr)
 }
 
 func (m *Multicast) setTTL(c *net.UDPConn) error {
@@ -236,6 +399,36 @@ func (m *Multicast) setLoopback(c *net.UDPConn) error {
 	return nil
 }
 
+func (m *Multicast) setDontFragment(c *net.UDPConn) error {
+	if !m.dontFragment || ipDontFragOption == 0 {
+		return nil
+	}
+	return setSocketOptionInt(c, syscall.IPPROTO_IP, ipDontFragOption, ipDontFragValue)
+}
+
+func (m *Multicast) setReadBuffer(c *net.UDPConn, size int) error {
+	// Explicitly configured size overrides the default:
+	if m.readBufferSize > 0 {
+		size = m.readBufferSize
+	}
+	if err := c.SetReadBuffer(size); err != nil {
+		return err
+	}
+
+	// Warn if the kernel clamped the buffer size (e.g. net.core.rmem_max on linux):
+	actual, err := getSocketOptionInt(c, syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	expected, granted := size, actual
+	if runtime.GOOS == "linux" {
+		// linux doubles the requested size for bookkeeping overhead and reports the doubled value; warn in the units
+		// that were requested:
+		expected, granted = 2*size, actual/2
+	}
+	if err == nil && actual < expected {
+		fmt.Fprintf(os.Stderr, "warning: receive buffer size clamped to %d bytes; requested %d\n", granted, size)
+	}
+	return nil
+}
+
 func (m *Multicast) setConnectionProperties(c *net.UDPConn) error {
 	if err := m.setTTL(c); err != nil {
 		return err
@@ -243,11 +436,30 @@ func (m *Multicast) setConnectionProperties(c *net.UDPConn) error {
 	if err := m.setLoopback(c); err != nil {
 		return err
 	}
+	if err := m.setSendInterface(c); err != nil {
+		return err
+	}
 	return nil
 }
 
 func (m *Multicast) SetDatagramSize(datagramSize int) {
-	m.datagramSize = datagramSize
+	atomic.StoreInt64(&m.datagramSize, int64(datagramSize))
+}
+
+// Sets the receive buffer size in bytes for listening sockets; 0 restores the defaults.
+func (m *Multicast) SetReadBuffer(bytes int) {
+	m.readBufferSize = bytes
+}
+
+// Sends multicast control messages and data out of ifi only, instead of the interface groups are joined on or the
+// routing table's choice. Unicast replies still follow the routing table. Fails if ifi is down, does not support
+// multicast or has no IPv4 address.
+func (m *Multicast) SetSendInterface(ifi *net.Interface) error {
+	if _, err := interfaceIPv4(ifi); err != nil {
+		return err
+	}
+	m.sendInterface = ifi
+	return nil
 }
 
 func (m *Multicast) SetTTL(ttl int) {
@@ -258,11 +470,38 @@ func (m *Multicast) SetLoopback(enable bool) {
 	m.loopback = enable
 }
 
+// Sets the don't-fragment bit on data datagrams so that one larger than the path MTU fails to send with EMSGSIZE
+// instead of being fragmented, where losing any fragment loses the whole datagram. Set before SendsData; has no
+// effect on dragonfly, netbsd and openbsd, which have no such socket option.
+func (m *Multicast) SetDontFragment(enable bool) {
+	m.dontFragment = enable
+}
+
 func (m *Multicast) MaxMessageSize() int {
-	return m.datagramSize
+	return int(atomic.LoadInt64(&m.datagramSize))
 }
 
-func (m *Multicast) receiveLoop(conn *net.UDPConn, ch chan UDPMessage) error {
+// Address the first bound socket actually bound to, checking control to-server, control to-client, then data; nil
+// if none are bound yet.
+func (m *Multicast) LocalAddr() net.Addr {
+	for _, c := range []packetConn{m.controlToServerConn, m.controlToClientConn, m.dataConn} {
+		if c != nil {
+			return c.LocalAddr()
+		}
+	}
+	return nil
+}
+
+// Group joined for control to-server messages, after defaulting the port; control to-client and data use the
+// following two ports.
+func (m *Multicast) Group() *net.UDPAddr {
+	g := *m.controlToServerAddr
+	return &g
+}
+
+func (m *Multicast) receiveLoop(conn packetConn, ch chan UDPMessage) error {
+	defer m.receivers.Done()
+
 	// Lock receive loops to specific CPU core:
 	runtime.LockOSThread()
 
@@ -271,25 +510,57 @@ func (m *Multicast) receiveLoop(conn *net.UDPConn, ch chan UDPMessage) error {
 		buf := make([]byte, m.MaxMessageSize())
 		n, recvAddr, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			ch <- UDPMessage{Error: err}
+			select {
+			case ch <- UDPMessage{Error: err}:
+			case <-m.closed:
+			}
 			return err
 		}
-		ch <- UDPMessage{Data: buf[0:n], SourceAddress: recvAddr}
+		if m.receiveFilter != nil && !m.receiveFilter(buf[0:n]) {
+			continue
+		}
+		select {
+		case ch <- UDPMessage{Data: buf[0:n], SourceAddress: recvAddr}:
+		case <-m.closed:
+			return nil
+		}
 	}
 	return nil
 }
 
 func (m *Multicast) SendControlToServer(msg []byte) (int, error) {
+	if m.controlToServerConn == nil {
+		return 0, ErrNotSending
+	}
 	n, err := m.controlToServerConn.WriteToUDP(msg, m.controlToServerAddr)
 	return n, err
 }
 
 func (m *Multicast) SendControlToClient(msg []byte) (int, error) {
+	if m.controlToClientConn == nil {
+		return 0, ErrNotSending
+	}
 	n, err := m.controlToClientConn.WriteToUDP(msg, m.controlToClientAddr)
 	return n, err
 }
 
+// Sends a control message to just the client whose control to-server message came from addr, at its control
+// to-client port. With SO_REUSEPORT, a host running several clients delivers it to only one of them.
+func (m *Multicast) SendControlToClientAt(msg []byte, addr *net.UDPAddr) (int, error) {
+	if m.controlToClientConn == nil {
+		return 0, ErrNotSending
+	}
+	to := &net.UDPAddr{IP: addr.IP, Port: m.controlToClientAddr.Port, Zone: addr.Zone}
+	n, err := m.controlToClientConn.WriteToUDP(msg, to)
+	return n, err
+}
+
+// Sends a data message to the group. The datagram is copied to the socket before returning, so msg may be reused
+// straight away.
 func (m *Multicast) SendData(msg []byte) (int, error) {
+	if m.dataConn == nil {
+		return 0, ErrNotSending
+	}
 	n, err := m.dataConn.WriteToUDP(msg, m.dataAddr)
 	return n, err
 }
@@ -0,0 +1,415 @@
+// multicast_test.go
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newLoopbackMulticast(t *testing.T) *Multicast {
+	m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 177), Port: 13760}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetLoopback(true)
+	m.SetTTL(0)
+	return m
+}
+
+// Carries datagrams between Multicasts in-process as loopback multicast would, so that transfers run without network
+// access. Each attached Multicast is a host with its own address: datagrams sent to a group reach every connection on
+// its port, those sent to a host only that host's. A full queue drops datagrams as a full receive buffer does.
+type memoryNetwork struct {
+	lock  sync.Mutex
+	hosts int
+	conns map[int][]*memoryConn
+}
+
+func newMemoryNetwork() *memoryNetwork {
+	return &memoryNetwork{conns: make(map[int][]*memoryConn)}
+}
+
+// A Multicast on group whose connections are opened on the network instead of with sockets:
+func (n *memoryNetwork) newMulticast(t *testing.T, group *net.UDPAddr) *Multicast {
+	m, err := NewMulticast(&net.UDPAddr{IP: group.IP, Port: group.Port}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.lock.Lock()
+	n.hosts++
+	host := net.IPv4(127, 1, byte(n.hosts>>8), byte(n.hosts))
+	n.lock.Unlock()
+	m.openConn = func(group *net.UDPAddr) (packetConn, error) {
+		return n.open(&net.UDPAddr{IP: host, Port: group.Port}), nil
+	}
+	return m
+}
+
+func (n *memoryNetwork) open(addr *net.UDPAddr) *memoryConn {
+	c := &memoryConn{n: n, addr: addr, queue: make(chan UDPMessage, 256), closed: make(chan empty)}
+	n.lock.Lock()
+	n.conns[addr.Port] = append(n.conns[addr.Port], c)
+	n.lock.Unlock()
+	return c
+}
+
+func (n *memoryNetwork) deliver(from *net.UDPAddr, to *net.UDPAddr, data []byte) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, c := range n.conns[to.Port] {
+		if !to.IP.IsMulticast() && !to.IP.Equal(c.addr.IP) {
+			continue
+		}
+		select {
+		case c.queue <- UDPMessage{Data: append([]byte(nil), data...), SourceAddress: from}:
+		default:
+		}
+	}
+}
+
+func (n *memoryNetwork) remove(c *memoryConn) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	conns := n.conns[c.addr.Port]
+	for i := range conns {
+		if conns[i] == c {
+			n.conns[c.addr.Port] = append(conns[:i:i], conns[i+1:]...)
+			return
+		}
+	}
+}
+
+type memoryConn struct {
+	n         *memoryNetwork
+	addr      *net.UDPAddr
+	queue     chan UDPMessage
+	closed    chan empty
+	closeOnce sync.Once
+}
+
+func (c *memoryConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case msg := <-c.queue:
+		// Truncated to the buffer as a datagram would be:
+		return copy(b, msg.Data), msg.SourceAddress, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *memoryConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.n.deliver(c.addr, addr, b)
+	return len(b), nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *memoryConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.n.remove(c)
+	})
+	return nil
+}
+
+func TestMulticast_MemoryNetwork(t *testing.T) {
+	n := newMemoryNetwork()
+	group := &net.UDPAddr{IP: net.IPv4(239, 0, 0, 194), Port: 13940}
+	server, client, other := n.newMulticast(t, group), n.newMulticast(t, group), n.newMulticast(t, group)
+	for _, m := range []*Multicast{server, client, other} {
+		defer m.Close()
+	}
+	if err := server.ListensControlToServer(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SendsControlToClient(); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []*Multicast{client, other} {
+		if err := m.SendsControlToServer(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.ListensControlToClient(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Group messages reach every listener:
+	if _, err := client.SendControlToServer([]byte("ask")); err != nil {
+		t.Fatal(err)
+	}
+	ask := <-server.ControlToServer
+	if string(ask.Data) != "ask" || !ask.SourceAddress.IP.Equal(client.LocalAddr().(*net.UDPAddr).IP) {
+		t.Fatalf("unexpected %q from %v", ask.Data, ask.SourceAddress)
+	}
+	if _, err := server.SendControlToClient([]byte("all")); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []*Multicast{client, other} {
+		if msg := <-m.ControlToClient; string(msg.Data) != "all" {
+			t.Fatalf("unexpected %q", msg.Data)
+		}
+	}
+
+	// Replies to a host reach only that host:
+	if _, err := server.SendControlToClientAt([]byte("you"), ask.SourceAddress); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-client.ControlToClient; string(msg.Data) != "you" {
+		t.Fatalf("unexpected %q", msg.Data)
+	}
+	select {
+	case msg := <-other.ControlToClient:
+		t.Fatalf("reply for another host received: %q", msg.Data)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Sends fail once closed, as on a closed socket:
+	client.Close()
+	if _, err := client.SendControlToServer([]byte("late")); err == nil {
+		t.Fatal("expected send on a closed connection to fail")
+	}
+}
+
+func TestMulticast_MultipleLocalReceivers(t *testing.T) {
+	receivers := []*Multicast{newLoopbackMulticast(t), newLoopbackMulticast(t)}
+	for _, r := range receivers {
+		// Both receivers must be able to bind the same group and port:
+		if err := r.ListensData(); err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+	}
+
+	sender := newLoopbackMulticast(t)
+	if err := sender.SendsData(); err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	msg := []byte("hello, receivers!")
+	if _, err := sender.SendData(msg); err != nil {
+		t.Skipf("multicast send unavailable: %v", err)
+	}
+
+	for i, r := range receivers {
+		select {
+		case recv := <-r.Data:
+			if recv.Error != nil {
+				t.Fatal(recv.Error)
+			}
+			if !bytes.Equal(recv.Data, msg) {
+				t.Fatalf("receiver %d got %q; expected %q", i, recv.Data, msg)
+			}
+		case <-time.After(2 * time.Second):
+			t.Skipf("receiver %d got no message; multicast loopback unavailable", i)
+		}
+	}
+}
+
+func TestMulticast_Addresses(t *testing.T) {
+	m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 177)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := m.Group(); !g.IP.Equal(net.IPv4(239, 0, 0, 177)) || g.Port != 1360 {
+		t.Fatalf("Group() = %v; expected 239.0.0.177:1360", g)
+	}
+	if m.LocalAddr() != nil {
+		t.Fatal("expected no local address before binding")
+	}
+
+	m = newLoopbackMulticast(t)
+	defer m.Close()
+	if err := m.ListensData(); err != nil {
+		t.Fatal(err)
+	}
+	addr, ok := m.LocalAddr().(*net.UDPAddr)
+	if !ok || addr.Port != 13762 {
+		t.Fatalf("LocalAddr() = %v; expected data port 13762", m.LocalAddr())
+	}
+}
+
+func TestMulticast_SendInterface(t *testing.T) {
+	m := newLoopbackMulticast(t)
+	defer m.Close()
+
+	down := &net.Interface{Name: "down0", Flags: net.FlagMulticast}
+	if err := m.SetSendInterface(down); !errors.Is(err, ErrInterfaceNotMulticast) {
+		t.Fatalf("expected ErrInterfaceNotMulticast; got %v", err)
+	}
+	if _, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 177), Port: 13760}, down); !errors.Is(err, ErrInterfaceNotMulticast) {
+		t.Fatalf("expected NewMulticast to reject the interface; got %v", err)
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range interfaces {
+		ifi := &interfaces[i]
+		if _, err := interfaceIPv4(ifi); err != nil {
+			continue
+		}
+		if err := m.SetSendInterface(ifi); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.SendsData(); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	t.Skip("no multicast interface with an IPv4 address")
+}
+
+func TestMulticast_DontFragment(t *testing.T) {
+	if ipDontFragOption == 0 {
+		t.Skip("no don't-fragment socket option on this platform")
+	}
+	m := newLoopbackMulticast(t)
+	defer m.Close()
+	m.SetDontFragment(true)
+	if err := m.SendsData(); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := getSocketOptionInt(m.dataConn.(*net.UDPConn), syscall.IPPROTO_IP, ipDontFragOption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != ipDontFragValue {
+		t.Fatalf("don't-fragment option = %d; expected %d", value, ipDontFragValue)
+	}
+}
+
+func TestMulticast_SourceAddress(t *testing.T) {
+	newMulticast := func() *Multicast {
+		m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 190), Port: 13900}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.SetLoopback(true)
+		m.SetTTL(0)
+		return m
+	}
+
+	// Every receive path reports where each datagram came from:
+	paths := []struct {
+		name   string
+		listen func(m *Multicast) error
+		recv   func(m *Multicast) chan UDPMessage
+		send   func(m *Multicast, msg []byte) (packetConn, error)
+	}{
+		{
+			"control to server",
+			(*Multicast).ListensControlToServer,
+			func(m *Multicast) chan UDPMessage { return m.ControlToServer },
+			func(m *Multicast, msg []byte) (packetConn, error) {
+				if err := m.SendsControlToServer(); err != nil {
+					return nil, err
+				}
+				_, err := m.SendControlToServer(msg)
+				return m.controlToServerConn, err
+			},
+		},
+		{
+			"control to client",
+			(*Multicast).ListensControlToClient,
+			func(m *Multicast) chan UDPMessage { return m.ControlToClient },
+			func(m *Multicast, msg []byte) (packetConn, error) {
+				if err := m.SendsControlToClient(); err != nil {
+					return nil, err
+				}
+				_, err := m.SendControlToClient(msg)
+				return m.controlToClientConn, err
+			},
+		},
+		{
+			"data",
+			(*Multicast).ListensData,
+			func(m *Multicast) chan UDPMessage { return m.Data },
+			func(m *Multicast, msg []byte) (packetConn, error) {
+				if err := m.SendsData(); err != nil {
+					return nil, err
+				}
+				_, err := m.SendData(msg)
+				return m.dataConn, err
+			},
+		},
+	}
+	for _, p := range paths {
+		receiver := newMulticast()
+		defer receiver.Close()
+		if err := p.listen(receiver); err != nil {
+			t.Fatal(err)
+		}
+
+		sender := newMulticast()
+		defer sender.Close()
+		conn, err := p.send(sender, []byte("where from?"))
+		if err != nil {
+			t.Skipf("%s: multicast send unavailable: %v", p.name, err)
+		}
+
+		select {
+		case recv := <-p.recv(receiver):
+			if recv.Error != nil {
+				t.Fatal(recv.Error)
+			}
+			from := conn.LocalAddr().(*net.UDPAddr)
+			if recv.SourceAddress == nil || recv.SourceAddress.IP == nil || recv.SourceAddress.Port != from.Port {
+				t.Fatalf("%s: source address %v; expected port %d", p.name, recv.SourceAddress, from.Port)
+			}
+		case <-time.After(2 * time.Second):
+			t.Skipf("%s: no message; multicast loopback unavailable", p.name)
+		}
+	}
+}
+
+func TestMulticast_CloseWhileSending(t *testing.T) {
+	m := newLoopbackMulticast(t)
+	if err := m.SendsData(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ListensData(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A sender keeps going, as the server's data loop does, while Close runs; run with -race:
+	stopped := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := m.SendData([]byte("mid-transfer")); err != nil {
+				stopped <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	select {
+	case err := <-stopped:
+		if err == ErrNotSending {
+			t.Fatal("expected the send to fail on the closed socket")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("sends did not fail once closed")
+	}
+}
@@ -24,6 +24,69 @@ func setSocketOptionInt(conn *net.UDPConn, level, option, value int) error {
 	return serr
 }
 
+func getSocketOptionInt(conn *net.UDPConn, level, option int) (int, error) {
+	sysConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var value int
+	var serr error
+	err = sysConn.Control(func(fd uintptr) {
+		value, serr = syscall.GetsockoptInt(int(fd), level, option)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return value, serr
+}
+
+func setSocketOptionInet4Addr(conn *net.UDPConn, level, option int, value [4]byte) error {
+	sysConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = sysConn.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInet4Addr(int(fd), level, option, value)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func setSocketOptionIPMreq(conn *net.UDPConn, level, option int, mreq *syscall.IPMreq) error {
+	sysConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = sysConn.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptIPMreq(int(fd), level, option, mreq)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func setReuseAddr(fd uintptr) error {
+	err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	if err != nil {
+		return err
+	}
+	if soReusePort != 0 {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func isENOBUFS(err error) bool {
 	if err == nil {
 		return false
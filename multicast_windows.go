@@ -5,6 +5,7 @@ package main
 import (
 	"net"
 	"syscall"
+	"unsafe"
 )
 
 func setSocketOptionInt(conn *net.UDPConn, level, option, value int) error {
@@ -23,6 +24,61 @@ func setSocketOptionInt(conn *net.UDPConn, level, option, value int) error {
 	return serr
 }
 
+func getSocketOptionInt(conn *net.UDPConn, level, option int) (int, error) {
+	sysConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var value int32
+	var serr error
+	err = sysConn.Control(func(fd uintptr) {
+		l := int32(unsafe.Sizeof(value))
+		serr = syscall.Getsockopt(syscall.Handle(fd), int32(level), int32(option), (*byte)(unsafe.Pointer(&value)), &l)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(value), serr
+}
+
+func setSocketOptionInet4Addr(conn *net.UDPConn, level, option int, value [4]byte) error {
+	sysConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = sysConn.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInet4Addr(syscall.Handle(fd), level, option, value)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func setSocketOptionIPMreq(conn *net.UDPConn, level, option int, mreq *syscall.IPMreq) error {
+	sysConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = sysConn.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptIPMreq(syscall.Handle(fd), level, option, mreq)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func setReuseAddr(fd uintptr) error {
+	// Windows has no SO_REUSEPORT; SO_REUSEADDR alone allows multiple receivers:
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+}
+
 func isENOBUFS(err error) bool {
 	if err == nil {
 		return false
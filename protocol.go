@@ -6,26 +6,55 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"math"
+	"net"
 	"time"
 )
 
-const protocolVersion = 1
+const protocolVersion = 4
 const hashSize = 8
-const protocolControlPrefixSize = 1 + hashSize + 1
-const protocolDataMsgPrefixSize = 1 + hashSize + 8
+const protocolControlPrefixSize = 1 + 1 + hashSize + 1
+const protocolDataMsgPrefixSize = 1 + 1 + hashSize + 8
 
-const metadataSectionMsgSize = 2
-const metadataHeaderMsgSize = 2
+// Largest possible UDP payload:
+const maxDatagramSize = 65535
+
+// Message types following the protocol version byte, so datagrams arriving on the wrong channel are ignored:
+const (
+	controlToClientMessageType = byte(iota + 1)
+	controlToServerMessageType
+	dataMessageType
+)
+
+// Metadata and TOC sections are prefixed with their uint16 index and the CRC-32 of the index and section data:
+const metadataSectionMsgSize = 2 + 4
+
+// Section count, then the server's data region size and metadata section size:
+const sectionCountMsgSize = 2
+const metadataHeaderMsgSize = sectionCountMsgSize + 2 + 2
 
 //const bufferFullTimeoutMilli = 50
 
+// NAK list encodings for AckDataSection messages:
+const (
+	nakEncodingRanges = byte(iota)
+	nakEncodingBitmap
+)
+
 var resendTimeout = 250 * time.Millisecond
 
 var (
 	ErrMessageTooShort      = errors.New("message too short")
 	ErrWrongProtocolVersion = errors.New("wrong protocol version")
+	ErrWrongMessageType     = errors.New("wrong message type")
 	ErrAckOutOfRange        = errors.New("ack out of range")
+	ErrUnknownNakEncoding   = errors.New("unknown nak encoding")
+	ErrBadNak               = errors.New("bad nak region")
+	ErrBadNakState          = errors.New("bad serialized nak state")
+	ErrBadAnnouncement      = errors.New("announcement is not a whole number of HashIds")
+	ErrBadRedirect          = errors.New("bad data redirect")
+	ErrSectionChecksum      = errors.New("section checksum mismatch")
 )
 
 var byteOrder = binary.LittleEndian
@@ -39,11 +68,34 @@ const (
 	RespondMetadataHeader
 	RespondMetadataSection
 	DeliverDataSection
+	RespondManifestDigest
+	RespondTOCHeader
+	RespondTOCSection
 
 	// To-Server control messages:
 	RequestMetadataHeader = ControlToServerOp(iota)
 	RequestMetadataSection
 	AckDataSection
+	RequestManifestDigest
+	RequestTOCHeader
+	RequestTOCSection
+	RequestAnnounce
+)
+
+// To-Client, numbered after the to-server messages so that earlier values are unchanged:
+const (
+	// Several HashIds in one message; see encodeAnnounceTarballs:
+	AnnounceTarballs = ControlToClientOp(RequestAnnounce + 1 + iota)
+	// Data is served from another group; see encodeRedirectData:
+	RedirectData
+	// Metadata entries answering RequestFileEntries; see encodeFileEntries:
+	RespondFileEntries
+)
+
+// To-Server, numbered after the to-client messages above:
+const (
+	// Asks for the metadata entries of one path or of every path with a prefix; see encodeFileEntriesRequest:
+	RequestFileEntries = ControlToServerOp(RespondFileEntries + 1 + iota)
 )
 
 func compareHashes(a []byte, b []byte) int {
@@ -61,6 +113,10 @@ type NakRegions struct {
 }
 
 func NewNakRegions(size int64) *NakRegions {
+	if size <= 0 {
+		// Nothing to receive, e.g. a tarball of only empty files without padding:
+		return &NakRegions{naks: []Region{}, size: size}
+	}
 	return &NakRegions{naks: []Region{{start: 0, endEx: size}}, size: size}
 }
 
@@ -86,12 +142,103 @@ func (r *NakRegions) Acks() []Region {
 	return o
 }
 
+// Serializes size and NAKed regions as uvarints:
+func (r *NakRegions) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, (2+2*len(r.naks))*binary.MaxVarintLen64)
+	var tmp [binary.MaxVarintLen64]byte
+	put := func(v int64) {
+		n := binary.PutUvarint(tmp[:], uint64(v))
+		buf = append(buf, tmp[:n]...)
+	}
+
+	put(r.size)
+	put(int64(len(r.naks)))
+	for _, k := range r.naks {
+		put(k.start)
+		put(k.endEx)
+	}
+	return buf, nil
+}
+
+func (r *NakRegions) UnmarshalBinary(data []byte) error {
+	i := 0
+	get := func() (int64, error) {
+		v, n := binary.Uvarint(data[i:])
+		if n <= 0 {
+			return 0, ErrBadNakState
+		}
+		i += n
+		return int64(v), nil
+	}
+
+	size, err := get()
+	if err != nil {
+		return err
+	}
+	count, err := get()
+	if err != nil {
+		return err
+	}
+	// Each region takes at least two bytes, so a count beyond that is corrupt rather than something to allocate:
+	if count < 0 || count > int64(len(data)-i)/2 {
+		return ErrBadNakState
+	}
+	naks := make([]Region, 0, count)
+	last := int64(0)
+	for n := int64(0); n < count; n++ {
+		var k Region
+		if k.start, err = get(); err != nil {
+			return err
+		}
+		if k.endEx, err = get(); err != nil {
+			return err
+		}
+		// Regions must be ordered, non-overlapping and in range:
+		if k.start < last || k.endEx < k.start || k.endEx > size {
+			return ErrBadNakState
+		}
+		last = k.endEx
+		naks = append(naks, k)
+	}
+
+	r.size = size
+	r.naks = naks
+	return nil
+}
+
+// Total bytes not yet ACKed:
+func (r *NakRegions) NakedBytes() int64 {
+	n := int64(0)
+	for _, k := range r.naks {
+		n += k.endEx - k.start
+	}
+	return n
+}
+
+// Bytes not yet ACKed within [start, endEx):
+func (r *NakRegions) NakedBytesWithin(start int64, endEx int64) int64 {
+	n := int64(0)
+	for _, k := range r.naks {
+		if k.start < endEx && start < k.endEx {
+			if k.start < start {
+				k.start = start
+			}
+			if k.endEx > endEx {
+				k.endEx = endEx
+			}
+			n += k.endEx - k.start
+		}
+	}
+	return n
+}
+
 func (r *NakRegions) Len() int {
 	return len(r.naks)
 }
 
 func (r *NakRegions) NakAll() {
-	r.naks = []Region{{start: 0, endEx: r.size}}
+	// Like NewNakRegions, an empty tarball has nothing to NAK:
+	r.naks = NewNakRegions(r.size).naks
 }
 
 func (r *NakRegions) IsAllAcked() bool {
@@ -128,6 +275,16 @@ func (r *NakRegions) NextNakRegion(p int64) int64 {
 	return -1
 }
 
+// Whether no part of [start, endEx) is NAKed; IsAcked instead only checks for a single NAK containing the whole range:
+func (r *NakRegions) IsFullyAcked(start int64, endEx int64) bool {
+	for _, k := range r.naks {
+		if k.start < endEx && start < k.endEx {
+			return false
+		}
+	}
+	return true
+}
+
 func (r *NakRegions) IsAcked(start int64, endEx int64) bool {
 	for _, k := range r.naks {
 		if start >= k.start && endEx <= k.endEx {
@@ -369,35 +526,221 @@ func (r *NakRegions) ASCIIMeterPosition(nakMeterLen int, pos int64) string {
 
 }
 
+// Encodes the last ACKed region followed by as many NAKed regions as fit in max bytes. NAKs are encoded either as
+// a list of [start, endEx) pairs or as a bitmap over fixed-size units, whichever is smaller.
+func encodeAckDataSection(ack Region, naks []Region, max int) []byte {
+	buf := make([]byte, max)
+	i := 1
+	i += binary.PutUvarint(buf[i:], uint64(ack.start))
+	i += binary.PutUvarint(buf[i:], uint64(ack.endEx))
+
+	ranges, complete := appendNakRanges(nil, naks, max-i)
+	if bitmap := appendNakBitmap(nil, naks, max-i); bitmap != nil {
+		if !complete || len(bitmap) < len(ranges) {
+			buf[0] = nakEncodingBitmap
+			i += copy(buf[i:], bitmap)
+			return buf[:i]
+		}
+	}
+
+	buf[0] = nakEncodingRanges
+	i += copy(buf[i:], ranges)
+	return buf[:i]
+}
+
+func decodeAckDataSection(data []byte) (ack Region, naks []Region, err error) {
+	if len(data) < 1 {
+		err = ErrMessageTooShort
+		return
+	}
+	encoding := data[0]
+	i := 1
+	if ack, i, err = readRegion(data, i); err != nil {
+		return
+	}
+
+	switch encoding {
+	case nakEncodingRanges:
+		naks, err = decodeNakRanges(data[i:])
+	case nakEncodingBitmap:
+		naks, err = decodeNakBitmap(data[i:])
+	default:
+		err = ErrUnknownNakEncoding
+	}
+	return
+}
+
+// Appends as many NAK ranges as fit in max bytes; reports whether all were appended.
+func appendNakRanges(o []byte, naks []Region, max int) ([]byte, bool) {
+	var tmp [2 * binary.MaxVarintLen64]byte
+	for _, k := range naks {
+		n := binary.PutUvarint(tmp[:], uint64(k.start))
+		n += binary.PutUvarint(tmp[n:], uint64(k.endEx))
+		if len(o)+n > max {
+			return o, false
+		}
+		o = append(o, tmp[:n]...)
+	}
+	return o, true
+}
+
+func decodeNakRanges(data []byte) ([]Region, error) {
+	naks := make([]Region, 0)
+	i := 0
+	for i < len(data) {
+		var nak Region
+		var err error
+		if nak, i, err = readRegion(data, i); err != nil {
+			return nil, err
+		}
+		if nak.start < 0 || nak.endEx < nak.start {
+			return nil, ErrBadNak
+		}
+		naks = append(naks, nak)
+	}
+	return naks, nil
+}
+
+// Bitmaps are encoded as uvarints (base, unit, endEx, bitCount) followed by the bits, LSB first, where bit n set
+// means [base + n*unit, base + (n+1)*unit) is NAKed, clipped to endEx. unit is chosen so the bitmap exactly
+// represents the NAK list. Returns nil if there are no NAKs or the bitmap would exceed max bytes.
+func appendNakBitmap(o []byte, naks []Region, max int) []byte {
+	if len(naks) == 0 {
+		return nil
+	}
+
+	base := naks[0].start
+	endEx := naks[len(naks)-1].endEx
+
+	// Find the largest unit that all region boundaries (except the final clipped one) are aligned to:
+	unit := int64(0)
+	for i, k := range naks {
+		unit = gcd(unit, k.start-base)
+		if i < len(naks)-1 {
+			unit = gcd(unit, k.endEx-base)
+		}
+	}
+	if unit == 0 {
+		unit = endEx - base
+	}
+
+	bitCount := (endEx - base + unit - 1) / unit
+	if (bitCount+7)/8 > int64(max) {
+		return nil
+	}
+	bits := make([]byte, (bitCount+7)/8)
+	for _, k := range naks {
+		for n := (k.start - base) / unit; n*unit+base < k.endEx; n++ {
+			bits[n/8] |= 1 << uint(n%8)
+		}
+	}
+
+	var tmp [binary.MaxVarintLen64]byte
+	for _, v := range []int64{base, unit, endEx, bitCount} {
+		n := binary.PutUvarint(tmp[:], uint64(v))
+		o = append(o, tmp[:n]...)
+	}
+	o = append(o, bits...)
+	if len(o) > max {
+		return nil
+	}
+	return o
+}
+
+func decodeNakBitmap(data []byte) ([]Region, error) {
+	var v [4]int64
+	i := 0
+	for j := range v {
+		u, n := binary.Uvarint(data[i:])
+		if n <= 0 {
+			return nil, ErrMessageTooShort
+		}
+		v[j] = int64(u)
+		i += n
+	}
+	base, unit, endEx, bitCount := v[0], v[1], v[2], v[3]
+	bits := data[i:]
+	if bitCount < 0 || bitCount > int64(len(bits))*8 {
+		return nil, ErrMessageTooShort
+	}
+	// Every bit must start inside [base, endEx), which also keeps base + n*unit from overflowing:
+	if unit <= 0 || base < 0 || endEx < base || (bitCount > 0 && (bitCount-1) > (endEx-base-1)/unit) {
+		return nil, ErrBadNak
+	}
+
+	naks := make([]Region, 0)
+	for n := int64(0); n < bitCount; n++ {
+		if bits[n/8]&(1<<uint(n%8)) == 0 {
+			continue
+		}
+		k := Region{start: base + n*unit, endEx: base + (n+1)*unit}
+		if k.endEx > endEx {
+			k.endEx = endEx
+		}
+		// Merge with adjacent NAK:
+		if l := len(naks) - 1; l >= 0 && naks[l].endEx == k.start {
+			naks[l].endEx = k.endEx
+			continue
+		}
+		naks = append(naks, k)
+	}
+	return naks, nil
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+func readRegion(data []byte, i int) (Region, int, error) {
+	start, n := binary.Uvarint(data[i:])
+	if n <= 0 {
+		return Region{}, i, ErrMessageTooShort
+	}
+	i += n
+	endEx, n := binary.Uvarint(data[i:])
+	if n <= 0 {
+		return Region{}, i, ErrMessageTooShort
+	}
+	i += n
+	return Region{int64(start), int64(endEx)}, i, nil
+}
+
 func controlToClientMessage(hashId []byte, op ControlToClientOp, data []byte) []byte {
-	msg := make([]byte, 0, protocolControlPrefixSize+len(data))
-	msg = append(msg, protocolVersion)
-	msg = append(msg, hashId[:hashSize]...)
-	msg = append(msg, byte(op))
-	msg = append(msg, data...)
-	return msg
+	return controlMessage(controlToClientMessageType, hashId, byte(op), data)
 }
 
 func controlToServerMessage(hashId []byte, op ControlToServerOp, data []byte) []byte {
+	return controlMessage(controlToServerMessageType, hashId, byte(op), data)
+}
+
+func controlMessage(msgType byte, hashId []byte, op byte, data []byte) []byte {
 	msg := make([]byte, 0, protocolControlPrefixSize+len(data))
 	msg = append(msg, protocolVersion)
+	msg = append(msg, msgType)
 	msg = append(msg, hashId[:hashSize]...)
-	msg = append(msg, byte(op))
+	msg = append(msg, op)
 	msg = append(msg, data...)
 	return msg
 }
 
-func dataMessage(hashId []byte, region int64, data []byte) []byte {
-	msg := make([]byte, 0, protocolDataMsgPrefixSize+len(data))
-	buf := bytes.NewBuffer(msg)
-	buf.WriteByte(protocolVersion)
-	buf.Write(hashId[:hashSize])
-	binary.Write(buf, byteOrder, region)
-	buf.Write(data)
-	return buf.Bytes()
+// Writes the prefix of a data message for region into the first protocolDataMsgPrefixSize bytes of msg, so that the
+// region's data can be read straight into the rest:
+func putDataMessagePrefix(msg []byte, hashId []byte, region int64) {
+	msg[0] = protocolVersion
+	msg[1] = dataMessageType
+	copy(msg[2:2+hashSize], hashId[:hashSize])
+	byteOrder.PutUint64(msg[2+hashSize:protocolDataMsgPrefixSize], uint64(region))
+}
+
+// Reports whether err means a datagram was malformed or not meant for this channel and should be dropped:
+func isMalformed(err error) bool {
+	return err == ErrMessageTooShort || err == ErrWrongProtocolVersion || err == ErrWrongMessageType
 }
 
-func extractControlMessage(ctrl UDPMessage) (hashId []byte, op byte, data []byte, err error) {
+func extractControlMessage(ctrl UDPMessage, msgType byte) (hashId []byte, op byte, data []byte, err error) {
 	if len(ctrl.Data) < protocolControlPrefixSize {
 		err = ErrMessageTooShort
 		return
@@ -407,9 +750,13 @@ func extractControlMessage(ctrl UDPMessage) (hashId []byte, op byte, data []byte
 		err = ErrWrongProtocolVersion
 		return
 	}
+	if ctrl.Data[1] != msgType {
+		err = ErrWrongMessageType
+		return
+	}
 
-	hashId = ctrl.Data[1 : 1+hashSize]
-	op = ctrl.Data[1+hashSize]
+	hashId = ctrl.Data[2 : 2+hashSize]
+	op = ctrl.Data[2+hashSize]
 	data = ctrl.Data[protocolControlPrefixSize:]
 
 	return
@@ -417,14 +764,14 @@ func extractControlMessage(ctrl UDPMessage) (hashId []byte, op byte, data []byte
 
 func extractClientMessage(ctrl UDPMessage) (hashId []byte, op ControlToClientOp, data []byte, err error) {
 	var opByte byte
-	hashId, opByte, data, err = extractControlMessage(ctrl)
+	hashId, opByte, data, err = extractControlMessage(ctrl, controlToClientMessageType)
 	op = ControlToClientOp(opByte)
 	return
 }
 
 func extractServerMessage(ctrl UDPMessage) (hashId []byte, op ControlToServerOp, data []byte, err error) {
 	var opByte byte
-	hashId, opByte, data, err = extractControlMessage(ctrl)
+	hashId, opByte, data, err = extractControlMessage(ctrl, controlToServerMessageType)
 	op = ControlToServerOp(opByte)
 	return
 }
@@ -439,10 +786,146 @@ func extractDataMessage(ctrl UDPMessage) (hashId []byte, region int64, data []by
 		err = ErrWrongProtocolVersion
 		return
 	}
+	if ctrl.Data[1] != dataMessageType {
+		err = ErrWrongMessageType
+		return
+	}
 
-	hashId = ctrl.Data[1 : 1+hashSize]
-	region = int64(byteOrder.Uint64(ctrl.Data[1+hashSize : protocolDataMsgPrefixSize]))
+	hashId = ctrl.Data[2 : 2+hashSize]
+	region = int64(byteOrder.Uint64(ctrl.Data[2+hashSize : protocolDataMsgPrefixSize]))
 	data = ctrl.Data[protocolDataMsgPrefixSize:]
 
 	return
 }
+
+// Optional body of AnnounceTarball so clients can describe a transfer without fetching its metadata:
+type AnnounceSummary struct {
+	Size           int64
+	FileCount      uint32
+	MetadataDigest []byte
+}
+
+const announceSummarySize = 8 + 4 + metadataDigestSize
+
+func encodeAnnounceSummary(a AnnounceSummary) []byte {
+	data := make([]byte, announceSummarySize)
+	byteOrder.PutUint64(data[0:8], uint64(a.Size))
+	byteOrder.PutUint32(data[8:12], a.FileCount)
+	copy(data[12:], a.MetadataDigest)
+	return data
+}
+
+// Returns nil for a bare announcement without a summary:
+func decodeAnnounceSummary(data []byte) (*AnnounceSummary, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if len(data) < announceSummarySize {
+		return nil, ErrMessageTooShort
+	}
+	return &AnnounceSummary{
+		Size:           int64(byteOrder.Uint64(data[0:8])),
+		FileCount:      byteOrder.Uint32(data[8:12]),
+		MetadataDigest: append([]byte(nil), data[12:announceSummarySize]...),
+	}, nil
+}
+
+// Packs HashIds into as few AnnounceTarballs messages of at most maxMessageSize bytes as possible. Each message
+// carries a zero HashId in its prefix followed by its HashIds back to back.
+func encodeAnnounceTarballs(hashIds [][]byte, maxMessageSize int) [][]byte {
+	perMessage := (maxMessageSize - protocolControlPrefixSize) / hashSize
+	if perMessage < 1 {
+		perMessage = 1
+	}
+
+	msgs := make([][]byte, 0, (len(hashIds)+perMessage-1)/perMessage)
+	for len(hashIds) > 0 {
+		n := perMessage
+		if n > len(hashIds) {
+			n = len(hashIds)
+		}
+		data := make([]byte, 0, n*hashSize)
+		for _, hashId := range hashIds[:n] {
+			data = append(data, hashId[:hashSize]...)
+		}
+		msgs = append(msgs, controlToClientMessage(make([]byte, hashSize), AnnounceTarballs, data))
+		hashIds = hashIds[n:]
+	}
+	return msgs
+}
+
+func decodeAnnounceTarballs(data []byte) ([][]byte, error) {
+	if len(data) == 0 || len(data)%hashSize != 0 {
+		return nil, ErrBadAnnouncement
+	}
+	hashIds := make([][]byte, 0, len(data)/hashSize)
+	for i := 0; i < len(data); i += hashSize {
+		hashIds = append(hashIds, append([]byte(nil), data[i:i+hashSize]...))
+	}
+	return hashIds, nil
+}
+
+// Prefixes a metadata or TOC section with its index and checksum:
+func encodeSection(index uint16, section []byte) []byte {
+	msg := make([]byte, metadataSectionMsgSize, metadataSectionMsgSize+len(section))
+	byteOrder.PutUint16(msg[0:2], index)
+	msg = append(msg, section...)
+	byteOrder.PutUint32(msg[2:6], sectionChecksum(msg))
+	return msg
+}
+
+// Returns the index and data of a section message, or ErrSectionChecksum if it was corrupted in transit. The data
+// aliases msg.
+func decodeSection(msg []byte) (uint16, []byte, error) {
+	if len(msg) < metadataSectionMsgSize {
+		return 0, nil, ErrMessageTooShort
+	}
+	if byteOrder.Uint32(msg[2:6]) != sectionChecksum(msg) {
+		return 0, nil, ErrSectionChecksum
+	}
+	return byteOrder.Uint16(msg[0:2]), msg[metadataSectionMsgSize:], nil
+}
+
+// CRC-32 of a section message's index and data, skipping the checksum field itself:
+func sectionChecksum(msg []byte) uint32 {
+	crc := crc32.ChecksumIEEE(msg[0:2])
+	return crc32.Update(crc, crc32.IEEETable, msg[metadataSectionMsgSize:])
+}
+
+// RedirectData messages carry the port as a uint16 followed by the 4-byte IPv4 group address:
+func encodeRedirectData(group *net.UDPAddr) []byte {
+	data := make([]byte, 2+net.IPv4len)
+	byteOrder.PutUint16(data[0:2], uint16(group.Port))
+	copy(data[2:], group.IP.To4())
+	return data
+}
+
+func decodeRedirectData(data []byte) (*net.UDPAddr, error) {
+	if len(data) < 2+net.IPv4len {
+		return nil, ErrMessageTooShort
+	}
+	group := &net.UDPAddr{
+		IP:   net.IP(append([]byte(nil), data[2:2+net.IPv4len]...)),
+		Port: int(byteOrder.Uint16(data[0:2])),
+	}
+	if group.Port == 0 || !group.IP.IsMulticast() {
+		return nil, ErrBadRedirect
+	}
+	return group, nil
+}
+
+// Returns the HashIds a control-to-client message announces, whether as a single AnnounceTarball or a packed
+// AnnounceTarballs; nil for other messages.
+func AnnouncedHashIds(msg UDPMessage) ([][]byte, error) {
+	hashId, op, data, err := extractClientMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case AnnounceTarball:
+		return [][]byte{append([]byte(nil), hashId...)}, nil
+	case AnnounceTarballs:
+		return decodeAnnounceTarballs(data)
+	}
+	return nil, nil
+}
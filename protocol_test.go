@@ -2,9 +2,21 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
 	"testing"
 )
 
+// A data message for region built the way the server does it, for feeding to clients directly:
+func dataMessage(hashId []byte, region int64, data []byte) []byte {
+	msg := make([]byte, protocolDataMsgPrefixSize, protocolDataMsgPrefixSize+len(data))
+	putDataMessagePrefix(msg, hashId, region)
+	return append(msg, data...)
+}
+
 func cmp(t *testing.T, actual []Region, expected []Region) {
 	if len(actual) != len(expected) {
 		t.Fatalf("len(actual) != len(expected); actual = %v, expected = %v", actual, expected)
@@ -34,6 +46,18 @@ func TestNakRegions_NakAll2(t *testing.T) {
 	cmp(t, r.Acks(), []Region{})
 }
 
+// A tarball with nothing to send, e.g. only empty files without padding, starts and stays fully ACKed:
+func TestNakRegions_Empty(t *testing.T) {
+	r := NewNakRegions(0)
+	if !r.IsAllAcked() || r.NextNakRegion(0) != -1 {
+		t.Fatalf("expected nothing NAKed; naks = %v", r.Naks())
+	}
+	r.NakAll()
+	if !r.IsAllAcked() {
+		t.Fatalf("expected nothing NAKed after NakAll; naks = %v", r.Naks())
+	}
+}
+
 // [].ack(?, ?) => []
 func TestNakRegions_Ack1(t *testing.T) {
 	r := NewNakRegions(10)
@@ -399,3 +423,249 @@ func TestNextNakRegion12(t *testing.T) {
 		t.Fatalf("expected %d got %d", expected, n)
 	}
 }
+
+func randomNakRegions(rnd *rand.Rand, regionSize int64) *NakRegions {
+	regionCount := int64(1 + rnd.Intn(500))
+	size := regionCount*regionSize - int64(rnd.Intn(int(regionSize)))
+	r := NewNakRegions(size)
+	for i := int64(0); i < regionCount; i++ {
+		if rnd.Intn(10) < 9 {
+			continue
+		}
+		endEx := (i + 1) * regionSize
+		if endEx > size {
+			endEx = size
+		}
+		r.Ack(i*regionSize, endEx)
+	}
+	return r
+}
+
+func TestNakEncoding_Fuzz(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for iter := 0; iter < 1000; iter++ {
+		r := randomNakRegions(rnd, int64(1+rnd.Intn(1400)))
+		naks := r.Naks()
+
+		ranges, complete := appendNakRanges(nil, naks, 1<<20)
+		if !complete {
+			t.Fatal("expected all ranges to be encoded")
+		}
+		fromRanges, err := decodeNakRanges(ranges)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmp(t, fromRanges, naks)
+
+		bitmap := appendNakBitmap(nil, naks, 1<<20)
+		if len(naks) == 0 {
+			if bitmap != nil {
+				t.Fatal("expected nil bitmap for no NAKs")
+			}
+			continue
+		}
+		fromBitmap, err := decodeNakBitmap(bitmap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmp(t, fromBitmap, fromRanges)
+	}
+}
+
+func TestNakEncoding_AckDataSection(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	for iter := 0; iter < 200; iter++ {
+		r := randomNakRegions(rnd, 1000)
+		ack := Region{start: 0, endEx: 1000}
+
+		msg := encodeAckDataSection(ack, r.Naks(), 65000)
+		decodedAck, naks, err := decodeAckDataSection(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmp(t, []Region{decodedAck}, []Region{ack})
+		cmp(t, naks, r.Naks())
+	}
+}
+
+func TestNakEncoding_PrefersBitmapWhenDense(t *testing.T) {
+	// Every other region missing:
+	r := NewNakRegions(1000 * 100)
+	for i := int64(0); i < 100; i += 2 {
+		r.Ack(i*1000, (i+1)*1000)
+	}
+
+	msg := encodeAckDataSection(Region{}, r.Naks(), 65000)
+	if msg[0] != nakEncodingBitmap {
+		t.Fatalf("expected bitmap encoding; got %d", msg[0])
+	}
+	_, naks, err := decodeAckDataSection(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, naks, r.Naks())
+}
+
+func FuzzDecodeAckDataSection(f *testing.F) {
+	f.Add(encodeAckDataSection(Region{0, 1000}, []Region{{10, 20}, {500, 510}}, 65000))
+	f.Add(append([]byte{nakEncodingBitmap}, appendNakBitmap([]byte{0, 0}, []Region{{0, 4}, {8, 12}}, 1<<20)...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, naks, err := decodeAckDataSection(data)
+		if err != nil {
+			return
+		}
+		for _, k := range naks {
+			if k.start < 0 || k.endEx < k.start {
+				t.Fatalf("decoded bad NAK %v", k)
+			}
+		}
+	})
+}
+
+func TestExtract_WrongChannel(t *testing.T) {
+	hashId := []byte("01234567")
+	toClient := UDPMessage{Data: controlToClientMessage(hashId, AnnounceTarball, nil)}
+	toServer := UDPMessage{Data: controlToServerMessage(hashId, RequestMetadataHeader, nil)}
+	data := UDPMessage{Data: dataMessage(hashId, 0, []byte("hello, world!"))}
+
+	if _, _, _, err := extractServerMessage(toClient); err != ErrWrongMessageType {
+		t.Fatalf("expected ErrWrongMessageType; got %v", err)
+	}
+	if _, _, _, err := extractServerMessage(data); err != ErrWrongMessageType {
+		t.Fatalf("expected ErrWrongMessageType; got %v", err)
+	}
+	if _, _, _, err := extractClientMessage(toServer); err != ErrWrongMessageType {
+		t.Fatalf("expected ErrWrongMessageType; got %v", err)
+	}
+	if _, _, _, err := extractClientMessage(data); err != ErrWrongMessageType {
+		t.Fatalf("expected ErrWrongMessageType; got %v", err)
+	}
+	if _, _, _, err := extractDataMessage(toClient); !isMalformed(err) {
+		t.Fatalf("expected malformed error; got %v", err)
+	}
+	if _, _, _, err := extractDataMessage(UDPMessage{Data: append(toServer.Data, make([]byte, 16)...)}); err != ErrWrongMessageType {
+		t.Fatalf("expected ErrWrongMessageType; got %v", err)
+	}
+
+	// Correct channels still decode:
+	id, op, _, err := extractClientMessage(toClient)
+	if err != nil || op != AnnounceTarball || compareHashes(id, hashId) != 0 {
+		t.Fatalf("unexpected client message %v %v %v", id, op, err)
+	}
+	id, region, payload, err := extractDataMessage(data)
+	if err != nil || region != 0 || string(payload) != "hello, world!" || compareHashes(id, hashId) != 0 {
+		t.Fatalf("unexpected data message %v %v %q %v", id, region, payload, err)
+	}
+}
+
+func TestNakRegions_MarshalBinary(t *testing.T) {
+	r := NewNakRegions(20)
+	r.Ack(2, 5)
+	r.Ack(9, 11)
+
+	data, err := r.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &NakRegions{}
+	if err := u.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if u.size != 20 {
+		t.Fatalf("size != 20; size = %d", u.size)
+	}
+	cmp(t, u.Naks(), r.Naks())
+
+	if err := u.UnmarshalBinary(data[:len(data)-1]); err != ErrBadNakState {
+		t.Fatalf("expected ErrBadNakState; got %v", err)
+	}
+
+	// A corrupt count is refused before anything is allocated for it:
+	huge := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(huge, 20)
+	n += binary.PutUvarint(huge[n:], 1<<62)
+	if err := u.UnmarshalBinary(huge[:n]); err != ErrBadNakState {
+		t.Fatalf("expected ErrBadNakState; got %v", err)
+	}
+}
+
+func TestAnnounceSummary(t *testing.T) {
+	a := AnnounceSummary{Size: 12345, FileCount: 3, MetadataDigest: metadataDigest([]byte("md"))}
+	b, err := decodeAnnounceSummary(encodeAnnounceSummary(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Size != a.Size || b.FileCount != a.FileCount || !bytes.Equal(b.MetadataDigest, a.MetadataDigest) {
+		t.Fatalf("summary = %+v; expected %+v", b, a)
+	}
+
+	if b, err := decodeAnnounceSummary(nil); b != nil || err != nil {
+		t.Fatalf("expected bare announcement; got %+v, %v", b, err)
+	}
+	if _, err := decodeAnnounceSummary(make([]byte, 10)); err != ErrMessageTooShort {
+		t.Fatalf("expected ErrMessageTooShort; got %v", err)
+	}
+}
+
+func TestAnnounceTarballs(t *testing.T) {
+	hashIds := make([][]byte, 0, 10)
+	for i := 0; i < 10; i++ {
+		hashIds = append(hashIds, []byte(fmt.Sprintf("tarbal%02d", i)))
+	}
+
+	// Room for 4 HashIds per message:
+	msgs := encodeAnnounceTarballs(hashIds, protocolControlPrefixSize+4*hashSize+3)
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages; got %d", len(msgs))
+	}
+	decoded := make([][]byte, 0, len(hashIds))
+	for _, msg := range msgs {
+		announced, err := AnnouncedHashIds(UDPMessage{Data: msg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, announced...)
+	}
+	if len(decoded) != len(hashIds) {
+		t.Fatalf("decoded %d HashIds; expected %d", len(decoded), len(hashIds))
+	}
+	for i := range hashIds {
+		if !bytes.Equal(decoded[i], hashIds[i][:hashSize]) {
+			t.Fatalf("HashId %d = %q; expected %q", i, decoded[i], hashIds[i][:hashSize])
+		}
+	}
+
+	// The single form announces its prefix HashId:
+	single, err := AnnouncedHashIds(UDPMessage{Data: controlToClientMessage(hashIds[0], AnnounceTarball, nil)})
+	if err != nil || len(single) != 1 || !bytes.Equal(single[0], hashIds[0][:hashSize]) {
+		t.Fatalf("unexpected single announcement %q, %v", single, err)
+	}
+	other, err := AnnouncedHashIds(UDPMessage{Data: controlToClientMessage(hashIds[0], RespondTOCHeader, nil)})
+	if other != nil || err != nil {
+		t.Fatalf("expected no HashIds from other messages; got %q, %v", other, err)
+	}
+	if _, err := AnnouncedHashIds(UDPMessage{Data: controlToClientMessage(hashIds[0], AnnounceTarballs, []byte("short"))}); err != ErrBadAnnouncement {
+		t.Fatalf("expected ErrBadAnnouncement; got %v", err)
+	}
+}
+
+func TestRedirectData(t *testing.T) {
+	group := &net.UDPAddr{IP: net.IPv4(239, 1, 2, 3), Port: 4567}
+	decoded, err := decodeRedirectData(encodeRedirectData(group))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.IP.Equal(group.IP) || decoded.Port != group.Port {
+		t.Fatalf("expected %s; got %s", group, decoded)
+	}
+
+	if _, err := decodeRedirectData([]byte{1, 2, 3}); err != ErrMessageTooShort {
+		t.Fatalf("expected ErrMessageTooShort; got %v", err)
+	}
+	if _, err := decodeRedirectData(encodeRedirectData(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4567})); err != ErrBadRedirect {
+		t.Fatalf("expected ErrBadRedirect for a unicast address; got %v", err)
+	}
+	if _, err := decodeRedirectData(encodeRedirectData(&net.UDPAddr{IP: group.IP})); err != ErrBadRedirect {
+		t.Fatalf("expected ErrBadRedirect for port 0; got %v", err)
+	}
+}
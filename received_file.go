@@ -0,0 +1,157 @@
+// received_file.go
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoMetadata     = errors.New("metadata not received yet")
+	ErrNotRegularFile = errors.New("not a regular file")
+	ErrNotExtracted   = errors.New("entry is received but not extracted")
+	ErrReadTimeout    = errors.New("timed out waiting for data to be received")
+)
+
+// A read-only view of a file being received that serves its bytes as soon as they are written, so that consumers,
+// e.g. a FUSE layer, can read the front of a large file before the rest arrives. Reads of bytes not yet written block
+// until they are.
+type ReceivedFile struct {
+	t  *VirtualTarballWriter
+	tf *TarballFile
+
+	// Opened once the first bytes read have been written:
+	lock sync.Mutex
+	f    *os.File
+
+	// How long ReadAt waits for bytes not yet received before failing with ErrReadTimeout; 0 waits indefinitely:
+	Timeout time.Duration
+}
+
+// Opens the regular file extracted to path for reading as it is received. Safe to call while writing.
+func (t *VirtualTarballWriter) OpenReceived(path string) (*ReceivedFile, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, tf := range t.files {
+		if tf.Path != path {
+			continue
+		}
+		if tf.Mode&os.ModeType != 0 {
+			return nil, ErrNotRegularFile
+		}
+		if t.skipped[tf] {
+			return nil, ErrNotExtracted
+		}
+		return &ReceivedFile{t: t, tf: tf}, nil
+	}
+	return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+}
+
+// Blocks until [start, endEx) of the tarball is written or ctx is done:
+func (t *VirtualTarballWriter) waitWritten(ctx context.Context, start, endEx int64) error {
+	for {
+		t.lock.Lock()
+		done := t.unwritten.IsFullyAcked(start, endEx)
+		written := t.written
+		t.lock.Unlock()
+		if done {
+			return nil
+		}
+
+		select {
+		case <-written:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (r *ReceivedFile) Size() int64 {
+	return r.tf.Size
+}
+
+// io.ReaderAt; waits at most Timeout for the bytes read to be received:
+func (r *ReceivedFile) ReadAt(p []byte, off int64) (int, error) {
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+
+	n, err := r.ReadAtContext(ctx, p, off)
+	if err == context.DeadlineExceeded {
+		err = ErrReadTimeout
+	}
+	return n, err
+}
+
+// Like ReadAt but waits until ctx is done instead, returning its error:
+func (r *ReceivedFile) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrOutOfRange
+	}
+	if off >= r.tf.Size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > r.tf.Size {
+		end = r.tf.Size
+	}
+
+	if err := r.t.waitWritten(ctx, r.tf.offset+off, r.tf.offset+end); err != nil {
+		return 0, err
+	}
+	f, err := r.file()
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.ReadAt(p[:end-off], off)
+	if err == nil && end < off+int64(len(p)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// The extracted file, with any bytes still buffered under WriteBufferSize written out to it:
+func (r *ReceivedFile) file() (*os.File, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// Opened under the writer's lock too, since resolving the path walks the root's directory state, which the
+	// writer changes as it extracts:
+	r.t.lock.Lock()
+	defer r.t.lock.Unlock()
+	if r.t.openFileInfo == r.tf {
+		if err := r.t.flushWrites(); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.f == nil {
+		f, err := r.t.fs.Open(r.tf.Path)
+		if err != nil {
+			return nil, err
+		}
+		r.f = f
+	}
+	return r.f, nil
+}
+
+// io.Closer:
+func (r *ReceivedFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
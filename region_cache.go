@@ -0,0 +1,118 @@
+// region_cache.go
+package main
+
+import (
+	"container/list"
+	"io"
+	"sync"
+)
+
+// Hit and miss counts of a regionCache along with its current size:
+type RegionCacheStats struct {
+	Bytes   int64
+	Entries int
+	Hits    int64
+	Misses  int64
+}
+
+// Fraction of reads served from memory:
+func (s RegionCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type cachedRegion struct {
+	offset int64
+	// Length of the read that filled this entry; data may be shorter at the end of the tarball:
+	length int
+	data   []byte
+}
+
+// LRU cache of recently read regions in front of an io.ReaderAt, so regions NAKed by many clients are re-sent from
+// memory. Only reads of the same offset and length hit.
+type regionCache struct {
+	r        io.ReaderAt
+	capacity int64
+
+	lock    sync.Mutex
+	lru     *list.List
+	entries map[int64]*list.Element
+	stats   RegionCacheStats
+}
+
+func newRegionCache(r io.ReaderAt, capacity int64) *regionCache {
+	return &regionCache{
+		r:        r,
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[int64]*list.Element),
+	}
+}
+
+// io.ReaderAt:
+func (c *regionCache) ReadAt(buf []byte, offset int64) (int, error) {
+	c.lock.Lock()
+	if e, ok := c.entries[offset]; ok && e.Value.(*cachedRegion).length == len(buf) {
+		c.lru.MoveToFront(e)
+		c.stats.Hits++
+		n := copy(buf, e.Value.(*cachedRegion).data)
+		c.lock.Unlock()
+		return n, nil
+	}
+	c.stats.Misses++
+	c.lock.Unlock()
+
+	n, err := c.r.ReadAt(buf, offset)
+	if err != nil {
+		return n, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.remove(offset)
+	if int64(n) > c.capacity {
+		return n, nil
+	}
+	r := &cachedRegion{offset: offset, length: len(buf), data: append([]byte(nil), buf[:n]...)}
+	c.entries[offset] = c.lru.PushFront(r)
+	c.stats.Bytes += int64(n)
+	c.stats.Entries++
+
+	// Evict least recently used regions to fit:
+	for c.stats.Bytes > c.capacity {
+		c.remove(c.lru.Back().Value.(*cachedRegion).offset)
+	}
+	return n, nil
+}
+
+// Drops cached regions overlapping [start, endEx), e.g. after their source file changed:
+func (c *regionCache) Invalidate(start, endEx int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for offset, e := range c.entries {
+		r := e.Value.(*cachedRegion)
+		if offset < endEx && start < offset+int64(len(r.data)) {
+			c.remove(offset)
+		}
+	}
+}
+
+func (c *regionCache) remove(offset int64) {
+	e, ok := c.entries[offset]
+	if !ok {
+		return
+	}
+	r := c.lru.Remove(e).(*cachedRegion)
+	delete(c.entries, offset)
+	c.stats.Bytes -= int64(len(r.data))
+	c.stats.Entries--
+}
+
+func (c *regionCache) Stats() RegionCacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
@@ -0,0 +1,6 @@
+// +build linux
+
+package main
+
+// SO_REUSEPORT is not defined by package syscall on all linux architectures:
+const soReusePort = 0xf
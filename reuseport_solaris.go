@@ -0,0 +1,6 @@
+// +build solaris
+
+package main
+
+// SO_REUSEPORT is not available:
+const soReusePort = 0
@@ -0,0 +1,18 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import "syscall"
+
+// Soft limit on open file descriptors; false if it cannot be determined or is unlimited:
+func openFileLimit() (int, bool) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, false
+	}
+	// RLIM_INFINITY is all ones, or negative where Cur is signed:
+	if uint64(rl.Cur) > 1<<30 {
+		return 0, false
+	}
+	return int(rl.Cur), true
+}
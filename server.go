@@ -3,10 +3,16 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
+	"crypto/ed25519"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,29 +21,77 @@ import "golang.org/x/time/rate"
 
 type empty struct{}
 
+var ErrNegativeQuiesce = errors.New("data quiesce must not be negative")
+var ErrNegativeRate = errors.New("response rate must not be negative")
+var ErrMetadataOnly = errors.New("metadata-only server has no data to send")
+var ErrNotStarted = errors.New("server has not started")
+
 type Server struct {
-	m  *Multicast
-	tb *VirtualTarballReader
+	m      *Multicast
+	tb     TarballReader
+	reader *CountingReaderAt
+	cache  *regionCache
 
 	options ServerOptions
 
 	hashId []byte
+	// Bytes of data served: the tarball's size, or the gzip stream's with GzipStream:
+	size int64
+	// Whole tarball compressed once for GzipStream, spooled to a temporary file:
+	stream *os.File
 
 	announceTicker <-chan time.Time
 	announceMsg    []byte
 
 	metadataHeader   []byte
 	metadataSections [][]byte
+	metadataDigest   []byte
+	signature        []byte
+
+	// When each metadata section was last sent, to coalesce repeated requests:
+	sectionSentAt     map[uint16]time.Time
+	sectionsCoalesced int64
+
+	tocHeader   []byte
+	tocSections [][]byte
 
 	packetsSentSinceLastAck int
 	allowSend               chan empty
 	limiter                 *rate.Limiter
 
+	// Paced separately from data so that a burst of requests from starting clients cannot crowd out data:
+	responseLock       sync.Mutex
+	metadataLimiter    *rate.Limiter
+	announceLimiter    *rate.Limiter
+	responsesThrottled int64
+
+	droppedMalformed int64
+
+	// Regions that are not sent: holes of sparse files, and source files modified while serving:
+	excluded     []Region
+	excludedPath map[string]bool
+
 	nextLock    sync.Mutex
 	nakRegions  *NakRegions
 	nextRegion  int64
 	regionSize  uint16
 	regionCount int64
+	// Datagram that regions are read into, reused by every send; sends are serialized by nextLock and SendData does
+	// not keep it:
+	dataBuf []byte
+
+	// With SetMaxRegionRetransmits, how often each region has been sent this round, and the regions given up on for
+	// being retransmitted too often, which are ACKed along with excluded regions until the round ends:
+	maxRegionRetransmits int
+	regionSends          []int32
+	abandoned            []Region
+
+	// Stop sending this long after the last client request; 0 sends until all NAKed regions are sent:
+	dataQuiesce time.Duration
+	// Set by Pause to hold off sending data until Resume:
+	paused bool
+	// Which part of RunOnce is underway, deciding how client ACKs are applied:
+	batch batchPhase
 
 	rate          int
 	lastSendTime  time.Time
@@ -50,110 +104,677 @@ type Server struct {
 
 type ServerOptions struct {
 	RefreshRate time.Duration
+	// Signs the metadata digest so clients can verify authenticity:
+	SigningKey ed25519.PrivateKey
+	// File to cache encoded metadata in, keyed by HashId, to skip rebuilding it on restart:
+	MetadataCachePath string
+	// Ignore any existing metadata cache and rebuild it:
+	RegenerateMetadata bool
+	// How often to restat source files to detect modification while serving; 0 disables the check:
+	SourceCheckInterval time.Duration
+	// Stop serving with ErrSourceModified instead of excluding the modified files' regions:
+	AbortOnSourceModified bool
+	// Include size, file count and metadata digest in announcements if they fit in a datagram:
+	AnnounceSummary bool
+	// HashIds of other tarballs offered to the same group, announced every second along with this one's, packed into
+	// as few datagrams as fit, so that a host offering many can announce them all from one server. Packed
+	// announcements carry no summary:
+	AnnounceWith [][]byte
+	// Source of time for announcements, reporting and send pacing; defaults to the real clock:
+	Clock Clock
+	// Bytes of recently sent regions to keep in memory for retransmission; 0 disables the cache:
+	RegionCacheSize int64
+	// Requests for a metadata section sent within this long are dropped since the earlier reply already went to the
+	// whole group; 0 replies to every request:
+	SectionCoalesce time.Duration
+	// How long RunOnce announces and answers metadata requests before sending data; 0 defaults to 3 seconds:
+	BatchLead time.Duration
+	// How long RunOnce collects NAKs after its pass to send the missed regions once more; 0 skips retransmission:
+	BatchRetransmitWait time.Duration
+	// Answer metadata, table of contents and manifest digest requests to the requesting client's address instead of
+	// the group so that clients which already have the metadata are not sent it again. Multicast suits a crowd of
+	// clients starting together better, and only one of several clients on one host receives unicast replies.
+	// Section requests are not coalesced when set:
+	UnicastMetadata bool
+	// File to save the outstanding NAKs and send position to on every report so that Run restarted after a crash
+	// carries on sending where it left off. Clients only notice the restart if the metadata has changed, in which case
+	// the saved state is ignored:
+	StatePath string
+	// Announce and answer metadata requests but never send data, for a catalog node that leaves serving data to
+	// others. Clients' data requests are answered with a redirect to DataRedirect if set, or ignored otherwise:
+	MetadataOnly bool
+	// Group of a server sending this tarball's data, which clients switch to for both data and requests:
+	DataRedirect *net.UDPAddr
+}
+
+type batchPhase int
+
+const (
+	// Serving indefinitely with Run:
+	batchNone = batchPhase(iota)
+	// Sending every region in order; ACKs are ignored:
+	batchSweep
+	// Collecting NAKs for retransmission; the regions clients report received are not ACKed so that every
+	// client's NAKs are kept:
+	batchCollect
+)
+
+// What RunOnce sent:
+type BatchStats struct {
+	RegionsSent   int64
+	BytesSent     int64
+	RegionsResent int64
+	BytesResent   int64
+	Elapsed       time.Duration
+	// Regions given up on after SetMaxRegionRetransmits retransmits:
+	RegionsAbandoned int64
 }
 
-func NewServer(m *Multicast, tb *VirtualTarballReader, options ServerOptions) *Server {
+func NewServer(m *Multicast, tb TarballReader, options ServerOptions) *Server {
 	if options.RefreshRate <= time.Duration(0) {
 		options.RefreshRate = time.Second
 	}
+	if options.Clock == nil {
+		options.Clock = realClock{}
+	}
+
+	s := &Server{
+		m:             m,
+		tb:            tb,
+		options:       options,
+		hashId:        tb.HashId(),
+		sectionSentAt: make(map[uint16]time.Time),
+		allowSend:     make(chan empty, 1),
+		limiter:       rate.NewLimiter(rate.Limit(1200.0), 1),
+
+		metadataLimiter: rate.NewLimiter(rate.Inf, 1),
+		announceLimiter: rate.NewLimiter(rate.Inf, 1),
+	}
 
-	return &Server{
-		m:         m,
-		tb:        tb,
-		options:   options,
-		hashId:    tb.HashId(),
-		allowSend: make(chan empty, 1),
-		limiter:   rate.NewLimiter(rate.Limit(1200.0), 1),
+	readerAt := io.ReaderAt(tb)
+	if options.RegionCacheSize > 0 {
+		s.cache = newRegionCache(tb, options.RegionCacheSize)
+		readerAt = s.cache
 	}
+	s.reader = NewCountingReaderAt(readerAt, tb.Size())
+	s.size = tb.Size()
+	return s
 }
 
 func (s *Server) Run() error {
+	return s.RunContext(context.Background())
+}
+
+// Serves until ctx is cancelled, then stops sending, leaves the multicast groups and returns ctx.Err().
+func (s *Server) RunContext(ctx context.Context) error {
 	err := (error)(nil)
 	defer func() {
 		err = s.m.Close()
 	}()
+	defer s.removeStream()
+
+	if err = s.start(); err != nil {
+		return err
+	}
+	if s.options.StatePath != "" {
+		if err := s.loadState(); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "ignoring server state: %s\n", err)
+		}
+	}
+
+	// Create a one-second ticker for reporting:
+	refreshTimer := s.options.Clock.Tick(s.options.RefreshRate)
+
+	sourceTicker := (<-chan time.Time)(nil)
+	if s.options.SourceCheckInterval > 0 {
+		sourceTicker = s.options.Clock.Tick(s.options.SourceCheckInterval)
+	}
+
+	fmt.Print("Started server\n")
+	fmt.Printf("%15s  ID: %s\n", humanize.Comma(s.tb.Size()), hex.EncodeToString(s.hashId))
+
+	// Send/recv loop:
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if !s.options.MetadataOnly {
+		sending := make(chan empty)
+		go func() {
+			s.sendDataLoop(ctx)
+			close(sending)
+		}()
+		// Sending stops before the sockets close underneath it:
+		defer func() {
+			cancel()
+			<-sending
+		}()
+	}
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case ctrl := <-s.m.ControlToServer:
+			if err := s.serveControl(ctrl); err != nil {
+				return err
+			}
+		case <-s.announceTicker:
+			s.announce()
+		case <-refreshTimer:
+			s.reportBandwidth()
+			if s.options.StatePath != "" {
+				if err := s.saveState(); err != nil {
+					fmt.Fprintf(os.Stderr, "unable to save server state: %s\n", err)
+				}
+			}
+		case <-sourceTicker:
+			if err := s.checkSources(); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Print("Stopped server\n")
+	return ctx.Err()
+}
+
+// Pushes the tarball once instead of serving indefinitely, for clients already listening: announces and answers
+// metadata requests for BatchLead, sends every region once in order, then if BatchRetransmitWait is set collects NAKs
+// for that long and sends the NAKed regions once more. Requests are answered throughout. Cancelling ctx stops early
+// with what was sent so far.
+func (s *Server) RunOnce(ctx context.Context) (stats BatchStats, err error) {
+	defer s.m.Close()
+	defer s.removeStream()
+
+	if s.options.MetadataOnly {
+		return stats, ErrMetadataOnly
+	}
+	if err := s.start(); err != nil {
+		return stats, err
+	}
+	started := s.options.Clock.Now()
+	defer func() {
+		stats.Elapsed = s.options.Clock.Now().Sub(started)
+		stats.RegionsAbandoned = int64(len(s.AbandonedRegions()))
+	}()
+
+	fmt.Print("Started batch\n")
+	fmt.Printf("%15s  ID: %s\n", humanize.Comma(s.tb.Size()), hex.EncodeToString(s.hashId))
+
+	lead := s.options.BatchLead
+	if lead <= 0 {
+		lead = 3 * time.Second
+	}
+	s.announce()
+	if err := s.serveControlFor(ctx, lead); err != nil {
+		return stats, err
+	}
+
+	// One pass over the whole tarball:
+	s.nextLock.Lock()
+	s.batch = batchSweep
+	s.nakRegions.NakAll()
+	s.ackExcluded()
+	s.nextRegion = 0
+	s.nextLock.Unlock()
+	stats.RegionsSent, stats.BytesSent, err = s.sendNaked(ctx)
+	if err != nil || s.options.BatchRetransmitWait <= 0 {
+		return stats, err
+	}
+
+	// Clients report what they missed:
+	s.nextLock.Lock()
+	s.batch = batchCollect
+	s.nakRegions.Ack(0, s.size)
+	s.nextLock.Unlock()
+	if err := s.serveControlFor(ctx, s.options.BatchRetransmitWait); err != nil {
+		return stats, err
+	}
+
+	s.nextLock.Lock()
+	s.batch = batchSweep
+	s.ackExcluded()
+	s.nextRegion = 0
+	s.nextLock.Unlock()
+	stats.RegionsResent, stats.BytesResent, err = s.sendNaked(ctx)
+	return stats, err
+}
+
+// Answers requests and announces until d passes:
+func (s *Server) serveControlFor(ctx context.Context, d time.Duration) error {
+	done := s.options.Clock.After(d)
+	for {
+		select {
+		case ctrl := <-s.m.ControlToServer:
+			if err := s.serveControl(ctrl); err != nil {
+				return err
+			}
+		case <-s.announceTicker:
+			s.announce()
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Sends each NAKed region once, answering requests between sends; returns the count of regions and bytes sent:
+func (s *Server) sendNaked(ctx context.Context) (regionCount int64, byteCount int64, err error) {
+	for {
+		s.nextLock.Lock()
+		done := s.nakRegions.IsAllAcked()
+		sent := s.bytesSent
+		s.nextLock.Unlock()
+		if done {
+			return regionCount, byteCount, nil
+		}
+		if s.Paused() {
+			// Keep answering requests and collecting NAKs until resumed:
+			if err := s.serveControlFor(ctx, 250*time.Millisecond); err != nil {
+				return regionCount, byteCount, err
+			}
+			continue
+		}
+
+		// Rate limit our sending:
+		if err := s.limiter.Wait(ctx); err != nil {
+			return regionCount, byteCount, err
+		}
 
+		for pending := true; pending; {
+			select {
+			case ctrl := <-s.m.ControlToServer:
+				if err := s.serveControl(ctrl); err != nil {
+					return regionCount, byteCount, err
+				}
+			case <-s.announceTicker:
+				s.announce()
+			default:
+				pending = false
+			}
+		}
+
+		// Send next data region:
+		err := s.sendData()
+		if isENOBUFS(err) {
+			// Not sent; try again:
+			fmt.Print("\r!")
+			continue
+		}
+		if err != nil {
+			return regionCount, byteCount, err
+		}
+		s.nextLock.Lock()
+		n := s.bytesSent - sent
+		s.nextLock.Unlock()
+		// Nothing is sent for a region given up on:
+		if n > 0 {
+			byteCount += n
+			regionCount++
+		}
+	}
+}
+
+// Builds metadata and sets up sockets, NAK state and announcements ahead of serving:
+func (s *Server) start() error {
+	if s.tb.Options().GzipStream {
+		// The stream's size goes in the metadata:
+		if err := s.compress(); err != nil {
+			return err
+		}
+	}
 	// Construct metadata sections:
-	if err = s.buildMetadata(); err != nil {
+	if err := s.buildMetadata(); err != nil {
 		return err
 	}
 
-	s.regionSize = uint16(s.m.MaxMessageSize() - (protocolDataMsgPrefixSize))
+	s.regionSize = s.dataRegionSize()
 	s.nextRegion = 0
-	s.regionCount = s.tb.size / int64(s.regionSize)
-	if int64(s.regionSize)*s.regionCount < s.tb.size {
+	s.regionCount = s.size / int64(s.regionSize)
+	if int64(s.regionSize)*s.regionCount < s.size {
 		s.regionCount++
 	}
 
 	// Initialize with fully ACKed so that resuming clients send NAK state:
-	s.nakRegions = NewNakRegions(s.tb.size)
+	s.nakRegions = NewNakRegions(s.size)
 	// ACK all at first so that no data is sent until clients send NAKs:
-	s.nakRegions.Ack(0, s.tb.size)
+	s.nakRegions.Ack(0, s.size)
+	// Clients recreate the holes of sparse files themselves; a gzip stream includes them:
+	if s.stream == nil {
+		s.excluded = append(s.excluded, tarballFileList(s.tb.Files()).holes()...)
+	}
 
 	// Let Multicast know what channels we're interested in sending/receiving:
-	err = s.m.SendsControlToClient()
-	if err != nil {
+	if err := s.m.SendsControlToClient(); err != nil {
 		return err
 	}
-	err = s.m.SendsData()
-	if err != nil {
-		return err
+	if !s.options.MetadataOnly {
+		if err := s.m.SendsData(); err != nil {
+			return err
+		}
 	}
-	err = s.m.ListensControlToServer()
-	if err != nil {
+	if err := s.m.ListensControlToServer(); err != nil {
 		return err
 	}
 
 	// Tick to send a server announcement:
-	s.announceTicker = time.Tick(1 * time.Second)
+	s.announceTicker = s.options.Clock.Tick(1 * time.Second)
 
 	// Create an announcement message:
-	s.announceMsg = controlToClientMessage(s.hashId, AnnounceTarball, nil)
+	s.announceMsg = controlToClientMessage(s.hashId, AnnounceTarball, s.announceSummary())
+	return nil
+}
 
-	// Create a one-second ticker for reporting:
-	refreshTimer := time.Tick(s.options.RefreshRate)
+// Processes a client request; only a failure to receive is returned, since one bad request must not stop serving:
+func (s *Server) serveControl(ctrl UDPMessage) error {
+	if ctrl.Error != nil {
+		return ctrl.Error
+	}
+	// Process client requests:
+	if err := s.processControl(ctrl); err != nil {
+		fmt.Printf("%s\n", err)
+	}
+	return nil
+}
 
-	fmt.Print("Started server\n")
-	fmt.Printf("%15s  ID: %s\n", humanize.Comma(s.tb.size), hex.EncodeToString(s.hashId))
+// Announce transfer available, along with AnnounceWith's:
+func (s *Server) announce() {
+	err := error(nil)
+	if len(s.options.AnnounceWith) > 0 {
+		err = AnnounceHashIds(s.m, append([][]byte{s.hashId}, s.options.AnnounceWith...))
+	} else {
+		_, err = s.m.SendControlToClient(s.announceMsg)
+	}
+	if isENOBUFS(err) {
+		fmt.Print("\r!")
+		err = nil
+	}
 
-	// Send/recv loop:
-	go s.sendDataLoop()
+	if err != nil {
+		fmt.Printf("%s\n", err)
+	}
+}
 
-	for {
-		select {
-		case ctrl := <-s.m.ControlToServer:
-			if ctrl.Error != nil {
-				return ctrl.Error
-			}
-			// Process client requests:
-			err := s.processControl(ctrl)
-			if err != nil {
-				fmt.Printf("%s\n", err)
-			}
-		case <-s.announceTicker:
-			// Announce transfer available:
-			//fmt.Printf("announce %s\n", hex.EncodeToString(s.hashId))
+// Announces several tarballs at once for a host offering many, packing HashIds into as few datagrams as fit; clients
+// waiting on any of them carry on as for a single announcement. m must already send control messages to clients.
+func AnnounceHashIds(m *Multicast, hashIds [][]byte) error {
+	for _, msg := range encodeAnnounceTarballs(hashIds, m.MaxMessageSize()) {
+		if _, err := m.SendControlToClient(msg); err != nil && !isENOBUFS(err) {
+			return err
+		}
+	}
+	return nil
+}
 
-			_, err := s.m.SendControlToClient(s.announceMsg)
-			if isENOBUFS(err) {
-				fmt.Print("\r!")
-				err = nil
-			}
+// Summary to announce with, or nil to announce the bare HashId:
+func (s *Server) announceSummary() []byte {
+	if !s.options.AnnounceSummary {
+		return nil
+	}
+	summary := encodeAnnounceSummary(AnnounceSummary{
+		Size:           s.tb.Size(),
+		FileCount:      uint32(len(s.tb.Files())),
+		MetadataDigest: s.metadataDigest,
+	})
+	if protocolControlPrefixSize+len(summary) > s.m.MaxMessageSize() {
+		// Fall back to the bare HashId if the summary would not fit:
+		return nil
+	}
+	return summary
+}
 
-			if err != nil {
-				fmt.Printf("%s\n", err)
-			}
-		case <-refreshTimer:
-			s.reportBandwidth()
+// Detects source files modified since the tarball was built; their delivered bytes would no longer match the
+// metadata, so either abort or stop serving their regions.
+func (s *Server) checkSources() error {
+	for _, f := range s.tb.ModifiedFiles() {
+		if s.excludedPath[f.Path] {
+			continue
+		}
+		fmt.Printf("\bsource modified: '%s'\n", f.Path)
+		if s.options.AbortOnSourceModified {
+			return ErrSourceModified
 		}
+
+		s.nextLock.Lock()
+		if s.excludedPath == nil {
+			s.excludedPath = make(map[string]bool)
+		}
+		s.excludedPath[f.Path] = true
+		if s.stream != nil {
+			// The stream was compressed from the file as it was and is still sent whole:
+			s.nextLock.Unlock()
+			continue
+		}
+		r := Region{start: f.offset, endEx: f.offset + f.Size + s.tb.Options().padding()}
+		s.excluded = append(s.excluded, r)
+		s.nakRegions.Ack(r.start, r.endEx)
+		if s.cache != nil {
+			s.cache.Invalidate(r.start, r.endEx)
+		}
+		s.nextLock.Unlock()
 	}
+	return nil
+}
 
-	fmt.Print("Stopped server\n")
-	return err
+// Returns the inclusive range of data regions covering a file, including its trailing NUL; start is -1 if the
+// file is not in the tarball. Files cannot be located within a gzip stream, so with GzipStream every file is
+// covered by the whole stream. Fails with ErrNotStarted until Run or RunOnce has determined the region size.
+func (s *Server) RegionsForFile(path string) (start, count int64, err error) {
+	if s.regionSize == 0 {
+		return -1, 0, ErrNotStarted
+	}
+	files := tarballFileList(s.tb.Files())
+	if s.stream != nil {
+		if _, _, ok := files.fileRange(path, 0); !ok {
+			return -1, 0, nil
+		}
+		return 0, s.regionCount, nil
+	}
+	start, count = files.regionsForFile(path, int64(s.regionSize), s.tb.Options().padding())
+	return start, count, nil
+}
+
+// Caps how many times each region is sent again after its first send, so that a client that keeps missing the same
+// regions cannot hold up the rest forever. A region over the cap is given up on: it is logged, not sent again and
+// listed by AbandonedRegions. The cap applies to a round of sending, which ends once no region is NAKed; regions
+// NAKed after that start a new round in which abandoned regions are sent again. 0, the default, retransmits without
+// limit.
+func (s *Server) SetMaxRegionRetransmits(n int) {
+	s.nextLock.Lock()
+	s.maxRegionRetransmits = n
+	s.nextLock.Unlock()
+}
+
+// Regions given up on for exceeding SetMaxRegionRetransmits in the current round. Safe to call while serving.
+func (s *Server) AbandonedRegions() []Region {
+	s.nextLock.Lock()
+	defer s.nextLock.Unlock()
+	return append([]Region(nil), s.abandoned...)
+}
+
+// Counts a send of the region at nextRegion, or gives up on the region instead, ACKing it, if it has already been
+// retransmitted maxRegionRetransmits times this round. Called with nextLock held:
+func (s *Server) retransmitsExhausted() bool {
+	if s.maxRegionRetransmits <= 0 {
+		return false
+	}
+	if s.regionSends == nil {
+		s.regionSends = make([]int32, s.regionCount)
+	}
+
+	// Counted against the region of the grid the send starts in; sendData ends it at that region's end:
+	start := s.nextRegion - s.nextRegion%int64(s.regionSize)
+	index := start / int64(s.regionSize)
+	if int(s.regionSends[index]) <= s.maxRegionRetransmits {
+		s.regionSends[index]++
+		return false
+	}
+
+	r := Region{start: start, endEx: start + int64(s.regionSize)}
+	if r.endEx > s.size {
+		r.endEx = s.size
+	}
+	fmt.Printf("\bgiving up on region %d after %d retransmits\n", index, s.maxRegionRetransmits)
+	s.abandoned = append(s.abandoned, r)
+	s.nakRegions.Ack(r.start, r.endEx)
+
+	s.nextRegion = r.endEx
+	if s.nextRegion >= s.size {
+		s.nextRegion = 0
+	}
+	return true
+}
+
+// Starts a new round of retransmit counting once nothing is NAKed, so that clients still missing abandoned regions
+// are sent them again. Called with nextLock held:
+func (s *Server) newRetransmitRound() {
+	if !s.nakRegions.IsAllAcked() {
+		return
+	}
+	s.regionSends = nil
+	s.abandoned = nil
+}
+
+// ACKs the regions never to be sent: holes, modified sources and regions abandoned this round. Called with nextLock
+// held:
+func (s *Server) ackExcluded() {
+	for _, r := range s.excluded {
+		s.nakRegions.Ack(r.start, r.endEx)
+	}
+	for _, r := range s.abandoned {
+		s.nakRegions.Ack(r.start, r.endEx)
+	}
+}
+
+// Sets how long after a client's last data request to keep sending. Unsent regions stay NAKed and resume sending
+// on the next request. 0, the default, sends until every NAKed region has been sent regardless of client activity.
+func (s *Server) SetDataQuiesce(d time.Duration) error {
+	if d < 0 {
+		return ErrNegativeQuiesce
+	}
+	s.nextLock.Lock()
+	s.dataQuiesce = d
+	s.nextLock.Unlock()
+	return nil
+}
+
+// Caps metadata, table of contents and manifest digest responses to perSecond with bursts of up to burst;
+// requests over the cap are dropped for clients to retry. 0 is unlimited, the default.
+func (s *Server) SetMetadataResponseRate(perSecond float64, burst int) error {
+	return s.setResponseRate(&s.metadataLimiter, perSecond, burst)
+}
+
+// Caps announcements sent on request, as opposed to the periodic announcement, like SetMetadataResponseRate:
+func (s *Server) SetAnnounceResponseRate(perSecond float64, burst int) error {
+	return s.setResponseRate(&s.announceLimiter, perSecond, burst)
+}
+
+func (s *Server) setResponseRate(l **rate.Limiter, perSecond float64, burst int) error {
+	if perSecond < 0 {
+		return ErrNegativeRate
+	}
+	limit := rate.Limit(perSecond)
+	if perSecond == 0 {
+		limit = rate.Inf
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	s.responseLock.Lock()
+	*l = rate.NewLimiter(limit, burst)
+	s.responseLock.Unlock()
+	return nil
+}
+
+// Whether a response may be sent now under l; otherwise counts it as throttled:
+func (s *Server) allowResponse(l **rate.Limiter) bool {
+	s.responseLock.Lock()
+	defer s.responseLock.Unlock()
+	if (*l).AllowN(s.options.Clock.Now(), 1) {
+		return true
+	}
+	s.responsesThrottled++
+	return false
+}
+
+// Count of requests dropped by SetMetadataResponseRate and SetAnnounceResponseRate:
+func (s *Server) ResponsesThrottled() int64 {
+	s.responseLock.Lock()
+	defer s.responseLock.Unlock()
+	return s.responsesThrottled
+}
+
+// Whether clients have gone quiet for longer than the data quiesce window:
+func (s *Server) quiesced() bool {
+	s.nextLock.Lock()
+	defer s.nextLock.Unlock()
+	return s.dataQuiesce > 0 && s.options.Clock.Now().Sub(s.lastAckTime) > s.dataQuiesce
+}
+
+// Stops sending data until Resume, e.g. to yield bandwidth to other traffic. Announcements and metadata responses
+// carry on so that clients keep waiting, and their NAKs are still collected to be sent once resumed.
+func (s *Server) Pause() {
+	s.nextLock.Lock()
+	s.paused = true
+	s.nextLock.Unlock()
+}
+
+// Carries on sending data after Pause from where it left off:
+func (s *Server) Resume() {
+	s.nextLock.Lock()
+	s.paused = false
+	s.nextLock.Unlock()
+}
+
+// Whether data sending is paused:
+func (s *Server) Paused() bool {
+	s.nextLock.Lock()
+	defer s.nextLock.Unlock()
+	return s.paused
+}
+
+// Reports whether a request for section can be dropped because it was sent within SectionCoalesce; otherwise records
+// it as sent now:
+func (s *Server) coalesceSection(section uint16) bool {
+	if s.options.SectionCoalesce <= 0 || s.options.UnicastMetadata {
+		return false
+	}
+
+	now := s.options.Clock.Now()
+	if sentAt, ok := s.sectionSentAt[section]; ok && now.Sub(sentAt) < s.options.SectionCoalesce {
+		s.sectionsCoalesced++
+		return true
+	}
+	s.sectionSentAt[section] = now
+	return false
+}
+
+// Count of metadata section requests answered by an earlier reply to the group:
+func (s *Server) SectionsCoalesced() int64 {
+	return s.sectionsCoalesced
+}
+
+// Size and hit rate of the region cache; zero if RegionCacheSize is not set:
+func (s *Server) RegionCacheStats() RegionCacheStats {
+	if s.cache == nil {
+		return RegionCacheStats{}
+	}
+	return s.cache.Stats()
+}
+
+// Count of datagrams dropped for being malformed or arriving on the wrong channel:
+func (s *Server) DroppedMalformed() int64 {
+	return s.droppedMalformed
 }
 
 func (s *Server) reportBandwidth() {
-	rightMeow := time.Now()
+	// Counters and NAKs are updated by the data loop:
+	s.nextLock.Lock()
+	defer s.nextLock.Unlock()
+
+	rightMeow := s.options.Clock.Now()
 	sec := rightMeow.Sub(s.timeLast).Seconds()
 	{
 		byteCount := s.bytesSent - s.bytesSentLast
@@ -162,22 +783,38 @@ func (s *Server) reportBandwidth() {
 		s.timeLast = rightMeow
 	}
 
-	fmt.Printf("\b%9s/s        [%s]\r", humanize.IBytes(uint64(s.lastRate)), s.nakRegions.ASCIIMeterPosition(48, s.nextRegion))
+	// Percentage of the tarball sent at least once:
+	pct := float64(100.0)
+	if s.size > 0 {
+		pct = float64(s.reader.UniqueBytes()) * 100.0 / float64(s.size)
+	}
+	fmt.Printf("\b%9s/s %6.2f%% [%s]\r", humanize.IBytes(uint64(s.lastRate)), pct, s.nakRegions.ASCIIMeterPosition(48, s.nextRegion))
 }
 
-// goroutine to only send data while clients request it:
-func (s *Server) sendDataLoop() {
+// goroutine to only send data while clients request it, until ctx is cancelled:
+func (s *Server) sendDataLoop(ctx context.Context) {
 	// Keep goroutine on specific CPU core to maintain cache locality:
 	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
 
 	for {
 		// Rate limit our sending:
-		if werr := s.limiter.Wait(context.Background()); werr != nil {
+		if werr := s.limiter.Wait(ctx); werr != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			continue
 		}
 
-		if s.nakRegions.IsAllAcked() {
-			time.Sleep(250 * time.Millisecond)
+		s.nextLock.Lock()
+		allAcked := s.nakRegions.IsAllAcked()
+		s.nextLock.Unlock()
+		if allAcked || s.quiesced() || s.Paused() {
+			select {
+			case <-s.options.Clock.After(250 * time.Millisecond):
+			case <-ctx.Done():
+				return
+			}
 			continue
 		}
 
@@ -212,11 +849,41 @@ func (s *Server) sendData() error {
 		//fmt.Printf("\bnew = %15d\n", nextNak)
 		s.nextRegion = nextNak
 	}
+	if s.retransmitsExhausted() {
+		return nil
+	}
+
+	// The last region of the tarball is short; never read past its final padding byte:
+	size := int64(s.regionSize)
+	if s.maxRegionRetransmits > 0 {
+		// Stay within one region of the grid so that each send counts against exactly one region:
+		size -= s.nextRegion % int64(s.regionSize)
+	}
+	if remaining := s.size - s.nextRegion; remaining < size {
+		size = remaining
+	}
+
+	// Never read into regions of modified source files:
+	for _, r := range s.excluded {
+		if r.start > s.nextRegion && r.start-s.nextRegion < size {
+			size = r.start - s.nextRegion
+		}
+	}
 
-	// Read data from virtual tarball:
+	// Read data from virtual tarball straight into the datagram after its prefix. sendfile cannot address the
+	// unconnected multicast socket, and the padding between files is in no source file, so this one copy out of the
+	// page cache is as few as the data path gets:
 	n := 0
-	buf := make([]byte, s.regionSize)
-	n, err = s.tb.ReadAt(buf, s.nextRegion)
+	if int64(len(s.dataBuf)) < protocolDataMsgPrefixSize+size {
+		// Sized for a whole region, which is only set as the server starts:
+		s.dataBuf = make([]byte, protocolDataMsgPrefixSize+int(s.regionSize))
+	}
+	buf := s.dataBuf[protocolDataMsgPrefixSize : protocolDataMsgPrefixSize+size]
+	n, err = s.reader.ReadAt(buf, s.nextRegion)
+	if err == io.EOF && n == len(buf) {
+		// io.ReaderAt may report EOF along with the final bytes:
+		err = nil
+	}
 	if err == ErrOutOfRange {
 		fmt.Printf("ReadAt: %s\n", err)
 		return nil
@@ -230,14 +897,14 @@ func (s *Server) sendData() error {
 
 	// Send data message:
 	m := 0
-	dataMsg := dataMessage(s.hashId, s.nextRegion, buf)
-	m, err = s.m.SendData(dataMsg)
+	putDataMessagePrefix(s.dataBuf, s.hashId, s.nextRegion)
+	m, err = s.m.SendData(s.dataBuf[:protocolDataMsgPrefixSize+n])
 	if err != nil {
 		// Rewind due to error:
 		s.nextRegion = lastRegion
 		return err
 	}
-	s.lastSendTime = time.Now()
+	s.lastSendTime = s.options.Clock.Now()
 	if m < len(buf) {
 		fmt.Printf("m < buf: %d < %d\n", m, len(buf))
 	}
@@ -248,15 +915,30 @@ func (s *Server) sendData() error {
 
 	// Advance to next region:
 	s.nextRegion += int64(n)
-	if s.nextRegion >= s.tb.size {
+	if s.nextRegion >= s.size {
 		s.nextRegion = 0
 	}
 
 	return nil
 }
 
+// Sends a response to a metadata request to the group, or to just the requester with UnicastMetadata:
+func (s *Server) respondMetadata(ctrl UDPMessage, msg []byte) error {
+	err := error(nil)
+	if s.options.UnicastMetadata && ctrl.SourceAddress != nil {
+		_, err = s.m.SendControlToClientAt(msg, ctrl.SourceAddress)
+	} else {
+		_, err = s.m.SendControlToClient(msg)
+	}
+	return err
+}
+
 func (s *Server) processControl(ctrl UDPMessage) error {
 	hashId, op, data, err := extractServerMessage(ctrl)
+	if isMalformed(err) {
+		s.droppedMalformed++
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -271,31 +953,105 @@ func (s *Server) processControl(ctrl UDPMessage) error {
 	case RequestMetadataHeader:
 		_ = data
 
+		if !s.allowResponse(&s.metadataLimiter) {
+			return nil
+		}
 		// Respond with metadata header:
-		_, err = s.m.SendControlToClient(controlToClientMessage(hashId, RespondMetadataHeader, s.metadataHeader))
+		err = s.respondMetadata(ctrl, controlToClientMessage(hashId, RespondMetadataHeader, s.metadataHeader))
 	case RequestMetadataSection:
+		if len(data) < 2 {
+			return ErrMessageTooShort
+		}
 		sectionIndex := byteOrder.Uint16(data[0:2])
 		if sectionIndex >= uint16(len(s.metadataSections)) {
 			// Out of range
 			return nil
 		}
+		if s.coalesceSection(sectionIndex) {
+			return nil
+		}
 
+		if !s.allowResponse(&s.metadataLimiter) {
+			return nil
+		}
 		// Send metadata section message:
 		section := s.metadataSections[sectionIndex]
-		_, err = s.m.SendControlToClient(controlToClientMessage(hashId, RespondMetadataSection, section))
+		err = s.respondMetadata(ctrl, controlToClientMessage(hashId, RespondMetadataSection, section))
+	case RequestTOCHeader:
+		if !s.allowResponse(&s.metadataLimiter) {
+			return nil
+		}
+		err = s.respondMetadata(ctrl, controlToClientMessage(hashId, RespondTOCHeader, s.tocHeader))
+	case RequestTOCSection:
+		if len(data) < 2 {
+			return ErrMessageTooShort
+		}
+		sectionIndex := byteOrder.Uint16(data[0:2])
+		if sectionIndex >= uint16(len(s.tocSections)) {
+			// Out of range
+			return nil
+		}
+
+		if !s.allowResponse(&s.metadataLimiter) {
+			return nil
+		}
+		err = s.respondMetadata(ctrl, controlToClientMessage(hashId, RespondTOCSection, s.tocSections[sectionIndex]))
+	case RequestAnnounce:
+		// Client already knows our HashId; announce now rather than waiting for the ticker:
+		if !s.allowResponse(&s.announceLimiter) {
+			return nil
+		}
+		_, err = s.m.SendControlToClient(s.announceMsg)
+	case RequestManifestDigest:
+		// Respond with digest of the whole metadata so clients can validate their cached copy:
+		if !s.allowResponse(&s.metadataLimiter) {
+			return nil
+		}
+		digest := append(append([]byte(nil), s.metadataDigest...), s.signature...)
+		err = s.respondMetadata(ctrl, controlToClientMessage(hashId, RespondManifestDigest, digest))
+	case RequestFileEntries:
+		// Scanning the file list costs more than any other answer, so the limit applies first:
+		if !s.allowResponse(&s.metadataLimiter) {
+			return nil
+		}
+		entries, ferr := s.fileEntries(data)
+		if ferr != nil {
+			return ferr
+		}
+		err = s.respondMetadata(ctrl, controlToClientMessage(hashId, RespondFileEntries, entries))
 	case AckDataSection:
+		ack, naks, err := decodeAckDataSection(data)
+		if err != nil {
+			return err
+		}
+		if s.options.MetadataOnly {
+			if s.options.DataRedirect == nil || !s.allowResponse(&s.metadataLimiter) {
+				return nil
+			}
+			err = s.respondMetadata(ctrl, controlToClientMessage(hashId, RedirectData, encodeRedirectData(s.options.DataRedirect)))
+			if isENOBUFS(err) {
+				fmt.Print("\r!")
+				err = nil
+			}
+			return err
+		}
+
 		s.nextLock.Lock()
-		i := 0
-		var ack Region
-		ack, i = readRegion(data, i)
-		s.nakRegions.Ack(ack.start, ack.endEx)
-		for i < len(data) {
-			var nak Region
-			nak, i = readRegion(data, i)
+		if s.batch == batchSweep {
+			// The pass sends everything regardless:
+			s.nextLock.Unlock()
+			return nil
+		}
+		if s.batch == batchNone {
+			s.nakRegions.Ack(ack.start, ack.endEx)
+			s.newRetransmitRound()
+		}
+		for _, nak := range naks {
 			//fmt.Printf("\bnak [%15v %15v]\n", nak.start, nak.endEx)
 			s.nakRegions.Nak(nak.start, nak.endEx)
 		}
-		s.lastAckTime = time.Now()
+		s.ackExcluded()
+		s.lastAckTime = s.options.Clock.Now()
 		s.nextLock.Unlock()
 		return nil
 	}
@@ -308,57 +1064,218 @@ func (s *Server) processControl(ctrl UDPMessage) error {
 	return err
 }
 
-func readRegion(data []byte, i int) (Region, int) {
-	start, n := binary.Uvarint(data[i:])
-	i += n
-	endEx, n := binary.Uvarint(data[i:])
-	i += n
-	return Region{int64(start), int64(endEx)}, i
+// Server state files hold the HashId and metadata digest the state applies to, the next region to send as an int64,
+// then the serialized NakRegions. Written to a temporary file first so that a crash never leaves a partial file:
+func (s *Server) saveState() error {
+	s.nextLock.Lock()
+	naks, err := s.nakRegions.MarshalBinary()
+	next := s.nextRegion
+	s.nextLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 0, hashSize+metadataDigestSize+8+len(naks))
+	buf = append(buf, s.hashId...)
+	buf = append(buf, s.metadataDigest...)
+	buf = append(buf, make([]byte, 8)...)
+	byteOrder.PutUint64(buf[len(buf)-8:], uint64(next))
+	buf = append(buf, naks...)
+
+	tmp := s.options.StatePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.options.StatePath)
 }
 
-func (s *Server) buildMetadata() error {
-	err := error(nil)
+// Restores state saved for the same HashId and metadata; state for anything else is ignored:
+func (s *Server) loadState() error {
+	buf, err := ioutil.ReadFile(s.options.StatePath)
+	if err != nil {
+		return err
+	}
+	prefix := hashSize + metadataDigestSize + 8
+	if len(buf) < prefix {
+		return ErrBadNakState
+	}
+	if compareHashes(buf[:hashSize], s.hashId) != 0 || !bytes.Equal(buf[hashSize:hashSize+metadataDigestSize], s.metadataDigest) {
+		return nil
+	}
+	next := int64(byteOrder.Uint64(buf[prefix-8 : prefix]))
 
-	tb := s.tb
-	mdSize := (2 + 8) + (len(tb.files) * (2 + 40 + 8 + 4 + 32))
-	mdBuf := bytes.NewBuffer(make([]byte, 0, mdSize))
+	r := &NakRegions{}
+	if err := r.UnmarshalBinary(buf[prefix:]); err != nil {
+		return err
+	}
+	if r.size != s.size || next < 0 || next >= s.size {
+		return ErrBadNakState
+	}
 
-	writePrimitive := func(data interface{}) {
-		if err == nil {
-			err = binary.Write(mdBuf, byteOrder, data)
-		}
+	s.nextLock.Lock()
+	s.nakRegions = r
+	s.ackExcluded()
+	s.nextRegion = next
+	// Quiescing counts from the restart:
+	s.lastAckTime = s.options.Clock.Now()
+	naked := s.nakRegions.NakedBytes()
+	s.nextLock.Unlock()
+	fmt.Printf("Resuming with %s left to send\n", humanize.IBytes(uint64(naked)))
+	return nil
+}
+
+// Compresses the tarball for GzipStream into a temporary file and serves the stream in its place, read straight from
+// the file without the region cache:
+func (s *Server) compress() error {
+	f, err := ioutil.TempFile("", "lancaster-gzip-")
+	if err != nil {
+		return err
 	}
-	writeString := func(s string) {
-		writePrimitive(uint16(len(s)))
-		if err == nil {
-			_, err = mdBuf.WriteString(s)
+	s.stream = f
+	if err := gzipTarball(s.tb, f); err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = stat.Size()
+	s.cache = nil
+	s.reader = NewCountingReaderAt(f, s.size)
+	fmt.Printf("%15s  compressed to %s\n", humanize.Comma(s.tb.Size()), humanize.Comma(s.size))
+	return nil
+}
+
+// Removes the spooled gzip stream, if any, once serving stops:
+func (s *Server) removeStream() {
+	if s.stream == nil {
+		return
+	}
+	s.stream.Close()
+	os.Remove(s.stream.Name())
+}
+
+// Answers a RequestFileEntries from the file list directly, for clients after a few files that would rather not
+// fetch every metadata section:
+func (s *Server) fileEntries(request []byte) ([]byte, error) {
+	path, prefix, first, err := decodeFileEntriesRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []*TarballFile(nil)
+	for _, f := range s.tb.Files() {
+		if f.Path == path || (prefix && strings.HasPrefix(f.Path, path)) {
+			matches = append(matches, f)
 		}
 	}
+	if int64(first) < int64(len(matches)) {
+		matches = matches[first:]
+	} else {
+		matches = nil
+	}
+	return encodeFileEntries(request, newMetadataHeader(s.tb.Size(), s.tb.Options()), matches, s.sectionSize())
+}
 
-	writePrimitive(tb.size)
-	writePrimitive(uint32(len(tb.files)))
+// Metadata is a function of the file list alone: files are encoded in the reader's order with no map iteration or
+// construction time involved, so a restarted server with unchanged sources and the same datagram size serves
+// byte-identical metadata and sections under the same HashId.
+func (s *Server) buildMetadata() error {
+	tb := s.tb
 	fmt.Print("Files:\n")
-	for _, f := range tb.files {
-		writeString(f.Path)
-		writePrimitive(f.Size)
-		writePrimitive(f.Mode)
-		writeString(f.SymlinkDestination)
+	for _, f := range tb.Files() {
 		fmt.Printf("  %v %15s '%s'\n", f.Mode, humanize.Comma(f.Size), f.Path)
 	}
+
+	md := []byte(nil)
+	if s.options.MetadataCachePath != "" && !s.options.RegenerateMetadata && s.stream == nil {
+		// Cached metadata would record the size of a stream compressed before:
+		md = s.cachedMetadata()
+	}
+	if md == nil {
+		// Hashes deferred by LazyHash are needed now:
+		if err := tb.HashContents(); err != nil {
+			return err
+		}
+		err := error(nil)
+		header := newMetadataHeader(tb.Size(), tb.Options())
+		if s.stream != nil {
+			header.streamSize = s.size
+		}
+		md, err = encodeHeaderAndFiles(header, tb.Files())
+		if err != nil {
+			return err
+		}
+		if s.options.MetadataCachePath != "" {
+			if err := saveServerMetadataCache(s.options.MetadataCachePath, s.hashId, md); err != nil {
+				fmt.Fprintf(os.Stderr, "unable to cache metadata: %s\n", err)
+			}
+		}
+	}
+	s.metadataDigest = metadataDigest(md)
+	if s.options.SigningKey != nil {
+		s.signature = signMetadataDigest(s.options.SigningKey, s.metadataDigest)
+	}
+
+	// Slice into sections; the header carries the signature block if signed:
+	s.metadataHeader, s.metadataSections = s.buildSections(md)
+	// Advertise our sizes so that clients configured with a different datagram size still agree with us:
+	sizes := make([]byte, metadataHeaderMsgSize-sectionCountMsgSize)
+	byteOrder.PutUint16(sizes[0:2], s.dataRegionSize())
+	byteOrder.PutUint16(sizes[2:4], uint16(s.sectionSize()))
+	s.metadataHeader = append(s.metadataHeader, sizes...)
+	s.metadataHeader = append(s.metadataHeader, s.signature...)
+	s.sectionSentAt = make(map[uint16]time.Time)
+
+	// Table of contents is served separately for clients that only need file locations:
+	s.tocHeader, s.tocSections = s.buildSections(encodeTOC(tb.Files()))
+
+	return nil
+}
+
+// Returns encoded metadata from the cache if it was built for this HashId and no file's size or modification time
+// has changed since; otherwise nil.
+func (s *Server) cachedMetadata() []byte {
+	hashId, files, md, err := loadServerMetadataCache(s.options.MetadataCachePath)
 	if err != nil {
-		return err
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "ignoring metadata cache: %s\n", err)
+		}
+		return nil
 	}
+	// HashId covers paths, sizes, modes and layout; modification times and hashes are checked here:
+	if compareHashes(hashId, s.hashId) != 0 || len(files) != len(s.tb.Files()) {
+		return nil
+	}
+	for i, f := range s.tb.Files() {
+		cf := files[i]
+		if cf.Path != f.Path || cf.Size != f.Size || !cf.ModTime.Equal(f.ModTime) || !bytes.Equal(cf.Hash, f.Hash) || cf.BlockSize != f.BlockSize {
+			return nil
+		}
+	}
+	return md
+}
 
-	// Slice into sections:
-	md := mdBuf.Bytes()
+// Bytes of tarball data sent per data message:
+func (s *Server) dataRegionSize() uint16 {
+	return uint16(s.m.MaxMessageSize() - (protocolDataMsgPrefixSize))
+}
+
+// Bytes of metadata or table of contents sent per section message:
+func (s *Server) sectionSize() int {
+	return s.m.MaxMessageSize() - (protocolControlPrefixSize + metadataSectionMsgSize)
+}
 
-	sectionSize := (s.m.MaxMessageSize() - (protocolControlPrefixSize + metadataSectionMsgSize))
+// Slices data into sections prefixed with their uint16 index and checksum, and a header describing how many sections
+// there are:
+func (s *Server) buildSections(md []byte) ([]byte, [][]byte) {
+	sectionSize := s.sectionSize()
 	sectionCount := len(md) / sectionSize
 	if sectionCount*sectionSize < len(md) {
 		sectionCount++
 	}
 
-	s.metadataSections = make([][]byte, 0, sectionCount)
+	sections := make([][]byte, 0, sectionCount)
 	o := 0
 	for n := 0; n < sectionCount; n++ {
 		// Determine end point of metadata slice:
@@ -367,19 +1284,13 @@ func (s *Server) buildMetadata() error {
 			l = len(md) - o
 		}
 
-		// Prepend section with uint16 of `n`:
-		ms := make([]byte, metadataSectionMsgSize, metadataSectionMsgSize+l)
-		byteOrder.PutUint16(ms[0:2], uint16(n))
-		ms = append(ms, md[o:o+l]...)
-
-		// Add section to list:
-		s.metadataSections = append(s.metadataSections, ms)
+		// Prepend section with uint16 of `n` and its checksum:
+		sections = append(sections, encodeSection(uint16(n), md[o:o+l]))
 		o += l
 	}
 
-	// Create metadata header to describe how many sections there are:
-	s.metadataHeader = make([]byte, metadataHeaderMsgSize)
-	byteOrder.PutUint16(s.metadataHeader, uint16(sectionCount))
+	header := make([]byte, sectionCountMsgSize)
+	byteOrder.PutUint16(header, uint16(sectionCount))
 
-	return nil
+	return header, sections
 }
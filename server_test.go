@@ -0,0 +1,1269 @@
+// server_test.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Clock that only moves when advanced:
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []*fakeTimer
+}
+
+type fakeTimer struct {
+	c        chan time.Time
+	next     time.Time
+	interval time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1500000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Tick(d time.Duration) <-chan time.Time  { return c.add(d, d) }
+func (c *fakeClock) After(d time.Duration) <-chan time.Time { return c.add(d, 0) }
+
+func (c *fakeClock) add(d time.Duration, interval time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &fakeTimer{c: make(chan time.Time, 1), next: c.now.Add(d), interval: interval}
+	c.waiters = append(c.waiters, t)
+	return t.c
+}
+
+// Moves time forward, firing any timers that come due; like time.Ticker, slow receivers miss ticks:
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, t := range c.waiters {
+		for !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			if t.interval == 0 {
+				break
+			}
+			t.next = t.next.Add(t.interval)
+		}
+		if t.interval != 0 || t.next.After(c.now) {
+			waiters = append(waiters, t)
+		}
+	}
+	c.waiters = waiters
+}
+
+func TestServer_MetadataCache(t *testing.T) {
+	const fname = "server.cache"
+	defer os.Remove(fname)
+	createTestFile("cached.txt", []byte("cached\n"))
+	defer os.Remove("cached.txt")
+
+	newFiles := func() []*TarballFile {
+		return []*TarballFile{
+			&TarballFile{Path: "cached.txt", LocalPath: "cached.txt", Size: 7, Mode: 0644},
+		}
+	}
+	options := getOptions()
+	options.HashFiles = true
+	tb, err := NewVirtualTarballReader(newFiles(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	md, err := encodeMetadata(tb.size, metadataFlags(tb.options), tb.files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveServerMetadataCache(fname, tb.HashId(), md); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{tb: tb, hashId: tb.HashId(), options: ServerOptions{MetadataCachePath: fname}}
+	if !bytes.Equal(s.cachedMetadata(), md) {
+		t.Fatal("expected cached metadata to be valid")
+	}
+
+	// Unchanged files reuse cached hashes:
+	files := newFiles()
+	if n, err := applyServerMetadataCache(fname, files, options); err != nil || n != 1 {
+		t.Fatalf("expected 1 applied; got %d, %v", n, err)
+	}
+	if !bytes.Equal(files[0].Hash, tb.files[0].Hash) {
+		t.Fatal("expected cached hash to be applied")
+	}
+
+	// Hashes cached at another hash size or block size are not served as they are:
+	for _, o := range []VirtualTarballOptions{{HashFiles: true, HashSize: 8}, {HashFiles: true, BlockSize: 4}} {
+		files = newFiles()
+		if n, err := applyServerMetadataCache(fname, files, o); err != nil || n != 0 || files[0].Hash != nil {
+			t.Fatalf("expected no hash applied for %+v; got %d, %v", o, n, err)
+		}
+	}
+
+	// A changed modification time invalidates the cache:
+	later := tb.files[0].ModTime.Add(time.Second)
+	os.Chtimes("cached.txt", later, later)
+	tb.files[0].ModTime = later
+	if s.cachedMetadata() != nil {
+		t.Fatal("expected cached metadata to be stale")
+	}
+	files = newFiles()
+	applyServerMetadataCache(fname, files, options)
+	if files[0].Hash != nil {
+		t.Fatal("expected stale hash not to be applied")
+	}
+}
+
+func TestServer_LazyHash(t *testing.T) {
+	createTestFile("lazy.txt", []byte("lazy\n"))
+	defer os.Remove("lazy.txt")
+
+	options := getOptions()
+	options.HashFiles = true
+	options.LazyHash = true
+	tb, err := NewVirtualTarballReader([]*TarballFile{
+		&TarballFile{Path: "lazy.txt", LocalPath: "lazy.txt", Size: 5, Mode: 0644},
+	}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	// Size and id are known before hashing:
+	if tb.Size() != 6 {
+		t.Fatalf("size = %d; expected 6", tb.Size())
+	}
+	if tb.files[0].Hash != nil {
+		t.Fatal("expected hashing to be deferred")
+	}
+	eager := newTarballReader(t, []*TarballFile{
+		&TarballFile{Path: "lazy.txt", LocalPath: "lazy.txt", Size: 5, Mode: 0644},
+	})
+	defer eager.Close()
+	if !bytes.Equal(tb.HashId(), eager.HashId()) {
+		t.Fatal("expected id not to depend on deferred hashing")
+	}
+
+	m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 180), Port: 13790}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(m, tb, ServerOptions{})
+	if err := s.buildMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	expected := sha256.Sum256([]byte("lazy\n"))
+	if !bytes.Equal(tb.files[0].Hash, expected[:]) {
+		t.Fatalf("hash = %x; expected %x after building metadata", tb.files[0].Hash, expected)
+	}
+}
+
+func TestServer_SourceModified(t *testing.T) {
+	createTestFile("live1.txt", []byte("live\n"))
+	createTestFile("live2.txt", []byte("stable\n"))
+	defer os.Remove("live1.txt")
+	defer os.Remove("live2.txt")
+
+	tb := newTarballReader(t, []*TarballFile{
+		&TarballFile{Path: "live1.txt", LocalPath: "live1.txt", Size: 5, Mode: 0644},
+		&TarballFile{Path: "live2.txt", LocalPath: "live2.txt", Size: 7, Mode: 0644},
+	})
+	defer tb.Close()
+
+	s := &Server{tb: tb, hashId: tb.HashId()}
+	s.nakRegions = NewNakRegions(tb.size)
+	if err := s.checkSources(); err != nil || len(s.excluded) != 0 {
+		t.Fatalf("expected no modified sources; got %v, %v", err, s.excluded)
+	}
+
+	later := tb.files[0].ModTime.Add(time.Second)
+	os.Chtimes("live1.txt", later, later)
+	if err := s.checkSources(); err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, s.nakRegions.Naks(), []Region{{6, 14}})
+
+	s.options.AbortOnSourceModified = true
+	os.Chtimes("live2.txt", later, later)
+	if err := s.checkSources(); err != ErrSourceModified {
+		t.Fatalf("expected ErrSourceModified; got %v", err)
+	}
+}
+
+func TestServer_Clock(t *testing.T) {
+	createTestFile("clocked.txt", []byte("tick tock\n"))
+	defer os.Remove("clocked.txt")
+	tb := newTarballReader(t, []*TarballFile{
+		&TarballFile{Path: "clocked.txt", LocalPath: "clocked.txt", Size: 10, Mode: 0644},
+	})
+	defer tb.Close()
+
+	clock := newFakeClock()
+	s := NewServer(nil, tb, ServerOptions{Clock: clock})
+	s.nakRegions = NewNakRegions(tb.size)
+
+	// Bandwidth is measured against the injected clock:
+	s.timeLast = clock.Now()
+	s.bytesSent = 4096
+	clock.Advance(2 * time.Second)
+	s.reportBandwidth()
+	if s.lastRate != 2048 {
+		t.Fatalf("lastRate = %v; expected 2048", s.lastRate)
+	}
+
+	ack := encodeAckDataSection(Region{0, 4}, nil, 64)
+	msg := controlToServerMessage(s.hashId, AckDataSection, ack)
+	if err := s.processControl(UDPMessage{Data: msg}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.lastAckTime.Equal(clock.Now()) {
+		t.Fatalf("lastAckTime = %v; expected %v", s.lastAckTime, clock.Now())
+	}
+
+	// Tickers only fire once time is advanced past their interval:
+	tick := clock.Tick(time.Second)
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case <-tick:
+		t.Fatal("tick fired early")
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	select {
+	case <-tick:
+	default:
+		t.Fatal("tick did not fire")
+	}
+}
+
+func TestServer_RequestAnnounce(t *testing.T) {
+	newMulticast := func() *Multicast {
+		m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 179), Port: 13780}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.SetLoopback(true)
+		m.SetTTL(0)
+		return m
+	}
+
+	createTestFile("pulled.txt", []byte("pulled\n"))
+	defer os.Remove("pulled.txt")
+	tb := newTarballReader(t, []*TarballFile{
+		&TarballFile{Path: "pulled.txt", LocalPath: "pulled.txt", Size: 7, Mode: 0644},
+	})
+	defer tb.Close()
+
+	sm := newMulticast()
+	defer sm.Close()
+	if err := sm.SendsControlToClient(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.ListensControlToServer(); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(sm, tb, ServerOptions{})
+	s.announceMsg = controlToClientMessage(s.hashId, AnnounceTarball, nil)
+
+	cm := newMulticast()
+	defer cm.Close()
+	if err := cm.SendsControlToServer(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.ListensControlToClient(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests for other tarballs are ignored; the matching one is announced immediately:
+	c := NewClient(cm, ClientOptions{HashId: []byte("notserved")})
+	if err := c.ask(); err != nil {
+		t.Skipf("multicast send unavailable: %v", err)
+	}
+	c = NewClient(cm, ClientOptions{HashId: s.hashId})
+	if err := c.ask(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case ctrl := <-sm.ControlToServer:
+			if err := s.processControl(ctrl); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Skip("no request received; multicast loopback unavailable")
+		}
+	}
+
+	select {
+	case msg := <-cm.ControlToClient:
+		hashId, op, _, err := extractClientMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != AnnounceTarball || compareHashes(hashId, s.hashId) != 0 {
+			t.Fatalf("unexpected reply op %v for %x", op, hashId)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no announcement received")
+	}
+	select {
+	case <-cm.ControlToClient:
+		t.Fatal("expected a single announcement")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServer_DataQuiesce(t *testing.T) {
+	createTestFile("quiesce.txt", []byte("quiet\n"))
+	defer os.Remove("quiesce.txt")
+	tb := newTarballReader(t, []*TarballFile{
+		&TarballFile{Path: "quiesce.txt", LocalPath: "quiesce.txt", Size: 6, Mode: 0644},
+	})
+	defer tb.Close()
+
+	clock := newFakeClock()
+	s := NewServer(nil, tb, ServerOptions{Clock: clock})
+	s.lastAckTime = clock.Now()
+
+	// Default keeps sending no matter how long clients are quiet:
+	clock.Advance(time.Hour)
+	if s.quiesced() {
+		t.Fatal("expected no quiesce by default")
+	}
+
+	if err := s.SetDataQuiesce(-time.Second); err != ErrNegativeQuiesce {
+		t.Fatalf("expected ErrNegativeQuiesce; got %v", err)
+	}
+	if err := s.SetDataQuiesce(500 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	s.lastAckTime = clock.Now()
+	clock.Advance(500 * time.Millisecond)
+	if s.quiesced() {
+		t.Fatal("quiesced within the window")
+	}
+	clock.Advance(time.Millisecond)
+	if !s.quiesced() {
+		t.Fatal("expected quiesce after the window")
+	}
+}
+
+func TestServer_Pause(t *testing.T) {
+	tb := newScriptedReader([]*TarballFile{&TarballFile{Path: "pause.bin", Size: 29, Mode: 0644}})
+	m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 191), Port: 13910}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if err := m.SendsData(); err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+
+	clock := newFakeClock()
+	s := NewServer(m, tb, ServerOptions{Clock: clock})
+	s.regionSize = 10
+	s.nakRegions = NewNakRegions(tb.size)
+	s.nakRegions.Ack(0, tb.size)
+
+	s.Pause()
+	if !s.Paused() {
+		t.Fatal("expected paused")
+	}
+	// NAKs are still collected while paused:
+	ack := encodeAckDataSection(Region{}, []Region{{0, 10}}, 100)
+	if err := s.processControl(UDPMessage{Data: controlToServerMessage(tb.HashId(), AckDataSection, ack)}); err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, s.nakRegions.Naks(), []Region{{0, 10}})
+
+	type result struct {
+		regions, bytes int64
+		err            error
+	}
+	done := make(chan result, 1)
+	go func() {
+		regions, bytes, err := s.sendNaked(context.Background())
+		done <- result{regions, bytes, err}
+	}()
+
+	// Nothing is sent however long the pause lasts:
+	for i := 0; i < 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+		clock.Advance(250 * time.Millisecond)
+	}
+	select {
+	case r := <-done:
+		t.Fatalf("sent %d regions while paused; err = %v", r.regions, r.err)
+	default:
+	}
+	s.nextLock.Lock()
+	sent := s.bytesSent
+	s.nextLock.Unlock()
+	if sent != 0 {
+		t.Fatalf("sent %d bytes while paused", sent)
+	}
+
+	// Resuming sends what was NAKed during the pause:
+	s.Resume()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case r := <-done:
+			if r.err != nil {
+				t.Skipf("multicast send unavailable: %v", r.err)
+			}
+			if r.regions != 1 || r.bytes != 10 {
+				t.Fatalf("sent %d regions of %d bytes; expected the NAKed region", r.regions, r.bytes)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+			clock.Advance(250 * time.Millisecond)
+		case <-timeout:
+			t.Fatal("nothing sent after resuming")
+		}
+	}
+}
+
+func TestServer_RunContext(t *testing.T) {
+	tb := newScriptedReader([]*TarballFile{&TarballFile{Path: "stop.bin", Size: 29, Mode: 0644}})
+	m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 193), Port: 13930}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetTTL(0)
+	s := NewServer(m, tb, ServerOptions{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.RunContext(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Cancelling stops the data loop too, which would otherwise send on closed sockets:
+	cancel()
+	select {
+	case err := <-stopped:
+		if _, ok := err.(net.Error); ok {
+			t.Skipf("multicast unavailable: %v", err)
+		}
+		if err != context.Canceled {
+			t.Fatalf("err = %v; expected context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still running after cancel")
+	}
+	if _, err := m.SendData([]byte("after")); err == nil {
+		t.Fatal("expected sockets to be closed")
+	}
+}
+
+func TestServer_AnnounceWith(t *testing.T) {
+	n := newMemoryNetwork()
+	group := &net.UDPAddr{IP: net.IPv4(239, 0, 0, 197), Port: 13970}
+	m, listener := n.newMulticast(t, group), n.newMulticast(t, group)
+	defer m.Close()
+	defer listener.Close()
+	if err := m.SendsControlToClient(); err != nil {
+		t.Fatal(err)
+	}
+	if err := listener.ListensControlToClient(); err != nil {
+		t.Fatal(err)
+	}
+
+	tb := newScriptedReader([]*TarballFile{&TarballFile{Path: "many.bin", Size: 8, Mode: 0644}})
+	s := NewServer(m, tb, ServerOptions{AnnounceWith: [][]byte{[]byte("other-01"), []byte("other-02")}})
+
+	// One datagram announces every tarball:
+	s.announce()
+	hashIds, err := AnnouncedHashIds(<-listener.ControlToClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	announced := []string{}
+	for _, hashId := range hashIds {
+		announced = append(announced, string(hashId))
+	}
+	if strings.Join(announced, ",") != string(tb.HashId())+",other-01,other-02" {
+		t.Fatalf("announced %q", announced)
+	}
+	select {
+	case msg := <-listener.ControlToClient:
+		t.Fatalf("unexpected second announcement %q", msg.Data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Tarball served from memory whose reads can be scripted to fail or come up short:
+type scriptedReader struct {
+	size   int64
+	hashId []byte
+	files  []*TarballFile
+	// Result of each ReadAt; nil fills buf with zeros:
+	read func(buf []byte, offset int64) (int, error)
+}
+
+func newScriptedReader(files []*TarballFile) *scriptedReader {
+	r := &scriptedReader{hashId: []byte("scripted"), files: files}
+	for _, f := range files {
+		f.offset = r.size
+		r.size += f.Size + 1
+	}
+	return r
+}
+
+func (r *scriptedReader) Size() int64                    { return r.size }
+func (r *scriptedReader) HashId() []byte                 { return r.hashId }
+func (r *scriptedReader) Files() []*TarballFile          { return r.files }
+func (r *scriptedReader) Options() VirtualTarballOptions { return VirtualTarballOptions{} }
+func (r *scriptedReader) ModifiedFiles() []*TarballFile  { return nil }
+func (r *scriptedReader) HashContents() error            { return nil }
+
+func (r *scriptedReader) ReadAt(buf []byte, offset int64) (int, error) {
+	if r.read != nil {
+		return r.read(buf, offset)
+	}
+	for i := range buf {
+		buf[i] = 0
+	}
+	return len(buf), nil
+}
+
+func TestServer_ScriptedMetadataSections(t *testing.T) {
+	files := []*TarballFile{}
+	for i := 0; i < 20; i++ {
+		files = append(files, &TarballFile{Path: fmt.Sprintf("dir/file%02d.bin", i), Size: int64(i * 100), Mode: 0644})
+	}
+	tb := newScriptedReader(files)
+
+	m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 180), Port: 13790}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Force many small sections:
+	m.SetDatagramSize(protocolControlPrefixSize + metadataSectionMsgSize + 64)
+	s := NewServer(m, tb, ServerOptions{})
+	if err := s.buildMetadata(); err != nil {
+		t.Fatal(err)
+	}
+
+	count := byteOrder.Uint16(s.metadataHeader[0:2])
+	if int(count) != len(s.metadataSections) || count < 2 {
+		t.Fatalf("header count %d; %d sections", count, len(s.metadataSections))
+	}
+	d := newMetadataDecoder(count, 0)
+	for _, section := range s.metadataSections {
+		if len(section) > metadataSectionMsgSize+64 {
+			t.Fatalf("section of %d bytes exceeds datagram", len(section))
+		}
+		index, data, err := decodeSection(section)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.AddSection(index, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size, decoded, err := d.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != tb.size || len(decoded) != len(files) || decoded[19].Path != "dir/file19.bin" || decoded[19].Size != 1900 {
+		t.Fatalf("decoded size %d with %d files", size, len(decoded))
+	}
+}
+
+func TestServer_ScriptedReads(t *testing.T) {
+	tb := newScriptedReader([]*TarballFile{&TarballFile{Path: "data.bin", Size: 99, Mode: 0644}})
+
+	m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 180), Port: 13790}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	s := NewServer(m, tb, ServerOptions{})
+	s.regionSize = 10
+	s.nakRegions = NewNakRegions(tb.size)
+
+	// Read errors rewind and leave the region NAKed:
+	errDisk := errors.New("disk on fire")
+	tb.read = func(buf []byte, offset int64) (int, error) { return 0, errDisk }
+	if err := s.sendData(); err != errDisk {
+		t.Fatalf("expected injected error; got %v", err)
+	}
+	if s.nextRegion != 0 || s.nakRegions.IsAcked(0, 10) {
+		t.Fatalf("expected rewind; nextRegion = %d", s.nextRegion)
+	}
+
+	// Short reads send and ACK only what was read:
+	if err := m.SendsData(); err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	tb.read = func(buf []byte, offset int64) (int, error) { return copy(buf, "abc"), nil }
+	if err := s.sendData(); err != nil {
+		t.Skipf("multicast send unavailable: %v", err)
+	}
+	if s.nextRegion != 3 {
+		t.Fatalf("nextRegion = %d; expected 3", s.nextRegion)
+	}
+	cmp(t, s.nakRegions.Naks(), []Region{{3, tb.size}})
+
+	// Every send reads into the same datagram:
+	first := &s.dataBuf[0]
+	if err := s.sendData(); err != nil {
+		t.Fatal(err)
+	}
+	if &s.dataBuf[0] != first {
+		t.Fatal("expected the datagram buffer to be reused")
+	}
+}
+
+func TestServer_RegionCache(t *testing.T) {
+	tb := newScriptedReader([]*TarballFile{&TarballFile{Path: "hot.bin", Size: 99, Mode: 0644}})
+	reads := 0
+	tb.read = func(buf []byte, offset int64) (int, error) {
+		reads++
+		for i := range buf {
+			buf[i] = byte(offset) + byte(i)
+		}
+		return len(buf), nil
+	}
+	s := NewServer(nil, tb, ServerOptions{RegionCacheSize: 30})
+
+	buf := make([]byte, 10)
+	for _, offset := range []int64{0, 10, 0, 20, 0, 30, 10} {
+		if _, err := s.reader.ReadAt(buf, offset); err != nil {
+			t.Fatal(err)
+		}
+		if buf[0] != byte(offset) || buf[9] != byte(offset)+9 {
+			t.Fatalf("wrong data at %d: %v", offset, buf)
+		}
+	}
+	// 0 stays hot; 10 is evicted by 30:
+	stats := s.RegionCacheStats()
+	if reads != 5 || stats.Hits != 2 || stats.Misses != 5 || stats.Bytes != 30 || stats.Entries != 3 {
+		t.Fatalf("reads = %d; stats = %+v", reads, stats)
+	}
+	if s.reader.TotalBytes() != 70 {
+		t.Fatalf("cache hits must still count as sent; TotalBytes = %d", s.reader.TotalBytes())
+	}
+
+	// A different read length at a cached offset misses:
+	s.reader.ReadAt(make([]byte, 5), 0)
+	if s.RegionCacheStats().Misses != 6 {
+		t.Fatal("expected a miss for a different length")
+	}
+
+	// Modified sources invalidate overlapping regions:
+	s.cache.Invalidate(15, 16)
+	s.reader.ReadAt(buf, 10)
+	if reads != 7 {
+		t.Fatalf("expected invalidated region to be re-read; reads = %d", reads)
+	}
+}
+
+func TestServer_MetadataResponseRate(t *testing.T) {
+	tb := newScriptedReader([]*TarballFile{&TarballFile{Path: "a.bin", Size: 10, Mode: 0644}})
+
+	m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 180), Port: 13790}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.SetTTL(0)
+	if err := m.SendsControlToClient(); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock()
+	s := NewServer(m, tb, ServerOptions{Clock: clock})
+	if err := s.buildMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	s.announceMsg = controlToClientMessage(s.hashId, AnnounceTarball, nil)
+	if err := s.SetMetadataResponseRate(-1, 1); err != ErrNegativeRate {
+		t.Fatalf("err = %v; expected ErrNegativeRate", err)
+	}
+	if err := s.SetMetadataResponseRate(10, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(op ControlToServerOp) {
+		ctrl := UDPMessage{Data: controlToServerMessage(s.hashId, op, nil)}
+		if err := s.processControl(ctrl); err != nil {
+			t.Skipf("multicast send unavailable: %v", err)
+		}
+	}
+
+	// A burst of metadata requests is cut off after the burst size; announcements are paced separately:
+	for i := 0; i < 5; i++ {
+		request(RequestMetadataHeader)
+	}
+	request(RequestAnnounce)
+	if n := s.ResponsesThrottled(); n != 3 {
+		t.Fatalf("throttled %d responses; expected 3", n)
+	}
+	// File entry requests are throttled before they are decoded or the file list scanned:
+	if err := s.processControl(UDPMessage{Data: controlToServerMessage(s.hashId, RequestFileEntries, nil)}); err != nil {
+		t.Fatalf("expected throttled request to be dropped; got %v", err)
+	}
+	if n := s.ResponsesThrottled(); n != 4 {
+		t.Fatalf("throttled %d responses; expected 4", n)
+	}
+
+	// A token is regained every 100ms:
+	clock.Advance(100 * time.Millisecond)
+	request(RequestTOCHeader)
+	request(RequestManifestDigest)
+	if n := s.ResponsesThrottled(); n != 5 {
+		t.Fatalf("throttled %d responses; expected 5", n)
+	}
+
+	// 0 lifts the cap:
+	if err := s.SetMetadataResponseRate(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	request(RequestMetadataHeader)
+	if n := s.ResponsesThrottled(); n != 5 {
+		t.Fatalf("throttled %d responses; expected 5 after lifting the cap", n)
+	}
+}
+
+func TestServer_SectionCoalesce(t *testing.T) {
+	files := []*TarballFile{}
+	for i := 0; i < 20; i++ {
+		files = append(files, &TarballFile{Path: fmt.Sprintf("dir/file%02d.bin", i), Size: 10, Mode: 0644})
+	}
+	tb := newScriptedReader(files)
+
+	m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 180), Port: 13790}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.SetTTL(0)
+	m.SetDatagramSize(protocolControlPrefixSize + metadataSectionMsgSize + 64)
+	if err := m.SendsControlToClient(); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock()
+	s := NewServer(m, tb, ServerOptions{Clock: clock, SectionCoalesce: 50 * time.Millisecond})
+	if err := s.buildMetadata(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(section uint16) {
+		data := make([]byte, 2)
+		byteOrder.PutUint16(data, section)
+		ctrl := UDPMessage{Data: controlToServerMessage(s.hashId, RequestMetadataSection, data)}
+		if err := s.processControl(ctrl); err != nil {
+			t.Skipf("multicast send unavailable: %v", err)
+		}
+	}
+
+	// A burst of clients asking for the same section gets one reply; other sections are unaffected:
+	for i := 0; i < 5; i++ {
+		request(0)
+	}
+	request(1)
+	if n := s.SectionsCoalesced(); n != 4 {
+		t.Fatalf("coalesced %d requests; expected 4", n)
+	}
+
+	// Once the window passes the section is sent again:
+	clock.Advance(50 * time.Millisecond)
+	request(0)
+	request(0)
+	if n := s.SectionsCoalesced(); n != 5 {
+		t.Fatalf("coalesced %d requests; expected 5", n)
+	}
+
+	// Truncated requests are rejected rather than read past:
+	ctrl := UDPMessage{Data: controlToServerMessage(s.hashId, RequestMetadataSection, []byte{0})}
+	if err := s.processControl(ctrl); err != ErrMessageTooShort {
+		t.Fatalf("expected ErrMessageTooShort; got %v", err)
+	}
+}
+
+// Reads the way io.ReaderAt documents, returning io.EOF with the final bytes:
+type eofReaderAt struct {
+	TarballReader
+}
+
+func (r eofReaderAt) ReadAt(buf []byte, offset int64) (int, error) {
+	n, err := r.TarballReader.ReadAt(buf, offset)
+	if err == nil && offset+int64(n) >= r.Size() {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func TestServer_FinalRegion(t *testing.T) {
+	createTestFile("final1.txt", []byte("first file\n"))
+	defer os.Remove("final1.txt")
+	createTestFile("final2.txt", []byte("last\n"))
+	defer os.Remove("final2.txt")
+	files := []*TarballFile{
+		&TarballFile{Path: "final1.txt", LocalPath: "final1.txt", Size: 11, Mode: 0644},
+		&TarballFile{Path: "final2.txt", LocalPath: "final2.txt", Size: 5, Mode: 0644},
+	}
+	reader := newTarballReader(t, files)
+	defer reader.Close()
+
+	// Record every region read for sending:
+	sent := make(map[int64][]byte)
+	tb := newScriptedReader(reader.files)
+	tb.read = func(buf []byte, offset int64) (int, error) {
+		n, err := reader.ReadAt(buf, offset)
+		sent[offset] = append([]byte(nil), buf[:n]...)
+		return n, err
+	}
+
+	m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 180), Port: 13790}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.SetTTL(0)
+	if err := m.SendsData(); err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	s := NewServer(m, eofReaderAt{tb}, ServerOptions{})
+	// 18 bytes in regions of 7 leaves a final region of 4:
+	s.regionSize = 7
+	s.nakRegions = NewNakRegions(tb.size)
+	for i := 0; i < 3; i++ {
+		err := s.sendData()
+		if _, ok := err.(net.Error); ok {
+			t.Skipf("multicast send unavailable: %v", err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !s.nakRegions.IsAllAcked() || s.nextRegion != 0 {
+		t.Fatalf("expected all regions sent; naks = %v, nextRegion = %d", s.nakRegions.Naks(), s.nextRegion)
+	}
+	if last := sent[14]; string(last) != "st\n\x00" {
+		t.Fatalf("final region = %q; expected the last file's tail and padding", last)
+	}
+
+	// The final region completes the last file, passing its padding check:
+	out := []*TarballFile{
+		&TarballFile{Path: filepath.Join("final_out", "final1.txt"), Size: 11, Mode: 0644},
+		&TarballFile{Path: filepath.Join("final_out", "final2.txt"), Size: 5, Mode: 0644},
+	}
+	defer os.RemoveAll("final_out")
+	writer, err := NewVirtualTarballWriter(out, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for offset, data := range sent {
+		if _, err := writer.WriteAt(data, offset); err != nil {
+			t.Fatalf("WriteAt(%d): %v", offset, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join("final_out", "final2.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "last\n" {
+		t.Fatalf("final2.txt = %q", data)
+	}
+}
+
+func TestServer_MaxRegionRetransmits(t *testing.T) {
+	tb := newScriptedReader([]*TarballFile{&TarballFile{Path: "lossy.bin", Size: 24, Mode: 0644}})
+
+	m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 180), Port: 13790}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.SetTTL(0)
+	if err := m.SendsData(); err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	s := NewServer(m, tb, ServerOptions{})
+	s.SetMaxRegionRetransmits(2)
+	// 25 bytes in regions of 10 leaves a final region of 5:
+	s.regionSize = 10
+	s.regionCount = 3
+	s.nakRegions = NewNakRegions(tb.size)
+	s.nakRegions.Ack(0, tb.size)
+
+	// A client that keeps missing the final region:
+	send := func() {
+		err := s.sendData()
+		if _, ok := err.(net.Error); ok {
+			t.Skipf("multicast send unavailable: %v", err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		s.nakRegions.Nak(20, tb.size)
+		send()
+		if s.bytesSent != int64(5*(i+1)) {
+			t.Fatalf("sent %d bytes after %d sends; expected the final region each time", s.bytesSent, i+1)
+		}
+	}
+	s.nakRegions.Nak(20, tb.size)
+	send()
+	if s.bytesSent != 15 {
+		t.Fatalf("sent %d bytes; expected the region to be given up on after 2 retransmits", s.bytesSent)
+	}
+	cmp(t, s.AbandonedRegions(), []Region{{20, 25}})
+	if !s.nakRegions.IsAllAcked() {
+		t.Fatalf("expected the abandoned region ACKed; naks = %v", s.nakRegions.Naks())
+	}
+
+	// Further NAKs for it are ignored while others are still sent:
+	nak := func(naks ...Region) {
+		ack := encodeAckDataSection(Region{}, naks, 1000)
+		if err := s.processControl(UDPMessage{Data: controlToServerMessage(tb.HashId(), AckDataSection, ack)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.nakRegions.Nak(0, 10)
+	nak(Region{0, 10}, Region{20, 25})
+	cmp(t, s.nakRegions.Naks(), []Region{{0, 10}})
+
+	// Once nothing is NAKed the round is over, and a client joining late is sent it again:
+	s.nakRegions.Ack(0, tb.size)
+	nak(Region{20, 25})
+	cmp(t, s.nakRegions.Naks(), []Region{{20, 25}})
+	if len(s.AbandonedRegions()) != 0 {
+		t.Fatalf("expected abandoned regions forgotten in a new round; got %v", s.AbandonedRegions())
+	}
+
+	// Sends starting part way into a region end with it, so they count against that region alone:
+	s.nakRegions.Ack(0, tb.size)
+	s.nakRegions.Nak(5, 15)
+	s.nextRegion = 0
+	sent := s.bytesSent
+	send()
+	if s.bytesSent-sent != 5 || s.regionSends[0] != 1 || s.regionSends[1] != 0 {
+		t.Fatalf("sent %d bytes from 5 with sends %v; expected 5 counted against region 0", s.bytesSent-sent, s.regionSends)
+	}
+}
+
+func TestServer_RunOnce(t *testing.T) {
+	tb := newScriptedReader([]*TarballFile{&TarballFile{Path: "once.bin", Size: 5000, Mode: 0644}})
+	newMulticast := func() *Multicast {
+		m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 183), Port: 13820}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.SetLoopback(true)
+		m.SetTTL(0)
+		m.SetDatagramSize(1400)
+		return m
+	}
+
+	// A client that keeps reporting it missed the first bytes:
+	cm := newMulticast()
+	defer cm.Close()
+	if err := cm.SendsControlToServer(); err != nil {
+		t.Fatal(err)
+	}
+	stop, stopped := make(chan empty), make(chan empty)
+	defer func() {
+		// Stop sending before the deferred Close takes the connection away:
+		close(stop)
+		<-stopped
+	}()
+	go func() {
+		defer close(stopped)
+		ack := encodeAckDataSection(Region{}, []Region{{0, 10}}, cm.MaxMessageSize()-protocolControlPrefixSize)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				cm.SendControlToServer(controlToServerMessage(tb.HashId(), AckDataSection, ack))
+			}
+		}
+	}()
+
+	s := NewServer(newMulticast(), tb, ServerOptions{BatchLead: 50 * time.Millisecond, BatchRetransmitWait: 200 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stats, err := s.RunOnce(ctx)
+	if _, ok := err.(net.Error); ok {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// NAKs during the pass are ignored; those collected after it resend just the first region:
+	if stats.BytesSent != tb.Size() || stats.RegionsSent != s.regionCount {
+		t.Fatalf("sent %d regions of %d bytes; expected %d regions of %d bytes", stats.RegionsSent, stats.BytesSent, s.regionCount, tb.Size())
+	}
+	if stats.RegionsResent != 1 || stats.BytesResent != int64(s.regionSize) {
+		t.Fatalf("resent %d regions of %d bytes; expected the first region of %d bytes", stats.RegionsResent, stats.BytesResent, s.regionSize)
+	}
+	if stats.Elapsed < 250*time.Millisecond {
+		t.Fatalf("elapsed %v; expected at least the lead and retransmit wait", stats.Elapsed)
+	}
+}
+
+func TestServer_UnicastMetadata(t *testing.T) {
+	tb := newScriptedReader([]*TarballFile{&TarballFile{Path: "a.bin", Size: 10, Mode: 0644}})
+
+	m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 184), Port: 13830}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.SetTTL(0)
+	if err := m.SendsControlToClient(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stands in for the requesting client; bound more specifically than the server's socket so it receives unicast:
+	lc := net.ListenConfig{Control: controlReuseAddr}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", "127.0.0.1:13831")
+	if err != nil {
+		t.Skipf("cannot listen for unicast: %v", err)
+	}
+	defer pc.Close()
+
+	s := NewServer(m, tb, ServerOptions{UnicastMetadata: true, SectionCoalesce: time.Hour})
+	if err := s.buildMetadata(); err != nil {
+		t.Fatal(err)
+	}
+
+	requester := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 13830}
+	for i := 0; i < 2; i++ {
+		ctrl := UDPMessage{Data: controlToServerMessage(s.hashId, RequestMetadataSection, []byte{0, 0}), SourceAddress: requester}
+		if err := s.processControl(ctrl); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 65536)
+		pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("expected a unicast reply: %v", err)
+		}
+		_, op, data, err := extractClientMessage(UDPMessage{Data: buf[:n]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != RespondMetadataSection || !bytes.Equal(data, s.metadataSections[0]) {
+			t.Fatalf("unexpected reply op %v", op)
+		}
+	}
+	// Another client asking for the same section was only answered by the unicast reply to it:
+	if n := s.SectionsCoalesced(); n != 0 {
+		t.Fatalf("coalesced %d requests; expected none when unicasting", n)
+	}
+}
+
+func TestServer_DeterministicMetadata(t *testing.T) {
+	if err := os.MkdirAll("determ_src/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("determ_src")
+	for i := 0; i < 30; i++ {
+		createTestFile(fmt.Sprintf("determ_src/file%02d.txt", i), []byte(fmt.Sprintf("contents %d\n", i)))
+	}
+	createTestFile("determ_src/sub/nested.txt", []byte("nested\n"))
+
+	m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 180), Port: 13790}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetDatagramSize(200)
+
+	// Each construction stands in for a restarted server:
+	build := func() *Server {
+		files, err := MergeTarballSources(TarballSource{Root: "determ_src"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		options := getOptions()
+		options.HashFiles = true
+		options.BlockSize = 4
+		tb, err := NewVirtualTarballReader(files, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := NewServer(m, tb, ServerOptions{})
+		if err := s.buildMetadata(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	a, b := build(), build()
+	defer a.tb.(*VirtualTarballReader).Close()
+	defer b.tb.(*VirtualTarballReader).Close()
+
+	if !bytes.Equal(a.hashId, b.hashId) {
+		t.Fatal("expected identical HashIds")
+	}
+	if !bytes.Equal(a.metadataHeader, b.metadataHeader) || !bytes.Equal(a.tocHeader, b.tocHeader) {
+		t.Fatal("expected identical metadata and table of contents headers")
+	}
+	if len(a.metadataSections) < 2 || len(a.metadataSections) != len(b.metadataSections) || len(a.tocSections) != len(b.tocSections) {
+		t.Fatalf("expected the same section counts; got %d and %d", len(a.metadataSections), len(b.metadataSections))
+	}
+	for i := range a.metadataSections {
+		if !bytes.Equal(a.metadataSections[i], b.metadataSections[i]) {
+			t.Fatalf("metadata section %d differs", i)
+		}
+	}
+	for i := range a.tocSections {
+		if !bytes.Equal(a.tocSections[i], b.tocSections[i]) {
+			t.Fatalf("table of contents section %d differs", i)
+		}
+	}
+}
+
+func TestServer_State(t *testing.T) {
+	const fname = "server.state"
+	defer os.Remove(fname)
+
+	m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 180), Port: 13790}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newServer := func(size int64) *Server {
+		s := NewServer(m, newScriptedReader([]*TarballFile{&TarballFile{Path: "a.bin", Size: size, Mode: 0644}}), ServerOptions{StatePath: fname})
+		if err := s.buildMetadata(); err != nil {
+			t.Fatal(err)
+		}
+		s.nakRegions = NewNakRegions(s.tb.Size())
+		s.nakRegions.Ack(0, s.tb.Size())
+		return s
+	}
+
+	s := newServer(100)
+	s.nakRegions.Nak(10, 20)
+	s.nakRegions.Nak(50, 60)
+	s.nextRegion = 15
+	if err := s.saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newServer(100)
+	if err := r.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, r.nakRegions.Naks(), []Region{{10, 20}, {50, 60}})
+	if r.nextRegion != 15 {
+		t.Fatalf("nextRegion = %d; expected 15", r.nextRegion)
+	}
+
+	// State for other metadata is ignored:
+	o := newServer(200)
+	if err := o.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if !o.nakRegions.IsAllAcked() || o.nextRegion != 0 {
+		t.Fatal("expected state for another tarball to be ignored")
+	}
+}
+
+// Sends regions back to back as sendDataLoop does, reporting what each send allocates; the datagram itself is reused:
+func BenchmarkServer_SendData(b *testing.B) {
+	tb := newScriptedReader([]*TarballFile{&TarballFile{Path: "bench.bin", Size: 1 << 20, Mode: 0644}})
+
+	m, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(239, 0, 0, 180), Port: 13790}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer m.Close()
+	m.SetLoopback(false)
+	m.SetTTL(0)
+	if err := m.SendsData(); err != nil {
+		b.Skipf("multicast unavailable: %v", err)
+	}
+	s := NewServer(m, tb, ServerOptions{})
+	s.regionSize = s.dataRegionSize()
+	s.nakRegions = NewNakRegions(tb.size)
+	if err := s.sendData(); err != nil {
+		b.Skipf("multicast send unavailable: %v", err)
+	}
+
+	b.SetBytes(int64(s.regionSize))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.sendData(); err != nil && !isENOBUFS(err) {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestServer_GzipStream(t *testing.T) {
+	createTestFile("gzipped.txt", bytes.Repeat([]byte("squeeze me\n"), 1000))
+	defer os.Remove("gzipped.txt")
+	options := getOptions()
+	options.GzipStream = true
+	tb, err := NewVirtualTarballReader([]*TarballFile{
+		&TarballFile{Path: "gzipped.txt", LocalPath: "gzipped.txt", Size: 11000, Mode: 0644},
+	}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	s := NewServer(nil, tb, ServerOptions{})
+	if err := s.compress(); err != nil {
+		t.Fatal(err)
+	}
+	// Spooled to disk rather than held in memory, and removed once serving stops:
+	spooled := s.stream.Name()
+	if s.size >= tb.Size() {
+		t.Fatalf("stream of %d bytes not compressed from %d", s.size, tb.Size())
+	}
+	if _, _, err := s.RegionsForFile("gzipped.txt"); err != ErrNotStarted {
+		t.Fatalf("expected ErrNotStarted before the region size is known; got %v", err)
+	}
+	s.regionSize = 100
+	s.regionCount = (s.size + 99) / 100
+	if start, count, err := s.RegionsForFile("gzipped.txt"); err != nil || start != 0 || count != s.regionCount {
+		t.Fatalf("expected the whole stream; got (%d, %d), %v", start, count, err)
+	}
+	if start, _, _ := s.RegionsForFile("missing.txt"); start != -1 {
+		t.Fatalf("expected -1 for a missing file; got %d", start)
+	}
+	s.removeStream()
+	if _, err := os.Stat(spooled); !os.IsNotExist(err) {
+		t.Fatalf("spooled stream not removed: %v", err)
+	}
+}
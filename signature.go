@@ -0,0 +1,92 @@
+// signature.go
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+var (
+	ErrSignatureInvalid = errors.New("metadata signature invalid")
+	ErrBadKey           = errors.New("key file must contain a hex-encoded ed25519 key")
+	ErrSignedNoHashes   = errors.New("signed metadata lacks file hashes, so content cannot be verified")
+)
+
+const signatureKeyIdSize = 8
+
+// A signature block is the signing key id followed by an ed25519 signature over the metadata digest:
+const signatureBlockSize = signatureKeyIdSize + ed25519.SignatureSize
+
+// Identifies a public key by the first bytes of its SHA256:
+func signatureKeyId(pub ed25519.PublicKey) []byte {
+	sum := sha256.Sum256(pub)
+	return sum[:signatureKeyIdSize]
+}
+
+func signMetadataDigest(key ed25519.PrivateKey, digest []byte) []byte {
+	block := make([]byte, 0, signatureBlockSize)
+	block = append(block, signatureKeyId(key.Public().(ed25519.PublicKey))...)
+	block = append(block, ed25519.Sign(key, digest)...)
+	return block
+}
+
+// Verifies a signature block against the metadata digest; unsigned metadata has an empty block and fails.
+func verifyMetadataSignature(pub ed25519.PublicKey, digest []byte, block []byte) error {
+	if len(block) != signatureBlockSize {
+		return ErrSignatureInvalid
+	}
+	if !bytes.Equal(block[:signatureKeyIdSize], signatureKeyId(pub)) {
+		return ErrSignatureInvalid
+	}
+	if !ed25519.Verify(pub, digest, block[signatureKeyIdSize:]) {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
+
+func readHexKey(path string, size int) ([]byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(key) != size {
+		return nil, ErrBadKey
+	}
+	return key, nil
+}
+
+// Private key files hold the hex-encoded 32-byte ed25519 seed:
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	seed, err := readHexKey(path, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func loadPublicKey(path string) (ed25519.PublicKey, error) {
+	key, err := readHexKey(path, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Writes a new key pair to path and path + ".pub":
+func generateKeyPair(path string) error {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+".pub", []byte(hex.EncodeToString(pub)+"\n"), 0644)
+}
@@ -0,0 +1,91 @@
+// signature_test.go
+package main
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSignature_Verify(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+
+	digest := metadataDigest(encodeTestMetadata(testMetadataFiles()))
+	block := signMetadataDigest(key, digest)
+	if err := verifyMetadataSignature(pub, digest, block); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte(nil), digest...)
+	tampered[0] ^= 0xff
+	if err := verifyMetadataSignature(pub, tampered, block); err != ErrSignatureInvalid {
+		t.Fatalf("expected ErrSignatureInvalid for tampered digest; got %v", err)
+	}
+	if err := verifyMetadataSignature(otherPub, digest, block); err != ErrSignatureInvalid {
+		t.Fatalf("expected ErrSignatureInvalid for wrong key; got %v", err)
+	}
+	if err := verifyMetadataSignature(pub, digest, nil); err != ErrSignatureInvalid {
+		t.Fatalf("expected ErrSignatureInvalid for unsigned metadata; got %v", err)
+	}
+
+	// Signed metadata is accepted with a warning when no key is configured:
+	files := testMetadataFiles()
+	c := NewClient(nil, ClientOptions{})
+	c.signature = block
+	if err := c.verifySignature(digest, files); err != nil {
+		t.Fatal(err)
+	}
+	if c.options.TarballOptions.VerifyHashes {
+		t.Fatal("VerifyHashes forced without a key")
+	}
+
+	// With a key, every file is verified against its signed hash:
+	c = NewClient(nil, ClientOptions{PublicKey: pub})
+	c.signature = block
+	if err := c.verifySignature(digest, files); err != nil {
+		t.Fatal(err)
+	}
+	if !c.options.TarballOptions.VerifyHashes {
+		t.Fatal("expected VerifyHashes to be forced by a key")
+	}
+
+	// Metadata signed without hashes vouches for no content:
+	files[0].Hash = nil
+	digest = metadataDigest(encodeTestMetadata(files))
+	c = NewClient(nil, ClientOptions{PublicKey: pub})
+	c.signature = signMetadataDigest(key, digest)
+	if err := c.verifySignature(digest, files); err != ErrSignedNoHashes {
+		t.Fatalf("expected ErrSignedNoHashes; got %v", err)
+	}
+}
+
+func TestSignature_KeyFiles(t *testing.T) {
+	const fname = "test.key"
+	if err := generateKeyPair(fname); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fname)
+	defer os.Remove(fname + ".pub")
+
+	key, err := loadSigningKey(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := loadPublicKey(fname + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(key.Public()) {
+		t.Fatal("public key does not match private key")
+	}
+
+	ioutil.WriteFile(fname+".pub", []byte("not a key\n"), 0644)
+	if _, err := loadPublicKey(fname + ".pub"); err != ErrBadKey {
+		t.Fatalf("expected ErrBadKey; got %v", err)
+	}
+}
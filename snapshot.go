@@ -0,0 +1,56 @@
+// snapshot.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// Takes a read-only, point-in-time copy of the directory tree at root to serve from so that changes to the sources
+// while serving are not seen. Returns where the copy of root is found and a function to remove the copy.
+type Snapshotter interface {
+	Snapshot(root string) (snapshotRoot string, release func() error, err error)
+}
+
+// Snapshots with "btrfs subvolume snapshot -r". Linux only; root must be a btrfs subvolume and creating and deleting
+// snapshots usually requires root. The snapshot is created beside root and deleted on release.
+type BtrfsSnapshotter struct{}
+
+func (BtrfsSnapshotter) Snapshot(root string) (string, func() error, error) {
+	root = filepath.Clean(root)
+	dest := filepath.Join(filepath.Dir(root), "."+filepath.Base(root)+".lancaster-"+strconv.Itoa(os.Getpid()))
+	if err := runSnapshotCommand("btrfs", "subvolume", "snapshot", "-r", root, dest); err != nil {
+		return "", nil, err
+	}
+	return dest, func() error {
+		return runSnapshotCommand("btrfs", "subvolume", "delete", dest)
+	}, nil
+}
+
+// Snapshots Dataset with "zfs snapshot" and serves it through the dataset's .zfs/snapshot directory, so root must be
+// the dataset's mount point. Needs permission to snapshot and destroy snapshots of the dataset, e.g. via zfs allow.
+type ZFSSnapshotter struct {
+	Dataset string
+}
+
+func (z ZFSSnapshotter) Snapshot(root string) (string, func() error, error) {
+	name := "lancaster-" + strconv.Itoa(os.Getpid())
+	snapshot := z.Dataset + "@" + name
+	if err := runSnapshotCommand("zfs", "snapshot", snapshot); err != nil {
+		return "", nil, err
+	}
+	return filepath.Join(root, ".zfs", "snapshot", name), func() error {
+		return runSnapshotCommand("zfs", "destroy", snapshot)
+	}, nil
+}
+
+func runSnapshotCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", name, err, out)
+	}
+	return nil
+}
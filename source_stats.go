@@ -0,0 +1,117 @@
+// source_stats.go
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// What a client has received on the data channel from one source. Several servers may serve the same HashId to a
+// group; each source is told apart by the address its datagrams come from, its IP and port, which is that of the
+// sending server's data socket. A server sending from several interfaces shows as several sources.
+type SourceStats struct {
+	Address string
+	// Data datagrams for our tarball, and the bytes in them that had not already been received:
+	Datagrams int64
+	NewBytes  int64
+	// Datagrams carrying only data already received, e.g. sent for another client:
+	Duplicates int64
+	// Bytes still NAKed that the source passed over between one datagram and the next. A source sends regions in
+	// order and skips only what every client has ACKed, so these were most likely lost on the way, or dropped by
+	// MaxReceiveRate:
+	LostBytes int64
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// Bytes/sec of new data from the source between the first and last datagram it sent:
+func (s SourceStats) Throughput() float64 {
+	d := s.LastSeen.Sub(s.FirstSeen).Seconds()
+	if d <= 0 {
+		return 0
+	}
+	return float64(s.NewBytes) / d
+}
+
+// Fraction of the source's datagrams that brought nothing new:
+func (s SourceStats) DuplicateRatio() float64 {
+	if s.Datagrams == 0 {
+		return 0
+	}
+	return float64(s.Duplicates) / float64(s.Datagrams)
+}
+
+// Fraction of the new and lost bytes from the source that were lost:
+func (s SourceStats) LossRatio() float64 {
+	if s.NewBytes+s.LostBytes == 0 {
+		return 0
+	}
+	return float64(s.LostBytes) / float64(s.NewBytes+s.LostBytes)
+}
+
+// A source's IP and port, compared without formatting the address for every datagram:
+type sourceKey struct {
+	ip   [net.IPv6len]byte
+	port int
+	zone string
+}
+
+type sourceState struct {
+	SourceStats
+	// Where the source's next datagram starts if it sends on from its last one:
+	next int64
+}
+
+// Receive stats per source, safe to read while the receiving goroutine records:
+type sourceTracker struct {
+	lock    sync.Mutex
+	sources map[sourceKey]*sourceState
+}
+
+// Records a datagram from addr carrying region r, newBytes of which had not been received; naks is what is still
+// NAKed, for counting what the source passed over:
+func (t *sourceTracker) record(addr *net.UDPAddr, r Region, newBytes int64, naks *NakRegions, now time.Time) {
+	if addr == nil {
+		return
+	}
+	key := sourceKey{port: addr.Port, zone: addr.Zone}
+	copy(key.ip[:], addr.IP.To16())
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.sources == nil {
+		t.sources = make(map[sourceKey]*sourceState)
+	}
+	s := t.sources[key]
+	if s == nil {
+		s = &sourceState{SourceStats: SourceStats{Address: addr.String(), FirstSeen: now}, next: r.start}
+		t.sources[key] = s
+	}
+	// A region before the last one starts the source's next pass over the tarball:
+	if r.start > s.next {
+		s.LostBytes += naks.NakedBytesWithin(s.next, r.start)
+	}
+	s.next = r.endEx
+	s.Datagrams++
+	s.NewBytes += newBytes
+	if newBytes == 0 {
+		s.Duplicates++
+	}
+	s.LastSeen = now
+}
+
+// Copies of every source's stats, by address:
+func (t *sourceTracker) stats() []SourceStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	stats := make([]SourceStats, 0, len(t.sources))
+	for _, s := range t.sources {
+		stats = append(stats, s.SourceStats)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Address < stats[j].Address })
+	return stats
+}
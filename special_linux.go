@@ -0,0 +1,42 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Extracts the major and minor numbers of a device node:
+func deviceNumbers(stat os.FileInfo) (major, minor uint32) {
+	st, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	dev := uint64(st.Rdev)
+	major = uint32((dev&0x00000000000fff00)>>8) | uint32((dev&0xfffff00000000000)>>32)
+	minor = uint32(dev&0x00000000000000ff) | uint32((dev&0x00000ffffff00000)>>12)
+	return
+}
+
+// Creates a FIFO or device node; creating device nodes requires privileges:
+func mknod(name string, mode os.FileMode, major, minor uint32) error {
+	kind := uint32(0)
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		kind = syscall.S_IFIFO
+	case mode&os.ModeCharDevice != 0:
+		kind = syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		kind = syscall.S_IFBLK
+	default:
+		return ErrSpecialUnsupported
+	}
+
+	dev := (uint64(major)&0x00000fff)<<8 | (uint64(major)&0xfffff000)<<32 |
+		uint64(minor)&0x000000ff | (uint64(minor)&0xffffff00)<<12
+	if err := syscall.Mknod(name, kind|uint32(mode.Perm()), int(dev)); err != nil {
+		return &os.PathError{Op: "mknod", Path: name, Err: err}
+	}
+	return nil
+}
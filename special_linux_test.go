@@ -0,0 +1,111 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestWriteAt_SpecialFiles(t *testing.T) {
+	files := []*TarballFile{
+		&TarballFile{Path: "special/fifo", Mode: os.ModeNamedPipe | 0640},
+		&TarballFile{Path: "special/null", Mode: os.ModeDevice | os.ModeCharDevice | 0666, DeviceMajor: 1, DeviceMinor: 3},
+		&TarballFile{Path: "special/sock", Mode: os.ModeSocket | 0755},
+	}
+	defer os.RemoveAll("special")
+	extract := func(options VirtualTarballOptions) {
+		tb, err := NewVirtualTarballWriter(files, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, tb.size)
+		if _, err := tb.WriteAt(buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := tb.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Device nodes are skipped unless asked for:
+	options := getOptions()
+	extract(options)
+	if _, err := os.Lstat("special/null"); !os.IsNotExist(err) {
+		t.Fatalf("expected device to be skipped; got %v", err)
+	}
+	options.CreateDevices = true
+	extract(options)
+
+	stat, err := os.Lstat("special/fifo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode() != os.ModeNamedPipe|0640 {
+		t.Fatalf("fifo mode = %v", stat.Mode())
+	}
+
+	// Device nodes are only created when privileged:
+	if stat, err := os.Lstat("special/null"); err == nil {
+		if stat.Mode()&os.ModeCharDevice == 0 {
+			t.Fatalf("device mode = %v", stat.Mode())
+		}
+		if major, minor := deviceNumbers(stat); major != 1 || minor != 3 {
+			t.Fatalf("device numbers = %d:%d; expected 1:3", major, minor)
+		}
+	} else if !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	// Sockets are skipped:
+	if _, err := os.Lstat("special/sock"); !os.IsNotExist(err) {
+		t.Fatalf("expected socket to be skipped; got %v", err)
+	}
+}
+
+func TestTarball_SpecialFiles(t *testing.T) {
+	if err := syscall.Mkfifo("reader_fifo", 0644); err != nil {
+		t.Skipf("cannot create fifo: %v", err)
+	}
+	defer os.Remove("reader_fifo")
+
+	files := []*TarballFile{
+		&TarballFile{Path: "null", LocalPath: "/dev/null", Mode: os.ModeDevice | os.ModeCharDevice | 0666},
+		&TarballFile{Path: "reader_fifo", LocalPath: "reader_fifo", Size: 10, Mode: os.ModeNamedPipe | 0644},
+	}
+	tb := newTarballReader(t, files)
+	defer tb.Close()
+
+	if tb.files[0].DeviceMajor != 1 || tb.files[0].DeviceMinor != 3 {
+		t.Fatalf("/dev/null = %d:%d; expected 1:3", tb.files[0].DeviceMajor, tb.files[0].DeviceMinor)
+	}
+	if tb.files[1].Size != 0 {
+		t.Fatalf("fifo size = %d; expected 0", tb.files[1].Size)
+	}
+
+	// Contents are never read from special files, only their padding:
+	buf := make([]byte, tb.size)
+	if n, err := tb.ReadAt(buf, 0); err != nil || n != 2 {
+		t.Fatalf("ReadAt = %d, %v; expected 2, nil", n, err)
+	}
+
+	md, err := encodeMetadata(tb.size, 0, tb.files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newMetadataDecoder(1, 0)
+	if err := d.AddSection(0, md); err != nil {
+		t.Fatal(err)
+	}
+	_, decoded, err := d.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded[0].Mode != tb.files[0].Mode || decoded[0].DeviceMajor != 1 || decoded[0].DeviceMinor != 3 {
+		t.Fatalf("decoded %+v", decoded[0])
+	}
+	if decoded[1].Mode != os.ModeNamedPipe|0644 {
+		t.Fatalf("decoded fifo mode %v", decoded[1].Mode)
+	}
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package main
+
+import "os"
+
+// Device numbers are not recorded on this platform:
+func deviceNumbers(stat os.FileInfo) (major, minor uint32) {
+	return 0, 0
+}
+
+// FIFOs and device nodes cannot be created on this platform:
+func mknod(name string, mode os.FileMode, major, minor uint32) error {
+	return ErrSpecialUnsupported
+}
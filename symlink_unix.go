@@ -0,0 +1,10 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import "os"
+
+// Directory and file symlinks are the same on unix:
+func createSymlink(oldname, newname string, isDir bool) error {
+	return os.Symlink(oldname, newname)
+}
@@ -0,0 +1,41 @@
+// +build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	symbolicLinkFlagDirectory               = 0x1
+	symbolicLinkFlagAllowUnprivilegedCreate = 0x2
+)
+
+// os.Symlink only creates a directory symlink if the target already exists, which it may not yet while
+// extracting, so pass the flag explicitly:
+func createSymlink(oldname, newname string, isDir bool) error {
+	flags := uint32(symbolicLinkFlagAllowUnprivilegedCreate)
+	if isDir {
+		flags |= symbolicLinkFlagDirectory
+	}
+
+	n, err := syscall.UTF16PtrFromString(newname)
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	o, err := syscall.UTF16PtrFromString(oldname)
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+
+	err = syscall.CreateSymbolicLink(n, o, flags)
+	if err != nil {
+		// Older Windows rejects the unprivileged flag:
+		err = syscall.CreateSymbolicLink(n, o, flags&^symbolicLinkFlagAllowUnprivilegedCreate)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
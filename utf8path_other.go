@@ -0,0 +1,6 @@
+// +build !windows
+
+package main
+
+// File names are bytes:
+const defaultInvalidUTF8 = InvalidUTF8Passthrough
@@ -0,0 +1,6 @@
+// +build windows
+
+package main
+
+// File names are UTF-16, which cannot hold bytes that are not valid UTF-8:
+const defaultInvalidUTF8 = InvalidUTF8Escape
@@ -4,9 +4,14 @@ package main
 import (
 	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -15,11 +20,167 @@ var (
 	ErrBadPath          = errors.New("bad path")
 	ErrDuplicatePaths   = errors.New("not all paths are unique")
 	ErrMissingLocalPath = errors.New("missing LocalPath")
-	ErrFilesOnly        = errors.New("LocalPaths may only reference files not directories")
 	ErrBadPaddingByte   = errors.New("expected 0 padding byte")
 	ErrCompatViolation  = errors.New("compat mode violation")
+	ErrCaseCollision    = errors.New("paths collide on a case-insensitive filesystem")
+	ErrMappedCollision  = errors.New("paths map to the same destination")
+
+	ErrInsufficientSpace  = errors.New("insufficient free disk space")
+	ErrInsufficientInodes = errors.New("insufficient free inodes")
+	ErrImplausibleModTime = errors.New("modification time is implausibly far in the future")
+	ErrSourceModified     = errors.New("source file modified while serving")
+	ErrSpecialUnsupported = errors.New("special file type not supported on this platform")
+	ErrHashMismatch       = errors.New("file contents do not match hash")
+	ErrConflictAborted    = errors.New("extraction aborted on conflict with an existing file")
+	ErrDirUnwritable      = errors.New("skipped entries whose directory could not be created")
+	ErrBadDataExtents     = errors.New("data extents out of order or outside the file")
+	ErrProviderNotRegular = errors.New("content providers only supply regular files")
+	ErrPathEscapesRoot    = errors.New("path escapes extraction root")
+	ErrReadOnlyTarget     = errors.New("extraction target is read-only")
+	ErrSizeMismatch       = errors.New("file size does not match its source")
+	ErrBadHashSize        = errors.New("hash size must be 0 or from 8 to 32 bytes")
+	ErrTarballTooLarge    = errors.New("tarball size overflows int64")
+	ErrInvalidUTF8Path    = errors.New("path is not valid UTF-8")
+	ErrBadBlockSize       = errors.New("block size too large")
+	ErrNegativeSize       = errors.New("entry size is negative")
 )
 
+// Largest BlockSize accepted, whether configured or received in metadata, since a block is read whole into memory:
+const maxBlockSize = 64 << 20
+
+// Enumerates every invalid path in a file list at once. Matches ErrBadPath, ErrPathEscapesRoot, ErrDuplicatePaths,
+// ErrCaseCollision, ErrMappedCollision and ErrInvalidUTF8Path with errors.Is; escaping paths also match ErrBadPath.
+type PathValidationError struct {
+	BadPaths []string
+	// Absolute paths, paths on another volume and paths climbing out with "..":
+	EscapingPaths  []string
+	DuplicatePaths []string
+	CaseCollisions []string
+	// Each as "source -> destination" for a source mapped onto a destination already taken by another path:
+	MappedCollisions []string
+	// Paths that are not valid UTF-8 with InvalidUTF8Reject:
+	InvalidUTF8Paths []string
+}
+
+func (e *PathValidationError) Error() string {
+	msgs := make([]string, 0, 2)
+	if len(e.BadPaths) > 0 {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", ErrBadPath, strings.Join(e.BadPaths, ", ")))
+	}
+	if len(e.EscapingPaths) > 0 {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", ErrPathEscapesRoot, strings.Join(e.EscapingPaths, ", ")))
+	}
+	if len(e.DuplicatePaths) > 0 {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", ErrDuplicatePaths, strings.Join(e.DuplicatePaths, ", ")))
+	}
+	if len(e.CaseCollisions) > 0 {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", ErrCaseCollision, strings.Join(e.CaseCollisions, ", ")))
+	}
+	if len(e.MappedCollisions) > 0 {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", ErrMappedCollision, strings.Join(e.MappedCollisions, ", ")))
+	}
+	if len(e.InvalidUTF8Paths) > 0 {
+		quoted := make([]string, 0, len(e.InvalidUTF8Paths))
+		for _, path := range e.InvalidUTF8Paths {
+			quoted = append(quoted, strconv.Quote(path))
+		}
+		msgs = append(msgs, fmt.Sprintf("%s: %s", ErrInvalidUTF8Path, strings.Join(quoted, ", ")))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Entries skipped under SkipUnwritableDirs, each as "path: cause":
+type UnwritableDirError struct {
+	Entries []string
+}
+
+func (e *UnwritableDirError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrDirUnwritable, strings.Join(e.Entries, ", "))
+}
+
+func (e *UnwritableDirError) Is(target error) bool {
+	return target == ErrDirUnwritable
+}
+
+func (e *PathValidationError) Is(target error) bool {
+	switch target {
+	case ErrBadPath:
+		return len(e.BadPaths) > 0 || len(e.EscapingPaths) > 0
+	case ErrPathEscapesRoot:
+		return len(e.EscapingPaths) > 0
+	case ErrDuplicatePaths:
+		return len(e.DuplicatePaths) > 0
+	case ErrCaseCollision:
+		return len(e.CaseCollisions) > 0
+	case ErrMappedCollision:
+		return len(e.MappedCollisions) > 0
+	case ErrInvalidUTF8Path:
+		return len(e.InvalidUTF8Paths) > 0
+	}
+	return false
+}
+
+// An entry that would be written outside the extraction root, either lexically or by following Target, a symlink
+// already on disk that leads outside it or cannot be resolved:
+type PathEscapeError struct {
+	Path   string
+	Target string
+}
+
+func (e *PathEscapeError) Error() string {
+	if e.Target != "" {
+		return fmt.Sprintf("%s: %s via %s", ErrPathEscapesRoot, e.Path, e.Target)
+	}
+	return fmt.Sprintf("%s: %s", ErrPathEscapesRoot, e.Path)
+}
+
+func (e *PathEscapeError) Is(target error) bool {
+	return target == ErrPathEscapesRoot
+}
+
+// A write to an extracted file refused with EROFS or EACCES, as when extracting onto a read-only mount. Matches
+// ErrReadOnlyTarget with errors.Is and unwraps to the write's own error.
+type ReadOnlyTargetError struct {
+	Path string
+	Err  error
+}
+
+func (e *ReadOnlyTargetError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", ErrReadOnlyTarget, e.Path, e.Err)
+}
+
+func (e *ReadOnlyTargetError) Is(target error) bool {
+	return target == ErrReadOnlyTarget
+}
+
+func (e *ReadOnlyTargetError) Unwrap() error {
+	return e.Err
+}
+
+// A regular file whose given Size differs from the size of its source on disk, as with a stale manifest. Matches
+// ErrSizeMismatch with errors.Is.
+type SizeMismatchError struct {
+	Path   string
+	Size   int64
+	Actual int64
+}
+
+func (e *SizeMismatchError) Error() string {
+	return fmt.Sprintf("%s: %s is %d bytes, given %d", ErrSizeMismatch, e.Path, e.Actual, e.Size)
+}
+
+func (e *SizeMismatchError) Is(target error) bool {
+	return target == ErrSizeMismatch
+}
+
+// Free space on a filesystem; the Known fields are false when the platform or filesystem cannot report it.
+type diskFree struct {
+	Bytes       uint64
+	BytesKnown  bool
+	Inodes      uint64
+	InodesKnown bool
+}
+
 type ReaderAtCloser interface {
 	io.ReaderAt
 	io.Closer
@@ -30,19 +191,199 @@ type WriterAtCloser interface {
 	io.Closer
 }
 
+// Supplies the contents of a regular file from somewhere other than a local file, e.g. decrypting on the fly or
+// generating data:
+type ContentProvider interface {
+	io.ReaderAt
+	Size() int64
+	// SHA-256 of the contents if known up front, otherwise nil to hash them by reading:
+	Hash() []byte
+}
+
 type TarballFile struct {
 	Path               string
 	LocalPath          string
 	Size               int64
 	Mode               os.FileMode
 	SymlinkDestination string
+	// Symlink points to a directory; Windows must create these differently
+	SymlinkIsDir bool
+	// Major and minor numbers of device nodes
+	DeviceMajor uint32
+	DeviceMinor uint32
+	ModTime     time.Time
+	// SHA-256 of file contents; only populated when hashing is enabled
+	Hash []byte
+	// SHA-256 of each BlockSize bytes of file contents, the last block possibly shorter; only populated when
+	// block hashing is enabled
+	BlockSize   uint32
+	BlockHashes [][]byte
+	// Extents of a sparse file holding data, in offset order; the rest of the file is holes that are never sent and
+	// are left unwritten. nil for files without holes; only populated when hole detection is enabled
+	DataExtents []DataExtent
+	// Serves the file's contents in place of LocalPath, which may then be empty; only regular files may have one.
+	// Size is taken from the provider. Never sent; clients write the contents to Path as usual
+	Content ContentProvider
 
 	offset int64
 }
 
+// Byte range of a sparse file that holds data:
+type DataExtent struct {
+	Offset int64
+	Length int64
+}
+
 type VirtualTarballOptions struct {
 	// Enables compatibility mode to be lowest common denominator of filesystem support, i.e. no chmod or symlinks
 	CompatMode bool
+	// Reject paths that differ only by case, for extracting onto case-insensitive filesystems
+	CaseInsensitive bool
+	// Memory-map source files for reading to avoid a syscall per region read
+	MemoryMap bool
+	// Compute content hashes of source files for receivers to compare against existing files
+	HashFiles bool
+	// With HashFiles, defer hashing from construction until HashContents so that the size and file list are known
+	// right away; the server hashes before building its metadata
+	LazyHash bool
+	// Downgrade failures to set file modes to warnings, for filesystems without Unix permissions
+	IgnoreModeErrors bool
+	// Reject restoring modification times more than this far past now; 0 disables the check
+	MaxModTimeSkew time.Duration
+	// Clamp implausible modification times to now instead of failing with ErrImplausibleModTime
+	ClampModTime bool
+	// Omit the trailing NUL padding byte after each file; zero-length entries are created by CreateEmptyEntries
+	NoPadding bool
+	// Warn and skip over a non-zero padding byte instead of failing the write with ErrBadPaddingByte
+	TolerateBadPadding bool
+	// Verify written files against their content hashes, hashing as bytes arrive in order and re-reading files
+	// that were written out of order
+	VerifyHashes bool
+	// With HashFiles, also hash file contents in blocks of this many bytes so that updating clients only receive the
+	// blocks that changed in place; 0 disables. At most 64MiB.
+	BlockSize uint32
+	// Rewrites each validated path before extraction, like tar --transform; returning "" skips the entry. Mapped
+	// paths are validated again. Only used by the writer.
+	PathMap func(path string) string
+	// Directory to extract into; empty extracts into the current directory. Nothing is created or written outside it:
+	// operations on entries that would leave it, including through symlinks already on disk, fail with a
+	// *PathEscapeError. Symlink entries may still point outside it. Only used by the writer.
+	ExtractRoot string
+	// Skip entries whose directory cannot be created, e.g. under a read-only mount, instead of failing the write;
+	// the writer's Unwritable lists them once done. Only used by the writer.
+	SkipUnwritableDirs bool
+	// Serve sources under SnapshotRoot from a snapshot taken by Snapshot when the reader is constructed and released
+	// when it is closed; see BtrfsSnapshotter and ZFSSnapshotter for platform requirements. If the snapshot cannot be
+	// taken the reader warns and pins files instead. Only used by the reader.
+	Snapshot     Snapshotter
+	SnapshotRoot string
+	// Keep every regular source file open from construction until Close so that a path replaced or removed while
+	// serving still serves its original file. Changes written into a file in place are still seen. Needs a file
+	// descriptor per file. Only used by the reader.
+	PinFiles bool
+	// Detect holes in sparse source files with SEEK_HOLE and SEEK_DATA so that they are not sent and receivers
+	// recreate them; files are sent dense on platforms without hole detection. Only used by the reader.
+	DetectHoles bool
+	// Most source files to keep open at once while reading, closing the least recently read beyond it; 0 reads one
+	// file at a time and negative takes half the open file limit. Capped by LimitOpenFiles; pinned files are held
+	// open regardless. Only used by the reader.
+	MaxOpenFiles int
+	// Coalesce contiguous writes to a file into writes of up to this many bytes, flushed when a write does not follow
+	// on, the file is closed and by Flush; 0 writes each region as it arrives. Only used by the writer.
+	WriteBufferSize int
+	// Retry opening and writing a file up to this many times when it fails with an error that may pass, such as EINTR,
+	// EAGAIN or ENOSPC on a network filesystem; other errors fail at once. 0 never retries. Only used by the writer.
+	WriteRetries int
+	// Wait before the first retry, doubling for each after up to a second; 0 defaults to 10ms. The writer stays locked
+	// while it waits, holding up every other write.
+	WriteRetryBackoff time.Duration
+	// Keep content hashes already set on files, as from a manifest or metadata cache, instead of hashing the sources
+	// again. Sizes are checked against the sources regardless. Only used by the reader.
+	TrustMetadata bool
+	// Send the whole tarball as one gzip stream, compressed once by the server and spooled to a temporary file,
+	// instead of as its raw bytes; this compresses many small similar files far better than compressing each would.
+	// Receivers adopt it from the metadata and decompress the stream in order, staging regions received out of order
+	// in a temporary file. Every file is received in full: nothing is skipped as up to date, holes are sent as zeros,
+	// and progress cannot be resumed.
+	GzipStream bool
+	// Truncate file content hashes to this many bytes, from 8 to 32, to shrink the metadata; 0 keeps full SHA-256
+	// hashes. Receivers adopt it from the metadata and verify at the same length. Truncated hashes still catch
+	// accidental corruption with near certainty but resist deliberate collisions far less: one matching an 8-byte hash
+	// takes about 2^32 tries to forge, so keep full hashes where contents must be verified against tampering. Block
+	// hashes are never truncated.
+	HashSize int
+	// Encode each file's mode in the metadata as a 1-byte code into a table of the tarball's recurring modes instead
+	// of in full, shrinking the metadata of large trees whose files share a few modes. Receivers expand the codes
+	// from the metadata header. Only used by the server.
+	ModeTable bool
+	// How to extract entries whose paths are not valid UTF-8, which Linux allows but other systems may not represent;
+	// only used by the client.
+	InvalidUTF8 InvalidUTF8Policy
+	// Create received device nodes, which give anyone able to open them access to whatever device the sender named;
+	// they are skipped with a warning otherwise. Only used by the writer.
+	CreateDevices bool
+}
+
+// How the writer treats paths that are not valid UTF-8:
+type InvalidUTF8Policy int
+
+const (
+	// Passthrough on Unix, where any bytes but '/' and NUL make a valid name; Escape on Windows:
+	InvalidUTF8Default = InvalidUTF8Policy(iota)
+	// Extract to the path as sent, byte for byte:
+	InvalidUTF8Passthrough
+	// Fail with ErrInvalidUTF8Path; clients refuse the tarball as soon as the metadata header says it has such paths:
+	InvalidUTF8Reject
+	// Extract to the path with each byte that is not part of a valid UTF-8 sequence replaced by %XX, its hex value:
+	InvalidUTF8Escape
+)
+
+// The policy in effect, resolving InvalidUTF8Default for this platform:
+func (p InvalidUTF8Policy) resolve() InvalidUTF8Policy {
+	if p == InvalidUTF8Default {
+		return defaultInvalidUTF8
+	}
+	return p
+}
+
+// FIFOs, sockets and device nodes carry no contents:
+const specialModes = os.ModeNamedPipe | os.ModeSocket | os.ModeDevice
+
+func isSpecial(mode os.FileMode) bool {
+	return mode&specialModes != 0
+}
+
+// Bytes of padding following each file in the tarball:
+func (o VirtualTarballOptions) padding() int64 {
+	if o.NoPadding {
+		return 0
+	}
+	return 1
+}
+
+// The size of a tarball of total bytes once an entry of size bytes and its padding are added, failing rather than
+// wrapping around to a negative size that every later offset check would be wrong about, or shrinking for an entry
+// of negative size:
+func addEntrySize(total, size, padding int64) (int64, error) {
+	if size < 0 {
+		return 0, ErrNegativeSize
+	}
+	if size > math.MaxInt64-padding-total {
+		return 0, ErrTarballTooLarge
+	}
+	return total + size + padding, nil
+}
+
+func validHashSize(n int) bool {
+	return n == 0 || (n >= 8 && n <= sha256.Size)
+}
+
+// A content hash cut to HashSize; the cut hash is a copy, leaving hash and whatever shares it untouched:
+func (o VirtualTarballOptions) truncateHash(hash []byte) []byte {
+	if o.HashSize > 0 && len(hash) > o.HashSize {
+		return append([]byte(nil), hash[:o.HashSize]...)
+	}
+	return hash
 }
 
 type tarballFileList []*TarballFile
@@ -55,6 +396,131 @@ func (l tarballFileList) Swap(i, j int) {
 	l[j] = tmpi
 }
 
+// Maps a file to the tarball bytes of its contents and trailing padding:
+func (l tarballFileList) fileRange(path string, padding int64) (offset, size int64, ok bool) {
+	for _, f := range l {
+		if f.Path == path {
+			return f.offset, f.Size + padding, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Maps a file to the inclusive range of regionSize-aligned regions covering its bytes and padding. Returns
+// start = -1 if the path is not in the list.
+func (l tarballFileList) regionsForFile(path string, regionSize int64, padding int64) (start, count int64) {
+	offset, size, ok := l.fileRange(path, padding)
+	if !ok {
+		return -1, 0
+	}
+
+	start = offset / regionSize
+	if size == 0 {
+		// Zero-length entry without padding covers no regions:
+		return start, 0
+	}
+	last := (offset + size - 1) / regionSize
+	return start, last - start + 1
+}
+
+// Whether a file's data extents are in order, do not overlap and lie within the file:
+func validDataExtents(f *TarballFile) bool {
+	o := int64(0)
+	for _, e := range f.DataExtents {
+		if e.Offset < o || e.Length <= 0 || e.Length > f.Size-e.Offset {
+			return false
+		}
+		o = e.Offset + e.Length
+	}
+	return f.DataExtents == nil || f.Mode&os.ModeType == 0
+}
+
+// Entries with no bytes to send: empty ones and sparse files that are all holes:
+func noData(f *TarballFile) bool {
+	return f.Size == 0 || f.DataExtents != nil && len(f.DataExtents) == 0
+}
+
+// Tarball regions of the holes of sparse files:
+func (l tarballFileList) holes() []Region {
+	holes := make([]Region, 0)
+	for _, f := range l {
+		if f.DataExtents == nil {
+			continue
+		}
+		o := int64(0)
+		for _, e := range f.DataExtents {
+			if e.Offset > o {
+				holes = append(holes, Region{start: f.offset + o, endEx: f.offset + e.Offset})
+			}
+			o = e.Offset + e.Length
+		}
+		if f.Size > o {
+			holes = append(holes, Region{start: f.offset + o, endEx: f.offset + f.Size})
+		}
+	}
+	return holes
+}
+
+// Translates between offsets into the tarball, which count each file's padding byte, and offsets into the
+// concatenated file contents alone, so that progress can be shown in content bytes:
+type contentIndex struct {
+	// Files in offset order and the content bytes before each:
+	files  []*TarballFile
+	before []int64
+	size   int64
+}
+
+func newContentIndex(files []*TarballFile, size int64) *contentIndex {
+	x := &contentIndex{
+		files:  append([]*TarballFile(nil), files...),
+		before: make([]int64, len(files)),
+		size:   size,
+	}
+	sort.Slice(x.files, func(i, j int) bool { return x.files[i].offset < x.files[j].offset })
+	content := int64(0)
+	for i, f := range x.files {
+		x.before[i] = content
+		content += f.Size
+	}
+	return x
+}
+
+func (x *contentIndex) contentSize() int64 {
+	if len(x.files) == 0 {
+		return 0
+	}
+	last := len(x.files) - 1
+	return x.before[last] + x.files[last].Size
+}
+
+// Content bytes before the tarball offset:
+func (x *contentIndex) contentOffset(offset int64) int64 {
+	i := sort.Search(len(x.files), func(i int) bool { return x.files[i].offset > offset }) - 1
+	if i < 0 {
+		return 0
+	}
+	within := offset - x.files[i].offset
+	if within > x.files[i].Size {
+		// Within the padding:
+		within = x.files[i].Size
+	}
+	return x.before[i] + within
+}
+
+// Tarball offset of the content byte at contentOffset; the tarball size past the last:
+func (x *contentIndex) virtualOffset(contentOffset int64) int64 {
+	i := sort.Search(len(x.files), func(i int) bool { return x.before[i]+x.files[i].Size > contentOffset })
+	if i == len(x.files) {
+		return x.size
+	}
+	return x.files[i].offset + contentOffset - x.before[i]
+}
+
+// Content bytes within [start, endEx) of the tarball:
+func (x *contentIndex) contentBytes(start, endEx int64) int64 {
+	return x.contentOffset(endEx) - x.contentOffset(start)
+}
+
 var zeroHash [32]byte = [32]byte{0}
 
 func hashFile(path string) ([]byte, error) {
@@ -64,22 +530,56 @@ func hashFile(path string) ([]byte, error) {
 	}
 	defer f.Close()
 
+	return hashContents(f)
+}
+
+func hashContents(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return zeroHash[:], nil
+	}
+
+	return h.Sum(nil), nil
+}
+
+// Hashes a file as a whole, matching hashFile, and in blocks of blockSize bytes in a single pass:
+func hashFileBlocks(path string, blockSize uint32) ([]byte, [][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	return hashContentBlocks(f, blockSize)
+}
+
+func hashContentBlocks(r io.Reader, blockSize uint32) ([]byte, [][]byte, error) {
 	h := sha256.New()
-	const bufSize = 4096
-	buf := make([]byte, bufSize)
-	tn := 0
+	blocks := make([][]byte, 0)
+	buf := make([]byte, blockSize)
+	total := int64(0)
 	for {
-		n, err := f.Read(buf)
-		if err == io.EOF && n == 0 && tn == 0 {
-			return zeroHash[:], nil
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			sum := sha256.Sum256(buf[:n])
+			blocks = append(blocks, sum[:])
+			total += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
 		}
-		if err != nil && err != io.EOF {
-			return nil, err
+		if err != nil {
+			return nil, nil, err
 		}
-		n, err = h.Write(buf[:n])
-		// So long as tn != 0 this is sufficient to detect empty hash case.
-		tn = n
+	}
+	if total == 0 {
+		return zeroHash[:], blocks, nil
 	}
 
-	return h.Sum(nil), nil
+	return h.Sum(nil), blocks, nil
 }
@@ -0,0 +1,274 @@
+// tarball
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Filesystem operations used by VirtualTarballWriter; tests substitute this to inject faults.
+type writerFS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (writerFile, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Chmod(name string, mode os.FileMode) error
+	Lstat(name string) (os.FileInfo, error)
+	Readlink(name string) (string, error)
+	Symlink(oldname, newname string, isDir bool) error
+	Lchmod(name string, mode os.FileMode) error
+	Mknod(name string, mode os.FileMode, major, minor uint32) error
+	Getwd() (string, error)
+	Chdir(dir string) error
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+	Remove(name string) error
+	// Opens a file for reading:
+	Open(name string) (*os.File, error)
+}
+
+type writerFile interface {
+	io.WriterAt
+	io.Closer
+	Truncate(size int64) error
+	Chmod(mode os.FileMode) error
+	Sync() error
+}
+
+// Default writerFS backed by package os:
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (writerFile, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// Avoid returning a non-nil interface holding a nil *os.File:
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (osFS) Chmod(name string, mode os.FileMode) error    { return os.Chmod(name, mode) }
+func (osFS) Lstat(name string) (os.FileInfo, error)       { return os.Lstat(name) }
+func (osFS) Readlink(name string) (string, error)         { return os.Readlink(name) }
+func (osFS) Lchmod(name string, mode os.FileMode) error   { return lchmod(name, mode) }
+func (osFS) Getwd() (string, error)                       { return os.Getwd() }
+func (osFS) Chdir(dir string) error                       { return os.Chdir(dir) }
+func (osFS) Remove(name string) error                     { return os.Remove(name) }
+func (osFS) Open(name string) (*os.File, error)           { return os.Open(name) }
+
+func (osFS) Mknod(name string, mode os.FileMode, major, minor uint32) error {
+	return mknod(name, mode, major, minor)
+}
+
+func (osFS) Symlink(oldname, newname string, isDir bool) error {
+	return createSymlink(oldname, newname, isDir)
+}
+
+func (osFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// Confines a writerFS to a root directory. Relative names are relative to the root, and absolute names must lie
+// within it. Operations on a name that leaves the root, lexically or through a symlink already on disk, fail with a
+// *PathEscapeError. Chdir and Getwd track a working directory within the root instead of the process's.
+type rootFS struct {
+	fs   writerFS
+	root string
+	// Working directory relative to root:
+	dir string
+}
+
+func newRootFS(fs writerFS, root string) (*rootFS, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	return &rootFS{fs: fs, root: abs}, nil
+}
+
+// Whether a tarball path, which is '/'-separated, climbs out of the directory it is extracted to or names another
+// volume. On Windows a '\' would separate components too, so any is refused there:
+func pathEscapes(path string) bool {
+	if strings.HasPrefix(path, "/") || filepath.IsAbs(path) || filepath.VolumeName(path) != "" {
+		return true
+	}
+	if filepath.Separator != '/' && strings.ContainsRune(path, filepath.Separator) {
+		return true
+	}
+	for _, p := range strings.Split(path, "/") {
+		if p == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a path of this host, relative to some directory, climbs out of it or names another volume:
+func relEscapes(rel string) bool {
+	if filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" {
+		return true
+	}
+	for _, p := range strings.Split(rel, string(filepath.Separator)) {
+		if p == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether path, with symlinks resolved, lies within the root:
+func (r *rootFS) contains(path string) bool {
+	root, err := filepath.EvalSymlinks(r.root)
+	if err != nil {
+		root = r.root
+	}
+	rel, err := filepath.Rel(root, path)
+	return err == nil && !relEscapes(rel)
+}
+
+// Returns the path of name within the root. Every existing directory on the way is checked for symlinks leading
+// outside the root, as is name itself when followLast since the operation would follow it.
+func (r *rootFS) resolve(name string, followLast bool) (string, error) {
+	rel := filepath.Join(r.dir, name)
+	if filepath.IsAbs(name) {
+		var err error
+		if rel, err = filepath.Rel(r.root, name); err != nil {
+			return "", &PathEscapeError{Path: name}
+		}
+	}
+	if relEscapes(rel) {
+		return "", &PathEscapeError{Path: name}
+	}
+
+	path := r.root
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i, part := range parts {
+		path = filepath.Join(path, part)
+		if i == len(parts)-1 && !followLast {
+			break
+		}
+		stat, err := r.fs.Lstat(path)
+		if err != nil {
+			// Nothing further exists to follow; the operation itself reports other failures:
+			break
+		}
+		if stat.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		// Dangling symlinks could be created through to anywhere:
+		target, err := filepath.EvalSymlinks(path)
+		if err != nil || !r.contains(target) {
+			if target == "" {
+				target, _ = os.Readlink(path)
+			}
+			return "", &PathEscapeError{Path: rel, Target: target}
+		}
+	}
+	return filepath.Join(r.root, rel), nil
+}
+
+func (r *rootFS) OpenFile(name string, flag int, perm os.FileMode) (writerFile, error) {
+	path, err := r.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return r.fs.OpenFile(path, flag, perm)
+}
+
+func (r *rootFS) Open(name string) (*os.File, error) {
+	path, err := r.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return r.fs.Open(path)
+}
+
+func (r *rootFS) MkdirAll(name string, perm os.FileMode) error {
+	path, err := r.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	return r.fs.MkdirAll(path, perm)
+}
+
+func (r *rootFS) Chmod(name string, mode os.FileMode) error {
+	path, err := r.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	return r.fs.Chmod(path, mode)
+}
+
+func (r *rootFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	path, err := r.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	return r.fs.Chtimes(path, atime, mtime)
+}
+
+func (r *rootFS) Lstat(name string) (os.FileInfo, error) {
+	path, err := r.resolve(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return r.fs.Lstat(path)
+}
+
+func (r *rootFS) Readlink(name string) (string, error) {
+	path, err := r.resolve(name, false)
+	if err != nil {
+		return "", err
+	}
+	return r.fs.Readlink(path)
+}
+
+func (r *rootFS) Lchmod(name string, mode os.FileMode) error {
+	path, err := r.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	return r.fs.Lchmod(path, mode)
+}
+
+func (r *rootFS) Symlink(oldname, newname string, isDir bool) error {
+	path, err := r.resolve(newname, false)
+	if err != nil {
+		return err
+	}
+	return r.fs.Symlink(oldname, path, isDir)
+}
+
+func (r *rootFS) Mknod(name string, mode os.FileMode, major, minor uint32) error {
+	path, err := r.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	return r.fs.Mknod(path, mode, major, minor)
+}
+
+func (r *rootFS) Remove(name string) error {
+	path, err := r.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	return r.fs.Remove(path)
+}
+
+func (r *rootFS) Getwd() (string, error) {
+	return filepath.Join(r.root, r.dir), nil
+}
+
+func (r *rootFS) Chdir(dir string) error {
+	path, err := r.resolve(dir, true)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(r.root, path)
+	if err != nil {
+		return err
+	}
+	r.dir = rel
+	return nil
+}
@@ -2,32 +2,137 @@
 package main
 
 import (
+	"container/list"
 	"encoding/binary"
+	"fmt"
 	"hash/fnv"
 	"io"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime/debug"
 	"sort"
 	"strings"
+	"time"
 )
 
+// Tarball contents as served by Server; tests substitute this to serve without files on disk.
+type TarballReader interface {
+	io.ReaderAt
+	Size() int64
+	HashId() []byte
+	Files() []*TarballFile
+	Options() VirtualTarballOptions
+	// Files whose sources changed since the tarball was built:
+	ModifiedFiles() []*TarballFile
+	// Fills in content hashes deferred by LazyHash; the server calls this before encoding metadata:
+	HashContents() error
+}
+
 type VirtualTarballReader struct {
 	files  tarballFileList
 	size   int64
 	hashId []byte
 
 	options VirtualTarballOptions
+	// Regular files still to be hashed under LazyHash:
+	unhashed []*TarballFile
+	content  *contentIndex
+
+	// Files held open by PinFiles, and removes the snapshot taken by Snapshot:
+	pinned          map[*TarballFile]*os.File
+	releaseSnapshot func() error
+	// Blob every file is read from when constructed by NewVirtualTarballReaderFromBlob:
+	blob *os.File
+
+	// Source files open for reading, most recently read first, and where each is in the list; at most maxOpen are
+	// kept open:
+	openLRU   *list.List
+	openFiles map[*TarballFile]*list.Element
+	maxOpen   int
+}
+
+// Source file open for reading:
+type openSource struct {
+	tf   *TarballFile
+	file *os.File
+	mmap *mappedFile
+}
+
+// Stands in for the Lstat of a file whose contents come from a ContentProvider:
+type providedFileInfo struct {
+	f *TarballFile
+}
+
+func (i providedFileInfo) Name() string       { return path.Base(i.f.Path) }
+func (i providedFileInfo) Size() int64        { return i.f.Content.Size() }
+func (i providedFileInfo) Mode() os.FileMode  { return i.f.Mode }
+func (i providedFileInfo) ModTime() time.Time { return i.f.ModTime }
+func (i providedFileInfo) IsDir() bool        { return false }
+func (i providedFileInfo) Sys() interface{}   { return nil }
+
+// Serves reads from a memory-mapped file, falling back to the file for reads beyond the mapping:
+type mappedFile struct {
+	data []byte
+	file *os.File
+}
+
+func (m *mappedFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if off+int64(len(p)) > int64(len(m.data)) {
+		// File grew since it was mapped:
+		return m.file.ReadAt(p, off)
+	}
 
-	// Currently open file for reading:
-	openFileInfo *TarballFile
-	openFile     *os.File
+	// Pages past the end of a file truncated since it was mapped fault with SIGBUS; turn that into a panic and read
+	// the file instead, which reports how much is left:
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			if _, fault := r.(interface{ Addr() uintptr }); !fault {
+				panic(r)
+			}
+			n, err = m.file.ReadAt(p, off)
+		}
+	}()
+	return copy(p, m.data[off:]), nil
 }
 
 func NewVirtualTarballReader(files []*TarballFile, options VirtualTarballOptions) (*VirtualTarballReader, error) {
+	if !validHashSize(options.HashSize) {
+		return nil, ErrBadHashSize
+	}
+	if options.BlockSize > maxBlockSize {
+		return nil, ErrBadBlockSize
+	}
+
 	t := &VirtualTarballReader{
-		files:   tarballFileList(make([]*TarballFile, 0, len(files))),
-		options: options,
+		files:     tarballFileList(make([]*TarballFile, 0, len(files))),
+		options:   options,
+		openLRU:   list.New(),
+		openFiles: make(map[*TarballFile]*list.Element),
+		maxOpen:   LimitOpenFiles(options.MaxOpenFiles),
+	}
+
+	if t.options.Snapshot != nil {
+		snapshotted, err := t.snapshot(files)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: serving without a snapshot, pinning files instead: %v\n", err)
+			t.options.PinFiles = true
+		} else {
+			files = snapshotted
+		}
+	}
+	if t.options.PinFiles {
+		t.pinned = make(map[*TarballFile]*os.File)
 	}
+	// Release the snapshot and pinned files if construction fails:
+	ok := false
+	defer func() {
+		if !ok {
+			t.Close()
+		}
+	}()
 
 	uniquePaths := make(map[string]string)
 	t.size = int64(0)
@@ -44,24 +149,42 @@ func NewVirtualTarballReader(files []*TarballFile, options VirtualTarballOptions
 			}
 		}
 
-		// Validate LocalPaths:
-		if f.LocalPath == "" {
-			return nil, ErrMissingLocalPath
-		}
-		stat, err := os.Lstat(f.LocalPath)
-		if err != nil {
-			return nil, err
+		stat, err := os.FileInfo(nil), error(nil)
+		rehash := false
+		if f.Content != nil {
+			// Symlinks, directories and special files have no contents to provide:
+			if f.Mode&os.ModeType != 0 {
+				return nil, ErrProviderNotRegular
+			}
+			f.Size = f.Content.Size()
+			if f.Hash == nil {
+				f.Hash = f.Content.Hash()
+			}
+			stat = providedFileInfo{f}
+		} else {
+			// Validate LocalPaths:
+			if f.LocalPath == "" {
+				return nil, ErrMissingLocalPath
+			}
+			stat, err = os.Lstat(f.LocalPath)
+			if err != nil {
+				return nil, err
+			}
 		}
-		// TODO: remove this limitation and allow directory entries to have their own permission bits
 		if stat.IsDir() {
-			return nil, ErrFilesOnly
+			// Directory entries carry only their mode so that empty directories are recreated:
+			f.Size = 0
+			f.Mode |= os.ModeDir
 		}
 		if t.options.CompatMode {
-			if stat.Mode()&os.ModeType != 0 {
+			if stat.Mode()&os.ModeType&^os.ModeDir != 0 {
 				return nil, ErrCompatViolation
 			}
-			// Force all chmods to -rw-r--r-- for compatibility purposes:
+			// Force all chmods to -rw-r--r-- (drwxr-xr-x for directories) for compatibility purposes:
 			f.Mode = 0644
+			if stat.IsDir() {
+				f.Mode = os.ModeDir | 0755
+			}
 		} else {
 			if stat.Mode()&os.ModeSymlink == os.ModeSymlink {
 				// Make sure size is 0 since we don't store contents for symlinks:
@@ -74,9 +197,63 @@ func NewVirtualTarballReader(files []*TarballFile, options VirtualTarballOptions
 						return nil, err
 					}
 				}
+				// Record whether the symlink points to a directory; dangling symlinks are file symlinks:
+				if target, err := os.Stat(f.LocalPath); err == nil && target.IsDir() {
+					f.SymlinkIsDir = true
+				}
+			} else if isSpecial(stat.Mode()) {
+				// Special files have no contents to send, only their type and device numbers:
+				f.Size = 0
+				if stat.Mode()&os.ModeDevice != 0 {
+					f.DeviceMajor, f.DeviceMinor = deviceNumbers(stat)
+				}
 			}
 		}
 
+		if stat.Mode()&os.ModeType == 0 && f.Content == nil {
+			// A stale manifest or hand-built entry would otherwise deliver the wrong length:
+			if stat.Size() != f.Size {
+				return nil, &SizeMismatchError{Path: f.Path, Size: f.Size, Actual: stat.Size()}
+			}
+			if !t.options.TrustMetadata && f.Hash != nil {
+				// Hashed again below even without HashFiles so that the file keeps a hash:
+				f.Hash, f.BlockHashes = nil, nil
+				rehash = true
+			}
+		}
+		if f.ModTime.IsZero() {
+			f.ModTime = stat.ModTime()
+		}
+		if t.pinned != nil && stat.Mode()&os.ModeType == 0 && f.Content == nil {
+			pin, err := os.Open(f.LocalPath)
+			if err != nil {
+				return nil, err
+			}
+			t.pinned[f] = pin
+		}
+		if t.options.DetectHoles && stat.Mode()&os.ModeType == 0 && f.Size > 0 && f.Content == nil {
+			if f.DataExtents, err = t.detectHoles(f); err != nil {
+				return nil, err
+			}
+		}
+		blockSize := uint32(0)
+		if t.options.HashFiles && stat.Mode()&os.ModeType == 0 {
+			blockSize = t.options.BlockSize
+		}
+		if f.BlockSize != blockSize {
+			// Block hashes preset from a metadata cache built with a different block size:
+			f.BlockSize, f.BlockHashes = 0, nil
+		}
+		if blockSize > 0 && (f.Hash == nil || f.BlockSize == 0) {
+			f.BlockSize = blockSize
+			f.Hash, f.BlockHashes = nil, nil
+			t.unhashed = append(t.unhashed, f)
+		} else if (t.options.HashFiles || rehash) && stat.Mode()&os.ModeType == 0 && f.Hash == nil {
+			t.unhashed = append(t.unhashed, f)
+		}
+		// Hashes supplied with the file are cut to HashSize like those computed:
+		f.Hash = t.options.truncateHash(f.Hash)
+
 		// Validate all paths are unique:
 		if _, ok := uniquePaths[f.Path]; ok {
 			return nil, ErrDuplicatePaths
@@ -88,63 +265,355 @@ func NewVirtualTarballReader(files []*TarballFile, options VirtualTarballOptions
 		t.files = append(t.files, f)
 
 		// Each file ends with a terminating NUL character so at least one call to WriteAt or ReadAt will happen to create/read all files.
-		t.size += f.Size + 1
+		if t.size, err = addEntrySize(t.size, f.Size, t.options.padding()); err != nil {
+			return nil, err
+		}
 	}
 
 	// Sort files for consistency:
 	sort.Sort(t.files)
 
 	// Generate a 64-bit hash for identification purposes:
+	t.hashId = tarballHashId(t.files, t.options)
+
+	t.content = newContentIndex(t.files, t.size)
+
+	if !t.options.LazyHash {
+		if err := t.HashContents(); err != nil {
+			return nil, err
+		}
+	}
+
+	ok = true
+	return t, nil
+}
+
+// HashId of a tarball of files, sorted by path, laid out with options. Content hashes are left out so that hashing may
+// be deferred:
+func tarballHashId(files []*TarballFile, options VirtualTarballOptions) []byte {
 	all := fnv.New64a()
-	for _, f := range t.files {
+	for _, f := range files {
 		// Write unique data about file into collection hash:
 		all.Write([]byte(f.Path))
 		binary.Write(all, byteOrder, f.Size)
 		binary.Write(all, byteOrder, f.Mode)
 		all.Write([]byte(f.SymlinkDestination))
+		if f.Mode&os.ModeDevice != 0 {
+			binary.Write(all, byteOrder, f.DeviceMajor)
+			binary.Write(all, byteOrder, f.DeviceMinor)
+		}
+		if options.DetectHoles {
+			// Holes are never sent, so where they lie is part of the content; no holes is one extent as encoded:
+			extents := f.DataExtents
+			if extents == nil {
+				extents = []DataExtent{{Offset: 0, Length: f.Size}}
+			}
+			binary.Write(all, byteOrder, uint32(len(extents)))
+			for _, e := range extents {
+				binary.Write(all, byteOrder, e.Offset)
+				binary.Write(all, byteOrder, e.Length)
+			}
+		}
+	}
+	if options.DetectHoles {
+		all.Write([]byte{metadataFlagDataExtents})
+	}
+	if options.NoPadding {
+		// Layout differs so the tarball must not be mistaken for its padded equivalent:
+		all.Write([]byte{metadataFlagNoPadding})
+	}
+	if options.GzipStream {
+		// As is sending it compressed:
+		all.Write([]byte{metadataFlagGzipStream})
+	}
+	if options.HashSize > 0 {
+		// As are truncated hashes, so that metadata cached with full ones is not served:
+		all.Write([]byte{metadataFlagHashSize, byte(options.HashSize)})
 	}
 
 	// Sum the 64-bit hash:
-	t.hashId = make([]byte, 8)
-	byteOrder.PutUint64(t.hashId, all.Sum64())
+	hashId := make([]byte, 8)
+	byteOrder.PutUint64(hashId, all.Sum64())
+	return hashId
+}
 
-	return t, nil
+// Finds the data extents of a sparse source file through its pinned handle if it has one:
+func (t *VirtualTarballReader) detectHoles(f *TarballFile) ([]DataExtent, error) {
+	if pin := t.pinned[f]; pin != nil {
+		return dataExtents(pin, f.Size)
+	}
+	file, err := os.Open(f.LocalPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return dataExtents(file, f.Size)
+}
+
+// Takes a snapshot of SnapshotRoot and returns files with the LocalPaths of those under it pointed into the snapshot.
+// Those entries are copies, so the caller's still name the live files once the snapshot is released:
+func (t *VirtualTarballReader) snapshot(files []*TarballFile) ([]*TarballFile, error) {
+	root, err := filepath.Abs(t.options.SnapshotRoot)
+	if err != nil {
+		return nil, err
+	}
+	snapshotRoot, release, err := t.options.Snapshot.Snapshot(root)
+	if err != nil {
+		return nil, err
+	}
+	t.releaseSnapshot = release
+
+	snapshotted := make([]*TarballFile, len(files))
+	copy(snapshotted, files)
+	for i, f := range files {
+		if f.Content != nil {
+			continue
+		}
+		path, err := filepath.Abs(f.LocalPath)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			// Not under the snapshot:
+			continue
+		}
+		c := *f
+		c.LocalPath = filepath.Join(snapshotRoot, rel)
+		snapshotted[i] = &c
+	}
+	return snapshotted, nil
+}
+
+// Hashes the contents of files not yet hashed; HashId does not depend on content hashes so is unaffected.
+func (t *VirtualTarballReader) HashContents() error {
+	for len(t.unhashed) > 0 {
+		f := t.unhashed[0]
+		err := error(nil)
+		if src := t.hashSource(f); src != nil {
+			// Hash what will be served:
+			r := io.NewSectionReader(src, 0, math.MaxInt64)
+			if f.BlockSize > 0 {
+				f.Hash, f.BlockHashes, err = hashContentBlocks(r, f.BlockSize)
+			} else {
+				f.Hash, err = hashContents(r)
+			}
+		} else if f.BlockSize > 0 {
+			f.Hash, f.BlockHashes, err = hashFileBlocks(f.LocalPath, f.BlockSize)
+		} else {
+			f.Hash, err = hashFile(f.LocalPath)
+		}
+		if err != nil {
+			return err
+		}
+		f.Hash = t.options.truncateHash(f.Hash)
+		t.unhashed = t.unhashed[1:]
+	}
+	return nil
+}
+
+// Returns what a file's contents are read from other than its LocalPath, or nil:
+func (t *VirtualTarballReader) hashSource(f *TarballFile) io.ReaderAt {
+	if f.Content != nil {
+		return f.Content
+	}
+	if pin := t.pinned[f]; pin != nil {
+		return pin
+	}
+	return nil
+}
+
+// Restats all source files and returns those whose size or modification time no longer match, or that are gone; pinned
+// files are restatted through their open handles and provided contents are modified when their size changes:
+func (t *VirtualTarballReader) ModifiedFiles() []*TarballFile {
+	modified := []*TarballFile(nil)
+	for _, f := range t.files {
+		if f.Content != nil {
+			if f.Content.Size() != f.Size {
+				modified = append(modified, f)
+			}
+			continue
+		}
+		stat, err := os.Lstat(f.LocalPath)
+		if pin := t.pinned[f]; pin != nil {
+			// Only changes to the pinned file itself are served:
+			stat, err = pin.Stat()
+		}
+		if err != nil {
+			modified = append(modified, f)
+			continue
+		}
+		size := stat.Size()
+		if stat.Mode()&os.ModeSymlink == os.ModeSymlink || stat.IsDir() || isSpecial(stat.Mode()) {
+			size = 0
+		}
+		if size != f.Size || !stat.ModTime().Equal(f.ModTime) {
+			modified = append(modified, f)
+		}
+	}
+	return modified
 }
 
 func (t *VirtualTarballReader) HashId() []byte {
 	return t.hashId
 }
 
-func (t *VirtualTarballReader) closeFile() error {
-	if t.openFileInfo == nil {
-		t.openFile = nil
-		return nil
+func (t *VirtualTarballReader) Size() int64 {
+	return t.size
+}
+
+// Size of the file contents alone, without padding:
+func (t *VirtualTarballReader) ContentSize() int64 {
+	return t.content.contentSize()
+}
+
+// Count of content bytes before a tarball offset, for reporting progress without padding:
+func (t *VirtualTarballReader) ContentOffset(offset int64) int64 {
+	return t.content.contentOffset(offset)
+}
+
+// Tarball offset of a content byte; inverse of ContentOffset:
+func (t *VirtualTarballReader) VirtualOffset(contentOffset int64) int64 {
+	return t.content.virtualOffset(contentOffset)
+}
+
+// The bytes of the tarball holding a file: its contents followed by the trailing NUL padding byte unless NoPadding
+// is set, so that the ranges of consecutive files are contiguous. ok is false if the path is not in the tarball.
+func (t *VirtualTarballReader) FileRange(path string) (offset, size int64, ok bool) {
+	return t.files.fileRange(path, t.options.padding())
+}
+
+func (t *VirtualTarballReader) Files() []*TarballFile {
+	return t.files
+}
+
+func (t *VirtualTarballReader) Options() VirtualTarballOptions {
+	return t.options
+}
+
+// Caps a requested count of open source files to half of the process's open file limit, leaving the rest for
+// sockets and other files; a negative request asks for that half. Without a known limit a negative request keeps one
+// file open. Requests under 1 otherwise keep one file open, like reading files one at a time.
+func LimitOpenFiles(requested int) int {
+	limit, ok := openFileLimit()
+	if !ok {
+		if requested < 1 {
+			return 1
+		}
+		return requested
+	}
+	half := limit / 2
+	if half < 1 {
+		half = 1
 	}
-	if t.openFile == nil {
-		t.openFileInfo = nil
-		return nil
+	if requested < 0 || requested > half {
+		return half
 	}
+	if requested < 1 {
+		return 1
+	}
+	return requested
+}
 
-	if !t.options.CompatMode {
-		err := t.openFile.Chmod(t.openFileInfo.Mode)
-		if err != nil {
-			return err
+// Returns a reader for a regular source file, opening it if it is not open yet and closing the least recently read
+// files to stay within the limit:
+func (t *VirtualTarballReader) openSource(tf *TarballFile) (io.ReaderAt, error) {
+	e, ok := t.openFiles[tf]
+	if !ok {
+		for t.openLRU.Len() >= t.maxOpen {
+			// Errors closing read-only files are not worth failing reads over:
+			t.closeSource(t.openLRU.Back())
+		}
+
+		f := t.pinned[tf]
+		if f == nil {
+			var err error
+			f, err = os.OpenFile(tf.LocalPath, os.O_RDONLY, 0)
+			if err != nil {
+				return nil, err
+			}
 		}
+
+		src := &openSource{tf: tf, file: f}
+		if t.options.MemoryMap && tf.Size > 0 {
+			// Fall back to ReadAt if the file cannot be mapped:
+			data, err := mmapFile(f, tf.Size)
+			if err == nil {
+				src.mmap = &mappedFile{data: data, file: f}
+			}
+		}
+		e = t.openLRU.PushFront(src)
+		t.openFiles[tf] = e
 	}
+	t.openLRU.MoveToFront(e)
 
-	err := t.openFile.Close()
-	if err != nil {
-		return err
+	src := e.Value.(*openSource)
+	if src.mmap != nil {
+		return src.mmap, nil
 	}
+	return src.file, nil
+}
 
-	t.openFile = nil
-	t.openFileInfo = nil
-	return nil
+func (t *VirtualTarballReader) closeSource(e *list.Element) error {
+	src := t.openLRU.Remove(e).(*openSource)
+	delete(t.openFiles, src.tf)
+
+	err := error(nil)
+	if src.mmap != nil {
+		err = munmapFile(src.mmap.data)
+	}
+	if !t.options.CompatMode {
+		if cerr := src.file.Chmod(src.tf.Mode); err == nil {
+			err = cerr
+		}
+	}
+	// Pinned files stay open until Close:
+	if t.pinned[src.tf] != src.file {
+		if cerr := src.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Count of source files currently open for reading, not counting pinned files:
+func (t *VirtualTarballReader) OpenFiles() int {
+	n := 0
+	for tf := range t.openFiles {
+		if t.pinned[tf] == nil {
+			n++
+		}
+	}
+	return n
 }
 
 // io.Closer:
 func (t *VirtualTarballReader) Close() error {
-	return t.closeFile()
+	err := error(nil)
+	for t.openLRU.Len() > 0 {
+		if cerr := t.closeSource(t.openLRU.Back()); err == nil {
+			err = cerr
+		}
+	}
+	for f, pin := range t.pinned {
+		if cerr := pin.Close(); err == nil {
+			err = cerr
+		}
+		delete(t.pinned, f)
+	}
+	if t.releaseSnapshot != nil {
+		if rerr := t.releaseSnapshot(); err == nil {
+			err = rerr
+		}
+		t.releaseSnapshot = nil
+	}
+	if t.blob != nil {
+		if cerr := t.blob.Close(); err == nil {
+			err = cerr
+		}
+		t.blob = nil
+	}
+	return err
 }
 
 // io.ReaderAt:
@@ -160,30 +629,19 @@ func (t *VirtualTarballReader) ReadAt(buf []byte, offset int64) (n int, err erro
 	total := 0
 	remainder := buf[:]
 	for _, tf := range t.files {
-		if offset < tf.offset || offset >= tf.offset+tf.Size+1 {
+		if offset < tf.offset || offset >= tf.offset+tf.Size+t.options.padding() {
 			continue
 		}
 
 		readerAt := io.ReaderAt(nil)
 		// Only open normal, non-empty files:
-		if tf.Mode&os.ModeType == 0 {
-			// Open file if not already:
-			if t.openFileInfo != tf {
-				// Close and finalize last open file:
-				if t.openFileInfo != nil {
-					t.closeFile()
-				}
-
-				f, err := os.OpenFile(tf.LocalPath, os.O_RDONLY, 0)
-				if err != nil {
-					return 0, err
-				}
-
-				t.openFile = f
-				t.openFileInfo = tf
+		if tf.Content != nil {
+			readerAt = tf.Content
+		} else if tf.Mode&os.ModeType == 0 {
+			readerAt, err = t.openSource(tf)
+			if err != nil {
+				return 0, err
 			}
-
-			readerAt = t.openFile
 		}
 
 		localOffset := offset - tf.offset
@@ -208,7 +666,7 @@ func (t *VirtualTarballReader) ReadAt(buf []byte, offset int64) (n int, err erro
 		}
 
 		// Fill in trailing NUL padding byte:
-		if offset == tf.offset+tf.Size && len(remainder) > 0 {
+		if !t.options.NoPadding && offset == tf.offset+tf.Size && len(remainder) > 0 {
 			remainder[0] = 0
 			remainder = remainder[1:]
 			offset++
@@ -2,9 +2,15 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -176,3 +182,699 @@ func TestReadAt_SpanningFiles(t *testing.T) {
 		t.Fatalf("expected message != read message")
 	}
 }
+
+func TestReadAt_MemoryMap(t *testing.T) {
+	testString := "hello, world!\n"
+	testMessage := []byte(testString)
+	const fname1 = "test1.txt"
+	const fname2 = "test2.txt"
+
+	testFile1, err := createTestFile(fname1, testMessage)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	testFile2, err := createTestFile(fname2, testMessage)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	files := []*TarballFile{
+		&TarballFile{Path: fname1, LocalPath: fname1, Size: testFile1.Size(), Mode: testFile1.Mode()},
+		&TarballFile{Path: fname2, LocalPath: fname2, Size: testFile2.Size(), Mode: testFile2.Mode()},
+	}
+
+	options := getOptions()
+	options.MemoryMap = true
+	tb, err := NewVirtualTarballReader(files, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTarballReader(t, tb)
+
+	// Read at an offset spanning both files:
+	expectedMessage := []byte(testString[3:] + "\x00" + testString[:5])
+	buf := make([]byte, len(expectedMessage))
+	n, err := tb.ReadAt(buf, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(expectedMessage) {
+		t.Fatalf("n != %d; n = %v", len(expectedMessage), n)
+	}
+	if bytes.Compare(buf, expectedMessage) != 0 {
+		t.Fatalf("expected message != read message; %q", buf)
+	}
+}
+
+func TestReadAt_MemoryMapTruncated(t *testing.T) {
+	const fname = "mapped.bin"
+	page := os.Getpagesize()
+	if _, err := createTestFile(fname, bytes.Repeat([]byte("m"), 3*page)); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fname)
+	f, err := os.OpenFile(fname, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := mmapFile(f, int64(3*page))
+	if err != nil {
+		t.Skipf("cannot map files here: %v", err)
+	}
+	m := &mappedFile{data: data, file: f}
+	defer munmapFile(data)
+
+	// Reading pages the file no longer has falls back to the file instead of crashing:
+	if err := f.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if n, err := m.ReadAt(buf, int64(2*page)); n != 0 || err != io.EOF {
+		t.Fatalf("ReadAt = %d, %v; expected 0, EOF", n, err)
+	}
+}
+
+func TestCountingReaderAt(t *testing.T) {
+	c := NewCountingReaderAt(bytes.NewReader([]byte("0123456789")), 10)
+
+	buf := make([]byte, 4)
+	c.ReadAt(buf, 0)
+	c.ReadAt(buf, 0)
+	c.ReadAt(buf, 2)
+	if n, _ := c.ReadAt(buf, 8); n != 2 {
+		t.Fatalf("n != 2; n = %d", n)
+	}
+
+	if c.TotalBytes() != 4+4+4+2 {
+		t.Fatalf("unexpected total %d", c.TotalBytes())
+	}
+	if c.UniqueBytes() != 8 {
+		t.Fatalf("unexpected unique %d", c.UniqueBytes())
+	}
+	if c.RegionReads(0) != 2 || c.RegionReads(2) != 1 || c.RegionReads(4) != 0 {
+		t.Fatal("unexpected region read counts")
+	}
+}
+
+func TestMergeTarballSources(t *testing.T) {
+	for _, dir := range []string{"merge_a/sub", "merge_b"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.RemoveAll("merge_a")
+	defer os.RemoveAll("merge_b")
+	createTestFile("merge_a/sub/one.txt", []byte("one\n"))
+	createTestFile("merge_b/two.txt", []byte("two\n"))
+
+	files, err := MergeTarballSources(
+		TarballSource{Root: "merge_a", Prefix: "opt", Directories: true},
+		TarballSource{Root: "merge_b", Prefix: "opt", Directories: true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := newTarballReader(t, files)
+	defer closeTarballReader(t, tb)
+	paths := []string{}
+	for _, f := range tb.files {
+		paths = append(paths, f.Path)
+	}
+	if strings.Join(paths, ",") != "opt/sub,opt/sub/one.txt,opt/two.txt" {
+		t.Fatalf("unexpected merged files %v", paths)
+	}
+	if tb.files[0].Mode&os.ModeDir == 0 || tb.files[0].Size != 0 {
+		t.Fatalf("expected directory entry for opt/sub; got %v size %d", tb.files[0].Mode, tb.files[0].Size)
+	}
+
+	// Directories are only listed when asked for, leaving the HashId of plain file lists as it was:
+	files, err = MergeTarballSources(
+		TarballSource{Root: "merge_a", Prefix: "opt"},
+		TarballSource{Root: "merge_b", Prefix: "opt"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Path != "opt/sub/one.txt" || files[1].Path != "opt/two.txt" {
+		t.Fatalf("expected only files; got %+v", files)
+	}
+
+	// Same file from two roots collides:
+	createTestFile("merge_a/two.txt", []byte("other two\n"))
+	_, err = MergeTarballSources(
+		TarballSource{Root: "merge_a", Prefix: "opt"},
+		TarballSource{Root: "merge_b", Prefix: "opt"},
+	)
+	pe, ok := err.(*PathValidationError)
+	if !ok || len(pe.DuplicatePaths) != 1 || pe.DuplicatePaths[0] != "opt/two.txt" {
+		t.Fatalf("expected collision on opt/two.txt; got %v", err)
+	}
+}
+
+func TestReadAt_NoPadding(t *testing.T) {
+	createTestFile("nopad1.txt", []byte("abc"))
+	createTestFile("nopad2.txt", []byte("de"))
+	files := []*TarballFile{
+		&TarballFile{Path: "nopad1.txt", LocalPath: "nopad1.txt", Size: 3, Mode: 0644},
+		&TarballFile{Path: "nopad2.txt", LocalPath: "nopad2.txt", Size: 2, Mode: 0644},
+	}
+	options := getOptions()
+	options.NoPadding = true
+	tb, err := NewVirtualTarballReader(files, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTarballReader(t, tb)
+
+	buf := make([]byte, tb.size)
+	if _, err := tb.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "abcde" {
+		t.Fatalf("read %q; expected %q", buf, "abcde")
+	}
+
+	padded := newTarballReader(t, files)
+	defer padded.Close()
+	if bytes.Equal(padded.HashId(), tb.HashId()) {
+		t.Fatal("padded and unpadded tarballs must have different ids")
+	}
+}
+
+func TestReadAt_SizeMismatch(t *testing.T) {
+	createTestFile("mismatch.txt", []byte("twelve bytes"))
+	defer os.Remove("mismatch.txt")
+
+	_, err := NewVirtualTarballReader([]*TarballFile{
+		&TarballFile{Path: "mismatch.txt", LocalPath: "mismatch.txt", Size: 5, Mode: 0644},
+	}, getOptions())
+	mismatch, ok := err.(*SizeMismatchError)
+	if !ok || mismatch.Path != "mismatch.txt" || mismatch.Size != 5 || mismatch.Actual != 12 {
+		t.Fatalf("expected a SizeMismatchError; got %v", err)
+	}
+
+	// A supplied hash is recomputed unless trusted, even without HashFiles:
+	stale := []byte("0123456789abcdef0123456789abcdef")
+	tb, err := NewVirtualTarballReader([]*TarballFile{
+		&TarballFile{Path: "mismatch.txt", LocalPath: "mismatch.txt", Size: 12, Mode: 0644, Hash: stale},
+	}, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTarballReader(t, tb)
+	expected, _ := hashFile("mismatch.txt")
+	if !bytes.Equal(tb.files[0].Hash, expected) {
+		t.Fatal("expected the supplied hash to be recomputed")
+	}
+}
+
+func TestTarball_DirectorySymlink(t *testing.T) {
+	if getOptions().CompatMode {
+		t.Skip("symlinks not supported in compat mode")
+	}
+
+	if err := os.Mkdir("linked_dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("linked_dir")
+	if err := os.Symlink("linked_dir", "dir_link"); err != nil {
+		t.Skipf("cannot create symlinks: %v", err)
+	}
+	defer os.Remove("dir_link")
+	if err := os.Symlink("missing", "file_link"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("file_link")
+
+	files := []*TarballFile{
+		&TarballFile{Path: "dir_link", LocalPath: "dir_link", Mode: os.ModeSymlink | 0777},
+		&TarballFile{Path: "file_link", LocalPath: "file_link", Mode: os.ModeSymlink | 0777},
+	}
+	tb, err := NewVirtualTarballReader(files, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	if !tb.files[0].SymlinkIsDir || tb.files[1].SymlinkIsDir {
+		t.Fatalf("SymlinkIsDir = %v, %v; expected true, false", tb.files[0].SymlinkIsDir, tb.files[1].SymlinkIsDir)
+	}
+	if tb.files[0].SymlinkDestination != "linked_dir" {
+		t.Fatalf("unexpected destination '%s'", tb.files[0].SymlinkDestination)
+	}
+}
+
+func TestReadAt_PaddingBoundaries(t *testing.T) {
+	createTestFile("pad1.txt", []byte("hello"))
+	createTestFile("pad2.txt", []byte{})
+	createTestFile("pad3.txt", []byte("abc"))
+	files := []*TarballFile{
+		&TarballFile{Path: "pad1.txt", LocalPath: "pad1.txt", Size: 5, Mode: 0644},
+		&TarballFile{Path: "pad2.txt", LocalPath: "pad2.txt", Size: 0, Mode: 0644},
+		&TarballFile{Path: "pad3.txt", LocalPath: "pad3.txt", Size: 3, Mode: 0644},
+	}
+	tb := newTarballReader(t, files)
+	defer closeTarballReader(t, tb)
+
+	expected := []byte("hello\x00\x00abc\x00")
+	if tb.size != int64(len(expected)) {
+		t.Fatalf("size = %d; expected %d", tb.size, len(expected))
+	}
+
+	// Every NUL position must read back as 0x00 on its own:
+	for _, f := range tb.files {
+		b := []byte{0xff}
+		n, err := tb.ReadAt(b, f.offset+f.Size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 || b[0] != 0 {
+			t.Fatalf("'%s': read %d bytes %#x at padding offset %d", f.Path, n, b[0], f.offset+f.Size)
+		}
+	}
+
+	// Every read range, including ones spanning files and the NULs between them, must match the stream:
+	for offset := 0; offset < len(expected); offset++ {
+		for end := offset + 1; end <= len(expected); end++ {
+			buf := bytes.Repeat([]byte{0xff}, end-offset)
+			n, err := tb.ReadAt(buf, int64(offset))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(buf) || !bytes.Equal(buf, expected[offset:end]) {
+				t.Fatalf("ReadAt(%d:%d) = %q (%d); expected %q", offset, end, buf[:n], n, expected[offset:end])
+			}
+		}
+	}
+}
+
+func TestReadAt_ContentOffsets(t *testing.T) {
+	createTestFile("pad1.txt", []byte("hello"))
+	createTestFile("pad2.txt", []byte{})
+	createTestFile("pad3.txt", []byte("abc"))
+	files := []*TarballFile{
+		&TarballFile{Path: "pad1.txt", LocalPath: "pad1.txt", Size: 5, Mode: 0644},
+		&TarballFile{Path: "pad2.txt", LocalPath: "pad2.txt", Size: 0, Mode: 0644},
+		&TarballFile{Path: "pad3.txt", LocalPath: "pad3.txt", Size: 3, Mode: 0644},
+	}
+	tb := newTarballReader(t, files)
+	defer closeTarballReader(t, tb)
+
+	// "hello\x00\x00abc\x00": padding bytes do not count as content:
+	if n := tb.ContentSize(); n != 8 {
+		t.Fatalf("content size = %d; expected 8", n)
+	}
+	contentOffsets := []int64{0, 1, 2, 3, 4, 5, 5, 5, 6, 7, 8, 8}
+	for offset, expected := range contentOffsets {
+		if n := tb.ContentOffset(int64(offset)); n != expected {
+			t.Fatalf("ContentOffset(%d) = %d; expected %d", offset, n, expected)
+		}
+	}
+	virtualOffsets := []int64{0, 1, 2, 3, 4, 7, 8, 9, 11}
+	for contentOffset, expected := range virtualOffsets {
+		if n := tb.VirtualOffset(int64(contentOffset)); n != expected {
+			t.Fatalf("VirtualOffset(%d) = %d; expected %d", contentOffset, n, expected)
+		}
+	}
+}
+
+func TestReadAt_PinFiles(t *testing.T) {
+	createTestFile("pinned.txt", []byte("old\n"))
+	defer os.Remove("pinned.txt")
+	defer os.Remove("pinned.new")
+
+	options := getOptions()
+	options.PinFiles = true
+	options.HashFiles = true
+	options.LazyHash = true
+	tb, err := NewVirtualTarballReader([]*TarballFile{
+		&TarballFile{Path: "pinned.txt", LocalPath: "pinned.txt", Size: 4, Mode: 0644},
+	}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTarballReader(t, tb)
+
+	// Replace the path as an editor saving a new version would:
+	if err := ioutil.WriteFile("pinned.new", []byte("new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename("pinned.new", "pinned.txt"); err != nil {
+		t.Skipf("cannot replace an open file: %v", err)
+	}
+
+	buf := make([]byte, tb.size)
+	if _, err := tb.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "old\n\x00" {
+		t.Fatalf("read %q; expected the pinned contents", buf)
+	}
+	if err := tb.HashContents(); err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256([]byte("old\n")); !bytes.Equal(tb.files[0].Hash, sum[:]) {
+		t.Fatal("expected the pinned contents to be hashed")
+	}
+	if modified := tb.ModifiedFiles(); len(modified) != 0 {
+		t.Fatalf("expected a replaced path not to modify the pinned file; got %d modified", len(modified))
+	}
+}
+
+// Snapshots by copying regular files, standing in for a filesystem snapshot:
+type copySnapshotter struct {
+	released bool
+}
+
+func (c *copySnapshotter) Snapshot(root string) (string, func() error, error) {
+	dest := root + ".snapshot"
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, path[len(root):])
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, contents, info.Mode())
+	})
+	return dest, func() error {
+		c.released = true
+		return os.RemoveAll(dest)
+	}, err
+}
+
+func TestNewReader_Snapshot(t *testing.T) {
+	if err := os.MkdirAll("snap_src", 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("snap_src")
+	createTestFile(filepath.Join("snap_src", "live.txt"), []byte("before\n"))
+
+	files, err := MergeTarballSources(TarballSource{Root: "snap_src"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotter := &copySnapshotter{}
+	options := getOptions()
+	options.Snapshot = snapshotter
+	options.SnapshotRoot = "snap_src"
+	live := files[0].LocalPath
+	tb, err := NewVirtualTarballReader(files, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The caller's entries still name the live files:
+	if files[0].LocalPath != live || tb.files[0].LocalPath == live {
+		t.Fatalf("LocalPath = %q, served from %q; expected only the reader's copy in the snapshot", files[0].LocalPath, tb.files[0].LocalPath)
+	}
+
+	// Changes after construction are not served:
+	if err := ioutil.WriteFile(filepath.Join("snap_src", "live.txt"), []byte("after!\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, tb.size)
+	if _, err := tb.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "before\n\x00" {
+		t.Fatalf("read %q; expected the snapshot contents", buf)
+	}
+	if modified := tb.ModifiedFiles(); len(modified) != 0 {
+		t.Fatalf("expected the snapshot to be unmodified; got %d modified", len(modified))
+	}
+
+	if err := tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !snapshotter.released {
+		t.Fatal("expected the snapshot to be released on close")
+	}
+	if _, err := os.Stat("snap_src.snapshot"); !os.IsNotExist(err) {
+		t.Fatalf("expected the snapshot to be removed; got %v", err)
+	}
+}
+
+func TestReadAt_DetectHoles(t *testing.T) {
+	f, err := os.Create("sparse.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("sparse.bin")
+	defer os.Remove("dense.bin")
+	if err = f.Truncate(1 << 20); err == nil {
+		_, err = f.WriteAt([]byte("data"), 1<<19)
+	}
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestFile("dense.bin", []byte("dense\n"))
+
+	options := getOptions()
+	options.DetectHoles = true
+	tb, err := NewVirtualTarballReader([]*TarballFile{
+		&TarballFile{Path: "sparse.bin", LocalPath: "sparse.bin", Size: 1 << 20, Mode: 0644},
+		&TarballFile{Path: "dense.bin", LocalPath: "dense.bin", Size: 6, Mode: 0644},
+	}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTarballReader(t, tb)
+
+	extents := tb.files[0].DataExtents
+	if extents == nil {
+		t.Skip("holes not detected on this platform or filesystem")
+	}
+	// Filesystems report data in whole blocks:
+	if len(extents) != 1 || extents[0].Offset > 1<<19 || extents[0].Offset+extents[0].Length < 1<<19+4 || extents[0].Length >= 1<<20 {
+		t.Fatalf("unexpected data extents %+v", extents)
+	}
+	if tb.files[1].DataExtents != nil {
+		t.Fatalf("unexpected data extents for a dense file: %+v", tb.files[1].DataExtents)
+	}
+	if flags := metadataFlags(tb.Options()); flags&metadataFlagDataExtents == 0 {
+		t.Fatal("expected data extents in the metadata")
+	}
+
+	// Where the holes lie is part of the tarball's identity:
+	files := []*TarballFile{&TarballFile{Path: "sparse.bin", Size: 1 << 20, Mode: 0644, DataExtents: extents}}
+	id := tarballHashId(files, options)
+	if bytes.Equal(id, tarballHashId(files, getOptions())) {
+		t.Fatal("expected data extents to change the HashId")
+	}
+	files[0].DataExtents = []DataExtent{{Offset: 0, Length: 4}}
+	if bytes.Equal(id, tarballHashId(files, options)) {
+		t.Fatal("expected different data extents to change the HashId")
+	}
+}
+
+func TestReadAt_MaxOpenFiles(t *testing.T) {
+	if err := os.MkdirAll("open_src", 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("open_src")
+	expected := []byte(nil)
+	for i := 0; i < 20; i++ {
+		contents := []byte(strings.Repeat(string(rune('a'+i)), i+1))
+		createTestFile(filepath.Join("open_src", fmt.Sprintf("f%02d", i)), contents)
+		expected = append(append(expected, contents...), 0)
+	}
+
+	files, err := MergeTarballSources(TarballSource{Root: "open_src"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := getOptions()
+	options.MaxOpenFiles = 3
+	options.MemoryMap = true
+	tb, err := NewVirtualTarballReader(files, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTarballReader(t, tb)
+
+	// Reads spanning files and jumping back and forth never hold more than the cap open:
+	buf := make([]byte, len(expected))
+	for _, step := range []int{7, 50, 3} {
+		for o := 0; o < len(expected); o += step {
+			for _, start := range []int{o, len(expected) - 1 - o} {
+				if start < 0 {
+					continue
+				}
+				end := start + step
+				if end > len(expected) {
+					end = len(expected)
+				}
+				if _, err := tb.ReadAt(buf[start:end], int64(start)); err != nil {
+					t.Fatal(err)
+				}
+				if n := tb.OpenFiles(); n > 3 {
+					t.Fatalf("%d files open; expected at most 3", n)
+				}
+			}
+		}
+		if !bytes.Equal(buf, expected) {
+			t.Fatalf("read %q; expected %q", buf, expected)
+		}
+	}
+
+	if err := tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := tb.OpenFiles(); n != 0 {
+		t.Fatalf("%d files open after closing", n)
+	}
+
+	if limit, ok := openFileLimit(); ok && LimitOpenFiles(limit) > limit/2 {
+		t.Fatalf("expected requests to be capped to half the open file limit of %d", limit)
+	}
+	if LimitOpenFiles(0) != 1 || LimitOpenFiles(2) != 2 {
+		t.Fatal("expected small requests to stand")
+	}
+}
+
+// Serves contents from memory:
+type bytesProvider struct {
+	*bytes.Reader
+	hash []byte
+}
+
+func (p bytesProvider) Hash() []byte {
+	return p.hash
+}
+
+func TestReadAt_ContentProvider(t *testing.T) {
+	testMessage := []byte("hello, world!\n")
+	const fname = "test_local.txt"
+	stat, err := createTestFile(fname, testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generated := []byte("generated contents")
+	precomputed := sha256.Sum256([]byte("trusted"))
+	files := []*TarballFile{
+		&TarballFile{Path: "generated.bin", Mode: 0644, Content: bytesProvider{Reader: bytes.NewReader(generated)}},
+		&TarballFile{Path: fname, LocalPath: fname, Size: stat.Size(), Mode: stat.Mode()},
+		&TarballFile{Path: "hashed.bin", Mode: 0644, Content: bytesProvider{Reader: bytes.NewReader(testMessage), hash: precomputed[:]}},
+	}
+	options := getOptions()
+	options.HashFiles = true
+	tb, err := NewVirtualTarballReader(files, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTarballReader(t, tb)
+
+	expected := []byte(string(generated) + "\x00" + string(testMessage) + "\x00" + string(testMessage) + "\x00")
+	if tb.Size() != int64(len(expected)) {
+		t.Fatalf("size %d; expected %d", tb.Size(), len(expected))
+	}
+	buf := make([]byte, len(expected))
+	if _, err := tb.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, expected) {
+		t.Fatalf("read %q; expected %q", buf, expected)
+	}
+	if tb.OpenFiles() != 1 {
+		t.Fatalf("expected only the local file to be opened; %d open", tb.OpenFiles())
+	}
+
+	// Providers without a hash are hashed by reading them:
+	generatedHash := sha256.Sum256(generated)
+	if !bytes.Equal(files[0].Hash, generatedHash[:]) {
+		t.Fatal("provided contents were not hashed")
+	}
+	if !bytes.Equal(files[2].Hash, precomputed[:]) {
+		t.Fatal("precomputed hash was not used")
+	}
+	if modified := tb.ModifiedFiles(); len(modified) != 0 {
+		t.Fatalf("unexpected modified files %v", modified)
+	}
+
+	// Only regular files have contents to provide:
+	_, err = NewVirtualTarballReader([]*TarballFile{
+		&TarballFile{Path: "link", Mode: os.ModeSymlink | 0777, Content: bytesProvider{Reader: bytes.NewReader(nil)}},
+	}, getOptions())
+	if err != ErrProviderNotRegular {
+		t.Fatalf("expected ErrProviderNotRegular; got %v", err)
+	}
+}
+
+func TestFileRange(t *testing.T) {
+	for _, noPadding := range []bool{false, true} {
+		files := []*TarballFile{
+			&TarballFile{Path: "a.bin", Mode: 0644, Content: bytesProvider{Reader: bytes.NewReader([]byte("first"))}},
+			&TarballFile{Path: "b.bin", Mode: 0644, Content: bytesProvider{Reader: bytes.NewReader(nil)}},
+			&TarballFile{Path: "c.bin", Mode: 0644, Content: bytesProvider{Reader: bytes.NewReader([]byte("last"))}},
+		}
+		options := getOptions()
+		options.NoPadding = noPadding
+		tb, err := NewVirtualTarballReader(files, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Each range is the file's contents and its padding byte, if any, leaving no gaps:
+		padding := int64(1)
+		if noPadding {
+			padding = 0
+		}
+		expected := map[string][2]int64{
+			"a.bin": {0, 5 + padding},
+			"b.bin": {5 + padding, padding},
+			"c.bin": {5 + 2*padding, 4 + padding},
+		}
+		for path, e := range expected {
+			offset, size, ok := tb.FileRange(path)
+			if !ok || offset != e[0] || size != e[1] {
+				t.Fatalf("noPadding=%v: %s: (%d, %d, %v) != (%d, %d)", noPadding, path, offset, size, ok, e[0], e[1])
+			}
+		}
+		if offset, size, _ := tb.FileRange("c.bin"); offset+size != tb.Size() {
+			t.Fatalf("noPadding=%v: last range ends at %d; expected the tarball size %d", noPadding, offset+size, tb.Size())
+		}
+		if _, _, ok := tb.FileRange("missing.bin"); ok {
+			t.Fatalf("noPadding=%v: expected no range for a missing file", noPadding)
+		}
+		closeTarballReader(t, tb)
+	}
+}
+
+// Claims a size without holding the contents, for sizes too large to allocate:
+type sizedProvider struct {
+	size int64
+}
+
+func (p sizedProvider) ReadAt(buf []byte, off int64) (int, error) { return len(buf), nil }
+func (p sizedProvider) Size() int64                               { return p.size }
+func (p sizedProvider) Hash() []byte                              { return nil }
+
+func TestNewReader_TooLarge(t *testing.T) {
+	files := []*TarballFile{
+		&TarballFile{Path: "a.bin", Mode: 0644, Content: sizedProvider{math.MaxInt64 / 2}},
+		&TarballFile{Path: "b.bin", Mode: 0644, Content: sizedProvider{math.MaxInt64 / 2}},
+	}
+	// Each file's padding byte tips the total past math.MaxInt64:
+	if _, err := NewVirtualTarballReader(files, getOptions()); err != ErrTarballTooLarge {
+		t.Fatalf("expected ErrTarballTooLarge; got %v", err)
+	}
+
+	options := getOptions()
+	options.NoPadding = true
+	tb, err := NewVirtualTarballReader(files, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+	if tb.Size() != math.MaxInt64-1 {
+		t.Fatalf("size = %d; expected %d", tb.Size(), int64(math.MaxInt64-1))
+	}
+}
@@ -0,0 +1,96 @@
+// virtual_tarball_sources.go
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A local directory tree to place under Prefix in the tarball; an empty Prefix places it at the root.
+type TarballSource struct {
+	Root   string
+	Prefix string
+	// Lists directories too, so that empty ones are recreated and directory modes restored. Directory entries are
+	// part of the HashId, so the tree is then a different transfer from the same tree listed without them:
+	Directories bool
+}
+
+// Walks each source recursively and merges them into one file list with prefixed paths, with directory entries for
+// sources that ask for them. Directories may appear in more than one source; other paths supplied by more than one
+// source are reported together as a *PathValidationError.
+func MergeTarballSources(sources ...TarballSource) ([]*TarballFile, error) {
+	files := make([]*TarballFile, 0)
+	seen := make(map[string]bool)
+	seenDirs := make(map[string]bool)
+	collisions := make(map[string]bool)
+
+	for _, src := range sources {
+		root, err := filepath.Abs(src.Root)
+		if err != nil {
+			return nil, err
+		}
+
+		err = filepath.Walk(root, func(fullPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// The root itself is implied by the prefix:
+			if info.IsDir() && fullPath == root {
+				return nil
+			}
+
+			// Translate to relative path with '/'s and prepend prefix; a file given as a root keeps its name. Rel
+			// copes with a root that already ends in a separator, such as "/":
+			tarPath := filepath.Base(root)
+			if fullPath != root {
+				rel, err := filepath.Rel(root, fullPath)
+				if err != nil {
+					return err
+				}
+				tarPath = filepath.ToSlash(rel)
+			}
+			if src.Prefix != "" {
+				tarPath = src.Prefix + "/" + tarPath
+			}
+
+			if info.IsDir() {
+				if !src.Directories {
+					return nil
+				}
+				// Sources may share directories:
+				if seenDirs[tarPath] {
+					return nil
+				}
+				seenDirs[tarPath] = true
+			}
+			if seen[tarPath] {
+				collisions[tarPath] = true
+				return nil
+			}
+			seen[tarPath] = true
+
+			files = append(files, &TarballFile{
+				Path:      tarPath,
+				LocalPath: fullPath,
+				Size:      info.Size(),
+				Mode:      info.Mode(),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(collisions) > 0 {
+		e := &PathValidationError{}
+		for p := range collisions {
+			e.DuplicatePaths = append(e.DuplicatePaths, p)
+		}
+		sort.Strings(e.DuplicatePaths)
+		return nil, e
+	}
+
+	return files, nil
+}
@@ -2,134 +2,1463 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// How to extract an entry whose path already exists:
+type ConflictAction int
+
+const (
+	// Replace the existing file; writes into an existing regular file in place:
+	ConflictOverwrite = ConflictAction(iota)
+	// Receive the entry but leave the existing file be:
+	ConflictSkip
+	// Extract to the first free path of the form "path.N":
+	ConflictRename
+	// Fail the write with ErrConflictAborted:
+	ConflictAbort
 )
 
 type VirtualTarballWriter struct {
 	files tarballFileList
 	size  int64
 
-	options VirtualTarballOptions
+	options VirtualTarballOptions
+	fs      writerFS
+
+	// Guards the open file between WriteAt, Flush and Close:
+	lock sync.Mutex
+	// Held, without lock, while ConflictResolver decides, so that it is asked about one entry at a time:
+	resolveLock sync.Mutex
+
+	// Which file is currently open for writing:
+	openFileInfo *TarballFile
+	openFile     writerFile
+	// Contiguous writes to the open file coalesced under WriteBufferSize, starting at pendingOffset in the file:
+	pending       []byte
+	pendingOffset int64
+
+	// Running hashes of files being verified as they are written:
+	verifiers map[*TarballFile]*fileVerifier
+
+	// Regions not yet written, and files already reported complete:
+	unwritten *NakRegions
+	content   *contentIndex
+	completed map[*TarballFile]bool
+
+	// Entries PathMap mapped to "" or a ConflictResolver skipped, which are received but not extracted:
+	skipped map[*TarballFile]bool
+	// Entries already checked for conflicts, or partly written by this or an earlier run:
+	resolved map[*TarballFile]bool
+	// Entries skipped by SkipUnwritableDirs, as "path: cause":
+	unwritable []string
+	// Sparse files whose holes have been cleared of any existing contents:
+	holesCleared map[*TarballFile]bool
+	// Files this writer has opened, and so created or truncated to size:
+	opened map[*TarballFile]bool
+	// Closed and replaced whenever more is written, waking ReceivedFile reads waiting on unwritten regions:
+	written chan empty
+
+	// Called once per file as soon as all of its bytes are written, and verified if VerifyHashes is set. Called
+	// after the write that completed the file returns from the writer, so it may call back into the writer.
+	OnFileComplete func(path string, tf *TarballFile)
+	// Called once per file that fails verification as soon as all of its bytes are written, likewise outside the
+	// write. The file is left unwritten and completes only once its bytes are written again.
+	OnFileCorrupt func(path string, tf *TarballFile)
+
+	// Maps each entry's recorded mode to the mode to restore, e.g. to strip setuid bits; nil restores modes as recorded.
+	ModeTransform func(tf *TarballFile) os.FileMode
+
+	// Consulted once per entry whose path already exists before it is first written; nil keeps the default of
+	// writing regular files in place and leaving existing symlinks and special files be. Existing directories never
+	// conflict with directory entries.
+	ConflictResolver func(existing os.FileInfo, incoming *TarballFile) ConflictAction
+}
+
+// Hashes a file's contents while they are written in order; once a write skips ahead the file must be re-read.
+type fileVerifier struct {
+	h       hash.Hash
+	next    int64
+	inOrder bool
+	// Set once every byte has been hashed in order:
+	complete bool
+	matched  bool
+}
+
+func NewVirtualTarballWriter(files []*TarballFile, options VirtualTarballOptions) (*VirtualTarballWriter, error) {
+	if !validHashSize(options.HashSize) {
+		return nil, ErrBadHashSize
+	}
+
+	// Every filesystem operation goes through the root so none can leave it:
+	root, err := newRootFS(osFS{}, options.ExtractRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &VirtualTarballWriter{
+		files:    tarballFileList(make([]*TarballFile, 0, len(files))),
+		options:  options,
+		fs:       root,
+		size:     0,
+		skipped:  make(map[*TarballFile]bool),
+		resolved: make(map[*TarballFile]bool),
+
+		holesCleared: make(map[*TarballFile]bool),
+		opened:       make(map[*TarballFile]bool),
+	}
+
+	// Collect all validation failures to report at once:
+	verr := &PathValidationError{}
+
+	uniquePaths := make(map[string]int)
+	mappedPaths := make(map[string]string)
+	mapped := make(map[*TarballFile]string)
+	foldedPaths := make(map[string]string)
+	collided := make(map[string]bool)
+	t.size = int64(0)
+	for _, f := range files {
+		if !validDataExtents(f) {
+			return nil, ErrBadDataExtents
+		}
+
+		// Validate paths:
+		if pathEscapes(f.Path) {
+			verr.EscapingPaths = append(verr.EscapingPaths, f.Path)
+		} else if !isValidTarballPath(f.Path) {
+			verr.BadPaths = append(verr.BadPaths, f.Path)
+		}
+
+		// Validate all paths are unique:
+		uniquePaths[f.Path]++
+		if uniquePaths[f.Path] == 2 {
+			verr.DuplicatePaths = append(verr.DuplicatePaths, f.Path)
+		}
+
+		// Relocate and validate again so a mapping cannot escape the destination:
+		path := f.Path
+		if t.options.PathMap != nil && isValidTarballPath(f.Path) {
+			path = t.options.PathMap(f.Path)
+			if path == "" {
+				t.skipped[f] = true
+			} else if pathEscapes(path) {
+				verr.EscapingPaths = append(verr.EscapingPaths, f.Path+" -> "+path)
+			} else if !isValidTarballPath(path) {
+				verr.BadPaths = append(verr.BadPaths, f.Path+" -> "+path)
+			} else if first, ok := mappedPaths[path]; ok && first != f.Path {
+				verr.MappedCollisions = append(verr.MappedCollisions, first+", "+f.Path+" -> "+path)
+			} else {
+				mappedPaths[path] = f.Path
+			}
+			mapped[f] = path
+		}
+
+		// Paths that are not valid UTF-8:
+		escaping := t.options.InvalidUTF8.resolve() == InvalidUTF8Escape
+		escaped := false
+		if path != "" && !utf8.ValidString(path) {
+			if escaping {
+				path = escapeInvalidUTF8(path)
+				mapped[f] = path
+				escaped = true
+			} else if t.options.InvalidUTF8.resolve() == InvalidUTF8Reject {
+				verr.InvalidUTF8Paths = append(verr.InvalidUTF8Paths, f.Path)
+			}
+		}
+		// An escaped path may land on another entry's, so every destination not already recorded by PathMap is:
+		if escaping && !t.skipped[f] && (t.options.PathMap == nil || escaped) {
+			if first, ok := mappedPaths[path]; ok && first != f.Path {
+				verr.MappedCollisions = append(verr.MappedCollisions, first+", "+f.Path+" -> "+path)
+			} else {
+				mappedPaths[path] = f.Path
+			}
+		}
+
+		// Validate paths are unique ignoring case:
+		if t.options.CaseInsensitive && !t.skipped[f] {
+			folded := strings.ToLower(path)
+			if first, ok := foldedPaths[folded]; !ok {
+				foldedPaths[folded] = path
+			} else if first != path && !collided[path] {
+				if !collided[first] {
+					collided[first] = true
+					verr.CaseCollisions = append(verr.CaseCollisions, first)
+				}
+				collided[path] = true
+				verr.CaseCollisions = append(verr.CaseCollisions, path)
+			}
+		}
+
+		f.offset = t.size
+		t.files = append(t.files, f)
+
+		// Each file ends with a terminating NUL character so at least one call to WriteAt or ReadAt will happen to create/read all files.
+		if t.size, err = addEntrySize(t.size, f.Size, t.options.padding()); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(verr.BadPaths) > 0 || len(verr.EscapingPaths) > 0 || len(verr.DuplicatePaths) > 0 || len(verr.CaseCollisions) > 0 || len(verr.MappedCollisions) > 0 ||
+		len(verr.InvalidUTF8Paths) > 0 {
+		return nil, verr
+	}
+
+	// Sort files for consistency:
+	sort.Sort(t.files)
+
+	// Work on copies so that mapped paths and renames on conflict leave the caller's entries their own paths:
+	for i, f := range t.files {
+		c := *f
+		if path, ok := mapped[f]; ok && !t.skipped[f] {
+			c.Path = path
+		}
+		if t.skipped[f] {
+			delete(t.skipped, f)
+			t.skipped[&c] = true
+		}
+		t.files[i] = &c
+	}
+
+	t.unwritten = NewNakRegions(t.size)
+	t.completed = make(map[*TarballFile]bool)
+	t.written = make(chan empty)
+	t.content = newContentIndex(t.files, t.size)
+
+	return t, nil
+}
+
+// PathMap that removes the first n leading path components, like tar --strip-components. Entries with no more than n
+// components are skipped.
+func StripComponents(n int) func(path string) string {
+	return func(p string) string {
+		s := strings.SplitN(p, "/", n+1)
+		if len(s) <= n {
+			return ""
+		}
+		return s[n]
+	}
+}
+
+// PathMap that replaces a leading oldPrefix directory with newPrefix; other paths are left unchanged. An empty
+// newPrefix moves the directory's contents up and skips the directory entry itself. Both are '/'-separated, as
+// tarball paths are.
+func ReplacePathPrefix(oldPrefix, newPrefix string) func(path string) string {
+	oldPrefix = path.Clean(oldPrefix)
+	return func(p string) string {
+		if p == oldPrefix {
+			if newPrefix == "" {
+				return ""
+			}
+			return path.Clean(newPrefix)
+		}
+		if !strings.HasPrefix(p, oldPrefix+"/") {
+			return p
+		}
+		return path.Join(newPrefix, p[len(oldPrefix)+1:])
+	}
+}
+
+// Replaces each byte of path that is not part of a valid UTF-8 sequence with %XX:
+func escapeInvalidUTF8(path string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(path); {
+		r, n := utf8.DecodeRuneInString(path[i:])
+		if r == utf8.RuneError && n == 1 {
+			fmt.Fprintf(&b, "%%%02X", path[i])
+		} else {
+			b.WriteString(path[i : i+n])
+		}
+		i += n
+	}
+	return b.String()
+}
+
+func isValidTarballPath(path string) bool {
+	if path == "" || pathEscapes(path) {
+		return false
+	}
+	s := strings.Split(path, "/")
+	for _, p := range s {
+		if p == "." || p == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *VirtualTarballWriter) closeFile() error {
+	if t.openFileInfo == nil {
+		t.openFile = nil
+		return nil
+	}
+	if t.openFile == nil {
+		t.openFileInfo = nil
+		return nil
+	}
+
+	if err := t.flushWrites(); err != nil {
+		t.openFile.Close()
+		t.openFile = nil
+		t.openFileInfo = nil
+		return err
+	}
+
+	if !t.options.CompatMode {
+		err := t.openFile.Chmod(t.mode(t.openFileInfo))
+		if err != nil && t.options.IgnoreModeErrors {
+			// Filesystem may not support Unix permissions; content is still fine:
+			fmt.Fprintf(os.Stderr, "warning: could not set mode of '%s': %v\n", t.openFileInfo.Path, err)
+			err = nil
+		}
+		if err != nil {
+			// Close anyway so the handle is not leaked:
+			t.openFile.Close()
+			t.openFile = nil
+			t.openFileInfo = nil
+			return err
+		}
+	}
+
+	err := t.openFile.Close()
+	if err != nil {
+		return err
+	}
+
+	// Restore modification time once the last byte is written; a partly written file keeps the time of its last
+	// write so that UpToDateFiles never takes it for complete:
+	tf := t.openFileInfo
+	if !tf.ModTime.IsZero() && t.unwritten.IsFullyAcked(tf.offset, tf.offset+tf.Size) {
+		modTime := time.Time{}
+		modTime, err = t.plausibleModTime(tf.ModTime)
+		if err == nil {
+			err = t.fs.Chtimes(tf.Path, modTime, modTime)
+		}
+	}
+
+	t.openFile = nil
+	t.openFileInfo = nil
+	return err
+}
+
+// Mode to restore for tf after ModeTransform:
+func (t *VirtualTarballWriter) mode(tf *TarballFile) os.FileMode {
+	if t.ModeTransform == nil {
+		return tf.Mode
+	}
+	return t.ModeTransform(tf)
+}
+
+// Mode a file is written under: only its owner may touch it, and setuid and the like are left off, until closeFile
+// sets the mode after ModeTransform. Without chmod in CompatMode, that mode is given at creation instead:
+func (t *VirtualTarballWriter) createMode(tf *TarballFile) os.FileMode {
+	if t.options.CompatMode {
+		return t.mode(tf).Perm() | 0600
+	}
+	return 0600
+}
+
+// Guards against a corrupt metadata field or a sender with a broken clock setting future timestamps:
+func (t *VirtualTarballWriter) plausibleModTime(modTime time.Time) (time.Time, error) {
+	if t.options.MaxModTimeSkew <= 0 {
+		return modTime, nil
+	}
+
+	now := time.Now()
+	if modTime.Sub(now) <= t.options.MaxModTimeSkew {
+		return modTime, nil
+	}
+	if t.options.ClampModTime {
+		return now, nil
+	}
+	return time.Time{}, ErrImplausibleModTime
+}
+
+// Verifies the filesystem containing root has enough free space for all file contents:
+func (t *VirtualTarballWriter) CheckFreeSpace(root string) error {
+	free, err := statDiskFree(root)
+	if err != nil {
+		return err
+	}
+	if !free.BytesKnown {
+		return nil
+	}
+
+	required := uint64(0)
+	for _, tf := range t.files {
+		if t.skipped[tf] {
+			continue
+		}
+		required += uint64(tf.Size)
+	}
+	if required > free.Bytes {
+		return ErrInsufficientSpace
+	}
+	return nil
+}
+
+// Verifies the filesystem containing root has enough free inodes for all files and directories to be created:
+func (t *VirtualTarballWriter) CheckFreeInodes(root string) error {
+	free, err := statDiskFree(root)
+	if err != nil {
+		return err
+	}
+	if !free.InodesKnown {
+		return nil
+	}
+
+	dirs := make(map[string]bool)
+	for _, tf := range t.files {
+		if t.skipped[tf] {
+			continue
+		}
+		for dir := filepath.Dir(tf.Path); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	required := uint64(len(t.files) + len(dirs))
+	if required > free.Inodes {
+		return ErrInsufficientInodes
+	}
+	return nil
+}
+
+// Returns the files which already exist on disk with matching contents, or matching size and modification time
+// when no content hash is known, so their regions need not be transferred.
+func (t *VirtualTarballWriter) UpToDateFiles() ([]*TarballFile, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	files := make([]*TarballFile, 0)
+	for _, tf := range t.files {
+		if t.skipped[tf] {
+			continue
+		}
+		stat, err := t.fs.Lstat(tf.Path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Only regular files are compared:
+		if tf.Mode&os.ModeType != 0 || stat.Mode()&os.ModeType != 0 {
+			continue
+		}
+		if stat.Size() != tf.Size {
+			continue
+		}
+		if tf.Hash != nil {
+			hash, err := t.hashFile(tf.Path)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(hash, tf.Hash) {
+				continue
+			}
+			if t.options.VerifyHashes {
+				// Already verified; no need to read it again in VerifyFiles:
+				if t.verifiers == nil {
+					t.verifiers = make(map[*TarballFile]*fileVerifier)
+				}
+				t.verifiers[tf] = &fileVerifier{complete: true, matched: true}
+			}
+		} else if tf.ModTime.IsZero() || stat.ModTime().Unix() != tf.ModTime.Unix() {
+			continue
+		}
+
+		files = append(files, tf)
+	}
+	return files, nil
+}
+
+// Skips entries last modified at or before since so that they are neither received nor extracted, and returns those
+// newly skipped. Directories, which newer entries may be extracted into, and entries without a recorded modification
+// time are always kept.
+func (t *VirtualTarballWriter) SkipOlder(since time.Time) []*TarballFile {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	files := make([]*TarballFile, 0)
+	for _, tf := range t.files {
+		if t.skipped[tf] || tf.Mode.IsDir() || tf.ModTime.IsZero() || tf.ModTime.After(since) {
+			continue
+		}
+		t.skipped[tf] = true
+		files = append(files, tf)
+	}
+	return files
+}
+
+// Returns the tarball regions of blocks of existing files that already match their block hashes, so that only the
+// blocks changed in place need be received. A file's last block is only reused when the existing file already has
+// the expected size so that writing the rest truncates anything longer.
+func (t *VirtualTarballWriter) UpToDateBlocks() ([]Region, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	regions := make([]Region, 0)
+	for _, tf := range t.files {
+		matching, err := t.matchingBlocks(tf)
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, matching...)
+	}
+	return regions, nil
+}
+
+// Like UpToDateBlocks for a single file, e.g. to check what an interrupted run already wrote of it:
+func (t *VirtualTarballWriter) MatchingBlocks(tf *TarballFile) ([]Region, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.matchingBlocks(tf)
+}
+
+func (t *VirtualTarballWriter) matchingBlocks(tf *TarballFile) ([]Region, error) {
+	regions := make([]Region, 0)
+	if t.skipped[tf] || tf.Mode&os.ModeType != 0 || tf.BlockSize == 0 {
+		return regions, nil
+	}
+	if tf.BlockSize > maxBlockSize {
+		return nil, ErrBadBlockSize
+	}
+	stat, err := t.fs.Lstat(tf.Path)
+	if os.IsNotExist(err) {
+		return regions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stat.Mode()&os.ModeType != 0 {
+		return regions, nil
+	}
+
+	f, err := t.fs.Open(tf.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, tf.BlockSize)
+	for n, want := range tf.BlockHashes {
+		start := int64(n) * int64(tf.BlockSize)
+		endEx := start + int64(tf.BlockSize)
+		if endEx > tf.Size {
+			endEx = tf.Size
+		}
+		if start >= endEx || endEx > stat.Size() || (endEx == tf.Size && stat.Size() != tf.Size) {
+			break
+		}
+
+		if _, err := f.ReadAt(buf[:endEx-start], start); err != nil {
+			return nil, err
+		}
+		if sum := sha256.Sum256(buf[:endEx-start]); !bytes.Equal(sum[:], want) {
+			continue
+		}
+
+		// Merge with the previous matching block:
+		r := Region{start: tf.offset + start, endEx: tf.offset + endEx}
+		if last := len(regions) - 1; last >= 0 && regions[last].endEx == r.start {
+			regions[last].endEx = r.endEx
+		} else {
+			regions = append(regions, r)
+		}
+	}
+	return regions, nil
+}
+
+// Removes files under root that are not part of the tarball, except for paths in keep. Returns the removed paths.
+func (t *VirtualTarballWriter) RemoveExtraneous(root string, keep ...string) ([]string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Compared as absolute paths, so keep paths may be given relative or absolute whatever root is:
+	paths := make(map[string]bool)
+	for _, tf := range t.files {
+		if t.skipped[tf] {
+			continue
+		}
+		abs, err := filepath.Abs(filepath.Join(root, tf.Path))
+		if err != nil {
+			return nil, err
+		}
+		paths[abs] = true
+	}
+	for _, k := range keep {
+		abs, err := filepath.Abs(k)
+		if err != nil {
+			return nil, err
+		}
+		paths[abs] = true
+	}
+
+	removed := make([]string, 0)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if paths[abs] {
+			return nil
+		}
+
+		// Removal is confined to the extraction root like every other operation:
+		if err := t.fs.Remove(abs); err != nil {
+			return err
+		}
+		removed = append(removed, path)
+		return nil
+	})
+	return removed, err
+}
+
+// io.Closer:
+func (t *VirtualTarballWriter) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.closeFile()
+}
+
+// Syncs the currently open file to disk without closing it:
+func (t *VirtualTarballWriter) Flush() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.openFile == nil {
+		return nil
+	}
+	if err := t.flushWrites(); err != nil {
+		return err
+	}
+	return t.openFile.Sync()
+}
+
+// Writes p at off in the open file, coalescing contiguous writes into WriteBufferSize writes. A write that does not
+// follow on from the buffered ones flushes them first.
+func (t *VirtualTarballWriter) bufferedWrite(p []byte, off int64) (int, error) {
+	size := t.options.WriteBufferSize
+	if size <= 0 {
+		n, err := t.writeOpen(p, off)
+		return n, t.writeFailed(err)
+	}
+
+	if len(t.pending) > 0 && (off != t.pendingOffset+int64(len(t.pending)) || len(t.pending)+len(p) > size) {
+		if err := t.flushWrites(); err != nil {
+			return 0, err
+		}
+	}
+	if len(p) >= size {
+		n, err := t.writeOpen(p, off)
+		return n, t.writeFailed(err)
+	}
+
+	if t.pending == nil {
+		t.pending = make([]byte, 0, size)
+	}
+	if len(t.pending) == 0 {
+		t.pendingOffset = off
+	}
+	t.pending = append(t.pending, p...)
+	if len(t.pending) >= size {
+		if err := t.flushWrites(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Writes out the coalesced writes to the open file:
+func (t *VirtualTarballWriter) flushWrites() error {
+	if len(t.pending) == 0 {
+		return nil
+	}
+	p := t.pending
+	t.pending = t.pending[:0]
+	n, err := t.writeOpen(p, t.pendingOffset)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return t.writeFailed(err)
+}
+
+// Writes p at off in the open file, retrying transient failures under WriteRetries. Writes at an offset can be
+// repeated whole:
+func (t *VirtualTarballWriter) writeOpen(p []byte, off int64) (int, error) {
+	n := 0
+	err := t.retry(func() (err error) {
+		n, err = t.openFile.WriteAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+// Longest wait between write retries, which hold the writer's lock throughout:
+const maxWriteRetryBackoff = time.Second
+
+// Runs op, trying again up to WriteRetries times with doubling waits while it fails with a transient error. Called
+// with lock held, which stays held while waiting since op acts on the open file:
+func (t *VirtualTarballWriter) retry(op func() error) error {
+	err := op()
+	for i := 0; i < t.options.WriteRetries && isTransientWriteError(err); i++ {
+		time.Sleep(t.retryBackoff(i))
+		err = op()
+	}
+	return err
+}
+
+// Wait before retry i, counting from 0:
+func (t *VirtualTarballWriter) retryBackoff(i int) time.Duration {
+	backoff := t.options.WriteRetryBackoff
+	if backoff <= 0 {
+		backoff = 10 * time.Millisecond
+	}
+	for ; i > 0 && backoff < maxWriteRetryBackoff; i-- {
+		backoff *= 2
+	}
+	if backoff > maxWriteRetryBackoff {
+		return maxWriteRetryBackoff
+	}
+	return backoff
+}
+
+// Errors that may pass if the operation is tried again: an interrupted call, a busy resource or a full disk that
+// may yet be freed:
+func isTransientWriteError(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ENOSPC)
+}
+
+// Wraps a failed write to the open file in a *ReadOnlyTargetError if the target refused it as read-only. EPERM, which
+// os.ErrPermission also matches, is left alone: it means the file itself may not be written, e.g. an immutable one:
+func (t *VirtualTarballWriter) writeFailed(err error) error {
+	if errors.Is(err, syscall.EROFS) || (errors.Is(err, os.ErrPermission) && !errors.Is(err, syscall.EPERM)) {
+		return &ReadOnlyTargetError{Path: t.openFileInfo.Path, Err: err}
+	}
+	return err
+}
+
+// Writes zeros over the given unwritten tarball regions, sorted by offset, of files this writer created or
+// truncated, so abandoned files do not expose prior disk contents. Files it never opened are left as they were.
+// Returns the number of bytes zeroed.
+func (t *VirtualTarballWriter) ZeroFill(naks []Region) (int64, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if err := t.closeFile(); err != nil {
+		return 0, err
+	}
+
+	zeros := make([]byte, 65536)
+	total := int64(0)
+	// Files and NAKs are both sorted by offset, so walk them together:
+	i := 0
+	for _, tf := range t.files {
+		for i < len(naks) && naks[i].endEx <= tf.offset {
+			i++
+		}
+		if i == len(naks) {
+			break
+		}
+		if !t.opened[tf] || t.skipped[tf] {
+			continue
+		}
+		if tf.Mode&os.ModeType != 0 || tf.Size == 0 {
+			continue
+		}
+
+		f := writerFile(nil)
+		for _, nak := range naks[i:] {
+			if nak.start >= tf.offset+tf.Size {
+				break
+			}
+			// Clip region to file contents:
+			start, endEx := nak.start, nak.endEx
+			if start < tf.offset {
+				start = tf.offset
+			}
+			if endEx > tf.offset+tf.Size {
+				endEx = tf.offset + tf.Size
+			}
+			if start >= endEx {
+				continue
+			}
+
+			if f == nil {
+				var err error
+				f, err = t.fs.OpenFile(tf.Path, os.O_WRONLY, 0)
+				if err != nil {
+					return total, err
+				}
+			}
+			for o := start; o < endEx; {
+				p := zeros
+				if int64(len(p)) > endEx-o {
+					p = zeros[:endEx-o]
+				}
+				n, err := f.WriteAt(p, o-tf.offset)
+				total += int64(n)
+				if err != nil {
+					f.Close()
+					return total, err
+				}
+				o += int64(n)
+			}
+		}
+		if f != nil {
+			if err := f.Close(); err != nil {
+				return total, err
+			}
+		}
+	}
+
+	return total, nil
+}
+
+func (t *VirtualTarballWriter) makeSymlink(tf *TarballFile) error {
+	stat, err := t.fs.Lstat(tf.Path)
+	if err == nil {
+		// Dont bother recreating if exists, unless it is a symlink to somewhere else, e.g. retargeted since an
+		// earlier download:
+		if stat.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		target := ""
+		target, err = t.fs.Readlink(tf.Path)
+		if err != nil {
+			return err
+		}
+		if target == tf.SymlinkDestination {
+			return nil
+		}
+		err = t.fs.Remove(tf.Path)
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	dir, fileName := filepath.Split(tf.Path)
+	if dir != "" {
+		// Get current working directory:
+		wd := ""
+		wd, err = t.fs.Getwd()
+		if err != nil {
+			return err
+		}
+
+		err = t.mkdirAll(dir, tf.Mode|0700)
+		if err != nil {
+			return err
+		}
+
+		err = t.fs.Chdir(dir)
+		if err != nil {
+			return err
+		}
+
+		// Change directory back to what it was before exiting:
+		defer func() {
+			if cerr := t.fs.Chdir(wd); err == nil {
+				err = cerr
+			}
+		}()
+	}
+
+	// Create symlink from directory:
+	err = t.fs.Symlink(tf.SymlinkDestination, fileName, tf.SymlinkIsDir)
+	if err == nil {
+		// Restore the symlink's own mode where the platform honors it:
+		err = t.fs.Lchmod(fileName, tf.Mode)
+	}
+
+	// Return the last error (possibly from defer):
+	return err
+}
+
+// Feeds bytes written to tf at localOffset into its running hash:
+func (t *VirtualTarballWriter) hashWritten(tf *TarballFile, p []byte, localOffset int64) {
+	if t.verifiers == nil {
+		t.verifiers = make(map[*TarballFile]*fileVerifier)
+	}
+	v := t.verifiers[tf]
+	if v == nil {
+		v = &fileVerifier{h: sha256.New(), inOrder: true}
+		t.verifiers[tf] = v
+	}
+	if !v.inOrder || v.complete {
+		return
+	}
+
+	if localOffset > v.next {
+		// Gap in the data; fall back to re-reading the file:
+		v.inOrder = false
+		return
+	}
+	// Skip any already hashed prefix of a retransmitted region:
+	if skip := v.next - localOffset; skip < int64(len(p)) {
+		v.h.Write(p[skip:])
+		v.next = localOffset + int64(len(p))
+	}
+	if v.next >= tf.Size {
+		v.complete = true
+		v.matched = bytes.Equal(t.options.truncateHash(v.h.Sum(nil)), tf.Hash)
+	}
+}
+
+// Verifies every written regular file that has a content hash. Files completely hashed as they were written in order
+// are not read again; all others are re-read from disk. Returns the files that do not match; their running hashes
+// are reset so that they can be received again.
+func (t *VirtualTarballWriter) VerifyFiles() ([]*TarballFile, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Files are re-read from disk:
+	if t.openFile != nil {
+		if err := t.flushWrites(); err != nil {
+			return nil, err
+		}
+	}
+
+	failed := make([]*TarballFile, 0)
+	for _, tf := range t.files {
+		if t.skipped[tf] {
+			continue
+		}
+		if tf.Hash == nil || tf.Mode&os.ModeType != 0 {
+			continue
+		}
+
+		if v := t.verifiers[tf]; v != nil && v.complete {
+			if !v.matched {
+				failed = append(failed, tf)
+			}
+		} else {
+			hash, err := t.hashFile(tf.Path)
+			if os.IsNotExist(err) {
+				failed = append(failed, tf)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(hash, tf.Hash) {
+				failed = append(failed, tf)
+			}
+		}
+	}
+
+	for _, tf := range failed {
+		delete(t.verifiers, tf)
+		t.unwritten.Nak(tf.offset, tf.offset+tf.Size+t.options.padding())
+		t.completed[tf] = false
+	}
+	return failed, nil
+}
+
+// Consults ConflictResolver the first time tf is written if its path already exists. Called with lock held, so
+// WriteAt and CreateEmptyEntries resolve their entries beforehand with resolveConflicts:
+func (t *VirtualTarballWriter) resolveConflict(tf *TarballFile) error {
+	existing, err := t.conflict(tf)
+	if err != nil || existing == nil {
+		return err
+	}
+	return t.applyConflictAction(tf, existing, t.ConflictResolver(existing, tf))
+}
 
-	// Which file is currently open for writing:
-	openFileInfo *TarballFile
-	openFile     *os.File
+// Consults ConflictResolver for each of files not yet resolved without holding lock, since a resolver may wait on
+// someone to answer. Writes to other entries carry on meanwhile:
+func (t *VirtualTarballWriter) resolveConflicts(files []*TarballFile) error {
+	if t.ConflictResolver == nil {
+		return nil
+	}
+	for _, tf := range files {
+		t.lock.Lock()
+		existing, err := t.conflict(tf)
+		t.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			if err := t.askConflict(tf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func NewVirtualTarballWriter(files []*TarballFile, options VirtualTarballOptions) (*VirtualTarballWriter, error) {
-	t := &VirtualTarballWriter{
-		files:   tarballFileList(make([]*TarballFile, 0, len(files))),
-		options: options,
-		size:    0,
+// Asks ConflictResolver about tf, one entry at a time:
+func (t *VirtualTarballWriter) askConflict(tf *TarballFile) error {
+	t.resolveLock.Lock()
+	defer t.resolveLock.Unlock()
+
+	// Another write may have asked while we waited:
+	t.lock.Lock()
+	existing, err := t.conflict(tf)
+	t.lock.Unlock()
+	if err != nil || existing == nil {
+		return err
 	}
 
-	uniquePaths := make(map[string]string)
-	t.size = int64(0)
-	for _, f := range files {
-		// Validate paths:
-		if filepath.IsAbs(f.Path) {
-			return nil, ErrBadPath
+	action := t.ConflictResolver(existing, tf)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.applyConflictAction(tf, existing, action)
+}
+
+// The existing file at tf's path if ConflictResolver has yet to decide about it; nil marks tf resolved if nothing
+// conflicts:
+func (t *VirtualTarballWriter) conflict(tf *TarballFile) (os.FileInfo, error) {
+	if t.ConflictResolver == nil || t.resolved[tf] || t.skipped[tf] {
+		return nil, nil
+	}
+
+	existing, err := t.fs.Lstat(tf.Path)
+	if os.IsNotExist(err) {
+		t.resolved[tf] = true
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if existing.IsDir() && tf.Mode&os.ModeDir != 0 {
+		t.resolved[tf] = true
+		return nil, nil
+	}
+	return existing, nil
+}
+
+func (t *VirtualTarballWriter) applyConflictAction(tf *TarballFile, existing os.FileInfo, action ConflictAction) error {
+	switch action {
+	case ConflictOverwrite:
+		// Only a regular file can be written over in place:
+		if existing.Mode()&os.ModeType != 0 || tf.Mode&os.ModeType != 0 {
+			if err := t.fs.Remove(tf.Path); err != nil {
+				return err
+			}
+		}
+	case ConflictSkip:
+		t.skipped[tf] = true
+	case ConflictRename:
+		path, err := t.freePath(tf.Path)
+		if err != nil {
+			return err
 		}
-		s := strings.Split(f.Path, string(filepath.Separator))
-		for _, p := range s {
-			if p == "." || p == ".." {
-				return nil, ErrBadPath
+		if tf.Mode&os.ModeDir != 0 {
+			// Entries under a renamed directory follow it:
+			for _, child := range t.files {
+				if strings.HasPrefix(child.Path, tf.Path+"/") {
+					child.Path = path + child.Path[len(tf.Path):]
+				}
 			}
 		}
+		tf.Path = path
+	case ConflictAbort:
+		return ErrConflictAborted
+	}
+	t.resolved[tf] = true
+	return nil
+}
 
-		// Validate all paths are unique:
-		if _, ok := uniquePaths[f.Path]; ok {
-			return nil, ErrDuplicatePaths
+// First "path.N" that neither exists nor is the path of another entry:
+func (t *VirtualTarballWriter) freePath(path string) (string, error) {
+	taken := make(map[string]bool, len(t.files))
+	for _, tf := range t.files {
+		taken[tf.Path] = true
+	}
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s.%d", path, n)
+		if taken[candidate] {
+			continue
 		}
-		uniquePaths[f.Path] = f.Path
+		_, err := t.fs.Lstat(candidate)
+		if os.IsNotExist(err) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
 
-		f.offset = t.size
-		t.files = append(t.files, f)
+// Hashes the contents of an extracted file, cut to HashSize to compare with received hashes:
+func (t *VirtualTarballWriter) hashFile(path string) ([]byte, error) {
+	f, err := t.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-		// Each file ends with a terminating NUL character so at least one call to WriteAt or ReadAt will happen to create/read all files.
-		t.size += f.Size + 1
+	hash, err := hashContents(f)
+	return t.options.truncateHash(hash), err
+}
+
+// Set apart from other failures to create an entry so that SkipUnwritableDirs can skip just these:
+type mkdirError struct {
+	err error
+}
+
+func (e *mkdirError) Error() string {
+	return e.err.Error()
+}
+
+func (t *VirtualTarballWriter) mkdirAll(path string, perm os.FileMode) error {
+	if err := t.fs.MkdirAll(path, perm); err != nil {
+		return &mkdirError{err}
 	}
+	return nil
+}
 
-	// Sort files for consistency:
-	sort.Sort(t.files)
+// Creates the entry for tf, opening it if a regular file. Under SkipUnwritableDirs an entry whose directory cannot be
+// created is marked skipped instead.
+func (t *VirtualTarballWriter) createEntry(tf *TarballFile) error {
+	err := error(nil)
+	if t.skipped[tf] {
+		// Received but not extracted.
+	} else if tf.Mode&os.ModeSymlink == os.ModeSymlink {
+		// Create symlink if not exists:
+		err = t.makeSymlink(tf)
+	} else if isSpecial(tf.Mode) {
+		// Create FIFO or device node if not exists:
+		err = t.makeSpecial(tf)
+	} else if tf.Mode&os.ModeDir != 0 {
+		// Create directory if not exists:
+		err = t.makeDir(tf)
+	} else if t.openFileInfo != tf {
+		// Create file if not already:
+		err = t.openTarballFile(tf)
+	}
 
-	return t, nil
+	if merr, ok := err.(*mkdirError); ok {
+		if !t.options.SkipUnwritableDirs {
+			return merr.err
+		}
+		fmt.Fprintf(os.Stderr, "warning: skipping '%s': %v\n", tf.Path, merr.err)
+		t.skipped[tf] = true
+		t.unwritable = append(t.unwritable, fmt.Sprintf("%s: %v", tf.Path, merr.err))
+		return nil
+	}
+	return err
 }
 
-func (t *VirtualTarballWriter) closeFile() error {
-	if t.openFileInfo == nil {
-		t.openFile = nil
+// Size of the file contents alone, without padding:
+func (t *VirtualTarballWriter) ContentSize() int64 {
+	return t.content.contentSize()
+}
+
+// Count of content bytes before a tarball offset, for reporting progress without padding:
+func (t *VirtualTarballWriter) ContentOffset(offset int64) int64 {
+	return t.content.contentOffset(offset)
+}
+
+// Tarball offset of a content byte; inverse of ContentOffset:
+func (t *VirtualTarballWriter) VirtualOffset(contentOffset int64) int64 {
+	return t.content.virtualOffset(contentOffset)
+}
+
+// Count of content bytes within [start, endEx) of the tarball:
+func (t *VirtualTarballWriter) ContentBytes(start, endEx int64) int64 {
+	return t.content.contentBytes(start, endEx)
+}
+
+// Reports entries skipped by SkipUnwritableDirs as an *UnwritableDirError; nil if none were.
+func (t *VirtualTarballWriter) Unwritable() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if len(t.unwritable) == 0 {
 		return nil
 	}
-	if t.openFile == nil {
-		t.openFileInfo = nil
+	return &UnwritableDirError{Entries: append([]string(nil), t.unwritable...)}
+}
+
+// Creates a directory entry, writable by owner until FinishDirectories applies its recorded mode:
+func (t *VirtualTarballWriter) makeDir(tf *TarballFile) error {
+	return t.mkdirAll(tf.Path, tf.Mode.Perm()|0700)
+}
+
+// Applies the recorded modes and modification times of directory entries once all files within them are written.
+// Deeper directories are finished first so that restrictive parent modes do not get in the way.
+func (t *VirtualTarballWriter) FinishDirectories() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	dirs := make([]*TarballFile, 0)
+	for _, tf := range t.files {
+		if tf.Mode&os.ModeDir != 0 && !t.skipped[tf] {
+			dirs = append(dirs, tf)
+		}
+	}
+	// By depth rather than by list order, which need not put a directory before its contents:
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i].Path, "/") > strings.Count(dirs[j].Path, "/")
+	})
+
+	for _, tf := range dirs {
+		if !t.options.CompatMode {
+			err := t.fs.Chmod(tf.Path, t.mode(tf))
+			if err != nil && t.options.IgnoreModeErrors {
+				fmt.Fprintf(os.Stderr, "warning: could not set mode of '%s': %v\n", tf.Path, err)
+				err = nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if !tf.ModTime.IsZero() {
+			modTime, err := t.plausibleModTime(tf.ModTime)
+			if err == nil {
+				err = t.fs.Chtimes(tf.Path, modTime, modTime)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Creates a FIFO or, with CreateDevices, a device node. Sockets, devices otherwise, and entries this process lacks the
+// privileges or platform support to create, are skipped with a warning rather than failing the transfer.
+func (t *VirtualTarballWriter) makeSpecial(tf *TarballFile) error {
+	_, err := t.fs.Lstat(tf.Path)
+	// Dont bother recreating if exists:
+	if err == nil {
 		return nil
 	}
+	if !os.IsNotExist(err) {
+		return err
+	}
 
-	if !t.options.CompatMode {
-		err := t.openFile.Chmod(t.openFileInfo.Mode)
+	if tf.Mode&os.ModeSocket != 0 {
+		fmt.Fprintf(os.Stderr, "warning: skipping socket '%s'\n", tf.Path)
+		return nil
+	}
+	if tf.Mode&os.ModeDevice != 0 && !t.options.CreateDevices {
+		fmt.Fprintf(os.Stderr, "warning: skipping device '%s'\n", tf.Path)
+		return nil
+	}
+
+	dir, _ := filepath.Split(tf.Path)
+	if dir != "" {
+		err = t.mkdirAll(dir, 0700)
 		if err != nil {
 			return err
 		}
 	}
 
-	err := t.openFile.Close()
+	err = t.fs.Mknod(tf.Path, tf.Mode, tf.DeviceMajor, tf.DeviceMinor)
+	if err == ErrSpecialUnsupported || os.IsPermission(err) {
+		fmt.Fprintf(os.Stderr, "warning: could not create %v '%s': %v\n", tf.Mode, tf.Path, err)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	t.openFile = nil
-	t.openFileInfo = nil
-	return nil
+	// Mode given to mknod is masked by umask:
+	return t.fs.Chmod(tf.Path, t.mode(tf))
 }
 
-// io.Closer:
-func (t *VirtualTarballWriter) Close() error {
-	return t.closeFile()
-}
+// Closes the last open file and opens tf for writing, creating it and reserving its disk space:
+func (t *VirtualTarballWriter) openTarballFile(tf *TarballFile) error {
+	// Close and finalize last open file:
+	if t.openFileInfo != nil {
+		t.closeFile()
+	}
 
-func (t *VirtualTarballWriter) makeSymlink(tf *TarballFile) error {
-	_, err := os.Lstat(tf.Path)
-	// Dont bother recreating if exists:
-	if err != nil {
-		if !os.IsNotExist(err) {
+	// Try to mkdir all paths involved:
+	dir, _ := filepath.Split(tf.Path)
+	if dir != "" {
+		// TODO: record directory entries for their modes.
+		// Make sure directories are at least rwx by owner:
+		err := t.mkdirAll(dir, tf.Mode|0700)
+		if err != nil {
 			return err
 		}
 	}
 
-	// Get current working directory:
-	wd := ""
-	wd, err = os.Getwd()
-	if err != nil {
+	// Size of an existing file whose contents may show through the holes of a sparse file:
+	existing := int64(0)
+	if tf.DataExtents != nil && !t.holesCleared[tf] {
+		if stat, err := t.fs.Lstat(tf.Path); err == nil && stat.Mode().IsRegular() {
+			existing = stat.Size()
+		}
+	}
+
+	f := writerFile(nil)
+	err := t.retry(func() (err error) {
+		f, err = t.fs.OpenFile(tf.Path, os.O_WRONLY|os.O_CREATE, t.createMode(tf))
 		return err
+	})
+	if err != nil {
+		if !t.options.CompatMode && os.IsPermission(err) {
+			// chmod existing file to be able to write:
+			err = t.fs.Chmod(tf.Path, t.createMode(tf))
+			if err != nil {
+				return err
+			}
+			// Try to reopen for writing:
+			f, err = t.fs.OpenFile(tf.Path, os.O_WRONLY|os.O_CREATE, t.createMode(tf))
+		}
+		if err != nil {
+			return err
+		}
 	}
 
-	dir, fileName := filepath.Split(tf.Path)
-	err = os.MkdirAll(dir, tf.Mode|0700)
+	// Reserve disk space; this leaves the holes of sparse files unallocated:
+	err = f.Truncate(tf.Size)
 	if err != nil {
+		f.Close()
 		return err
 	}
+	if tf.DataExtents != nil && !t.holesCleared[tf] {
+		if err = t.clearHoles(f, tf, existing); err != nil {
+			f.Close()
+			return err
+		}
+		t.holesCleared[tf] = true
+	}
+
+	t.openFile = f
+	t.openFileInfo = tf
+	t.opened[tf] = true
+	return nil
+}
 
-	err = os.Chdir(dir)
+// Zeros the parts of holes within the first existing bytes of a file that hold nonzero data, since holes are never
+// written. Holes already reading as zeros, e.g. left by an interrupted run, are not written and so stay sparse.
+func (t *VirtualTarballWriter) clearHoles(f writerFile, tf *TarballFile, existing int64) error {
+	if existing == 0 {
+		return nil
+	}
+	r, err := t.fs.Open(tf.Path)
 	if err != nil {
 		return err
 	}
+	defer r.Close()
+
+	buf := make([]byte, 65536)
+	zeros := make([]byte, len(buf))
+	for _, h := range (tarballFileList{tf}).holes() {
+		start, endEx := h.start-tf.offset, h.endEx-tf.offset
+		if endEx > existing {
+			endEx = existing
+		}
+		for o := start; o < endEx; {
+			p := buf
+			if int64(len(p)) > endEx-o {
+				p = buf[:endEx-o]
+			}
+			n, err := r.ReadAt(p, o)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if n == 0 {
+				break
+			}
+			if !bytes.Equal(p[:n], zeros[:n]) {
+				if _, err := f.WriteAt(zeros[:n], o); err != nil {
+					return err
+				}
+			}
+			o += int64(n)
+		}
+	}
+	return nil
+}
+
+// Tarball regions of the holes of sparse files, which are never sent; see DetectHoles:
+func (t *VirtualTarballWriter) Holes() []Region {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	holes := make([]Region, 0)
+	for _, tf := range t.files {
+		if !t.skipped[tf] {
+			holes = append(holes, tarballFileList{tf}.holes()...)
+		}
+	}
+	return holes
+}
 
-	// Change directory back to what it was before exiting:
-	defer func() {
-		err = os.Chdir(wd)
-	}()
+// Creates empty files, directories, symlinks, special files and sparse files that are all holes, which are never
+// reached by WriteAt when NoPadding is set:
+func (t *VirtualTarballWriter) CreateEmptyEntries() error {
+	empty := []*TarballFile(nil)
+	for _, tf := range t.files {
+		if noData(tf) {
+			empty = append(empty, tf)
+		}
+	}
+	if err := t.resolveConflicts(empty); err != nil {
+		return err
+	}
 
-	// Create symlink from directory:
-	err = os.Symlink(tf.SymlinkDestination, fileName)
+	t.lock.Lock()
+	err := t.createEmptyEntries()
+	completed := []*TarballFile(nil)
+	if t.OnFileComplete != nil {
+		for _, tf := range t.files {
+			if noData(tf) && !t.completed[tf] && !t.skipped[tf] {
+				t.completed[tf] = true
+				completed = append(completed, tf)
+			}
+		}
+	}
+	t.lock.Unlock()
 
-	// Return the last error (possibly from defer):
+	for _, tf := range completed {
+		t.OnFileComplete(tf.Path, tf)
+	}
 	return err
 }
 
+func (t *VirtualTarballWriter) createEmptyEntries() error {
+	for _, tf := range t.files {
+		if !noData(tf) {
+			continue
+		}
+		if err := t.resolveConflict(tf); err != nil {
+			return err
+		}
+		if err := t.createEntry(tf); err != nil {
+			return err
+		}
+		if t.openFileInfo == tf {
+			if err := t.closeFile(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // io.WriterAt:
 func (t *VirtualTarballWriter) WriteAt(buf []byte, offset int64) (int, error) {
 	if buf == nil {
@@ -138,67 +1467,151 @@ func (t *VirtualTarballWriter) WriteAt(buf []byte, offset int64) (int, error) {
 	if offset < 0 || offset >= t.size {
 		return 0, ErrOutOfRange
 	}
+	if err := t.resolveConflicts(t.filesWithin(offset, offset+int64(len(buf)))); err != nil {
+		return 0, err
+	}
 
-	// Write to file(s):
-	total := 0
-	remainder := buf[:]
+	t.lock.Lock()
+	n, err := t.writeAt(buf, offset)
+	completed, corrupt := []*TarballFile(nil), []*TarballFile(nil)
+	if err == nil {
+		t.unwritten.Ack(offset, offset+int64(n))
+		t.notifyWritten()
+		if t.OnFileComplete != nil || t.OnFileCorrupt != nil {
+			completed, corrupt, err = t.completeFiles(offset, offset+int64(n))
+		}
+	}
+	t.lock.Unlock()
+
+	// Notify outside the lock so the callbacks may use the writer:
+	if t.OnFileComplete != nil {
+		for _, tf := range completed {
+			t.OnFileComplete(tf.Path, tf)
+		}
+	}
+	if t.OnFileCorrupt != nil {
+		for _, tf := range corrupt {
+			t.OnFileCorrupt(tf.Path, tf)
+		}
+	}
+	return n, err
+}
+
+// Marks regions as already written, e.g. by an earlier run being resumed. Files this completes are not reported to
+// OnFileComplete.
+func (t *VirtualTarballWriter) MarkWritten(start, endEx int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.unwritten.Ack(start, endEx)
+	t.notifyWritten()
 	for _, tf := range t.files {
-		if offset < tf.offset || offset >= tf.offset+tf.Size+1 {
+		end := tf.offset + tf.Size + t.options.padding()
+		if tf.offset < endEx && start < end {
+			// Our own earlier output is not a conflict:
+			t.resolved[tf] = true
+			if t.unwritten.IsFullyAcked(tf.offset, end) {
+				t.completed[tf] = true
+			}
+		}
+	}
+}
+
+// Wakes readers waiting for regions to be written. Called with lock held:
+func (t *VirtualTarballWriter) notifyWritten() {
+	close(t.written)
+	t.written = make(chan empty)
+}
+
+// Entries whose bytes, padding included, overlap [start, endEx):
+func (t *VirtualTarballWriter) filesWithin(start, endEx int64) []*TarballFile {
+	padding := t.options.padding()
+	first := sort.Search(len(t.files), func(i int) bool {
+		return t.files[i].offset+t.files[i].Size+padding > start
+	})
+	last := first
+	for last < len(t.files) && t.files[last].offset < endEx {
+		last++
+	}
+	return t.files[first:last]
+}
+
+// Returns files overlapping [start, endEx) that have just had all of their bytes written and, if enabled, verified,
+// followed by those that just failed verification. Completed files are closed so that their mode and modification
+// time are final.
+func (t *VirtualTarballWriter) completeFiles(start, endEx int64) ([]*TarballFile, []*TarballFile, error) {
+	completed, corrupt := []*TarballFile(nil), []*TarballFile(nil)
+	for _, tf := range t.filesWithin(start, endEx) {
+		end := tf.offset + tf.Size + t.options.padding()
+		if t.completed[tf] || !t.unwritten.IsFullyAcked(tf.offset, end) {
+			continue
+		}
+		if t.skipped[tf] {
+			t.completed[tf] = true
 			continue
 		}
 
-		if tf.Mode&os.ModeSymlink == os.ModeSymlink {
-			// Create symlink if not exists:
-			err := t.makeSymlink(tf)
-			if err != nil {
-				return 0, err
+		if t.openFileInfo == tf {
+			if err := t.closeFile(); err != nil {
+				return completed, corrupt, err
 			}
-		} else {
-			// Create file if not already:
-			if t.openFileInfo != tf {
-				// Close and finalize last open file:
-				if t.openFileInfo != nil {
-					t.closeFile()
-				}
+		}
+		if !t.verifyComplete(tf) {
+			corrupt = append(corrupt, tf)
+			continue
+		}
+		t.completed[tf] = true
+		completed = append(completed, tf)
+	}
+	return completed, corrupt, nil
+}
 
-				// Try to mkdir all paths involved:
-				dir, _ := filepath.Split(tf.Path)
-				if dir != "" {
-					// TODO: record directory entries for their modes.
-					// Make sure directories are at least rwx by owner:
-					err := os.MkdirAll(dir, tf.Mode|0700)
-					if err != nil {
-						return 0, err
-					}
-				}
+// Checks a completely written file against its hash, re-reading it if it was not hashed in order. A failed file is
+// marked unwritten again so that it only completes once received again.
+func (t *VirtualTarballWriter) verifyComplete(tf *TarballFile) bool {
+	if !t.options.VerifyHashes || tf.Hash == nil || tf.Mode&os.ModeType != 0 {
+		return true
+	}
 
-				f, err := os.OpenFile(tf.Path, os.O_WRONLY|os.O_CREATE, tf.Mode|0700)
-				if err != nil {
-					if !t.options.CompatMode && os.IsPermission(err) {
-						// chmod existing file to be able to write:
-						err = os.Chmod(tf.Path, tf.Mode|0700)
-						if err != nil {
-							return 0, err
-						}
-						// Try to reopen for writing:
-						f, err = os.OpenFile(tf.Path, os.O_WRONLY|os.O_CREATE, tf.Mode|0700)
-					}
-					if err != nil {
-						return 0, err
-					}
-				}
+	v := t.verifiers[tf]
+	if v == nil || !v.complete {
+		hash, err := t.hashFile(tf.Path)
+		v = &fileVerifier{complete: true, matched: err == nil && bytes.Equal(hash, tf.Hash)}
+		if t.verifiers == nil {
+			t.verifiers = make(map[*TarballFile]*fileVerifier)
+		}
+		// Keep the result so VerifyFiles need not read it again:
+		t.verifiers[tf] = v
+	}
+	if !v.matched {
+		t.unwritten.Nak(tf.offset, tf.offset+tf.Size+t.options.padding())
+	}
+	return v.matched
+}
 
-				// Reserve disk space:
-				err = f.Truncate(tf.Size)
-				if err != nil {
-					return 0, err
-				}
+func (t *VirtualTarballWriter) writeAt(buf []byte, offset int64) (int, error) {
+	// Write to file(s):
+	total := 0
+	remainder := buf[:]
+	// Files are sorted by offset; skip straight to the first that ends past it:
+	padding := t.options.padding()
+	first := sort.Search(len(t.files), func(i int) bool {
+		return t.files[i].offset+t.files[i].Size+padding > offset
+	})
+	for _, tf := range t.files[first:] {
+		if offset < tf.offset || offset >= tf.offset+tf.Size+t.options.padding() {
+			continue
+		}
 
-				t.openFile = f
-				t.openFileInfo = tf
-			}
+		if err := t.resolveConflict(tf); err != nil {
+			return 0, err
 		}
 
+		if err := t.createEntry(tf); err != nil {
+			return 0, err
+		}
+
+		segment := offset
 		localOffset := offset - tf.offset
 		if localOffset < tf.Size {
 			// Perform write:
@@ -208,9 +1621,16 @@ func (t *VirtualTarballWriter) WriteAt(buf []byte, offset int64) (int, error) {
 			}
 			if len(p) > 0 {
 				// NOTE: we allow len(p) == 0 to create file as a side effect in case that's useful.
-				n, err := t.openFile.WriteAt(p, localOffset)
-				if err != nil {
-					return 0, err
+				n := len(p)
+				if !t.skipped[tf] {
+					var err error
+					n, err = t.bufferedWrite(p, localOffset)
+					if err != nil {
+						return 0, err
+					}
+					if t.options.VerifyHashes && tf.Hash != nil {
+						t.hashWritten(tf, p[:n], localOffset)
+					}
 				}
 				total += n
 				offset += int64(n)
@@ -220,14 +1640,19 @@ func (t *VirtualTarballWriter) WriteAt(buf []byte, offset int64) (int, error) {
 		}
 
 		// Expect trailing NUL padding byte:
-		if offset == tf.offset+tf.Size && len(remainder) > 0 {
+		if !t.options.NoPadding && offset == tf.offset+tf.Size && len(remainder) > 0 {
 			if remainder[0] != 0 {
-				return 0, ErrBadPaddingByte
+				if !t.options.TolerateBadPadding {
+					return 0, ErrBadPaddingByte
+				}
+				fmt.Fprintf(os.Stderr, "warning: bad padding byte 0x%02x after '%s'\n", remainder[0], tf.Path)
 			}
 			remainder = remainder[1:]
 			offset++
 			total++
 		}
+		// Acked per file so a file finished here is complete before the next one closes it:
+		t.unwritten.Ack(segment, offset)
 
 		// Keep iterating files until we have no more to write:
 		if len(remainder) == 0 {
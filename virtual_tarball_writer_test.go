@@ -1,8 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func newTarballWriter(t *testing.T, files []*TarballFile) *VirtualTarballWriter {
@@ -188,3 +201,2198 @@ func TestWriteAt_ZeroFileMultiple2(t *testing.T) {
 		t.Fatalf("n != %d; n = %v", expectedLen, n)
 	}
 }
+
+func TestTarballWriter_AllInvalidPaths(t *testing.T) {
+	files := []*TarballFile{
+		&TarballFile{Path: "../bad1.txt"},
+		&TarballFile{Path: "dup.txt"},
+		&TarballFile{Path: "ok.txt"},
+		&TarballFile{Path: "dup.txt"},
+		&TarballFile{Path: "../bad2.txt"},
+		&TarballFile{Path: "dup.txt"},
+	}
+
+	_, err := NewVirtualTarballWriter(files, getOptions())
+	if !errors.Is(err, ErrDuplicatePaths) {
+		t.Fatalf("Expected ErrDuplicatePaths; got %v", err)
+	}
+	if !errors.Is(err, ErrBadPath) {
+		t.Fatalf("Expected ErrBadPath; got %v", err)
+	}
+
+	if !errors.Is(err, ErrPathEscapesRoot) {
+		t.Fatalf("Expected ErrPathEscapesRoot; got %v", err)
+	}
+
+	verr := err.(*PathValidationError)
+	if len(verr.EscapingPaths) != 2 {
+		t.Fatalf("Expected 2 escaping paths; got %v", verr.EscapingPaths)
+	}
+	if len(verr.DuplicatePaths) != 1 || verr.DuplicatePaths[0] != "dup.txt" {
+		t.Fatalf("Expected 1 duplicate path; got %v", verr.DuplicatePaths)
+	}
+}
+
+// Wraps osFS to fail specific operations and track open file handles:
+type faultFS struct {
+	osFS
+	fail      map[string]error
+	openFiles int
+}
+
+type faultFile struct {
+	writerFile
+	fs *faultFS
+}
+
+func newFaultFS(op string, err error) *faultFS {
+	return &faultFS{fail: map[string]error{op: err}}
+}
+
+func (fs *faultFS) OpenFile(name string, flag int, perm os.FileMode) (writerFile, error) {
+	if err := fs.fail["open"]; err != nil {
+		return nil, err
+	}
+	f, err := fs.osFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fs.openFiles++
+	return &faultFile{writerFile: f, fs: fs}, nil
+}
+
+func (fs *faultFS) MkdirAll(path string, perm os.FileMode) error {
+	if err := fs.fail["mkdir"]; err != nil {
+		return err
+	}
+	return fs.osFS.MkdirAll(path, perm)
+}
+
+func (fs *faultFS) Chdir(dir string) error {
+	if err := fs.fail["chdir"]; err != nil {
+		return err
+	}
+	return fs.osFS.Chdir(dir)
+}
+
+func (fs *faultFS) Symlink(oldname, newname string, isDir bool) error {
+	if err := fs.fail["symlink"]; err != nil {
+		return err
+	}
+	return fs.osFS.Symlink(oldname, newname, isDir)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.fs.fail["write"]; err != nil {
+		return 0, err
+	}
+	return f.writerFile.WriteAt(p, off)
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if err := f.fs.fail["truncate"]; err != nil {
+		return err
+	}
+	return f.writerFile.Truncate(size)
+}
+
+func (f *faultFile) Chmod(mode os.FileMode) error {
+	if err := f.fs.fail["chmod"]; err != nil {
+		return err
+	}
+	return f.writerFile.Chmod(mode)
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.fail["sync"]; err != nil {
+		return err
+	}
+	return f.writerFile.Sync()
+}
+
+func (f *faultFile) Close() error {
+	f.fs.openFiles--
+	return f.writerFile.Close()
+}
+
+var errInjected = errors.New("injected fault")
+
+func TestWriteAt_Faults(t *testing.T) {
+	for _, op := range []string{"open", "truncate", "mkdir", "write"} {
+		files := []*TarballFile{
+			&TarballFile{Path: "faultdir/fault.txt", Size: 3, Mode: 0644},
+		}
+		tb := newTarballWriter(t, files)
+		fs := newFaultFS(op, errInjected)
+		tb.fs = fs
+
+		_, err := tb.WriteAt([]byte("hi\n\x00"), 0)
+		if err != errInjected {
+			t.Fatalf("%s: expected injected fault; got %v", op, err)
+		}
+		if err := tb.Close(); err != nil {
+			t.Fatalf("%s: %v", op, err)
+		}
+		if fs.openFiles != 0 {
+			t.Fatalf("%s: leaked %d file handles", op, fs.openFiles)
+		}
+		os.RemoveAll("faultdir")
+	}
+}
+
+// Fails the first opens and writes with err, then behaves like osFS; counts every attempt:
+type flakyFS struct {
+	osFS
+	err                   error
+	failOpens, failWrites int
+	opens, writes         int
+}
+
+type flakyFile struct {
+	writerFile
+	fs *flakyFS
+}
+
+func (fs *flakyFS) OpenFile(name string, flag int, perm os.FileMode) (writerFile, error) {
+	fs.opens++
+	if fs.opens <= fs.failOpens {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.err}
+	}
+	f, err := fs.osFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &flakyFile{writerFile: f, fs: fs}, nil
+}
+
+func (f *flakyFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.writes++
+	if f.fs.writes <= f.fs.failWrites {
+		return 0, &os.PathError{Op: "write", Err: f.fs.err}
+	}
+	return f.writerFile.WriteAt(p, off)
+}
+
+func TestWriteAt_WriteRetries(t *testing.T) {
+	defer os.Remove("retry.txt")
+	tests := []struct {
+		retries  int
+		err      syscall.Errno
+		failures int
+		// Attempts at each of opening and writing, and whether the write succeeds:
+		attempts int
+		ok       bool
+	}{
+		{3, syscall.EINTR, 2, 3, true},
+		{1, syscall.EINTR, 2, 2, false},
+		{0, syscall.EAGAIN, 1, 1, false},
+		// Not transient; fails at once:
+		{3, syscall.EIO, 1, 1, false},
+	}
+	for _, test := range tests {
+		os.Remove("retry.txt")
+		options := getOptions()
+		options.WriteRetries = test.retries
+		options.WriteRetryBackoff = time.Millisecond
+		tb, err := NewVirtualTarballWriter([]*TarballFile{&TarballFile{Path: "retry.txt", Size: 3, Mode: 0644}}, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Opening fails first:
+		fs := &flakyFS{err: test.err, failOpens: test.failures}
+		tb.fs = fs
+		_, err = tb.WriteAt([]byte("ok\n\x00"), 0)
+		if fs.opens != test.attempts || (err == nil) != test.ok || (err != nil && !errors.Is(err, test.err)) {
+			t.Fatalf("%+v: open tried %d times; err = %v", test, fs.opens, err)
+		}
+
+		// Then writing:
+		fs = &flakyFS{err: test.err, failWrites: test.failures}
+		tb.fs = fs
+		tb.Close()
+		_, err = tb.WriteAt([]byte("ok\n\x00"), 0)
+		if fs.writes != test.attempts || (err == nil) != test.ok || (err != nil && !errors.Is(err, test.err)) {
+			t.Fatalf("%+v: write tried %d times; err = %v", test, fs.writes, err)
+		}
+		tb.Close()
+		if test.ok {
+			if data, err := ioutil.ReadFile("retry.txt"); err != nil || string(data) != "ok\n" {
+				t.Fatalf("retry.txt = %q, %v", data, err)
+			}
+		}
+	}
+}
+
+func TestWriteRetryBackoff(t *testing.T) {
+	tb := newTarballWriter(t, nil)
+	// Waits double from the default, capped since the writer stays locked meanwhile:
+	for i, expected := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond} {
+		if backoff := tb.retryBackoff(i); backoff != expected {
+			t.Fatalf("retry %d waits %v; expected %v", i, backoff, expected)
+		}
+	}
+	if backoff := tb.retryBackoff(1000); backoff != maxWriteRetryBackoff {
+		t.Fatalf("retry 1000 waits %v; expected %v", backoff, maxWriteRetryBackoff)
+	}
+	tb.options.WriteRetryBackoff = time.Hour
+	if backoff := tb.retryBackoff(0); backoff != maxWriteRetryBackoff {
+		t.Fatalf("first retry waits %v; expected %v", backoff, maxWriteRetryBackoff)
+	}
+}
+
+func TestWriteAt_ReadOnlyTarget(t *testing.T) {
+	for _, errno := range []syscall.Errno{syscall.EROFS, syscall.EACCES} {
+		files := []*TarballFile{
+			&TarballFile{Path: "readonly.txt", Size: 3, Mode: 0644},
+		}
+		tb := newTarballWriter(t, files)
+		tb.fs = newFaultFS("write", &os.PathError{Op: "write", Path: "readonly.txt", Err: errno})
+
+		_, err := tb.WriteAt([]byte("hi\n\x00"), 0)
+		if !errors.Is(err, ErrReadOnlyTarget) || !errors.Is(err, errno) {
+			t.Fatalf("%v: expected ErrReadOnlyTarget wrapping the write error; got %v", errno, err)
+		}
+		if rerr, ok := err.(*ReadOnlyTargetError); !ok || rerr.Path != "readonly.txt" || !strings.HasPrefix(err.Error(), ErrReadOnlyTarget.Error()+": readonly.txt: ") {
+			t.Fatalf("%v: expected the file's path; got %#v", errno, err)
+		}
+		if err := tb.Close(); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove("readonly.txt")
+	}
+
+	// EPERM refuses the one file, e.g. an immutable one, not the target:
+	tb := newTarballWriter(t, []*TarballFile{&TarballFile{Path: "readonly.txt", Size: 3, Mode: 0644}})
+	defer os.Remove("readonly.txt")
+	tb.fs = newFaultFS("write", &os.PathError{Op: "write", Path: "readonly.txt", Err: syscall.EPERM})
+	if _, err := tb.WriteAt([]byte("hi\n\x00"), 0); errors.Is(err, ErrReadOnlyTarget) || !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("expected the EPERM write error alone; got %v", err)
+	}
+	if err := tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteAt_ChmodFault(t *testing.T) {
+	if getOptions().CompatMode {
+		t.Skip("chmod not used in compat mode")
+	}
+
+	files := []*TarballFile{
+		&TarballFile{Path: "fault.txt", Size: 3, Mode: 0644},
+	}
+	tb := newTarballWriter(t, files)
+	fs := newFaultFS("chmod", errInjected)
+	tb.fs = fs
+	defer os.Remove("fault.txt")
+
+	if _, err := tb.WriteAt([]byte("hi\n\x00"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Close(); err != errInjected {
+		t.Fatalf("expected injected fault; got %v", err)
+	}
+	if fs.openFiles != 0 {
+		t.Fatalf("leaked %d file handles", fs.openFiles)
+	}
+}
+
+func TestWriteAt_IgnoreModeErrors(t *testing.T) {
+	if getOptions().CompatMode {
+		t.Skip("chmod not used in compat mode")
+	}
+
+	files := []*TarballFile{
+		&TarballFile{Path: "fault.txt", Size: 3, Mode: 0644},
+	}
+	tb := newTarballWriter(t, files)
+	tb.options.IgnoreModeErrors = true
+	fs := newFaultFS("chmod", errInjected)
+	tb.fs = fs
+	defer os.Remove("fault.txt")
+
+	if _, err := tb.WriteAt([]byte("hi\n\x00"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Close(); err != nil {
+		t.Fatalf("expected chmod fault to be ignored; got %v", err)
+	}
+	if fs.openFiles != 0 {
+		t.Fatalf("leaked %d file handles", fs.openFiles)
+	}
+	if buf, _ := ioutil.ReadFile("fault.txt"); string(buf) != "hi\n" {
+		t.Fatalf("unexpected contents %q", buf)
+	}
+}
+
+func TestWriteAt_DirectorySymlink(t *testing.T) {
+	if getOptions().CompatMode {
+		t.Skip("symlinks not supported in compat mode")
+	}
+
+	files := []*TarballFile{
+		&TarballFile{Path: "symdir", Mode: os.ModeSymlink | 0777, SymlinkDestination: "symtarget", SymlinkIsDir: true},
+	}
+	tb := newTarballWriter(t, files)
+	defer os.Remove("symdir")
+	defer os.Remove("symtarget")
+
+	// The target does not exist yet when the symlink is created:
+	if _, err := tb.WriteAt([]byte{0}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir("symtarget", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := os.Stat("symdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stat.IsDir() {
+		t.Fatal("expected symlink to resolve to a directory")
+	}
+
+	// Existing symlinks are left alone:
+	if _, err := tb.WriteAt([]byte{0}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// ...unless they point somewhere else:
+	files[0] = &TarballFile{Path: "symdir", Mode: os.ModeSymlink | 0777, SymlinkDestination: "symother", SymlinkIsDir: true}
+	tb = newTarballWriter(t, files)
+	if _, err := tb.WriteAt([]byte{0}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink("symdir"); err != nil || target != "symother" {
+		t.Fatalf("symlink target = %q, %v; expected it retargeted to symother", target, err)
+	}
+}
+
+func TestWriteAt_SymlinkChdirFault(t *testing.T) {
+	if getOptions().CompatMode {
+		t.Skip("symlinks not supported in compat mode")
+	}
+
+	for _, op := range []string{"chdir", "symlink"} {
+		files := []*TarballFile{
+			&TarballFile{Path: "faultdir/link", Mode: os.ModeSymlink | 0777, SymlinkDestination: "target"},
+		}
+		tb := newTarballWriter(t, files)
+		tb.fs = newFaultFS(op, errInjected)
+
+		wd, _ := os.Getwd()
+		_, err := tb.WriteAt([]byte("\x00"), 0)
+		if err != errInjected {
+			t.Fatalf("%s: expected injected fault; got %v", op, err)
+		}
+		if cwd, _ := os.Getwd(); cwd != wd {
+			os.Chdir(wd)
+			t.Fatalf("%s: working directory not restored", op)
+		}
+		os.RemoveAll("faultdir")
+	}
+}
+
+func TestTarballWriter_CaseCollision(t *testing.T) {
+	files := []*TarballFile{
+		&TarballFile{Path: "Foo.txt"},
+		&TarballFile{Path: "bar.txt"},
+		&TarballFile{Path: "foo.txt"},
+		&TarballFile{Path: "FOO.txt"},
+	}
+
+	options := getOptions()
+	options.CaseInsensitive = true
+	_, err := NewVirtualTarballWriter(files, options)
+	if !errors.Is(err, ErrCaseCollision) {
+		t.Fatalf("Expected ErrCaseCollision; got %v", err)
+	}
+	verr := err.(*PathValidationError)
+	if len(verr.CaseCollisions) != 3 {
+		t.Fatalf("Expected 3 colliding paths; got %v", verr.CaseCollisions)
+	}
+
+	// Case variants are allowed on case-sensitive filesystems:
+	options.CaseInsensitive = false
+	if _, err := NewVirtualTarballWriter(files, options); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteAt_Flush(t *testing.T) {
+	files := []*TarballFile{
+		&TarballFile{Path: "flush1.txt", Size: 3, Mode: 0644},
+		&TarballFile{Path: "flush2.txt", Size: 3, Mode: 0644},
+	}
+
+	tb := newTarballWriter(t, files)
+	defer closeTarballWriter(t, tb)
+
+	// Nothing open yet:
+	if err := tb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tb.WriteAt([]byte("hi\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flushed data is visible while the file remains open:
+	data, err := ioutil.ReadFile("flush1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hi\n" {
+		t.Fatalf("unexpected contents %q", data)
+	}
+	if tb.openFile == nil {
+		t.Fatal("expected file to remain open")
+	}
+
+	tb.fs = newFaultFS("sync", errInjected)
+	tb.closeFile()
+	if _, err := tb.WriteAt([]byte("\x00yo\n"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Flush(); err != errInjected {
+		t.Fatalf("expected injected fault; got %v", err)
+	}
+}
+
+func TestWriteAt_RestoresModTime(t *testing.T) {
+	modTime := time.Unix(1500000000, 0)
+	files := []*TarballFile{
+		&TarballFile{Path: "mtime.txt", Size: 3, Mode: 0644, ModTime: modTime},
+	}
+
+	tb := newTarballWriter(t, files)
+	defer closeTarballWriter(t, tb)
+
+	if _, err := tb.WriteAt([]byte("hi\n\x00"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.closeFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := os.Stat("mtime.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stat.ModTime().Equal(modTime) {
+		t.Fatalf("mtime not restored; %v != %v", stat.ModTime(), modTime)
+	}
+}
+
+func TestWriteAt_ImplausibleModTime(t *testing.T) {
+	future := time.Now().Add(365 * 24 * time.Hour)
+	for _, clamp := range []bool{false, true} {
+		files := []*TarballFile{
+			&TarballFile{Path: "future.txt", Size: 3, Mode: 0644, ModTime: future},
+		}
+
+		tb := newTarballWriter(t, files)
+		tb.options.MaxModTimeSkew = time.Hour
+		tb.options.ClampModTime = clamp
+
+		if _, err := tb.WriteAt([]byte("hi\n\x00"), 0); err != nil {
+			t.Fatal(err)
+		}
+		err := tb.closeFile()
+		if !clamp {
+			if err != ErrImplausibleModTime {
+				t.Fatalf("expected ErrImplausibleModTime; got %v", err)
+			}
+			closeTarballWriter(t, tb)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stat, err := os.Stat("future.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.ModTime().After(time.Now()) {
+			t.Fatalf("mtime not clamped; %v", stat.ModTime())
+		}
+		closeTarballWriter(t, tb)
+	}
+}
+
+func TestTarballWriter_UpToDateFiles(t *testing.T) {
+	contents := []byte("same\n")
+	if err := ioutil.WriteFile("same.txt", contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("same.txt")
+	if err := ioutil.WriteFile("changed.txt", []byte("old!\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("changed.txt")
+	hash, err := hashFile("same.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := os.Stat("changed.txt")
+
+	files := []*TarballFile{
+		&TarballFile{Path: "same.txt", Size: 5, Mode: 0644, Hash: hash},
+		&TarballFile{Path: "changed.txt", Size: 5, Mode: 0644, Hash: hash},
+		&TarballFile{Path: "missing.txt", Size: 5, Mode: 0644, Hash: hash},
+	}
+	tb, err := NewVirtualTarballWriter(files, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upToDate, err := tb.UpToDateFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upToDate) != 1 || upToDate[0].Path != "same.txt" {
+		t.Fatalf("expected only same.txt up to date; got %v", upToDate)
+	}
+
+	// Without a hash, size and modification time are compared:
+	files[1].Hash = nil
+	files[1].ModTime = stat.ModTime()
+	if tb, err = NewVirtualTarballWriter(files, getOptions()); err != nil {
+		t.Fatal(err)
+	}
+	upToDate, err = tb.UpToDateFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upToDate) != 2 {
+		t.Fatalf("expected 2 files up to date; got %v", upToDate)
+	}
+
+	// A half-written file keeps the time of its last write, so it is not taken for up to date:
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	partial := []*TarballFile{&TarballFile{Path: "partial.txt", Size: 5, Mode: 0644, ModTime: modTime}}
+	tb = newTarballWriter(t, partial)
+	defer os.Remove("partial.txt")
+	if _, err := tb.WriteAt([]byte("par"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tb = newTarballWriter(t, partial)
+	if upToDate, err = tb.UpToDateFiles(); err != nil || len(upToDate) != 0 {
+		t.Fatalf("expected partial file not up to date; got %v, %v", upToDate, err)
+	}
+}
+
+func TestTarballWriter_RemoveExtraneous(t *testing.T) {
+	os.MkdirAll("extraneous/sub", 0755)
+	defer os.RemoveAll("extraneous")
+	for _, path := range []string{"extraneous/keep.txt", "extraneous/sub/keep.txt", "extraneous/sub/remove.txt", "extraneous/cache"} {
+		ioutil.WriteFile(path, nil, 0644)
+	}
+
+	files := []*TarballFile{
+		&TarballFile{Path: "keep.txt"},
+		&TarballFile{Path: "sub/keep.txt"},
+	}
+	tb, err := NewVirtualTarballWriter(files, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep paths match whether or not they are given the same way as the root:
+	cache, err := filepath.Abs("extraneous/cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := tb.RemoveExtraneous("extraneous", cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || filepath.ToSlash(removed[0]) != "extraneous/sub/remove.txt" {
+		t.Fatalf("unexpected removals %v", removed)
+	}
+	if _, err := os.Stat("extraneous/sub/keep.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("extraneous/cache"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTarballWriter_CheckFree(t *testing.T) {
+	free, err := statDiskFree(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []*TarballFile{
+		&TarballFile{Path: "a/b/c.txt", Size: 1},
+		&TarballFile{Path: "a/d.txt", Size: 1},
+	}
+	tb := newTarballWriter(t, files)
+	if err := tb.CheckFreeSpace("."); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.CheckFreeInodes("."); err != nil {
+		t.Fatal(err)
+	}
+
+	if free.BytesKnown {
+		huge := newTarballWriter(t, []*TarballFile{&TarballFile{Path: "huge", Size: int64(free.Bytes) + 1}})
+		if err := huge.CheckFreeSpace("."); err != ErrInsufficientSpace {
+			t.Fatalf("expected ErrInsufficientSpace; got %v", err)
+		}
+	}
+	if free.InodesKnown && free.Inodes < 100000 {
+		many := make([]*TarballFile, 0, free.Inodes+1)
+		for i := uint64(0); i <= free.Inodes; i++ {
+			many = append(many, &TarballFile{Path: fmt.Sprintf("f%d", i)})
+		}
+		if err := newTarballWriter(t, many).CheckFreeInodes("."); err != ErrInsufficientInodes {
+			t.Fatalf("expected ErrInsufficientInodes; got %v", err)
+		}
+	}
+}
+
+func TestTarball_RegionsForFile(t *testing.T) {
+	files := []*TarballFile{
+		&TarballFile{Path: "a", Size: 9},
+		&TarballFile{Path: "b", Size: 10},
+		&TarballFile{Path: "c", Size: 0},
+		&TarballFile{Path: "d", Size: 8},
+		&TarballFile{Path: "e", Size: 25},
+	}
+	tb := newTarballWriter(t, files)
+
+	expected := map[string][2]int64{
+		// [0, 10): NUL ends region 0
+		"a": {0, 1},
+		// [10, 21): NUL spills into region 2
+		"b": {1, 2},
+		// [21, 22)
+		"c": {2, 1},
+		// [22, 31)
+		"d": {2, 2},
+		// [31, 57)
+		"e":       {3, 3},
+		"missing": {-1, 0},
+	}
+	for path, e := range expected {
+		start, count := tb.files.regionsForFile(path, 10, 1)
+		if start != e[0] || count != e[1] {
+			t.Fatalf("%s: (%d, %d) != (%d, %d)", path, start, count, e[0], e[1])
+		}
+	}
+}
+
+func TestTarballWriter_ZeroFill(t *testing.T) {
+	files := []*TarballFile{
+		&TarballFile{Path: "zero1.txt", Size: 8, Mode: 0644},
+		&TarballFile{Path: "zero2.txt", Size: 4, Mode: 0644},
+	}
+	tb := newTarballWriter(t, files)
+	defer os.Remove("zero1.txt")
+
+	// Simulate garbage left behind in the unwritten tail of a preallocated file:
+	if _, err := tb.WriteAt([]byte("ab"), 0); err != nil {
+		t.Fatal(err)
+	}
+	tb.Close()
+	if err := ioutil.WriteFile("zero1.txt", []byte("abGARBAG"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := tb.ZeroFill([]Region{{2, 13}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Fatalf("n != 6; n = %d", n)
+	}
+	buf, _ := ioutil.ReadFile("zero1.txt")
+	if string(buf) != "ab\x00\x00\x00\x00\x00\x00" {
+		t.Fatalf("unexpected contents %q", buf)
+	}
+	if _, err := os.Lstat("zero2.txt"); !os.IsNotExist(err) {
+		t.Fatalf("expected zero2.txt not to be created; got %v", err)
+	}
+
+	// A user's file this run never opened is left alone:
+	if err := ioutil.WriteFile("zero2.txt", []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("zero2.txt")
+	if n, err := tb.ZeroFill([]Region{{2, 13}}); err != nil || n != 6 {
+		t.Fatalf("ZeroFill = %d, %v", n, err)
+	}
+	if buf, _ := ioutil.ReadFile("zero2.txt"); string(buf) != "mine" {
+		t.Fatalf("unopened file zeroed to %q", buf)
+	}
+}
+
+func TestWriteAt_NoPadding(t *testing.T) {
+	files := []*TarballFile{
+		&TarballFile{Path: "nopad1.txt", Size: 3, Mode: 0644},
+		&TarballFile{Path: "nopad_empty.txt", Size: 0, Mode: 0644},
+		&TarballFile{Path: "nopad2.txt", Size: 2, Mode: 0644},
+	}
+	options := getOptions()
+	options.NoPadding = true
+	tb, err := NewVirtualTarballWriter(files, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTarballWriter(t, tb)
+
+	if tb.size != 5 {
+		t.Fatalf("size != 5; size = %d", tb.size)
+	}
+	if _, err := tb.WriteAt([]byte("abcde"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.CreateEmptyEntries(); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]string{"nopad1.txt": "abc", "nopad_empty.txt": "", "nopad2.txt": "de"} {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != expected {
+			t.Fatalf("%s = %q; expected %q", path, buf, expected)
+		}
+	}
+}
+
+func TestWriteAt_TolerateBadPadding(t *testing.T) {
+	files := []*TarballFile{
+		&TarballFile{Path: "badpad1.txt", Size: 3, Mode: 0644},
+		&TarballFile{Path: "badpad2.txt", Size: 3, Mode: 0644},
+	}
+	data := []byte("one\xfftwo\x00")
+
+	strict := newTarballWriter(t, files)
+	if _, err := strict.WriteAt(data, 0); err != ErrBadPaddingByte {
+		t.Fatalf("expected ErrBadPaddingByte; got %v", err)
+	}
+	strict.Close()
+
+	options := getOptions()
+	options.TolerateBadPadding = true
+	tb, err := NewVirtualTarballWriter(files, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTarballWriter(t, tb)
+
+	n, err := tb.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) {
+		t.Fatalf("n = %d; expected %d", n, len(data))
+	}
+	if contents, _ := ioutil.ReadFile("badpad2.txt"); string(contents) != "two" {
+		t.Fatalf("badpad2.txt = %q; expected %q", contents, "two")
+	}
+}
+
+func TestTarball_EmptyDirectoryRoundTrip(t *testing.T) {
+	for _, dir := range []string{"dirs_src/empty", "dirs_src/full"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.RemoveAll("dirs_src")
+	defer os.RemoveAll("dirs_out")
+	os.Chmod("dirs_src/empty", 0750)
+	createTestFile("dirs_src/full/f.txt", []byte("full\n"))
+
+	files, err := MergeTarballSources(TarballSource{Root: "dirs_src", Prefix: "dirs_out", Directories: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := newTarballReader(t, files)
+	defer reader.Close()
+	buf := make([]byte, reader.size)
+	if _, err := reader.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Send the metadata through the encoder as a client would receive it:
+	md, err := encodeMetadata(reader.size, 0, reader.files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newMetadataDecoder(1, 0)
+	if err := d.AddSection(0, md); err != nil {
+		t.Fatal(err)
+	}
+	_, received, err := d.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer := newTarballWriter(t, received)
+	if _, err := writer.WriteAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.FinishDirectories(); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := os.Stat("dirs_out/empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stat.IsDir() {
+		t.Fatal("expected empty directory to be created")
+	}
+	if !writer.options.CompatMode && stat.Mode().Perm() != 0750 {
+		t.Fatalf("empty directory mode = %v; expected 0750", stat.Mode().Perm())
+	}
+	if contents, _ := ioutil.ReadFile("dirs_out/full/f.txt"); string(contents) != "full\n" {
+		t.Fatalf("dirs_out/full/f.txt = %q", contents)
+	}
+}
+
+// Records the paths chmodded, in order:
+type chmodOrderFS struct {
+	osFS
+	paths []string
+}
+
+func (fs *chmodOrderFS) Chmod(name string, mode os.FileMode) error {
+	fs.paths = append(fs.paths, name)
+	return fs.osFS.Chmod(name, mode)
+}
+
+func TestWriteAt_FinishDirectoriesOrder(t *testing.T) {
+	if getOptions().CompatMode {
+		t.Skip("directory modes not restored in compat mode")
+	}
+
+	// Listed parents last, unlike a walk:
+	files := []*TarballFile{
+		&TarballFile{Path: "order_out/a/b", Mode: os.ModeDir | 0755},
+		&TarballFile{Path: "order_out", Mode: os.ModeDir | 0755},
+		&TarballFile{Path: "order_out/a", Mode: os.ModeDir | 0755},
+	}
+	tb := newTarballWriter(t, files)
+	defer os.RemoveAll("order_out")
+	fs := &chmodOrderFS{}
+	tb.fs = fs
+
+	if _, err := tb.WriteAt([]byte{0, 0, 0}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.FinishDirectories(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(fs.paths, ",") != "order_out/a/b,order_out/a,order_out" {
+		t.Fatalf("directories finished in order %v; expected deepest first", fs.paths)
+	}
+}
+
+func TestWriteAt_VerifyHashes(t *testing.T) {
+	contents := []byte("verified contents\n")
+	sum := sha256.Sum256(contents)
+	newWriter := func(hash []byte) *VirtualTarballWriter {
+		options := getOptions()
+		options.VerifyHashes = true
+		tb, err := NewVirtualTarballWriter([]*TarballFile{
+			&TarballFile{Path: "verify.txt", Size: int64(len(contents)), Mode: 0644, Hash: hash},
+		}, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tb
+	}
+	defer os.Remove("verify.txt")
+	data := append(append([]byte(nil), contents...), 0)
+
+	// In order, including a retransmitted region, verifies without re-reading:
+	tb := newWriter(sum[:])
+	tb.WriteAt(data[:5], 0)
+	tb.WriteAt(data[:8], 0)
+	tb.WriteAt(data[8:], 8)
+	tb.Close()
+	ioutil.WriteFile("verify.txt", []byte("changed on disk!!\n"), 0644)
+	if failed, err := tb.VerifyFiles(); err != nil || len(failed) != 0 {
+		t.Fatalf("expected in-order file to verify without re-reading; got %v, %v", failed, err)
+	}
+
+	// Out of order falls back to re-reading:
+	tb = newWriter(sum[:])
+	tb.WriteAt(data[8:], 8)
+	tb.WriteAt(data[:8], 0)
+	tb.Close()
+	if failed, err := tb.VerifyFiles(); err != nil || len(failed) != 0 {
+		t.Fatalf("expected out-of-order file to verify; got %v, %v", failed, err)
+	}
+	ioutil.WriteFile("verify.txt", []byte("changed on disk!!\n"), 0644)
+	if failed, _ := tb.VerifyFiles(); len(failed) != 1 {
+		t.Fatal("expected re-read of out-of-order file to fail")
+	}
+
+	// Mismatched contents fail:
+	bad := sha256.Sum256([]byte("something else"))
+	tb = newWriter(bad[:])
+	tb.OnFileComplete = func(path string, tf *TarballFile) {
+		t.Fatalf("'%s' reported complete despite failing verification", path)
+	}
+	corrupt := []string{}
+	tb.OnFileCorrupt = func(path string, tf *TarballFile) {
+		corrupt = append(corrupt, path)
+	}
+	tb.WriteAt(data, 0)
+	if len(corrupt) != 1 || corrupt[0] != "verify.txt" {
+		t.Fatalf("expected verify.txt reported corrupt once; got %v", corrupt)
+	}
+	tb.Close()
+	if failed, _ := tb.VerifyFiles(); len(failed) != 1 || failed[0].Path != "verify.txt" {
+		t.Fatalf("expected verify.txt to fail; got %v", failed)
+	}
+}
+
+func TestWriteAt_OnFileComplete(t *testing.T) {
+	files := []*TarballFile{
+		&TarballFile{Path: "complete1.txt", Size: 6, Mode: 0644},
+		&TarballFile{Path: "complete2.txt", Size: 6, Mode: 0644},
+		&TarballFile{Path: "complete3.txt", Size: 6, Mode: 0644},
+	}
+	tb := newTarballWriter(t, files)
+	defer closeTarballWriter(t, tb)
+
+	completions := map[string]int{}
+	order := []string{}
+	tb.OnFileComplete = func(path string, tf *TarballFile) {
+		completions[path]++
+		order = append(order, path)
+	}
+
+	// Third file was received by an earlier run; it is not reported:
+	tb.MarkWritten(14, 21)
+
+	data := []byte("first\n\x00secnd\n\x00third\n\x00")
+	// Out of order, with overlapping retransmissions:
+	tb.WriteAt(data[10:14], 10)
+	tb.WriteAt(data[3:9], 3)
+	if len(order) != 0 {
+		t.Fatalf("reported %v before any file was complete", order)
+	}
+	tb.WriteAt(data[0:4], 0)
+	tb.WriteAt(data[9:10], 9)
+	tb.WriteAt(data[0:14], 0)
+
+	if strings.Join(order, ",") != "complete1.txt,complete2.txt" {
+		t.Fatalf("completed %v", order)
+	}
+	for path, n := range completions {
+		if n != 1 {
+			t.Fatalf("'%s' reported %d times", path, n)
+		}
+	}
+
+	tb.WriteAt(data[14:], 14)
+}
+
+func TestWriteAt_ModeTransform(t *testing.T) {
+	if getOptions().CompatMode {
+		t.Skip("modes not restored in compat mode")
+	}
+
+	files := []*TarballFile{
+		&TarballFile{Path: "setuid.sh", Size: 3, Mode: os.ModeSetuid | os.ModeSetgid | 0755},
+	}
+	tb := newTarballWriter(t, files)
+	defer os.Remove("setuid.sh")
+	tb.ModeTransform = func(tf *TarballFile) os.FileMode {
+		return tf.Mode &^ (os.ModeSetuid | os.ModeSetgid)
+	}
+
+	// Until it is complete, the file is only the owner's and has no setuid or setgid bit:
+	if _, err := tb.WriteAt([]byte("s"), 0); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat("setuid.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode() != 0600 {
+		t.Fatalf("mode while writing = %v; expected %v", stat.Mode(), os.FileMode(0600))
+	}
+
+	if _, err := tb.WriteAt([]byte("h\n\x00"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err = os.Stat("setuid.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode() != 0755 {
+		t.Fatalf("mode = %v; expected setuid and setgid stripped to %v", stat.Mode(), os.FileMode(0755))
+	}
+}
+
+func TestWriteAt_PathMap(t *testing.T) {
+	files := []*TarballFile{
+		&TarballFile{Path: "strip_top", Mode: os.ModeDir | 0755},
+		&TarballFile{Path: "strip_top/a.txt", Size: 2, Mode: 0644},
+		&TarballFile{Path: "strip_top/b.txt", Size: 3, Mode: 0644},
+	}
+	options := getOptions()
+	options.PathMap = ReplacePathPrefix("strip_top", "strip_out")
+	tb, err := NewVirtualTarballWriter(files, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("strip_out")
+	defer os.RemoveAll("strip_top")
+
+	if _, err := tb.WriteAt([]byte("\x00a\n\x00bb\n\x00"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{"strip_out/a.txt": "a\n", "strip_out/b.txt": "bb\n"} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Fatalf("%s = %q; expected %q", path, data, expected)
+		}
+	}
+	if _, err := os.Lstat("strip_top"); !os.IsNotExist(err) {
+		t.Fatalf("expected source path not to be created; got %v", err)
+	}
+	// The writer maps copies, leaving the caller's entries as they were:
+	if files[1].Path != "strip_top/a.txt" {
+		t.Fatalf("caller's entry rewritten to '%s'", files[1].Path)
+	}
+}
+
+func TestPathMaps(t *testing.T) {
+	tests := []struct {
+		m        func(path string) string
+		path     string
+		expected string
+	}{
+		{StripComponents(1), "top/sub/file.txt", "sub/file.txt"},
+		{StripComponents(2), "top/sub/file.txt", "file.txt"},
+		{StripComponents(2), "top/sub", ""},
+		// Backslashes are part of a name, not separators:
+		{StripComponents(1), `top\file.txt`, ""},
+		{ReplacePathPrefix("top", "out"), "top", "out"},
+		{ReplacePathPrefix("top", "out/deeper"), "top/sub/file.txt", "out/deeper/sub/file.txt"},
+		{ReplacePathPrefix("top/", ""), "top/file.txt", "file.txt"},
+		{ReplacePathPrefix("top", ""), "top", ""},
+		{ReplacePathPrefix("top", "out"), "topmost/file.txt", "topmost/file.txt"},
+	}
+	for _, test := range tests {
+		if actual := test.m(test.path); actual != test.expected {
+			t.Fatalf("'%s' mapped to '%s'; expected '%s'", test.path, actual, test.expected)
+		}
+	}
+}
+
+func TestWriteAt_StripComponents(t *testing.T) {
+	files := []*TarballFile{
+		&TarballFile{Path: "stripped", Mode: os.ModeDir | 0755},
+		&TarballFile{Path: "stripped/kept.txt", Size: 5, Mode: 0644},
+	}
+	options := getOptions()
+	options.PathMap = StripComponents(1)
+	tb, err := NewVirtualTarballWriter(files, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("kept.txt")
+
+	// Skipped entries are still consumed from the stream:
+	if _, err := tb.WriteAt([]byte("\x00kept\n\x00"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.FinishDirectories(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("kept.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "kept\n" {
+		t.Fatalf("kept.txt = %q", data)
+	}
+	if _, err := os.Lstat("stripped"); !os.IsNotExist(err) {
+		t.Fatalf("expected stripped directory to be skipped; got %v", err)
+	}
+}
+
+func TestNewWriter_PathMapValidation(t *testing.T) {
+	// Different sources landing on the same destination:
+	options := getOptions()
+	options.PathMap = StripComponents(1)
+	_, err := NewVirtualTarballWriter([]*TarballFile{
+		&TarballFile{Path: "x/same.txt", Size: 1, Mode: 0644},
+		&TarballFile{Path: "y/same.txt", Size: 1, Mode: 0644},
+	}, options)
+	if !errors.Is(err, ErrMappedCollision) {
+		t.Fatalf("expected ErrMappedCollision; got %v", err)
+	}
+	if !strings.Contains(err.Error(), "same.txt") {
+		t.Fatalf("expected colliding paths in error: %v", err)
+	}
+
+	// Mapped paths are checked for traversal again:
+	options.PathMap = func(path string) string { return "../" + path }
+	_, err = NewVirtualTarballWriter([]*TarballFile{
+		&TarballFile{Path: "escape.txt", Size: 1, Mode: 0644},
+	}, options)
+	if !errors.Is(err, ErrBadPath) {
+		t.Fatalf("expected ErrBadPath; got %v", err)
+	}
+}
+
+func TestWriteAt_InvalidUTF8(t *testing.T) {
+	const bad = "utf8_\xffbad.txt"
+	files := func() []*TarballFile {
+		return []*TarballFile{&TarballFile{Path: bad, Size: 2, Mode: 0644}}
+	}
+
+	options := getOptions()
+	options.InvalidUTF8 = InvalidUTF8Reject
+	_, err := NewVirtualTarballWriter(files(), options)
+	if !errors.Is(err, ErrInvalidUTF8Path) {
+		t.Fatalf("expected ErrInvalidUTF8Path; got %v", err)
+	}
+	if !strings.Contains(err.Error(), `"utf8_\xffbad.txt"`) {
+		t.Fatalf("expected the quoted path in error: %v", err)
+	}
+
+	// Invalid bytes are escaped; valid multi-byte sequences are kept:
+	if got := escapeInvalidUTF8("caf\xc3\xa9\xc3/\xff"); got != "caf\xc3\xa9%C3/%FF" {
+		t.Fatalf("escaped to %q", got)
+	}
+	options.InvalidUTF8 = InvalidUTF8Escape
+	tb, err := NewVirtualTarballWriter(files(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("utf8_%FFbad.txt")
+	if _, err := tb.WriteAt([]byte("e\n\x00"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile("utf8_%FFbad.txt"); err != nil || string(data) != "e\n" {
+		t.Fatalf("escaped file = %q, %v", data, err)
+	}
+
+	// An escaped path may not land on another entry's, whichever comes first:
+	_, err = NewVirtualTarballWriter(append(files(), &TarballFile{Path: "utf8_%FFbad.txt", Mode: 0644}), options)
+	if !errors.Is(err, ErrMappedCollision) {
+		t.Fatalf("expected ErrMappedCollision; got %v", err)
+	}
+	_, err = NewVirtualTarballWriter(append([]*TarballFile{&TarballFile{Path: "utf8_%FFbad.txt", Mode: 0644}}, files()...), options)
+	if !errors.Is(err, ErrMappedCollision) {
+		t.Fatalf("expected ErrMappedCollision; got %v", err)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	// Passed through byte for byte by default on Unix:
+	options.InvalidUTF8 = InvalidUTF8Default
+	tb, err = NewVirtualTarballWriter(files(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(bad)
+	if _, err := tb.WriteAt([]byte("p\n\x00"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(bad); err != nil || string(data) != "p\n" {
+		t.Fatalf("passed through file = %q, %v", data, err)
+	}
+}
+
+func TestWriteAt_UpToDateBlocks(t *testing.T) {
+	createTestFile("blocks_src.bin", []byte("aaaaBBBBccccdd"))
+	defer os.Remove("blocks_src.bin")
+	// Existing copy differs only in its second block:
+	createTestFile("blocks.bin", []byte("aaaabbbbccccdd"))
+	defer os.Remove("blocks.bin")
+
+	options := getOptions()
+	options.HashFiles = true
+	options.BlockSize = 4
+	reader, err := NewVirtualTarballReader([]*TarballFile{
+		&TarballFile{Path: "blocks.bin", LocalPath: "blocks_src.bin", Size: 14, Mode: 0644},
+	}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	buf := make([]byte, reader.size)
+	if _, err := reader.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Send the metadata through the encoder as a client would receive it:
+	md, err := encodeMetadata(reader.size, metadataFlags(options), reader.files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newMetadataDecoder(1, 0)
+	if err := d.AddSection(0, md); err != nil {
+		t.Fatal(err)
+	}
+	_, received, err := d.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received[0].BlockHashes) != 4 {
+		t.Fatalf("expected 4 block hashes; got %d", len(received[0].BlockHashes))
+	}
+
+	writer := newTarballWriter(t, received)
+	blocks, err := writer.UpToDateBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, blocks, []Region{{0, 4}, {8, 14}})
+
+	// Receiving only the changed block and the padding completes the file:
+	if _, err := writer.WriteAt(buf[4:8], 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteAt(buf[14:], 14); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("blocks.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "aaaaBBBBccccdd" {
+		t.Fatalf("blocks.bin = %q", data)
+	}
+
+	// The last block is not reused from a longer file, so writing it truncates the file:
+	if err := ioutil.WriteFile("blocks.bin", []byte("aaaaBBBBccccddEXTRA"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writer = newTarballWriter(t, received)
+	blocks, err = writer.UpToDateBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, blocks, []Region{{0, 12}})
+}
+
+func TestWriteAt_ConflictResolver(t *testing.T) {
+	tests := []struct {
+		action   ConflictAction
+		path     string
+		contents string
+		err      error
+	}{
+		{ConflictOverwrite, "conflict.txt", "new\n", nil},
+		{ConflictSkip, "conflict.txt", "old\n", nil},
+		{ConflictRename, "conflict.txt.1", "new\n", nil},
+		{ConflictAbort, "conflict.txt", "old\n", ErrConflictAborted},
+	}
+
+	for _, test := range tests {
+		func() {
+			defer os.Remove("conflict.txt")
+			defer os.Remove("conflict.txt.1")
+			if err := ioutil.WriteFile("conflict.txt", []byte("old\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			files := []*TarballFile{
+				&TarballFile{Path: "conflict.txt", Size: 4, Mode: 0644},
+			}
+			tb := newTarballWriter(t, files)
+			consulted := 0
+			tb.ConflictResolver = func(existing os.FileInfo, incoming *TarballFile) ConflictAction {
+				consulted++
+				if existing.Size() != 4 || incoming.Path != "conflict.txt" {
+					t.Errorf("action %d: resolver called with %s of %d bytes for '%s'", test.action, existing.Name(), existing.Size(), incoming.Path)
+				}
+				return test.action
+			}
+
+			_, err := tb.WriteAt([]byte("ne"), 0)
+			if err == nil {
+				_, err = tb.WriteAt([]byte("w\n\x00"), 2)
+			}
+			if err != test.err {
+				t.Fatalf("action %d: err = %v; expected %v", test.action, err, test.err)
+			}
+			if err := tb.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if consulted != 1 {
+				t.Errorf("action %d: resolver consulted %d times; expected once", test.action, consulted)
+			}
+			// Renaming is done on the writer's copy of the entry:
+			if files[0].Path != "conflict.txt" {
+				t.Errorf("action %d: caller's entry renamed to '%s'", test.action, files[0].Path)
+			}
+
+			contents, err := ioutil.ReadFile(test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(contents) != test.contents {
+				t.Errorf("action %d: '%s' contains %q; expected %q", test.action, test.path, contents, test.contents)
+			}
+		}()
+	}
+}
+
+func TestWriteAt_ConflictResolverUnlocked(t *testing.T) {
+	defer os.Remove("asked.txt")
+	defer os.Remove("other.txt")
+	if err := ioutil.WriteFile("asked.txt", []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tb := newTarballWriter(t, []*TarballFile{
+		&TarballFile{Path: "asked.txt", Size: 4, Mode: 0644},
+		&TarballFile{Path: "other.txt", Size: 6, Mode: 0644},
+	})
+	asking, answer := make(chan empty), make(chan ConflictAction)
+	tb.ConflictResolver = func(existing os.FileInfo, incoming *TarballFile) ConflictAction {
+		close(asking)
+		return <-answer
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := tb.WriteAt([]byte("new\n\x00"), 0)
+		written <- err
+	}()
+	<-asking
+
+	// Other files are written while the resolver waits on an answer:
+	wrote := make(chan error, 1)
+	go func() {
+		_, err := tb.WriteAt([]byte("other\n\x00"), 5)
+		wrote <- err
+	}()
+	select {
+	case err := <-wrote:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("write blocked behind the conflict resolver")
+	}
+
+	answer <- ConflictOverwrite
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile("asked.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "new\n" {
+		t.Fatalf("asked.txt contains %q", contents)
+	}
+}
+
+// Populates root with a random tree of nested directories, files of random sizes, modes and modification times, and
+// symlinks:
+func createRandomTree(r *rand.Rand, root string, symlinks bool) error {
+	dirs := []string{root}
+	for i := 0; i < 1+r.Intn(30); i++ {
+		parent := dirs[r.Intn(len(dirs))]
+		name := filepath.Join(parent, fmt.Sprintf("e%02d", i))
+
+		switch kind := r.Intn(10); {
+		case kind < 2:
+			if err := os.Mkdir(name, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, name)
+		case kind < 3 && symlinks:
+			// Dangling or not, relative to the link:
+			if err := os.Symlink(fmt.Sprintf("../e%02d", r.Intn(i+1)), name); err != nil {
+				return err
+			}
+			continue
+		default:
+			// Favor small and empty files, which stress padding:
+			size := r.Intn(4)
+			if r.Intn(3) == 0 {
+				size = r.Intn(5000)
+			}
+			contents := make([]byte, size)
+			r.Read(contents)
+			if err := ioutil.WriteFile(name, contents, 0600); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Modes are set last so that directories stay writable while populating; directories stay traversable:
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root || info.Mode()&os.ModeSymlink != 0 {
+			return err
+		}
+		if info.IsDir() {
+			return os.Chmod(path, os.FileMode(0700|r.Intn(0100)))
+		}
+		modTime := time.Unix(1e9+r.Int63n(1e9), r.Int63n(1e9))
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			return err
+		}
+		return os.Chmod(path, os.FileMode(0400|r.Intn(0400)))
+	})
+}
+
+// Compares the trees under a and b entry by entry: types, modes unless in compat mode, contents, file modification
+// times and symlink targets.
+func compareTrees(t *testing.T, a string, b string, compareModes bool) {
+	paths := make(map[string]bool)
+	for _, root := range []string{a, b} {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// The roots themselves are not entries:
+			if path != root {
+				paths[path[len(root):]] = true
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for path := range paths {
+		sa, erra := os.Lstat(a + path)
+		sb, errb := os.Lstat(b + path)
+		if erra != nil || errb != nil {
+			t.Errorf("'%s': %v; %v", path, erra, errb)
+			continue
+		}
+		if sa.Mode()&os.ModeType != sb.Mode()&os.ModeType {
+			t.Errorf("'%s': type %v != %v", path, sa.Mode()&os.ModeType, sb.Mode()&os.ModeType)
+			continue
+		}
+		if compareModes && sa.Mode()&os.ModeSymlink == 0 && sa.Mode() != sb.Mode() {
+			t.Errorf("'%s': mode %v != %v", path, sa.Mode(), sb.Mode())
+		}
+		if sa.Mode()&os.ModeSymlink != 0 {
+			da, _ := os.Readlink(a + path)
+			db, _ := os.Readlink(b + path)
+			if da != db {
+				t.Errorf("'%s': symlink '%s' != '%s'", path, da, db)
+			}
+		} else if !sa.IsDir() {
+			if !sa.ModTime().Equal(sb.ModTime()) {
+				t.Errorf("'%s': modification time %v != %v", path, sa.ModTime(), sb.ModTime())
+			}
+			ca, _ := ioutil.ReadFile(a + path)
+			cb, _ := ioutil.ReadFile(b + path)
+			if !bytes.Equal(ca, cb) {
+				t.Errorf("'%s': contents of %d and %d bytes differ", path, len(ca), len(cb))
+			}
+		}
+	}
+}
+
+func TestTarball_RandomRoundTrip(t *testing.T) {
+	for seed := int64(1); seed <= 50; seed++ {
+		func() {
+			r := rand.New(rand.NewSource(seed))
+			options := getOptions()
+			options.NoPadding = r.Intn(2) == 0
+			options.HashFiles = r.Intn(2) == 0
+			options.VerifyHashes = options.HashFiles
+			if options.HashFiles && r.Intn(2) == 0 {
+				options.BlockSize = uint32(1 + r.Intn(1000))
+			}
+			src, err := ioutil.TempDir("", "lancaster_src")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(src)
+			defer os.RemoveAll("random_out")
+			if err := createRandomTree(r, src, !options.CompatMode); err != nil {
+				t.Fatal(err)
+			}
+
+			files, err := MergeTarballSources(TarballSource{Root: src, Prefix: "random_out", Directories: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader, err := NewVirtualTarballReader(files, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+
+			// Send the metadata through the encoder as a client would receive it:
+			md, err := encodeMetadata(reader.size, metadataFlags(reader.options), reader.files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := newMetadataDecoder(1, 0)
+			if err := d.AddSection(0, md); err != nil {
+				t.Fatal(err)
+			}
+			_, received, err := d.Finish()
+			if err != nil {
+				t.Fatal(err)
+			}
+			writer, err := NewVirtualTarballWriter(received, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Stream the tarball in regions of random sizes, delivered in random order:
+			regions := make([]Region, 0)
+			for offset := int64(0); offset < reader.size; {
+				end := offset + 1 + r.Int63n(2000)
+				if end > reader.size {
+					end = reader.size
+				}
+				regions = append(regions, Region{offset, end})
+				offset = end
+			}
+			r.Shuffle(len(regions), func(i, j int) { regions[i], regions[j] = regions[j], regions[i] })
+			for _, region := range regions {
+				buf := make([]byte, region.endEx-region.start)
+				if _, err := reader.ReadAt(buf, region.start); err != nil {
+					t.Fatalf("seed %d: read at %d: %v", seed, region.start, err)
+				}
+				if _, err := writer.WriteAt(buf, region.start); err != nil {
+					t.Fatalf("seed %d: write at %d: %v", seed, region.start, err)
+				}
+			}
+			if err := writer.CreateEmptyEntries(); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.FinishDirectories(); err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := filepath.Abs("random_out")
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareTrees(t, src, out, !options.CompatMode)
+			if t.Failed() {
+				t.Fatalf("seed %d: trees differ", seed)
+			}
+		}()
+	}
+}
+
+// Fails to create directories under readOnly, like a read-only mount inside the destination:
+type readOnlyFS struct {
+	osFS
+	readOnly string
+}
+
+func (fs readOnlyFS) MkdirAll(path string, perm os.FileMode) error {
+	if strings.HasPrefix(filepath.Clean(path), fs.readOnly) {
+		return &os.PathError{Op: "mkdir", Path: path, Err: os.ErrPermission}
+	}
+	return fs.osFS.MkdirAll(path, perm)
+}
+
+func TestWriteAt_SkipUnwritableDirs(t *testing.T) {
+	files := []*TarballFile{
+		&TarballFile{Path: filepath.Join("mixed_rw", "a.txt"), Size: 2, Mode: 0644},
+		&TarballFile{Path: filepath.Join("mixed_ro", "b.txt"), Size: 2, Mode: 0644},
+		&TarballFile{Path: filepath.Join("mixed_ro", "sub"), Mode: os.ModeDir | 0755},
+	}
+	defer os.RemoveAll("mixed_rw")
+	buf := []byte("a\n\x00b\n\x00\x00")
+
+	// Fails fast by default:
+	tb := newTarballWriter(t, files)
+	tb.fs = readOnlyFS{readOnly: "mixed_ro"}
+	if _, err := tb.WriteAt(buf, 0); !os.IsPermission(err) {
+		t.Fatalf("err = %v; expected permission error", err)
+	}
+	tb.Close()
+
+	options := getOptions()
+	options.SkipUnwritableDirs = true
+	tb, err := NewVirtualTarballWriter(files, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb.fs = readOnlyFS{readOnly: "mixed_ro"}
+	if _, err := tb.WriteAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := ioutil.ReadFile(filepath.Join("mixed_rw", "a.txt")); string(contents) != "a\n" {
+		t.Fatalf("a.txt = %q; expected the writable subtree extracted", contents)
+	}
+
+	err = tb.Unwritable()
+	if !errors.Is(err, ErrDirUnwritable) {
+		t.Fatalf("err = %v; expected ErrDirUnwritable", err)
+	}
+	entries := err.(*UnwritableDirError).Entries
+	if len(entries) != 2 || !strings.HasPrefix(entries[0], files[1].Path+": ") || !strings.HasPrefix(entries[1], files[2].Path+": ") {
+		t.Fatalf("entries = %q; expected b.txt and sub", entries)
+	}
+}
+
+func TestWriteAt_Holes(t *testing.T) {
+	// Existing contents must not show through the holes:
+	if err := ioutil.WriteFile("sparse.bin", []byte("XXXXXXXXXXXXXXXX"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tb := newTarballWriter(t, []*TarballFile{
+		&TarballFile{Path: "sparse.bin", Size: 12, Mode: 0644, DataExtents: []DataExtent{{Offset: 4, Length: 4}}},
+		&TarballFile{Path: "zeros.bin", Size: 5, Mode: 0644, DataExtents: []DataExtent{}},
+	})
+	defer closeTarballWriter(t, tb)
+
+	cmp(t, tb.Holes(), []Region{{0, 4}, {8, 12}, {13, 18}})
+
+	// Only the data extents and padding are written:
+	if _, err := tb.WriteAt([]byte("dddd"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tb.WriteAt([]byte{0, 0}, 12); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tb.WriteAt([]byte{0}, 18); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile("sparse.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "\x00\x00\x00\x00dddd\x00\x00\x00\x00" {
+		t.Fatalf("unexpected contents %q", contents)
+	}
+	if stat, err := os.Stat("zeros.bin"); err != nil || stat.Size() != 5 {
+		t.Fatalf("expected a 5 byte file of holes; got %v, %v", stat, err)
+	}
+
+	if _, err := NewVirtualTarballWriter([]*TarballFile{
+		&TarballFile{Path: "bad.bin", Size: 4, Mode: 0644, DataExtents: []DataExtent{{Offset: 2, Length: 4}}},
+	}, getOptions()); err != ErrBadDataExtents {
+		t.Fatalf("expected ErrBadDataExtents; got %v", err)
+	}
+}
+
+// Counts writes reaching files:
+type countingFS struct {
+	osFS
+	writes *int
+}
+
+type countingFile struct {
+	writerFile
+	writes *int
+}
+
+func (fs countingFS) OpenFile(name string, flag int, perm os.FileMode) (writerFile, error) {
+	f, err := fs.osFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return countingFile{writerFile: f, writes: fs.writes}, nil
+}
+
+func (f countingFile) WriteAt(p []byte, off int64) (int, error) {
+	*f.writes++
+	return f.writerFile.WriteAt(p, off)
+}
+
+func TestWriteAt_WriteBuffer(t *testing.T) {
+	contents := make([]byte, 100)
+	for i := range contents {
+		contents[i] = byte('a' + i%26)
+	}
+	data := append(append([]byte(nil), contents...), 0)
+
+	options := getOptions()
+	options.WriteBufferSize = 32
+	tb, err := NewVirtualTarballWriter([]*TarballFile{&TarballFile{Path: "buffered.bin", Size: 100, Mode: 0644}}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := 0
+	tb.fs = countingFS{writes: &writes}
+	completed := false
+	tb.OnFileComplete = func(path string, tf *TarballFile) { completed = true }
+	defer closeTarballWriter(t, tb)
+
+	write := func(start, endEx int) {
+		if _, err := tb.WriteAt(data[start:endEx], int64(start)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// In-order regions are coalesced until the buffer would overflow:
+	write(0, 10)
+	write(10, 20)
+	write(20, 30)
+	if writes != 0 {
+		t.Fatalf("%d writes; expected in-order regions to be buffered", writes)
+	}
+	write(30, 40)
+	if writes != 1 {
+		t.Fatalf("%d writes; expected a full buffer to be written", writes)
+	}
+	// Out of order regions flush what is buffered first:
+	write(70, 80)
+	write(40, 70)
+	if writes != 3 {
+		t.Fatalf("%d writes; expected gaps to flush", writes)
+	}
+	// Completing the file writes out the rest:
+	write(80, 101)
+	if !completed || writes != 5 {
+		t.Fatalf("%d writes; expected completion to flush", writes)
+	}
+
+	written, err := ioutil.ReadFile("buffered.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, contents) {
+		t.Fatalf("wrote %q; expected %q", written, contents)
+	}
+}
+
+func TestWriteAt_ExtractRoot(t *testing.T) {
+	defer os.RemoveAll("sandbox")
+	root := filepath.Join("sandbox", "root")
+	outside, err := filepath.Abs(filepath.Join("sandbox", "outside"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{root, outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	options := getOptions()
+	options.ExtractRoot = root
+
+	// Paths leaving the root lexically are rejected up front:
+	escaping := []string{"../up.txt", filepath.ToSlash(filepath.Join(outside, "abs.txt")), "a/../../climb.txt"}
+	if runtime.GOOS == "windows" {
+		escaping = append(escaping, `C:evil.txt`, `\\server\share\evil.txt`, `..\backslash.txt`)
+	}
+	files := []*TarballFile{}
+	for _, p := range escaping {
+		files = append(files, &TarballFile{Path: p, Size: 1, Mode: 0644})
+	}
+	_, err = NewVirtualTarballWriter(files, options)
+	if !errors.Is(err, ErrPathEscapesRoot) {
+		t.Fatalf("expected ErrPathEscapesRoot; got %v", err)
+	}
+	if verr := err.(*PathValidationError); len(verr.EscapingPaths) != len(escaping) {
+		t.Fatalf("expected %d escaping paths; got %v", len(escaping), verr.EscapingPaths)
+	}
+
+	// Legitimate entries land under the root; a volume-like name, or one with a backslash, is only a name elsewhere:
+	inside := "sub/in.txt"
+	if runtime.GOOS != "windows" {
+		inside = `C:/..\in.txt`
+	}
+	tb, err := NewVirtualTarballWriter([]*TarballFile{&TarballFile{Path: inside, Size: 2, Mode: 0644}}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tb.WriteAt([]byte("in\x00"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := ioutil.ReadFile(filepath.Join(root, inside)); err != nil || string(contents) != "in" {
+		t.Fatalf("expected %s under the root; got %q, %v", inside, contents, err)
+	}
+
+	if options.CompatMode {
+		return
+	}
+
+	// Symlinks leading outside, whether received or already on disk, are never written through:
+	if err := os.Symlink(outside, filepath.Join(root, "existing")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "dangling.txt"), filepath.Join(root, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	for _, entries := range [][]*TarballFile{
+		{
+			&TarballFile{Path: "link", Mode: os.ModeSymlink | 0777, SymlinkDestination: outside, SymlinkIsDir: true},
+			&TarballFile{Path: filepath.Join("link", "evil.txt"), Size: 4, Mode: 0644},
+		},
+		{
+			&TarballFile{Path: "up", Mode: os.ModeSymlink | 0777, SymlinkDestination: "..", SymlinkIsDir: true},
+			&TarballFile{Path: filepath.Join("up", "outside", "evil.txt"), Size: 4, Mode: 0644},
+		},
+		{&TarballFile{Path: filepath.Join("existing", "evil.txt"), Size: 4, Mode: 0644}},
+		{&TarballFile{Path: filepath.Join("existing", "deeper", "evil.txt"), Size: 4, Mode: 0644}},
+		{&TarballFile{Path: "dangling", Size: 4, Mode: 0644}},
+	} {
+		tb, err := NewVirtualTarballWriter(entries, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte(strings.Repeat("\x00", len(entries)-1) + "evil\x00")
+		_, err = tb.WriteAt(data, 0)
+		if !errors.Is(err, ErrPathEscapesRoot) {
+			t.Fatalf("%s: expected ErrPathEscapesRoot; got %v", entries[len(entries)-1].Path, err)
+		}
+		tb.Close()
+	}
+	escaped, err := ioutil.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(escaped) != 0 {
+		t.Fatalf("%d entries written outside the root", len(escaped))
+	}
+
+	// Symlinks within the root are followed:
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub", filepath.Join(root, "inner")); err != nil {
+		t.Fatal(err)
+	}
+	tb, err = NewVirtualTarballWriter([]*TarballFile{&TarballFile{Path: filepath.Join("inner", "ok.txt"), Size: 2, Mode: 0644}}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tb.WriteAt([]byte("ok\x00"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := ioutil.ReadFile(filepath.Join(root, "sub", "ok.txt")); err != nil || string(contents) != "ok" {
+		t.Fatalf("expected ok.txt through the inner symlink; got %q, %v", contents, err)
+	}
+}
+
+func TestReceivedFile_ReadAt(t *testing.T) {
+	contents := []byte("the front arrives first, then the back")
+	options := getOptions()
+	options.WriteBufferSize = 64
+	tb, err := NewVirtualTarballWriter([]*TarballFile{&TarballFile{Path: "streamed.txt", Size: int64(len(contents)), Mode: 0644}}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTarballWriter(t, tb)
+
+	if _, err := tb.OpenReceived("missing.txt"); !os.IsNotExist(err) {
+		t.Fatalf("expected a not-exist error; got %v", err)
+	}
+	r, err := tb.OpenReceived("streamed.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.Timeout = 50 * time.Millisecond
+
+	// Nothing written yet:
+	buf := make([]byte, 9)
+	if _, err := r.ReadAt(buf, 0); err != ErrReadTimeout {
+		t.Fatalf("expected ErrReadTimeout; got %v", err)
+	}
+
+	// The front is readable while still buffered, but not past it:
+	if _, err := tb.WriteAt(contents[:23], 0); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.ReadAt(buf, 0); err != nil || string(buf[:n]) != "the front" {
+		t.Fatalf("read %q, %v; expected the front", buf[:n], err)
+	}
+	if _, err := r.ReadAt(buf, 20); err != ErrReadTimeout {
+		t.Fatalf("expected ErrReadTimeout reading past what was written; got %v", err)
+	}
+
+	// A blocked read completes once the rest is written:
+	r.Timeout = 0
+	read := make(chan error, 1)
+	back := make([]byte, 20)
+	go func() {
+		n, err := r.ReadAt(back, int64(len(contents)-8))
+		back = back[:n]
+		read <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := tb.WriteAt(append(append([]byte(nil), contents[23:]...), 0), 23); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-read:
+		if err != io.EOF || string(back) != "the back" {
+			t.Fatalf("read %q, %v; expected the back and EOF", back, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read still blocked after the data was written")
+	}
+}
+
+func TestReceivedFile_OpenWhileExtracting(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on Windows")
+	}
+	files := []*TarballFile{&TarballFile{Path: "a_opened.txt", Size: 2, Mode: 0644}}
+	for i := 0; i < 50; i++ {
+		files = append(files, &TarballFile{Path: fmt.Sprintf("links/l%02d", i), Mode: os.ModeSymlink | 0777, SymlinkDestination: "../a_opened.txt"})
+	}
+	tb := newTarballWriter(t, files)
+	defer os.Remove("a_opened.txt")
+	defer os.RemoveAll("links")
+	defer tb.Close()
+	if _, err := tb.WriteAt([]byte("ok\x00"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Symlinks are made from within their directory, so files are opened while the root changes directory; run
+	// with -race:
+	done, started, stop := make(chan error, 1), make(chan empty), make(chan empty)
+	go func() {
+		for first := true; ; first = false {
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+			r, err := tb.OpenReceived("a_opened.txt")
+			if err != nil {
+				done <- err
+				return
+			}
+			buf := make([]byte, 2)
+			_, err = r.ReadAt(buf, 0)
+			r.Close()
+			if err != nil || string(buf) != "ok" {
+				done <- fmt.Errorf("read %q, %v", buf, err)
+				return
+			}
+			if first {
+				close(started)
+			}
+		}
+	}()
+	<-started
+	for o := int64(3); o < tb.size; o++ {
+		if _, err := tb.WriteAt([]byte{0}, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTarball_HashSize(t *testing.T) {
+	contents := []byte("verified at eight bytes\n")
+	newReader := func(hashSize int) *VirtualTarballReader {
+		options := getOptions()
+		options.HashFiles = true
+		options.HashSize = hashSize
+		tb, err := NewVirtualTarballReader([]*TarballFile{
+			&TarballFile{Path: "short.txt", Mode: 0644, Content: bytesProvider{Reader: bytes.NewReader(contents)}},
+		}, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tb
+	}
+	full, short := newReader(0), newReader(8)
+	defer closeTarballReader(t, full)
+	defer closeTarballReader(t, short)
+
+	sum := sha256.Sum256(contents)
+	if !bytes.Equal(short.files[0].Hash, sum[:8]) {
+		t.Fatalf("hash = %x; expected the first 8 bytes of %x", short.files[0].Hash, sum)
+	}
+	if bytes.Equal(short.HashId(), full.HashId()) {
+		t.Fatal("expected truncated hashes to change the HashId")
+	}
+	if _, err := NewVirtualTarballReader(nil, VirtualTarballOptions{HashSize: 40}); err != ErrBadHashSize {
+		t.Fatalf("expected ErrBadHashSize; got %v", err)
+	}
+
+	// A supplied hash is cut into a copy that does not share the caller's bytes:
+	supplied := append([]byte(nil), sum[:]...)
+	options := getOptions()
+	options.HashSize = 8
+	preset, err := NewVirtualTarballReader([]*TarballFile{
+		&TarballFile{Path: "short.txt", Mode: 0644, Content: bytesProvider{Reader: bytes.NewReader(contents)}, Hash: supplied},
+	}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTarballReader(t, preset)
+	_ = append(preset.files[0].Hash, 0)
+	if !bytes.Equal(supplied, sum[:]) {
+		t.Fatalf("supplied hash changed to %x", supplied)
+	}
+
+	// Receivers verify at the truncated length, whether hashed in order or re-read:
+	defer os.Remove("short.txt")
+	data := append(append([]byte(nil), contents...), 0)
+	for _, outOfOrder := range []bool{false, true} {
+		options := getOptions()
+		options.VerifyHashes = true
+		options.HashSize = 8
+		tb, err := NewVirtualTarballWriter([]*TarballFile{&TarballFile{Path: "short.txt", Size: int64(len(contents)), Mode: 0644, Hash: short.files[0].Hash}}, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outOfOrder {
+			tb.WriteAt(data[8:], 8)
+			tb.WriteAt(data[:8], 0)
+		} else {
+			tb.WriteAt(data, 0)
+		}
+		tb.Close()
+		if failed, err := tb.VerifyFiles(); err != nil || len(failed) != 0 {
+			t.Fatalf("outOfOrder=%v: expected the file to verify; got %v, %v", outOfOrder, failed, err)
+		}
+	}
+}
+
+func TestNewWriter_TooLarge(t *testing.T) {
+	// The largest tarball that fits:
+	tb, err := NewVirtualTarballWriter([]*TarballFile{&TarballFile{Path: "huge.bin", Size: math.MaxInt64 - 1, Mode: 0644}}, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tb.size != math.MaxInt64 {
+		t.Fatalf("size = %d; expected %d", tb.size, int64(math.MaxInt64))
+	}
+
+	// One byte more, even only the padding of an empty file, overflows:
+	_, err = NewVirtualTarballWriter([]*TarballFile{
+		&TarballFile{Path: "huge.bin", Size: math.MaxInt64 - 1, Mode: 0644},
+		&TarballFile{Path: "zzz.bin", Size: 0, Mode: 0644},
+	}, getOptions())
+	if err != ErrTarballTooLarge {
+		t.Fatalf("expected ErrTarballTooLarge; got %v", err)
+	}
+	options := getOptions()
+	options.NoPadding = true
+	_, err = NewVirtualTarballWriter([]*TarballFile{
+		&TarballFile{Path: "a.bin", Size: math.MaxInt64 / 2, Mode: 0644},
+		&TarballFile{Path: "b.bin", Size: math.MaxInt64/2 + 2, Mode: 0644},
+	}, options)
+	if err != ErrTarballTooLarge {
+		t.Fatalf("expected ErrTarballTooLarge without padding; got %v", err)
+	}
+
+	// Nor may a negative size from the wire pull the total back within range:
+	_, err = NewVirtualTarballWriter([]*TarballFile{
+		&TarballFile{Path: "huge.bin", Size: math.MaxInt64 - 1, Mode: 0644},
+		&TarballFile{Path: "negative.bin", Size: -2, Mode: 0644},
+	}, options)
+	if err != ErrNegativeSize {
+		t.Fatalf("expected ErrNegativeSize; got %v", err)
+	}
+}
+
+// Out-of-order writes into the last of many files, where finding the file dominates:
+func BenchmarkWriteAt_ManyFiles(b *testing.B) {
+	for _, count := range []int{10, 1000, 10000} {
+		b.Run(fmt.Sprintf("%d", count), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "lancaster_bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			const chunk, chunks = 1024, 256
+			files := make([]*TarballFile, 0, count)
+			for i := 0; i < count-1; i++ {
+				files = append(files, &TarballFile{Path: fmt.Sprintf("empty%05d", i), Mode: 0644})
+			}
+			files = append(files, &TarballFile{Path: "last", Size: chunk * chunks, Mode: 0644})
+
+			options := getOptions()
+			options.ExtractRoot = dir
+			tb, err := NewVirtualTarballWriter(files, options)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer tb.Close()
+
+			last := tb.files[len(tb.files)-1]
+			order := rand.New(rand.NewSource(1)).Perm(chunks)
+			buf := make([]byte, chunk)
+			b.SetBytes(chunk)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := tb.WriteAt(buf, last.offset+int64(order[i%chunks])*chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
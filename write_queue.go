@@ -0,0 +1,87 @@
+// write_queue.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+type receivedRegion struct {
+	offset int64
+	data   []byte
+}
+
+// Bounded queue of received regions applied to disk by a separate goroutine so that disk writes do not stall
+// receiving. Put blocks when the queue is full.
+type writeQueue struct {
+	w       io.WriterAt
+	regions chan receivedRegion
+	done    chan empty
+
+	lock sync.Mutex
+	err  error
+}
+
+func newWriteQueue(w io.WriterAt, depth int) *writeQueue {
+	q := &writeQueue{
+		w:       w,
+		regions: make(chan receivedRegion, depth),
+		done:    make(chan empty),
+	}
+	go q.writeLoop()
+	return q
+}
+
+func (q *writeQueue) writeLoop() {
+	defer close(q.done)
+
+	for r := range q.regions {
+		n, err := q.w.WriteAt(r.data, r.offset)
+		if err == nil && n < len(r.data) {
+			fmt.Printf("\bNot enough data written! %d < %d\n", n, len(r.data))
+		}
+		if err != nil {
+			q.lock.Lock()
+			if q.err == nil {
+				q.err = err
+			}
+			q.lock.Unlock()
+		}
+	}
+}
+
+// Returns the first write error encountered so far:
+func (q *writeQueue) Err() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.err
+}
+
+func (q *writeQueue) Put(offset int64, data []byte) error {
+	if err := q.Err(); err != nil {
+		return err
+	}
+	q.regions <- receivedRegion{offset: offset, data: data}
+	return nil
+}
+
+// Count of regions waiting to be written:
+func (q *writeQueue) Len() int {
+	return len(q.regions)
+}
+
+func (q *writeQueue) Cap() int {
+	return cap(q.regions)
+}
+
+func (q *writeQueue) Full() bool {
+	return len(q.regions) >= cap(q.regions)
+}
+
+// Waits for all queued regions to be written:
+func (q *writeQueue) Close() error {
+	close(q.regions)
+	<-q.done
+	return q.Err()
+}